@@ -0,0 +1,703 @@
+package gojinn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	actorsBucket        = "ACTORS"
+	actorsRoute         = "/actors/"
+	actorNodeSubject    = "gojinn.actors.node."
+	defaultActorIdle    = 5 * time.Minute
+	defaultActorLease   = 15 * time.Second
+	actorMailboxSize    = 64
+	actorDeliverRetries = 5
+
+	// maxActorState keeps a checkpoint within the default NATS payload limit.
+	maxActorState = 1024 * 1024
+)
+
+var (
+	errActorMoved       = errors.New("actor is placed on another node")
+	errActorUnavailable = errors.New("actor owner is unreachable")
+	errActorLost        = errors.New("actor placement lost")
+)
+
+// ActorConfig serves functions as durable actors at /actors/{type}/{id},
+// where type is a function name. Each actor runs on a single node of the
+// cluster, handles one message at a time and checkpoints its state to the
+// tenant's KV bucket.
+type ActorConfig struct {
+	// Types limits the functions that can be addressed as actors. Empty
+	// allows every declared function.
+	Types []string `json:"types,omitempty"`
+
+	// IdleTimeout passivates an actor that received no message for that long.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// LeaseTTL is how long a placement survives a node that stopped renewing
+	// it. Requests for its actors fail with 503 until it expires.
+	LeaseTTL caddy.Duration `json:"lease_ttl,omitempty"`
+}
+
+func (c *ActorConfig) validate() error {
+	for _, t := range c.Types {
+		if !validFunctionName.MatchString(t) {
+			return fmt.Errorf("invalid actor type %q", t)
+		}
+	}
+	if c.IdleTimeout < 0 || c.LeaseTTL < 0 {
+		return fmt.Errorf("actor idle_timeout and lease_ttl must not be negative")
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = caddy.Duration(defaultActorIdle)
+	}
+	if c.LeaseTTL == 0 {
+		c.LeaseTTL = caddy.Duration(defaultActorLease)
+	}
+	if time.Duration(c.LeaseTTL) < time.Second {
+		return fmt.Errorf("actor lease_ttl must be at least 1s")
+	}
+	return nil
+}
+
+type actorRef struct {
+	Tenant string `json:"tenant"`
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+}
+
+func (a actorRef) name() string     { return a.Tenant + "." + a.Type + "." + a.ID }
+func (a actorRef) leaseKey() string { return "lease." + a.name() }
+func (a actorRef) alarmKey() string { return "alarm." + a.name() }
+func (a actorRef) String() string   { return a.Type + "/" + a.ID }
+
+// stateKey is where the actor checkpoints in the tenant's bucket, so other
+// functions of the tenant can read it with kv_read permissions.
+func (a actorRef) stateKey() string { return "actor." + a.Type + "." + a.ID }
+
+// ActorInfo tells a module which actor it is running as.
+type ActorInfo struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Alarm bool   `json:"alarm,omitempty"`
+}
+
+// actorLease places an actor on a node. It is replaced with a compare-and-set
+// once expired, like a mutex lease.
+type actorLease struct {
+	Node      string `json:"node"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// actorAlarm is a pending alarm. Every node watches them and delivers the due
+// ones; only the delivery that deletes the record runs the actor.
+type actorAlarm struct {
+	Actor   actorRef `json:"actor"`
+	At      int64    `json:"at"`
+	Attempt uint64   `json:"attempt,omitempty"`
+}
+
+// actorEnvelope carries a message to the node holding the actor.
+type actorEnvelope struct {
+	Actor actorRef        `json:"actor"`
+	Input json.RawMessage `json:"input,omitempty"`
+	Alarm uint64          `json:"alarm,omitempty"`
+}
+
+type actorReply struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Moved  bool   `json:"moved,omitempty"`
+}
+
+type actorMessage struct {
+	input []byte
+	alarm uint64
+	reply chan actorResult
+}
+
+type actorResult struct {
+	out string
+	err error
+}
+
+// actorInstance is the live copy of an actor on this node. Everything below
+// mailbox is only touched by its run loop and the host functions it invokes.
+type actorInstance struct {
+	ref      actorRef
+	fn       *function
+	kv       nats.KeyValue
+	mailbox  chan *actorMessage
+	quit     chan struct{}
+	inflight int
+	stopped  bool
+
+	leaseRev uint64
+	state    []byte
+	stateRev uint64
+
+	next     []byte
+	dirty    bool
+	alarmAt  *time.Time
+	alarmSet bool
+}
+
+// actorRequest is the stdin of an actor invocation.
+type actorRequest struct {
+	Method  string              `json:"method,omitempty"`
+	URI     string              `json:"uri,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    string              `json:"body,omitempty"`
+	Params  map[string]string   `json:"params,omitempty"`
+	Actor   *ActorInfo          `json:"actor"`
+}
+
+func (r *Gojinn) setupActors() error {
+	kv, err := r.js.KeyValue(actorsBucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      actorsBucket,
+			Description: "Actor placement and alarms",
+			Storage:     nats.FileStorage,
+			History:     1,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision actors bucket: %w", err)
+		}
+	}
+	r.actorsKV = kv
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	r.actorNode = hex.EncodeToString(b)
+	r.actors = make(map[string]*actorInstance)
+	r.actorTimers = make(map[string]actorTimer)
+
+	sub, err := r.natsConn.Subscribe(actorNodeSubject+r.actorNode, func(m *nats.Msg) {
+		go r.serveForwardedActor(m)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe actor node: %w", err)
+	}
+	r.actorSub = sub
+
+	watcher, err := kv.Watch("alarm.>")
+	if err != nil {
+		return fmt.Errorf("failed to watch actor alarms: %w", err)
+	}
+	r.actorWatcher = watcher
+	go r.watchActorAlarms(watcher)
+	return nil
+}
+
+// serveActor handles /actors/{type}/{id}[/...]. The request reaches the
+// actor wherever it is placed.
+func (r *Gojinn) serveActor(rw http.ResponseWriter, req *http.Request) error {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, actorsRoute), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("expected /actors/{type}/{id}"))
+	}
+	tenantID, err := r.extractTenantAndHandleMiddleware(rw, req)
+	if err != nil {
+		return err
+	}
+	if r.actorFunction(parts[0]) == nil {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("unknown actor type %q", parts[0]))
+	}
+	ref := actorRef{Tenant: tenantID, Type: parts[0], ID: parts[1]}
+	if !validFunctionName.MatchString(ref.ID) {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid actor id %q", ref.ID))
+	}
+	if err := r.checkQuota(tenantID); err != nil {
+		return caddyhttp.Error(http.StatusTooManyRequests, err)
+	}
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		r.logger.Error("Failed to provision tenant resources", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("infrastructure failure: %v", err))
+	}
+
+	bodyBytes, _ := io.ReadAll(req.Body)
+	req.Body.Close()
+
+	input, _ := json.Marshal(actorRequest{
+		Method:  req.Method,
+		URI:     req.RequestURI,
+		Headers: req.Header,
+		Body:    string(bodyBytes),
+		Params:  map[string]string{"type": ref.Type, "id": ref.ID},
+		Actor:   &ActorInfo{Type: ref.Type, ID: ref.ID},
+	})
+
+	stdout, err := r.deliverActor(req.Context(), ref, input, 0, false)
+	if errors.Is(err, errActorUnavailable) {
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Duration(r.Actors.LeaseTTL).Seconds())))
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	if err != nil {
+		r.logger.Error("Actor execution failed", zap.Stringer("actor", ref), zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	r.writeFunctionResponse(rw, stdout)
+	return nil
+}
+
+func (r *Gojinn) actorFunction(typ string) *function {
+	if len(r.Actors.Types) > 0 && !slices.Contains(r.Actors.Types, typ) {
+		return nil
+	}
+	fn := r.lookupFunction(typ)
+	if fn == nil {
+		return nil
+	}
+	return r.pickVersion(fn, "")
+}
+
+// deliverActor runs a message on the single live instance of ref: locally
+// when this node holds the placement or can take it, otherwise on the node
+// that does. A forwarded message is never forwarded again.
+func (r *Gojinn) deliverActor(ctx context.Context, ref actorRef, input []byte, alarm uint64, forwarded bool) (string, error) {
+	for attempt := 0; attempt < actorDeliverRetries; attempt++ {
+		if inst := r.localActor(ref); inst != nil {
+			out, err := r.sendActor(ctx, inst, &actorMessage{input: input, alarm: alarm})
+			if errors.Is(err, errActorMoved) {
+				continue
+			}
+			return out, err
+		}
+
+		entry, err := r.actorsKV.Get(ref.leaseKey())
+		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			return "", err
+		}
+		var lease actorLease
+		if entry != nil {
+			_ = json.Unmarshal(entry.Value(), &lease)
+		}
+		if entry != nil && lease.Node != r.actorNode && time.Now().UnixNano() < lease.ExpiresAt {
+			if forwarded {
+				return "", errActorMoved
+			}
+			out, err := r.forwardActor(ctx, lease.Node, actorEnvelope{Actor: ref, Input: input, Alarm: alarm})
+			if errors.Is(err, errActorMoved) {
+				continue
+			}
+			return out, err
+		}
+
+		if err := r.activateActor(ref, entry); err != nil && !errors.Is(err, errActorLost) {
+			return "", err
+		}
+	}
+	return "", errActorUnavailable
+}
+
+func (r *Gojinn) forwardActor(ctx context.Context, node string, env actorEnvelope) (string, error) {
+	fn := r.actorFunction(env.Actor.Type)
+	if fn == nil {
+		return "", fmt.Errorf("unknown actor type %q", env.Actor.Type)
+	}
+	ctx, cancel := context.WithTimeout(ctx, fn.timeout()+5*time.Second)
+	defer cancel()
+
+	msg, err := r.natsConn.RequestWithContext(ctx, actorNodeSubject+node, mustJSON(env))
+	if errors.Is(err, nats.ErrNoResponders) {
+		return "", errActorUnavailable
+	}
+	if err != nil {
+		return "", err
+	}
+	var reply actorReply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return "", err
+	}
+	switch {
+	case reply.Moved:
+		return "", errActorMoved
+	case reply.Error != "":
+		return "", errors.New(reply.Error)
+	}
+	return reply.Output, nil
+}
+
+func (r *Gojinn) serveForwardedActor(m *nats.Msg) {
+	var env actorEnvelope
+	var reply actorReply
+	if err := json.Unmarshal(m.Data, &env); err != nil {
+		reply.Error = err.Error()
+	} else if _, err := r.EnsureTenantResources(env.Actor.Tenant); err != nil {
+		reply.Error = err.Error()
+	} else {
+		out, err := r.deliverActor(context.Background(), env.Actor, env.Input, env.Alarm, true)
+		reply.Output = out
+		if errors.Is(err, errActorMoved) {
+			reply.Moved = true
+		} else if err != nil {
+			reply.Error = err.Error()
+		}
+	}
+	_ = m.Respond(mustJSON(reply))
+}
+
+func (r *Gojinn) localActor(ref actorRef) *actorInstance {
+	r.actorsMu.Lock()
+	defer r.actorsMu.Unlock()
+	return r.actors[ref.name()]
+}
+
+// activateActor takes the placement of ref, replacing current when it is
+// expired or a leftover of this node, and loads the last checkpoint.
+func (r *Gojinn) activateActor(ref actorRef, current nats.KeyValueEntry) error {
+	fn := r.actorFunction(ref.Type)
+	if fn == nil {
+		return fmt.Errorf("unknown actor type %q", ref.Type)
+	}
+	kv, err := r.js.KeyValue(tenantBucketName(ref.Tenant))
+	if err != nil {
+		return err
+	}
+
+	lease := mustJSON(actorLease{Node: r.actorNode, ExpiresAt: time.Now().Add(time.Duration(r.Actors.LeaseTTL)).UnixNano()})
+	var leaseRev uint64
+	if current == nil {
+		leaseRev, err = r.actorsKV.Create(ref.leaseKey(), lease)
+	} else {
+		leaseRev, err = r.actorsKV.Update(ref.leaseKey(), lease, current.Revision())
+	}
+	if err != nil {
+		return errActorLost
+	}
+
+	inst := &actorInstance{
+		ref:      ref,
+		fn:       fn,
+		kv:       kv,
+		mailbox:  make(chan *actorMessage, actorMailboxSize),
+		quit:     make(chan struct{}),
+		leaseRev: leaseRev,
+	}
+	entry, err := kv.Get(ref.stateKey())
+	switch {
+	case err == nil:
+		inst.state = entry.Value()
+		inst.stateRev = entry.Revision()
+	case !errors.Is(err, nats.ErrKeyNotFound):
+		_ = r.actorsKV.Delete(ref.leaseKey(), nats.LastRevision(leaseRev))
+		return err
+	}
+
+	r.actorsMu.Lock()
+	r.actors[ref.name()] = inst
+	r.actorsWG.Add(1)
+	r.actorsMu.Unlock()
+
+	r.logger.Debug("Actor activated", zap.Stringer("actor", ref), zap.String("tenant", ref.Tenant), zap.Uint64("state_revision", inst.stateRev))
+	go r.runActor(inst)
+	return nil
+}
+
+// sendActor queues msg and waits for its result. Counting it in flight under
+// the registry lock keeps the instance from passivating with it queued; a
+// sender that gives up on a full mailbox takes its count back.
+func (r *Gojinn) sendActor(ctx context.Context, inst *actorInstance, msg *actorMessage) (string, error) {
+	r.actorsMu.Lock()
+	if inst.stopped {
+		r.actorsMu.Unlock()
+		return "", errActorMoved
+	}
+	inst.inflight++
+	r.actorsMu.Unlock()
+
+	msg.reply = make(chan actorResult, 1)
+	select {
+	case inst.mailbox <- msg:
+	case <-ctx.Done():
+		r.actorsMu.Lock()
+		if !inst.stopped {
+			inst.inflight--
+			r.actorsMu.Unlock()
+			return "", ctx.Err()
+		}
+		r.actorsMu.Unlock()
+		// stopActor already counted this message and is draining the
+		// mailbox, so the send cannot block.
+		inst.mailbox <- msg
+		return "", ctx.Err()
+	}
+
+	select {
+	case res := <-msg.reply:
+		return res.out, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// runActor handles the mailbox one message at a time, renews the placement
+// and passivates the actor once it has been idle for idle_timeout.
+func (r *Gojinn) runActor(inst *actorInstance) {
+	defer r.actorsWG.Done()
+	idleTimeout := time.Duration(r.Actors.IdleTimeout)
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	renew := time.NewTicker(time.Duration(r.Actors.LeaseTTL) / 3)
+	defer renew.Stop()
+
+	for {
+		select {
+		case msg := <-inst.mailbox:
+			res := r.handleActorMessage(inst, msg)
+			msg.reply <- res
+			r.actorsMu.Lock()
+			inst.inflight--
+			r.actorsMu.Unlock()
+			if errors.Is(res.err, errActorLost) {
+				r.logger.Warn("Actor checkpoint rejected, deactivating", zap.Stringer("actor", inst.ref), zap.String("tenant", inst.ref.Tenant), zap.Error(res.err))
+				r.stopActor(inst, false)
+				return
+			}
+			idle.Reset(idleTimeout)
+
+		case <-renew.C:
+			if err := r.renewActorLease(inst); err != nil {
+				r.logger.Warn("Actor placement lost", zap.Stringer("actor", inst.ref), zap.String("tenant", inst.ref.Tenant), zap.Error(err))
+				r.stopActor(inst, false)
+				return
+			}
+
+		case <-idle.C:
+			r.actorsMu.Lock()
+			busy := inst.inflight > 0
+			r.actorsMu.Unlock()
+			if busy {
+				idle.Reset(idleTimeout)
+				continue
+			}
+			r.logger.Debug("Actor passivated", zap.Stringer("actor", inst.ref), zap.String("tenant", inst.ref.Tenant))
+			r.stopActor(inst, true)
+			return
+
+		case <-inst.quit:
+			r.stopActor(inst, true)
+			return
+		}
+	}
+}
+
+// handleActorMessage runs one message. State and alarm changes made by the
+// module are only kept when it succeeds.
+func (r *Gojinn) handleActorMessage(inst *actorInstance, msg *actorMessage) actorResult {
+	input := msg.input
+	var alarm *actorAlarm
+	if msg.alarm != 0 {
+		// Every node delivers due alarms; the one that deletes the record runs it.
+		entry, err := r.actorsKV.Get(inst.ref.alarmKey())
+		if err != nil || entry.Revision() != msg.alarm {
+			return actorResult{}
+		}
+		if err := r.actorsKV.Delete(inst.ref.alarmKey(), nats.LastRevision(msg.alarm)); err != nil {
+			return actorResult{}
+		}
+		alarm = &actorAlarm{}
+		_ = json.Unmarshal(entry.Value(), alarm)
+		input = mustJSON(actorRequest{Actor: &ActorInfo{Type: inst.ref.Type, ID: inst.ref.ID, Alarm: true}})
+	}
+
+	inst.next, inst.dirty = inst.state, false
+	inst.alarmAt, inst.alarmSet = nil, false
+
+	inv := r.newInvocation(inst.ref.Tenant, inst.kv, inst.fn)
+	inv.actor = inst
+	out, err := r.runSyncJob(withInvocation(context.Background(), inv), inst.fn, string(input))
+	if err != nil {
+		if alarm != nil {
+			r.retryActorAlarm(inst.fn, alarm, err)
+		}
+		return actorResult{err: err}
+	}
+	if err := r.checkpointActor(inst); err != nil {
+		return actorResult{err: fmt.Errorf("%w: %v", errActorLost, err)}
+	}
+	return actorResult{out: out}
+}
+
+// checkpointActor stores the state set by the last message. The write is a
+// compare-and-set on the revision the actor loaded, so an instance that lost
+// its placement cannot overwrite the new owner.
+func (r *Gojinn) checkpointActor(inst *actorInstance) error {
+	if inst.dirty {
+		key := inst.ref.stateKey()
+		var rev uint64
+		var err error
+		switch {
+		case len(inst.next) == 0 && inst.stateRev == 0:
+		case len(inst.next) == 0:
+			err = inst.kv.Delete(key, nats.LastRevision(inst.stateRev))
+		case inst.stateRev == 0:
+			rev, err = inst.kv.Create(key, inst.next)
+		default:
+			rev, err = inst.kv.Update(key, inst.next, inst.stateRev)
+		}
+		if err != nil {
+			return err
+		}
+		inst.state, inst.stateRev = inst.next, rev
+	}
+
+	if inst.alarmSet {
+		if inst.alarmAt == nil {
+			if err := r.actorsKV.Delete(inst.ref.alarmKey()); err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+				r.logger.Warn("Failed to cancel actor alarm", zap.Stringer("actor", inst.ref), zap.Error(err))
+			}
+			return nil
+		}
+		record := actorAlarm{Actor: inst.ref, At: inst.alarmAt.UnixNano()}
+		if _, err := r.actorsKV.Put(inst.ref.alarmKey(), mustJSON(record)); err != nil {
+			r.logger.Warn("Failed to set actor alarm", zap.Stringer("actor", inst.ref), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// retryActorAlarm reschedules a failed alarm with the retry policy of the
+// actor's function, and drops it after the last attempt.
+func (r *Gojinn) retryActorAlarm(fn *function, alarm *actorAlarm, cause error) {
+	policy := fn.retry()
+	alarm.Attempt++
+	if alarm.Attempt >= uint64(policy.maxAttempts()) { //nolint:gosec
+		r.logger.Error("Actor alarm failed, giving up", zap.Stringer("actor", alarm.Actor), zap.String("tenant", alarm.Actor.Tenant), zap.Uint64("attempts", alarm.Attempt), zap.Error(cause))
+		return
+	}
+	alarm.At = time.Now().Add(policy.nextDelay(alarm.Attempt)).UnixNano()
+	if _, err := r.actorsKV.Create(alarm.Actor.alarmKey(), mustJSON(alarm)); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+		r.logger.Warn("Failed to reschedule actor alarm", zap.Stringer("actor", alarm.Actor), zap.Error(err))
+	}
+}
+
+func (r *Gojinn) renewActorLease(inst *actorInstance) error {
+	lease := actorLease{Node: r.actorNode, ExpiresAt: time.Now().Add(time.Duration(r.Actors.LeaseTTL)).UnixNano()}
+	rev, err := r.actorsKV.Update(inst.ref.leaseKey(), mustJSON(lease), inst.leaseRev)
+	if err != nil {
+		return err
+	}
+	inst.leaseRev = rev
+	return nil
+}
+
+// stopActor unregisters inst. Messages already queued are answered as moved,
+// so their senders retry on whichever instance comes next.
+func (r *Gojinn) stopActor(inst *actorInstance, release bool) {
+	r.actorsMu.Lock()
+	inst.stopped = true
+	if r.actors[inst.ref.name()] == inst {
+		delete(r.actors, inst.ref.name())
+	}
+	pending := inst.inflight
+	r.actorsMu.Unlock()
+
+	for ; pending > 0; pending-- {
+		msg := <-inst.mailbox
+		msg.reply <- actorResult{err: errActorMoved}
+	}
+	if release {
+		_ = r.actorsKV.Delete(inst.ref.leaseKey(), nats.LastRevision(inst.leaseRev))
+	}
+}
+
+type actorTimer struct {
+	timer    *time.Timer
+	revision uint64
+}
+
+// watchActorAlarms keeps a timer for every pending alarm of the cluster.
+func (r *Gojinn) watchActorAlarms(w nats.KeyWatcher) {
+	for entry := range w.Updates() {
+		if entry == nil {
+			continue
+		}
+		key, rev := entry.Key(), entry.Revision()
+
+		r.actorsMu.Lock()
+		if t, ok := r.actorTimers[key]; ok {
+			t.timer.Stop()
+			delete(r.actorTimers, key)
+		}
+		var alarm actorAlarm
+		if entry.Operation() == nats.KeyValuePut && json.Unmarshal(entry.Value(), &alarm) == nil {
+			r.actorTimers[key] = actorTimer{
+				revision: rev,
+				timer: time.AfterFunc(time.Until(time.Unix(0, alarm.At)), func() {
+					r.fireActorAlarm(key, alarm.Actor, rev)
+				}),
+			}
+		}
+		r.actorsMu.Unlock()
+	}
+}
+
+func (r *Gojinn) fireActorAlarm(key string, ref actorRef, rev uint64) {
+	r.actorsMu.Lock()
+	if t, ok := r.actorTimers[key]; ok && t.revision == rev {
+		delete(r.actorTimers, key)
+	}
+	r.actorsMu.Unlock()
+
+	if r.actorFunction(ref.Type) == nil {
+		return
+	}
+	if _, err := r.EnsureTenantResources(ref.Tenant); err != nil {
+		r.logger.Warn("Actor alarm not delivered", zap.Stringer("actor", ref), zap.String("tenant", ref.Tenant), zap.Error(err))
+		return
+	}
+	if _, err := r.deliverActor(context.Background(), ref, nil, rev, false); err != nil {
+		r.logger.Warn("Actor alarm not delivered", zap.Stringer("actor", ref), zap.String("tenant", ref.Tenant), zap.Error(err))
+	}
+}
+
+// stopActors passivates every local actor, releasing their placements for
+// the other nodes.
+func (r *Gojinn) stopActors() {
+	// Stopping a watcher waits for the server, which may already be gone.
+	if r.actorWatcher != nil && r.natsConn.IsConnected() {
+		_ = r.actorWatcher.Stop()
+	}
+	if r.actorSub != nil {
+		_ = r.actorSub.Unsubscribe()
+	}
+	r.actorsMu.Lock()
+	for key, t := range r.actorTimers {
+		t.timer.Stop()
+		delete(r.actorTimers, key)
+	}
+	for _, inst := range r.actors {
+		close(inst.quit)
+	}
+	r.actorsMu.Unlock()
+	r.actorsWG.Wait()
+}
+
+func (r *Gojinn) actorStatus() map[string]interface{} {
+	r.actorsMu.Lock()
+	defer r.actorsMu.Unlock()
+	return map[string]interface{}{
+		"node":   r.actorNode,
+		"active": len(r.actors),
+		"alarms": len(r.actorTimers),
+	}
+}
@@ -153,9 +153,21 @@ func (r *Gojinn) HandleMCPMessage(w http.ResponseWriter, req *http.Request) {
 			Arguments map[string]interface{} `json:"arguments"`
 		}
 		json.Unmarshal(jsonReq.Params, &params)
-		if params.Name == r.ToolMeta.Name {
+		fn := r.servedDefault()
+		if params.Name == r.ToolMeta.Name && fn != nil {
+			tenantID, err := r.extractTenantAndHandleMiddleware(w, req)
+			if err != nil {
+				return
+			}
+			tenantKV, err := r.EnsureTenantResources(tenantID)
+			if err != nil {
+				response.Error = map[string]string{"message": err.Error()}
+				break
+			}
+
 			payload, _ := json.Marshal(params.Arguments)
-			result, err := r.runSyncJob(req.Context(), r.Path, string(payload))
+			invCtx := withInvocation(req.Context(), r.newInvocation(tenantID, tenantKV, fn))
+			result, err := r.runSyncJob(invCtx, fn, string(payload))
 			if err != nil {
 				response.Error = map[string]string{"message": err.Error()}
 			} else {
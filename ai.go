@@ -7,7 +7,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -60,12 +59,7 @@ func (g *Gojinn) askAI(prompt string) (string, error) {
 			if provider == "ollama" && (hostname == "localhost" || hostname == "127.0.0.1") {
 				allowed = true
 			} else {
-				for _, host := range g.AllowedHosts {
-					if strings.Contains(hostname, host) {
-						allowed = true
-						break
-					}
-				}
+				allowed = g.egressAllowed(hostname)
 			}
 			if !allowed {
 				return "", fmt.Errorf("egress denied to %s", hostname)
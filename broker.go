@@ -194,8 +194,8 @@ func (g *Gojinn) EnsureTenantResources(tenantID string) (nats.KeyValue, error) {
 		return nil, fmt.Errorf("JetStream not initialized")
 	}
 
-	streamName := fmt.Sprintf("WORKER_%s", strings.ToUpper(tenantID))
-	kvBucket := fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
+	streamName := tenantStreamName(tenantID)
+	kvBucket := tenantBucketName(tenantID)
 	subject := fmt.Sprintf("gojinn.tenant.%s.exec.>", tenantID)
 
 	_, err := g.js.StreamInfo(streamName)
@@ -228,6 +228,7 @@ func (g *Gojinn) EnsureTenantResources(tenantID string) (nats.KeyValue, error) {
 			return nil, fmt.Errorf("failed to provision tenant kv store: %w", err)
 		}
 	}
+	g.enableKVTTL(kvBucket)
 
 	return kv, nil
 }
@@ -247,11 +248,23 @@ func (g *Gojinn) ReloadWorkers() error {
 	}
 
 	g.tenantSubs = make(map[string][]*nats.Subscription)
+	g.workerSets = make(map[string]struct{})
+
+	g.reloadFunctions()
+	g.refreshPools()
 
 	g.logger.Info("Hot Reload Complete. Workers will spin up on-demand.")
 	return nil
 }
 
-func (g *Gojinn) getFunctionTopic(tenantID string) string {
-	return fmt.Sprintf("gojinn.tenant.%s.exec.%s", tenantID, hashString(g.Path))
+func (g *Gojinn) functionTopic(tenantID string, fn *function) string {
+	return fmt.Sprintf("gojinn.tenant.%s.exec.%s", tenantID, fn.id())
+}
+
+func tenantStreamName(tenantID string) string {
+	return fmt.Sprintf("WORKER_%s", strings.ToUpper(tenantID))
+}
+
+func tenantBucketName(tenantID string) string {
+	return fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
 }
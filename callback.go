@@ -0,0 +1,312 @@
+package gojinn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	headerCallbackURL    = "Gojinn-Callback-URL"
+	headerCallbackSecret = "Gojinn-Callback-Secret"
+
+	callbackStream      = "CALLBACKS"
+	callbackSubject     = "gojinn.callbacks"
+	callbackQueueGroup  = "CALLBACK_DISPATCHERS"
+	callbackMaxAttempts = 8
+	callbackMaxBackoff  = 5 * time.Minute
+	callbackTimeout     = 10 * time.Second
+
+	callbackKeysBucket = "CALLBACK_KEYS"
+	callbackSealKey    = "seal"
+)
+
+// callbackDelivery is queued in the CALLBACKS stream. Secret is sealed with
+// the cluster callback key, like the job header it was copied from.
+type callbackDelivery struct {
+	URL    string     `json:"url"`
+	Secret string     `json:"secret,omitempty"`
+	Job    *JobRecord `json:"job"`
+}
+
+// validateCallbackURL checks a caller supplied callback before the job is
+// accepted, so egress violations are reported synchronously.
+func (r *Gojinn) validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid callback url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback url must be http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("callback url has no host")
+	}
+	if !r.egressAllowed(u.Hostname()) {
+		return fmt.Errorf("egress denied to %s", u.Hostname())
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && privateAddr(ip) && !r.Egress.AllowPrivate {
+		return fmt.Errorf("%w: %s", errEgressPrivate, u.Hostname())
+	}
+	return nil
+}
+
+// loadCallbackKey fetches the key that seals callback secrets, creating it
+// on the first node to start. Secrets never reach job messages, the CALLBACKS
+// stream or dead letters in clear text.
+func (r *Gojinn) loadCallbackKey() error {
+	kv, err := r.js.KeyValue(callbackKeysBucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      callbackKeysBucket,
+			Description: "Keys sealing job callback secrets",
+			Storage:     nats.FileStorage,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision callback keys: %w", err)
+		}
+	}
+
+	entry, err := kv.Get(callbackSealKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		key := make([]byte, 32)
+		_, _ = rand.Read(key)
+		if _, err = kv.Create(callbackSealKey, key); err == nil {
+			r.callbackKey = key
+			return nil
+		}
+		entry, err = kv.Get(callbackSealKey)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load callback key: %w", err)
+	}
+	r.callbackKey = entry.Value()
+	return nil
+}
+
+func (r *Gojinn) callbackAEAD() (cipher.AEAD, error) {
+	if len(r.callbackKey) == 0 {
+		return nil, errors.New("callback key not loaded")
+	}
+	block, err := aes.NewCipher(r.callbackKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (r *Gojinn) sealCallbackSecret(secret string) (string, error) {
+	aead, err := r.callbackAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func (r *Gojinn) openCallbackSecret(sealed string) (string, error) {
+	aead, err := r.callbackAEAD()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed callback secret")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open callback secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+func (r *Gojinn) startCallbackDispatcher() error {
+	if err := r.loadCallbackKey(); err != nil {
+		return err
+	}
+
+	if _, err := r.js.StreamInfo(callbackStream); err != nil {
+		_, err = r.js.AddStream(&nats.StreamConfig{
+			Name:      callbackStream,
+			Subjects:  []string{callbackSubject + ".>"},
+			Storage:   nats.FileStorage,
+			Retention: nats.WorkQueuePolicy,
+			Replicas:  r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision callback stream: %w", err)
+		}
+	}
+
+	sub, err := r.js.QueueSubscribe(callbackSubject+".>", callbackQueueGroup, r.handleCallbackMsg,
+		nats.ManualAck(),
+		nats.BindStream(callbackStream),
+		nats.MaxDeliver(callbackMaxAttempts),
+		nats.AckWait(callbackTimeout+5*time.Second))
+	if err != nil {
+		return fmt.Errorf("failed to start callback dispatcher: %w", err)
+	}
+	r.callbackSub = sub
+	return nil
+}
+
+// enqueueCallback schedules the delivery of a finished job to the callback
+// URL carried by its message, if any.
+func (r *Gojinn) enqueueCallback(tenantID string, m *nats.Msg, rec *JobRecord) {
+	callbackURL := m.Header.Get(headerCallbackURL)
+	if callbackURL == "" || rec == nil || r.js == nil {
+		return
+	}
+
+	data, _ := json.Marshal(callbackDelivery{
+		URL:    callbackURL,
+		Secret: m.Header.Get(headerCallbackSecret),
+		Job:    rec,
+	})
+
+	subject := fmt.Sprintf("%s.%s", callbackSubject, tenantID)
+	msgID := fmt.Sprintf("cb_%s_%d_%s", tenantID, rec.ID, rec.Status)
+	if _, err := r.js.Publish(subject, data, nats.MsgId(msgID)); err != nil {
+		r.logger.Error("Failed to queue job callback", zap.String("tenant", tenantID), zap.Uint64("job_id", rec.ID), zap.Error(err))
+	}
+}
+
+func (r *Gojinn) handleCallbackMsg(m *nats.Msg) {
+	meta, err := m.Metadata()
+	if err != nil {
+		_ = m.Nak()
+		return
+	}
+
+	var delivery callbackDelivery
+	if err := json.Unmarshal(m.Data, &delivery); err != nil || delivery.Job == nil {
+		r.logger.Error("Discarding malformed callback delivery", zap.Error(err))
+		_ = m.Term()
+		return
+	}
+
+	logFields := []zap.Field{
+		zap.String("tenant", delivery.Job.Tenant),
+		zap.Uint64("job_id", delivery.Job.ID),
+		zap.String("url", delivery.URL),
+		zap.Uint64("attempt", meta.NumDelivered),
+	}
+
+	retry, err := r.deliverCallback(delivery)
+	if err == nil {
+		r.logger.Info("Job callback delivered", logFields...)
+		_ = m.Ack()
+		return
+	}
+
+	if !retry || meta.NumDelivered >= callbackMaxAttempts {
+		r.logger.Error("Job callback abandoned", append(logFields, zap.Error(err))...)
+		_ = m.Term()
+		return
+	}
+
+	r.logger.Warn("Job callback failed, retrying", append(logFields, zap.Error(err))...)
+	_ = m.NakWithDelay(callbackBackoff(meta.NumDelivered))
+}
+
+// deliverCallback POSTs the job record. The returned bool tells whether a
+// failed delivery is worth retrying.
+func (r *Gojinn) deliverCallback(delivery callbackDelivery) (bool, error) {
+	if err := r.validateCallbackURL(delivery.URL); err != nil {
+		return false, err
+	}
+
+	// With api_keys the tenant id is the key itself, so receivers only get
+	// the same opaque label as the metrics.
+	job := delivery.Job
+	job.Tenant = r.tenantLabel(job.Tenant)
+	body, _ := json.Marshal(job)
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gojinn-Callback/1.0")
+	req.Header.Set("X-Gojinn-Job-ID", strconv.FormatUint(delivery.Job.ID, 10))
+	req.Header.Set("X-Gojinn-Tenant", job.Tenant)
+	req.Header.Set("X-Gojinn-Job-Status", delivery.Job.Status)
+	req.Header.Set("X-Gojinn-Timestamp", timestamp)
+
+	if delivery.Secret != "" {
+		secret, err := r.openCallbackSecret(delivery.Secret)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("X-Gojinn-Signature", "sha256="+signCallback(secret, timestamp, body))
+	}
+
+	// Callbacks go through the egress transport, so private and metadata
+	// addresses are refused after DNS resolution like guest requests.
+	client := &http.Client{
+		Transport: r.egressTransport,
+		Timeout:   callbackTimeout,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			if !r.egressAllowed(next.URL.Hostname()) {
+				return fmt.Errorf("egress denied to %s", next.URL.Hostname())
+			}
+			return nil
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errEgressPrivate), err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("callback endpoint returned %d", resp.StatusCode)
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, err
+}
+
+// signCallback computes the HMAC-SHA256 of "<timestamp>.<body>", letting
+// receivers reject both forged and replayed deliveries.
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func callbackBackoff(attempt uint64) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(attempt-1))) * time.Second
+	if delay > callbackMaxBackoff {
+		return callbackMaxBackoff
+	}
+	return delay
+}
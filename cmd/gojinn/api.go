@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sysRequest calls the /_sys API of a running server and decodes the JSON
+// response into out when it is non-nil.
+func sysRequest(server, apiKey, method, path, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimRight(server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// functionManifest mirrors the version manifest returned by
+// /_sys/functions/{name}.
+type functionManifest struct {
+	Function string `json:"function"`
+	Versions []struct {
+		ID        string    `json:"id"`
+		Size      int       `json:"size"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"versions"`
+	Aliases map[string]string `json:"aliases"`
+	Weights map[string]int    `json:"weights"`
+}
+
+func (m functionManifest) summary() string {
+	s := fmt.Sprintf("prod=%s", orNone(m.Aliases["prod"]))
+	if canary, ok := m.Aliases["canary"]; ok {
+		s += fmt.Sprintf(" canary=%s", canary)
+	}
+	if len(m.Weights) > 0 {
+		s += fmt.Sprintf(" traffic=prod:%d%%/canary:%d%%", m.Weights["prod"], m.Weights["canary"])
+	}
+	return s
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
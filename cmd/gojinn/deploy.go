@@ -3,29 +3,51 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	deployCanary string
+	deployServer string
+	deployAPIKey string
+)
+
 func init() {
+	deployCmd.Flags().StringVar(&deployCanary, "canary", "", "Ship as a canary receiving this share of traffic (e.g. 10%)")
+	deployCmd.Flags().StringVar(&deployServer, "server", "http://localhost:8080", "Gojinn server address")
+	deployCmd.Flags().StringVar(&deployAPIKey, "api-key", os.Getenv("GOJINN_API_KEY"), "Admin key sent as X-API-Key")
 	rootCmd.AddCommand(deployCmd)
 }
 
 var deployCmd = &cobra.Command{
 	Use:   "deploy [path_to_function]",
 	Short: "Compile and hot-deploy a function",
-	Long:  `Detects language, compiles to WASM, updates the worker pool via Hot Reload.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Detects language, compiles to WASM, updates the worker pool via Hot Reload.
+
+Every deploy is recorded as an immutable version. With --canary the new
+version only receives the given share of traffic until it is promoted with
+a plain deploy or reverted with "gojinn rollback".`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		funcDir := args[0]
 		funcName := filepath.Base(funcDir)
 
+		weight := 0
+		if deployCanary != "" {
+			w, err := parseCanaryWeight(deployCanary)
+			if err != nil {
+				fmt.Printf("Invalid --canary: %v\n", err)
+				os.Exit(1)
+			}
+			weight = w
+		}
+
 		fmt.Printf("Deploying function: %s\n", funcName)
 
 		wasmPath, err := compileAny(funcDir, funcName)
@@ -34,6 +56,16 @@ var deployCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if deployCanary != "" {
+			m, err := uploadVersion(funcName, wasmPath, fmt.Sprintf("alias=canary&weight=%d", weight))
+			if err != nil {
+				fmt.Printf("Canary upload failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Canary live: %s\n", m.summary())
+			return
+		}
+
 		finalPath := filepath.Join("functions", funcName+".wasm")
 		if err := copyFile(wasmPath, finalPath); err != nil {
 			fmt.Printf("Install failed: %v\n", err)
@@ -44,27 +76,48 @@ var deployCmd = &cobra.Command{
 		if err := triggerHotReload(); err != nil {
 			fmt.Printf("Hot Reload failed (Server down?): %v\n", err)
 			fmt.Println("Manual restart required: Ctrl+C -> gojinn run")
-		} else {
-			fmt.Println("Hot Reload Triggered Successfully!")
+			return
 		}
+		fmt.Println("Hot Reload Triggered Successfully!")
+
+		m, err := uploadVersion(funcName, wasmPath, "alias=prod")
+		if err != nil {
+			fmt.Printf("Version not recorded, rollback unavailable: %v\n", err)
+			return
+		}
+		fmt.Printf("Promoted to prod: %s\n", m.summary())
 	},
 }
 
 func triggerHotReload() error {
-	url := "http://localhost:8080/_sys/patch"
 	payload := []byte(`{"reload": true}`)
+	return sysRequest(deployServer, deployAPIKey, "POST", "/_sys/patch", "application/json", bytes.NewReader(payload), nil)
+}
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(payload))
+func uploadVersion(name, wasmPath, query string) (*functionManifest, error) {
+	f, err := os.Open(wasmPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	var m functionManifest
+	path := fmt.Sprintf("/_sys/functions/%s/versions?%s", name, query)
+	if err := sysRequest(deployServer, deployAPIKey, "POST", path, "application/wasm", f, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func parseCanaryWeight(s string) (int, error) {
+	w, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil {
+		return 0, err
+	}
+	if w < 1 || w > 99 {
+		return 0, fmt.Errorf("weight must be between 1%% and 99%%, got %d%%", w)
 	}
-	return nil
+	return w, nil
 }
 
 func compileAny(dir, name string) (string, error) {
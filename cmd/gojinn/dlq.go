@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	dlqServer string
+	dlqTenant string
+	dlqAPIKey string
+	dlqLimit  int
+	dlqAfter  uint64
+	dlqAll    bool
+)
+
+func init() {
+	dlqCmd.PersistentFlags().StringVar(&dlqServer, "server", "http://localhost:8080", "Gojinn server address")
+	dlqCmd.PersistentFlags().StringVar(&dlqTenant, "tenant", "", "Tenant whose dead letters are managed (default: the tenant of the caller)")
+	dlqCmd.PersistentFlags().StringVar(&dlqAPIKey, "api-key", os.Getenv("GOJINN_API_KEY"), "API key sent as X-API-Key")
+
+	dlqListCmd.Flags().IntVar(&dlqLimit, "limit", 50, "Maximum number of entries")
+	dlqListCmd.Flags().Uint64Var(&dlqAfter, "after", 0, "Only list entries after this sequence")
+	dlqReplayCmd.Flags().BoolVar(&dlqAll, "all", false, "Replay every dead letter")
+	dlqPurgeCmd.Flags().BoolVar(&dlqAll, "all", false, "Purge every dead letter")
+
+	dlqCmd.AddCommand(dlqListCmd, dlqInspectCmd, dlqReplayCmd, dlqPurgeCmd)
+}
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Inspect and requeue dead-lettered jobs",
+	Long:  `Manages the per-tenant DLQ_<TENANT> stream of a running Gojinn server through its /_sys/dlq API.`,
+
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var dlqListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List dead-lettered jobs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var resp struct {
+			Tenant string `json:"tenant"`
+			Items  []struct {
+				Sequence uint64    `json:"seq"`
+				JobID    uint64    `json:"job_id"`
+				WasmFile string    `json:"wasm_file"`
+				Error    string    `json:"error"`
+				Attempts uint64    `json:"attempts"`
+				FailedAt time.Time `json:"failed_at"`
+			} `json:"items"`
+		}
+		path := fmt.Sprintf("?limit=%d&after=%d", dlqLimit, dlqAfter)
+		if err := dlqRequest("GET", path, &resp); err != nil {
+			return err
+		}
+
+		if len(resp.Items) == 0 {
+			fmt.Printf("No dead letters for tenant %s\n", resp.Tenant)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SEQ\tJOB\tATTEMPTS\tFAILED AT\tFUNCTION\tERROR")
+		for _, it := range resp.Items {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\n", it.Sequence, it.JobID, it.Attempts, it.FailedAt.Format(time.RFC3339), it.WasmFile, truncate(it.Error, 60))
+		}
+		return w.Flush()
+	},
+}
+
+var dlqInspectCmd = &cobra.Command{
+	Use:   "inspect [seq]",
+	Short: "Show a dead letter with payload, headers and attempt history",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var entry json.RawMessage
+		if err := dlqRequest("GET", "/"+args[0], &entry); err != nil {
+			return err
+		}
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, entry, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(pretty.String())
+		return nil
+	},
+}
+
+var dlqReplayCmd = &cobra.Command{
+	Use:   "replay [seq]",
+	Short: "Requeue dead letters on their original function",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := dlqTarget(args)
+		if err != nil {
+			return err
+		}
+		var resp map[string]interface{}
+		if err := dlqRequest("POST", path+"/replay", &resp); err != nil {
+			return err
+		}
+		if ids, ok := resp["job_ids"]; ok {
+			fmt.Printf("Requeued as jobs: %v\n", ids)
+			if failures, ok := resp["failures"].([]interface{}); ok && len(failures) > 0 {
+				fmt.Printf("Failed: %v\n", failures)
+			}
+			return nil
+		}
+		fmt.Printf("Requeued as job %v\n", resp["job_id"])
+		return nil
+	},
+}
+
+var dlqPurgeCmd = &cobra.Command{
+	Use:   "purge [seq]",
+	Short: "Delete dead letters",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := dlqTarget(args)
+		if err != nil {
+			return err
+		}
+		if err := dlqRequest("DELETE", path, nil); err != nil {
+			return err
+		}
+		fmt.Println("Purged.")
+		return nil
+	},
+}
+
+func dlqTarget(args []string) (string, error) {
+	if dlqAll == (len(args) == 1) {
+		return "", fmt.Errorf("pass either a sequence or --all")
+	}
+	if dlqAll {
+		return "", nil
+	}
+	return "/" + args[0], nil
+}
+
+func dlqRequest(method, path string, out interface{}) error {
+	base := "/_sys/dlq"
+	if dlqTenant != "" {
+		base = "/_sys/tenants/" + dlqTenant + "/dlq"
+	}
+	return sysRequest(dlqServer, dlqAPIKey, method, base+path, "", nil, out)
+}
+
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
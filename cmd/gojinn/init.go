@@ -12,7 +12,7 @@ import (
 var templateType string
 
 func init() {
-	initCmd.Flags().StringVarP(&templateType, "template", "t", "basic", "Template type: 'basic' (HTTP) or 'actor' (WebSocket)")
+	initCmd.Flags().StringVarP(&templateType, "template", "t", "basic", "Template type: 'basic' (HTTP), 'actor' (durable actor) or 'websocket'")
 	rootCmd.AddCommand(initCmd)
 }
 
@@ -35,7 +35,7 @@ var initCmd = &cobra.Command{
 
 		content, exists := templates[templateType]
 		if !exists {
-			fmt.Printf("Unknown template: %s. Available: basic, actor\n", templateType)
+			fmt.Printf("Unknown template: %s. Available: basic, actor, websocket\n", templateType)
 			os.Exit(1)
 		}
 
@@ -51,6 +51,12 @@ var initCmd = &cobra.Command{
 
 		fmt.Printf("Created %s\n", targetFile)
 		fmt.Printf("Next step: GOOS=wasip1 GOARCH=wasm go build -o functions/%s.wasm ./functions/%s/main.go\n", funcName, funcName)
+		if templateType == "actor" {
+			fmt.Printf("Enable 'actors' in the Caddyfile and call it at /actors/%s/{id}\n", funcName)
+		}
+		if templateType == "websocket" {
+			fmt.Println("Allow the room with 'permissions { ws_rooms lobby }' in the Caddyfile")
+		}
 	},
 }
 
@@ -88,7 +94,7 @@ func main() {
 }
 `),
 
-	"actor": strings.TrimSpace(`
+	"websocket": strings.TrimSpace(`
 package main
 
 import (
@@ -100,13 +106,23 @@ import (
 )
 
 //go:wasmimport gojinn host_ws_upgrade
-func host_ws_upgrade() uint32 
+func host_ws_upgrade() uint32
+
+//go:wasmimport gojinn host_ws_receive
+func host_ws_receive(outPtr, outMaxLen uint32) uint64
+
+//go:wasmimport gojinn host_ws_join
+func host_ws_join(roomPtr, roomLen uint32) uint32
 
-//go:wasmimport gojinn host_ws_read
-func host_ws_read(outPtr, outMaxLen uint32) uint64
+//go:wasmimport gojinn host_ws_publish
+func host_ws_publish(roomPtr, roomLen, msgPtr, msgLen, flags uint32) uint32
 
-//go:wasmimport gojinn host_ws_write
-func host_ws_write(msgPtr, msgLen uint32)
+const (
+	room        = "lobby"
+	excludeSelf = 2
+)
+
+func ptr(s string) uint32 { return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))) }
 
 func main() {
 	input, _ := io.ReadAll(os.Stdin)
@@ -114,27 +130,88 @@ func main() {
 
 	isWS := strings.Contains(reqJSON, "websocket") || strings.Contains(reqJSON, "Upgrade")
 
-	if isWS {
-		if host_ws_upgrade() == 1 {
-			buf := make([]byte, 4096)
-			ptr := uint32(uintptr(unsafe.Pointer(&buf[0])))
-
-			for {
-				n := host_ws_read(ptr, 4096)
-				if n == 0 { break } // Connection closed
-
-				msg := string(buf[:n])
-				
-				reply := fmt.Sprintf("Actor received: %s", msg)
-				replyPtr := uint32(uintptr(unsafe.Pointer(unsafe.StringData(reply))))
-				
-				host_ws_write(replyPtr, uint32(len(reply)))
-			}
+	// Every socket that joined the room receives the messages of the others,
+	// on whichever node it is connected. Allow the room with ws_rooms.
+	if isWS && host_ws_upgrade() == 1 {
+		if host_ws_join(ptr(room), uint32(len(room))) != 0 {
 			return
 		}
+		buf := make([]byte, 4096)
+		for {
+			n := host_ws_receive(uint32(uintptr(unsafe.Pointer(&buf[0]))), uint32(len(buf)))
+			if n == ^uint64(0) {
+				return // Connection closed
+			}
+			size := uint32(n)
+			if size > uint32(len(buf)) {
+				buf = make([]byte, size)
+				continue
+			}
+			msg := string(buf[:size])
+			host_ws_publish(ptr(room), uint32(len(room)), ptr(msg), uint32(len(msg)), excludeSelf)
+		}
 	}
 
 	fmt.Printf(` + "`" + `{"status": 200, "body": "Please connect via WebSocket"}` + "`" + `)
 }
+`),
+	"actor": strings.TrimSpace(`
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_actor_state
+func host_actor_state(outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_state
+func host_actor_set_state(ptr, length uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_alarm
+func host_actor_set_alarm(delayMillis uint64) uint32
+
+type Request struct {
+	Method string ` + "`" + `json:"method"` + "`" + `
+	Body   string ` + "`" + `json:"body"` + "`" + `
+	Actor  struct {
+		ID    string ` + "`" + `json:"id"` + "`" + `
+		Alarm bool   ` + "`" + `json:"alarm"` + "`" + `
+	} ` + "`" + `json:"actor"` + "`" + `
+}
+
+// Each /actors/<name>/{id} is a counter living on one node of the cluster.
+// Messages arrive one at a time, so the read-modify-write below is safe.
+func main() {
+	input, _ := io.ReadAll(os.Stdin)
+	var req Request
+	_ = json.Unmarshal(input, &req)
+
+	buf := make([]byte, 64)
+	count := 0
+	if n := host_actor_state(uint32(uintptr(unsafe.Pointer(&buf[0]))), uint32(len(buf))); n != 0xFFFFFFFF {
+		count, _ = strconv.Atoi(string(buf[:n]))
+	}
+
+	switch {
+	case req.Actor.Alarm:
+		// Fired 60s after the last POST: start over.
+		count = 0
+	case req.Method == "POST":
+		count++
+		host_actor_set_alarm(60_000)
+	}
+
+	// The state is checkpointed only if the function exits successfully.
+	state := []byte(strconv.Itoa(count))
+	host_actor_set_state(uint32(uintptr(unsafe.Pointer(&state[0]))), uint32(len(state)))
+
+	fmt.Printf(` + "`" + `{"status": 200, "body": "%s: %d"}` + "`" + `, req.Actor.ID, count)
+}
 `),
 }
@@ -23,17 +23,24 @@ func main() {
 
 func init() {
 	caddycmd.RegisterCommand(caddycmd.Command{
-		Name:  "deploy",
-		Usage: "[path_to_function]",
-		Short: "Compile and hot-deploy a function (Cobra Bridge)",
-		Func:  wrapCobra(deployCmd),
+		Name:      "deploy",
+		Usage:     "[--canary <pct>] [path_to_function]",
+		Short:     "Compile and hot-deploy a function (Cobra Bridge)",
+		CobraFunc: passthroughCobra(deployCmd),
 	})
 
 	caddycmd.RegisterCommand(caddycmd.Command{
-		Name:  "init",
-		Usage: "[function_name]",
-		Short: "Scaffold a new Gojinn function (Cobra Bridge)",
-		Func:  wrapCobra(initCmd),
+		Name:      "rollback",
+		Usage:     "[--to <version>] [function_name]",
+		Short:     "Revert a function to its previous version (Cobra Bridge)",
+		CobraFunc: passthroughCobra(rollbackCmd),
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:      "init",
+		Usage:     "[--template basic|actor|websocket] [function_name]",
+		Short:     "Scaffold a new Gojinn function (Cobra Bridge)",
+		CobraFunc: passthroughCobra(initCmd),
 	})
 
 	caddycmd.RegisterCommand(caddycmd.Command{
@@ -43,6 +50,20 @@ func init() {
 		Func:  wrapCobra(replayCmd),
 	})
 
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:      "dlq",
+		Usage:     "list|inspect|replay|purge",
+		Short:     "Manage dead-lettered jobs (Cobra Bridge)",
+		CobraFunc: passthroughCobra(dlqCmd),
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:      "migrate",
+		Usage:     "up|down|status [--config Caddyfile] [--driver <driver> --dsn <dsn>] [--dir <path>]",
+		Short:     "Apply or revert host database migrations (Cobra Bridge)",
+		CobraFunc: passthroughCobra(migrateCmd),
+	})
+
 	caddycmd.RegisterCommand(caddycmd.Command{
 		Name:  "up",
 		Usage: "",
@@ -61,3 +82,15 @@ func wrapCobra(cmd *cobra.Command) caddycmd.CommandFunc {
 		return 0, nil
 	}
 }
+
+// passthroughCobra hands the raw arguments to a command that has flags or
+// subcommands of its own, so caddy must not parse them.
+func passthroughCobra(target *cobra.Command) func(*cobra.Command) {
+	return func(cmd *cobra.Command) {
+		cmd.DisableFlagParsing = true
+		cmd.RunE = func(_ *cobra.Command, args []string) error {
+			target.SetArgs(args)
+			return target.Execute()
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/gojinn-io/gojinn/pkg/migrate"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateConfig    string
+	migrateDriver    string
+	migrateDSN       string
+	migrateDir       string
+	migrateUpSteps   int
+	migrateDownSteps int
+)
+
+func init() {
+	migrateCmd.PersistentFlags().StringVar(&migrateConfig, "config", "Caddyfile", "Caddyfile to read db_driver, db_dsn and migrations from")
+	migrateCmd.PersistentFlags().StringVar(&migrateDriver, "driver", "", "Database driver (overrides the Caddyfile)")
+	migrateCmd.PersistentFlags().StringVar(&migrateDSN, "dsn", "", "Database connection string (overrides the Caddyfile)")
+	migrateCmd.PersistentFlags().StringVar(&migrateDir, "dir", "", "Migrations directory (overrides the Caddyfile)")
+
+	migrateUpCmd.Flags().IntVar(&migrateUpSteps, "steps", 0, "Apply at most this many migrations (default: all)")
+	migrateDownCmd.Flags().IntVar(&migrateDownSteps, "steps", 1, "Number of migrations to revert")
+
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply, revert and inspect host database migrations",
+	Long: `Runs the versioned SQL files of the migrations directory against the host database.
+Files are named <version>.up.sql and <version>.down.sql and applied in version order.
+Applied versions are tracked in the gojinn_migrations table.`,
+
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply pending migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, closeDB, err := openMigrator()
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		applied, err := m.Up(context.Background(), migrateUpSteps)
+		for _, version := range applied {
+			fmt.Printf("✅ Applied %s\n", version)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date.")
+		}
+		return nil
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the most recent migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, closeDB, err := openMigrator()
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		reverted, err := m.Down(context.Background(), migrateDownSteps)
+		for _, version := range reverted {
+			fmt.Printf("↩️  Reverted %s\n", version)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No applied migrations to revert.")
+		}
+		return nil
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show applied and pending migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, closeDB, err := openMigrator()
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		states, err := m.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		if len(states) == 0 {
+			fmt.Printf("No migrations in %s\n", m.Dir)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATE\tAPPLIED AT")
+		for _, s := range states {
+			state := "pending"
+			switch {
+			case s.Missing:
+				state = "applied (file missing)"
+			case s.Applied:
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Version, state, s.AppliedAt)
+		}
+		return w.Flush()
+	},
+}
+
+func openMigrator() (*migrate.Migrator, func(), error) {
+	driver, dsn, dir := migrateDriver, migrateDSN, migrateDir
+	if driver == "" || dsn == "" || dir == "" {
+		cfg, err := caddyfileDatabase(migrateConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		driver = cmp.Or(driver, cfg.Driver)
+		dsn = cmp.Or(dsn, cfg.DSN)
+		dir = cmp.Or(dir, cfg.Migrations)
+	}
+	if driver == "" || dsn == "" {
+		return nil, nil, fmt.Errorf("no database configured: set db_driver and db_dsn in %s or pass --driver and --dsn", migrateConfig)
+	}
+	if dir == "" {
+		return nil, nil, fmt.Errorf("no migrations directory: set migrations in %s or pass --dir", migrateConfig)
+	}
+
+	dialect, err := migrate.DialectFor(driver)
+	if err != nil {
+		return nil, nil, err
+	}
+	driver, dsn = migrate.Normalize(driver, dsn)
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &migrate.Migrator{DB: db, Dialect: dialect, Dir: dir}, func() { db.Close() }, nil
+}
+
+type dbSettings struct {
+	Driver     string `json:"db_driver"`
+	DSN        string `json:"db_dsn"`
+	Migrations string `json:"migrations"`
+}
+
+// caddyfileDatabase adapts the Caddyfile and returns the database settings of
+// its gojinn handlers. Handlers sharing one database are fine; different
+// databases must be selected with flags.
+func caddyfileDatabase(path string) (dbSettings, error) {
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return dbSettings{}, nil
+	}
+	if err != nil {
+		return dbSettings{}, err
+	}
+
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	if adapter == nil {
+		return dbSettings{}, fmt.Errorf("caddyfile adapter not available")
+	}
+	raw, _, err := adapter.Adapt(body, map[string]interface{}{"filename": path})
+	if err != nil {
+		return dbSettings{}, fmt.Errorf("failed to adapt %s: %w", path, err)
+	}
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return dbSettings{}, err
+	}
+
+	var found []dbSettings
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if node["handler"] == "gojinn" && node["db_driver"] != nil {
+				var s dbSettings
+				b, _ := json.Marshal(node)
+				_ = json.Unmarshal(b, &s)
+				found = append(found, s)
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(tree)
+
+	var out dbSettings
+	for _, s := range found {
+		if out.Driver == "" {
+			out = s
+			continue
+		}
+		if s.Driver != out.Driver || s.DSN != out.DSN {
+			return dbSettings{}, fmt.Errorf("%s configures more than one database; pass --driver and --dsn", path)
+		}
+		out.Migrations = cmp.Or(out.Migrations, s.Migrations)
+	}
+	return out, nil
+}
@@ -78,17 +78,45 @@ var replayCmd = &cobra.Command{
 			fmt.Printf("[REPLAY LOG] %s\n", string(mem))
 		}).Export("host_log").
 			NewFunctionBuilder().WithFunc(func() {}).Export("host_db_query").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_db_result").
 			NewFunctionBuilder().WithFunc(func() {}).Export("host_kv_set").
 			NewFunctionBuilder().WithFunc(func() uint64 { return 0 }).Export("host_kv_get").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_kv_delete").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_kv_op").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_kv_result").
 			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_mutex_lock").
+			NewFunctionBuilder().WithFunc(func() uint64 { return 1 }).Export("host_mutex_acquire").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_mutex_renew").
 			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_mutex_unlock").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_actor_state").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_actor_set_state").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_actor_set_alarm").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_actor_cancel_alarm").
 			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_s3_put").
-			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_s3_get").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_get").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_s3_delete").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_head").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_list").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_open").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_read").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_s3_write").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_s3_close").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_s3_presign").
 			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_enqueue").
 			NewFunctionBuilder().WithFunc(func() uint64 { return 0 }).Export("host_ask_ai").
 			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_ws_upgrade").
 			NewFunctionBuilder().WithFunc(func() uint64 { return 0 }).Export("host_ws_read").
 			NewFunctionBuilder().WithFunc(func() {}).Export("host_ws_write").
+			NewFunctionBuilder().WithFunc(func() uint64 { return 0xFFFFFFFFFFFFFFFF }).Export("host_ws_receive").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_ws_send").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_ws_close").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_ws_join").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 1 }).Export("host_ws_leave").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_ws_publish").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_mqtt_publish").
+			NewFunctionBuilder().WithFunc(func() uint64 { return 0 }).Export("host_http_get").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_http_fetch").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0xFFFFFFFF }).Export("host_http_response").
 			Instantiate(ctx)
 
 		if err != nil {
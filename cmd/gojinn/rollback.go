@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var rollbackTo string
+
+func init() {
+	rollbackCmd.Flags().StringVar(&rollbackTo, "to", "", "Version id to restore instead of the previous prod")
+	rollbackCmd.Flags().StringVar(&deployServer, "server", "http://localhost:8080", "Gojinn server address")
+	rollbackCmd.Flags().StringVar(&deployAPIKey, "api-key", os.Getenv("GOJINN_API_KEY"), "Admin key sent as X-API-Key")
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [function_name]",
+	Short: "Revert a function to its previous version",
+	Long: `Ends an active canary, sending all traffic back to prod. Without a canary
+the prod alias returns to the version it pointed at before the last deploy.`,
+	Args: cobra.ExactArgs(1),
+
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var body bytes.Buffer
+		if rollbackTo != "" {
+			_ = json.NewEncoder(&body).Encode(map[string]string{"version": rollbackTo})
+		}
+
+		var m functionManifest
+		path := fmt.Sprintf("/_sys/functions/%s/rollback", args[0])
+		if err := sysRequest(deployServer, deployAPIKey, "POST", path, "application/json", &body, &m); err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %s: %s\n", args[0], m.summary())
+		return nil
+	},
+}
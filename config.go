@@ -1,22 +1,34 @@
 package gojinn
 
 import (
+	"fmt"
 	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/gojinn-io/gojinn/pkg/blob/s3"
+	"github.com/dustin/go-humanize"
 )
 
 type CronJob struct {
+	Name     string `json:"name,omitempty"`
 	Schedule string `json:"schedule"`
 	WasmFile string `json:"wasm_file"`
+	Tenant   string `json:"tenant,omitempty"`
+	Payload  string `json:"payload,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	Overlap  string `json:"overlap,omitempty"`
 }
 
 type MQTTSub struct {
 	Topic    string `json:"topic"`
 	WasmFile string `json:"wasm_file"`
+	Tenant   string `json:"tenant,omitempty"`
+	QoS      byte   `json:"qos,omitempty"`
+
+	// Tenants lists the tenant ids a {N} placeholder may resolve to on top
+	// of the registry and api_keys.
+	Tenants []string `json:"tenants,omitempty"`
 }
 
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -32,13 +44,12 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 	m.NatsRoutes = []string{}
 	m.ClusterPeers = []string{}
 	m.TrustedNatsUsers = []string{}
+	flatS3 := false
 
 	m.RateLimit = 0
 	m.RateBurst = 0
 	m.CrashPath = "./crashes"
 
-	var s3Bucket, s3Region, s3AccessKey, s3SecretKey, s3Endpoint string
-
 	for h.Next() {
 		args := h.RemainingArgs()
 		if len(args) > 0 {
@@ -93,6 +104,53 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 						m.PoolSize = val
 					}
 				}
+			case "compilation_cache":
+				if !h.NextArg() {
+					return nil, h.Err("compilation_cache expects 'memory' or 'disk'")
+				}
+				if h.Val() != "memory" && h.Val() != "disk" {
+					return nil, h.Errf("invalid compilation_cache: %s", h.Val())
+				}
+				m.CompilationCache = h.Val()
+			case "retry":
+				if err := parseRetryPolicy(h, &m.Retry); err != nil {
+					return nil, err
+				}
+			case "functions":
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					spec, err := parseFunctionSpec(h)
+					if err != nil {
+						return nil, err
+					}
+					m.Functions = append(m.Functions, spec)
+				}
+			case "functions_dir":
+				if !h.NextArg() {
+					return nil, h.Err("functions_dir expects a directory")
+				}
+				m.FunctionsDir = h.Val()
+			case "job_results":
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					switch h.Val() {
+					case "ttl":
+						if !h.NextArg() {
+							return nil, h.Err("job_results ttl expects a duration")
+						}
+						val, err := caddy.ParseDuration(h.Val())
+						if err != nil {
+							return nil, h.Errf("invalid job_results ttl: %v", err)
+						}
+						m.JobResultTTL = caddy.Duration(val)
+					case "max_output":
+						if !h.NextArg() {
+							return nil, h.Err("job_results max_output expects a size")
+						}
+						if _, err := humanize.ParseBytes(h.Val()); err != nil {
+							return nil, h.Errf("invalid job_results max_output: %v", err)
+						}
+						m.JobResultMaxOutput = h.Val()
+					}
+				}
 			case "debug_secret":
 				if h.NextArg() {
 					m.DebugSecret = h.Val()
@@ -105,25 +163,32 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				if h.NextArg() {
 					m.DBDSN = h.Val()
 				}
-			case "s3_bucket":
-				if h.NextArg() {
-					s3Bucket = h.Val()
-				}
-			case "s3_region":
-				if h.NextArg() {
-					s3Region = h.Val()
-				}
-			case "s3_access_key":
-				if h.NextArg() {
-					s3AccessKey = h.Val()
+			case "migrations":
+				if !h.NextArg() {
+					return nil, h.Err("migrations expects a directory")
 				}
-			case "s3_secret_key":
-				if h.NextArg() {
-					s3SecretKey = h.Val()
+				m.Migrations = h.Val()
+			case "s3_bucket", "s3_region", "s3_access_key", "s3_secret_key", "s3_endpoint":
+				directive := h.Val()
+				if !h.NextArg() {
+					break
 				}
-			case "s3_endpoint":
-				if h.NextArg() {
-					s3Endpoint = h.Val()
+				cfg, err := legacyS3(&m)
+				if err != nil {
+					return nil, h.Errf("%s: %v", directive, err)
+				}
+				flatS3 = true
+				switch directive {
+				case "s3_bucket":
+					cfg.Bucket = h.Val()
+				case "s3_region":
+					cfg.Region = h.Val()
+				case "s3_access_key":
+					cfg.AccessKey = h.Val()
+				case "s3_secret_key":
+					cfg.SecretKey = h.Val()
+				case "s3_endpoint":
+					cfg.Endpoint = h.Val()
 				}
 
 			case "db_sync_url":
@@ -134,20 +199,25 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				if h.NextArg() {
 					m.DBSyncToken = h.Val()
 				}
+			case "tenant_db":
+				cfg, err := parseTenantDBConfig(h)
+				if err != nil {
+					return nil, err
+				}
+				m.TenantDB = cfg
 
-			case "permissions":
-				for nesting := h.Nesting(); h.NextBlock(nesting); {
-					switch h.Val() {
-					case "kv_read":
-						m.Perms.KVRead = append(m.Perms.KVRead, h.RemainingArgs()...)
-					case "kv_write":
-						m.Perms.KVWrite = append(m.Perms.KVWrite, h.RemainingArgs()...)
-					case "s3_read":
-						m.Perms.S3Read = append(m.Perms.S3Read, h.RemainingArgs()...)
-					case "s3_write":
-						m.Perms.S3Write = append(m.Perms.S3Write, h.RemainingArgs()...)
-					}
+			case "storage":
+				cfg, err := parseStorageConfig(h)
+				if err != nil {
+					return nil, err
 				}
+				if flatS3 && cfg.Driver != StorageS3 {
+					return nil, h.Errf("storage %s conflicts with the s3_* directives", cfg.Driver)
+				}
+				m.StorageConfig = cfg
+
+			case "permissions":
+				parsePermissions(h, &m.Perms)
 
 			case "ai_tool":
 				m.ExposeAsTool = true
@@ -215,6 +285,37 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					return nil, h.Err("cron expects a wasm file path")
 				}
 				job.WasmFile = h.Val()
+
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					switch h.Val() {
+					case "name":
+						if h.NextArg() {
+							job.Name = h.Val()
+						}
+					case "tenant":
+						if h.NextArg() {
+							job.Tenant = h.Val()
+						}
+					case "payload":
+						if h.NextArg() {
+							job.Payload = h.Val()
+						}
+					case "timezone":
+						if h.NextArg() {
+							job.Timezone = h.Val()
+						}
+					case "overlap":
+						if !h.NextArg() {
+							return nil, h.Err("cron overlap expects 'skip', 'queue' or 'replace'")
+						}
+						switch h.Val() {
+						case CronOverlapSkip, CronOverlapQueue, CronOverlapReplace:
+							job.Overlap = h.Val()
+						default:
+							return nil, h.Errf("invalid cron overlap policy: %s", h.Val())
+						}
+					}
+				}
 				m.CronJobs = append(m.CronJobs, job)
 
 			case "mqtt_broker":
@@ -233,6 +334,15 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				if h.NextArg() {
 					m.MQTTPassword = h.Val()
 				}
+			case "mqtt_max_tenants":
+				if !h.NextArg() {
+					return nil, h.Err("mqtt_max_tenants expects a number")
+				}
+				n, err := strconv.Atoi(h.Val())
+				if err != nil || n < 1 {
+					return nil, h.Errf("invalid mqtt_max_tenants: %s", h.Val())
+				}
+				m.MQTTMaxTenants = n
 			case "mqtt_subscribe":
 				var sub MQTTSub
 				if !h.NextArg() {
@@ -243,6 +353,26 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					return nil, h.Err("mqtt_subscribe expects a wasm file path")
 				}
 				sub.WasmFile = h.Val()
+
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					switch h.Val() {
+					case "tenant":
+						if h.NextArg() {
+							sub.Tenant = h.Val()
+						}
+					case "tenants":
+						sub.Tenants = append(sub.Tenants, h.RemainingArgs()...)
+					case "qos":
+						if !h.NextArg() {
+							return nil, h.Err("mqtt_subscribe qos expects 0, 1 or 2")
+						}
+						qos, err := strconv.Atoi(h.Val())
+						if err != nil || qos < 0 || qos > 2 {
+							return nil, h.Errf("invalid mqtt qos: %s", h.Val())
+						}
+						sub.QoS = byte(qos)
+					}
+				}
 				m.MQTTSubs = append(m.MQTTSubs, sub)
 
 			case "ai_provider":
@@ -266,14 +396,24 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				if h.NextArg() {
 					m.APIKeys = append(m.APIKeys, h.Val())
 				}
+			case "admin_key":
+				if h.NextArg() {
+					m.AdminKeys = append(m.AdminKeys, h.Val())
+				}
 			case "allow_host":
 				if h.NextArg() {
 					m.AllowedHosts = append(m.AllowedHosts, h.Val())
 				}
+			case "egress":
+				if err := parseEgressPolicy(h, &m); err != nil {
+					return nil, err
+				}
 			case "cors_origin":
 				if h.NextArg() {
 					m.CorsOrigins = append(m.CorsOrigins, h.Val())
 				}
+			case "ws_origin":
+				m.WSOrigins = append(m.WSOrigins, h.RemainingArgs()...)
 
 			case "rate_limit":
 				if h.NextArg() {
@@ -347,10 +487,31 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 							if h.NextArg() {
 								policy.StaleReads = h.Val() == "true"
 							}
+						case "replicas":
+							if !h.NextArg() {
+								return nil, h.ArgErr()
+							}
+							val, err := strconv.Atoi(h.Val())
+							if err != nil {
+								return nil, h.Errf("invalid consensus replicas: %v", err)
+							}
+							policy.Replicas = val
+						default:
+							return nil, h.Errf("unknown consensus subdirective: %s", h.Val())
 						}
 					}
+					if err := policy.validate(); err != nil {
+						return nil, h.Err(err.Error())
+					}
 					m.Consensus = append(m.Consensus, policy)
 				}
+			case "actors":
+				cfg, err := parseActorConfig(h)
+				if err != nil {
+					return nil, err
+				}
+				m.Actors = cfg
+
 			case "store_cipher_key":
 				if !h.NextArg() {
 					return nil, h.Err("store_cipher_key requires a master password or cipher string")
@@ -378,15 +539,327 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 		}
 	}
 
-	if s3Bucket != "" {
-		m.Storage = s3.New(s3.Config{
-			Bucket:    s3Bucket,
-			Region:    s3Region,
-			AccessKey: s3AccessKey,
-			SecretKey: s3SecretKey,
-			Endpoint:  s3Endpoint,
-		})
+	if err := m.validateMQTT(); err != nil {
+		return nil, h.Err(err.Error())
 	}
-
 	return &m, nil
 }
+
+// legacyS3 returns the s3 storage config filled by the flat s3_* directives.
+// They only apply to the s3 driver, so a storage block selecting another
+// driver is a conflict rather than something to merge into.
+func legacyS3(m *Gojinn) (*StorageConfig, error) {
+	if m.StorageConfig == nil {
+		m.StorageConfig = &StorageConfig{Driver: StorageS3}
+	}
+	switch m.StorageConfig.Driver {
+	case "":
+		m.StorageConfig.Driver = StorageS3
+	case StorageS3:
+	default:
+		return nil, fmt.Errorf("conflicts with storage %s", m.StorageConfig.Driver)
+	}
+	return m.StorageConfig, nil
+}
+
+// parseStorageConfig reads the storage block:
+//
+//	storage fs|mem|s3|jetstream {
+//	    path ./data/blobs      # fs
+//	    bucket gojinn-objects  # s3, jetstream
+//	    region us-east-1       # s3
+//	    endpoint http://minio:9000
+//	    access_key ...
+//	    secret_key ...
+//	}
+func parseStorageConfig(h httpcaddyfile.Helper) (*StorageConfig, error) {
+	if !h.NextArg() {
+		return nil, h.Err("storage expects a driver: fs, mem, s3 or jetstream")
+	}
+	cfg := &StorageConfig{Driver: h.Val()}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		key := h.Val()
+		if !h.NextArg() {
+			return nil, h.Errf("storage %s expects a value", key)
+		}
+		switch key {
+		case "path":
+			cfg.Path = h.Val()
+		case "bucket":
+			cfg.Bucket = h.Val()
+		case "region":
+			cfg.Region = h.Val()
+		case "endpoint":
+			cfg.Endpoint = h.Val()
+		case "access_key":
+			cfg.AccessKey = h.Val()
+		case "secret_key":
+			cfg.SecretKey = h.Val()
+		default:
+			return nil, h.Errf("unknown storage subdirective: %s", key)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, h.Err(err.Error())
+	}
+	return cfg, nil
+}
+
+// parseEgressPolicy reads the egress block:
+//
+//	egress {
+//	    allow_host api.stripe.com *.githubusercontent.com
+//	    allow_private
+//	    timeout 10s
+//	    max_response 5MB
+//	}
+func parseEgressPolicy(h httpcaddyfile.Helper, m *Gojinn) error {
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "allow_host":
+			m.AllowedHosts = append(m.AllowedHosts, h.RemainingArgs()...)
+		case "allow_private":
+			m.Egress.AllowPrivate = true
+		case "timeout":
+			if !h.NextArg() {
+				return h.Err("egress timeout expects a duration")
+			}
+			val, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return h.Errf("invalid egress timeout: %v", err)
+			}
+			m.Egress.Timeout = caddy.Duration(val)
+		case "max_response":
+			if !h.NextArg() {
+				return h.Err("egress max_response expects a size")
+			}
+			m.Egress.MaxResponse = h.Val()
+		default:
+			return h.Errf("unknown egress subdirective: %s", h.Val())
+		}
+	}
+	if err := m.Egress.validate(); err != nil {
+		return h.Err(err.Error())
+	}
+	return nil
+}
+
+// parseTenantDBConfig reads the tenant_db block:
+//
+//	tenant_db {
+//	    max_open 64
+//	    migrations ./migrations/tenant
+//	    max_size 100MB
+//	}
+func parseTenantDBConfig(h httpcaddyfile.Helper) (*TenantDBConfig, error) {
+	cfg := &TenantDBConfig{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "max_open":
+			if !h.NextArg() {
+				return nil, h.Err("tenant_db max_open expects a number")
+			}
+			n, err := strconv.Atoi(h.Val())
+			if err != nil || n <= 0 {
+				return nil, h.Errf("invalid tenant_db max_open: %s", h.Val())
+			}
+			cfg.MaxOpen = n
+		case "migrations":
+			if !h.NextArg() {
+				return nil, h.Err("tenant_db migrations expects a directory")
+			}
+			cfg.Migrations = h.Val()
+		case "max_size":
+			if !h.NextArg() {
+				return nil, h.Err("tenant_db max_size expects a size")
+			}
+			if _, err := humanize.ParseBytes(h.Val()); err != nil {
+				return nil, h.Errf("invalid tenant_db max_size: %v", err)
+			}
+			cfg.MaxSize = h.Val()
+		default:
+			return nil, h.Errf("unknown tenant_db subdirective: %s", h.Val())
+		}
+	}
+	return cfg, nil
+}
+
+// parseActorConfig reads the actors block. A bare "actors" enables every
+// declared function with the defaults:
+//
+//	actors {
+//	    types counter cart
+//	    idle_timeout 5m
+//	    lease_ttl 15s
+//	}
+func parseActorConfig(h httpcaddyfile.Helper) (*ActorConfig, error) {
+	cfg := &ActorConfig{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "types":
+			cfg.Types = append(cfg.Types, h.RemainingArgs()...)
+		case "idle_timeout", "lease_ttl":
+			name := h.Val()
+			if !h.NextArg() {
+				return nil, h.Errf("actors %s expects a duration", name)
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid actors %s: %v", name, err)
+			}
+			if name == "idle_timeout" {
+				cfg.IdleTimeout = caddy.Duration(d)
+			} else {
+				cfg.LeaseTTL = caddy.Duration(d)
+			}
+		default:
+			return nil, h.Errf("unknown actors subdirective: %s", h.Val())
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, h.Err(err.Error())
+	}
+	return cfg, nil
+}
+
+func parsePermissions(h httpcaddyfile.Helper, p *Permissions) {
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "kv_read":
+			p.KVRead = append(p.KVRead, h.RemainingArgs()...)
+		case "kv_write":
+			p.KVWrite = append(p.KVWrite, h.RemainingArgs()...)
+		case "s3_read":
+			p.S3Read = append(p.S3Read, h.RemainingArgs()...)
+		case "s3_write":
+			p.S3Write = append(p.S3Write, h.RemainingArgs()...)
+		case "mqtt_publish":
+			p.MQTTPublish = append(p.MQTTPublish, h.RemainingArgs()...)
+		case "ws_rooms":
+			p.WSRooms = append(p.WSRooms, h.RemainingArgs()...)
+		}
+	}
+}
+
+func parseRetryPolicy(h httpcaddyfile.Helper, p *RetryPolicy) error {
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "max_attempts":
+			if !h.NextArg() {
+				return h.Err("retry max_attempts expects a number")
+			}
+			val, err := strconv.Atoi(h.Val())
+			if err != nil || val < 1 {
+				return h.Errf("invalid retry max_attempts: %s", h.Val())
+			}
+			p.MaxAttempts = val
+		case "backoff":
+			if !h.NextArg() {
+				return h.Err("retry backoff expects 'fixed', 'linear' or 'exponential'")
+			}
+			p.Backoff = h.Val()
+		case "delay":
+			if !h.NextArg() {
+				return h.Err("retry delay expects a duration")
+			}
+			val, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return h.Errf("invalid retry delay: %v", err)
+			}
+			p.Delay = caddy.Duration(val)
+		case "max_delay":
+			if !h.NextArg() {
+				return h.Err("retry max_delay expects a duration")
+			}
+			val, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return h.Errf("invalid retry max_delay: %v", err)
+			}
+			p.MaxDelay = caddy.Duration(val)
+		case "jitter":
+			if !h.NextArg() {
+				return h.Err("retry jitter expects a fraction between 0 and 1")
+			}
+			val, err := strconv.ParseFloat(h.Val(), 64)
+			if err != nil {
+				return h.Errf("invalid retry jitter: %s", h.Val())
+			}
+			p.Jitter = val
+		case "retry_on":
+			p.RetryOn = h.RemainingArgs()
+		}
+	}
+	if err := p.validate(); err != nil {
+		return h.Err(err.Error())
+	}
+	return nil
+}
+
+// parseFunctionSpec reads one entry of the functions block:
+//
+//	<name> <wasm_file> {
+//	    route /users/{id}
+//	    methods GET PUT
+//	    env KEY value
+//	    timeout 5s
+//	    pool_size 4
+//	    permissions { ... }
+//	    retry { ... }
+//	}
+func parseFunctionSpec(h httpcaddyfile.Helper) (FunctionSpec, error) {
+	spec := FunctionSpec{Name: h.Val()}
+	if !h.NextArg() {
+		return spec, h.Errf("function %s expects a wasm file path", spec.Name)
+	}
+	spec.WasmFile = h.Val()
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "route":
+			if !h.NextArg() {
+				return spec, h.Err("route expects a path pattern")
+			}
+			spec.Route = h.Val()
+		case "methods":
+			spec.Methods = append(spec.Methods, h.RemainingArgs()...)
+		case "env":
+			args := h.RemainingArgs()
+			if len(args) != 2 {
+				return spec, h.Err("env expects a key and a value")
+			}
+			if spec.Env == nil {
+				spec.Env = make(map[string]string)
+			}
+			spec.Env[args[0]] = args[1]
+		case "timeout":
+			if !h.NextArg() {
+				return spec, h.Err("timeout expects a duration")
+			}
+			val, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return spec, h.Errf("invalid timeout: %v", err)
+			}
+			spec.Timeout = caddy.Duration(val)
+		case "pool_size":
+			if !h.NextArg() {
+				return spec, h.Err("pool_size expects a number")
+			}
+			val, err := strconv.Atoi(h.Val())
+			if err != nil || val < 1 {
+				return spec, h.Errf("invalid pool_size: %s", h.Val())
+			}
+			spec.PoolSize = val
+		case "permissions":
+			spec.Perms = &Permissions{}
+			parsePermissions(h, spec.Perms)
+		case "retry":
+			spec.Retry = &RetryPolicy{}
+			if err := parseRetryPolicy(h, spec.Retry); err != nil {
+				return spec, err
+			}
+		default:
+			return spec, h.Errf("unknown function subdirective: %s", h.Val())
+		}
+	}
+	return spec, nil
+}
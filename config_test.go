@@ -7,6 +7,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -104,3 +105,528 @@ func TestParseCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCaddyfile_CronJobs(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		cron "@every 1m" ./tick.wasm
+		cron "0 0 3 * * *" ./report.wasm {
+			name nightly-report
+			tenant acme
+			payload "{\"kind\":\"daily\"}"
+			timezone America/Sao_Paulo
+			overlap skip
+		}
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Len(t, g.CronJobs, 2)
+
+	assert.Equal(t, "@every 1m", g.CronJobs[0].Schedule)
+	assert.Equal(t, defaultJobTenant, g.CronJobs[0].tenantID())
+	assert.Equal(t, defaultCronPayload, g.CronJobs[0].payload())
+
+	job := g.CronJobs[1]
+	assert.Equal(t, "nightly-report", job.jobName())
+	assert.Equal(t, "acme", job.tenantID())
+	assert.Equal(t, `{"kind":"daily"}`, job.payload())
+	assert.Equal(t, CronOverlapSkip, job.Overlap)
+	assert.Equal(t, "CRON_TZ=America/Sao_Paulo 0 0 3 * * *", job.spec())
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		cron "@daily" ./x.wasm {
+			overlap sometimes
+		}
+	}`)
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.Error(t, err)
+}
+
+func TestParseCaddyfile_JobResults(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		job_results {
+			ttl 1h
+			max_output 64KB
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, time.Hour, g.jobResultTTL())
+	assert.Equal(t, 64000, g.jobResultMaxOutput())
+
+	assert.Equal(t, defaultJobResultTTL, (&Gojinn{}).jobResultTTL())
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		job_results {
+			max_output lots
+		}
+	}`)
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.Error(t, err)
+}
+
+func TestParseCaddyfile_RetryPolicy(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		retry {
+			max_attempts 8
+			backoff exponential
+			delay 500ms
+			max_delay 10s
+			jitter 0.25
+			retry_on timeout trap
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	p := handler.(*Gojinn).Retry
+	assert.Equal(t, 8, p.maxAttempts())
+	assert.Equal(t, BackoffExponential, p.Backoff)
+	assert.Equal(t, caddy.Duration(500*time.Millisecond), p.Delay)
+	assert.Equal(t, 0.25, p.Jitter)
+	assert.True(t, p.retryable(FailureTimeout))
+	assert.False(t, p.retryable(FailureFunctionError))
+
+	invalid := []string{
+		"backoff random",
+		"retry_on everything",
+		"jitter 2",
+		"max_attempts 0",
+	}
+	for _, line := range invalid {
+		d = caddyfile.NewTestDispenser("gojinn ./app.wasm {\n retry {\n " + line + "\n }\n}")
+		_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseCaddyfile_Storage(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		storage jetstream {
+			bucket BLOBS
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, &StorageConfig{Driver: StorageJetStream, Bucket: "BLOBS"}, handler.(*Gojinn).StorageConfig)
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		s3_bucket objects
+		s3_endpoint http://minio:9000
+	}`)
+	handler, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, &StorageConfig{Driver: StorageS3, Bucket: "objects", Endpoint: "http://minio:9000"}, handler.(*Gojinn).StorageConfig)
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		storage s3 {
+			bucket objects
+		}
+		s3_region eu-west-1
+	}`)
+	handler, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err, "Flat s3_* directives still refine an s3 storage block")
+	assert.Equal(t, &StorageConfig{Driver: StorageS3, Bucket: "objects", Region: "eu-west-1"}, handler.(*Gojinn).StorageConfig)
+
+	invalid := []string{
+		"storage",
+		"storage ftp",
+		"storage s3",
+		"storage fs {\n root /tmp\n }",
+		"storage fs\n s3_bucket objects",
+		"s3_bucket objects\n storage mem",
+	}
+	for _, line := range invalid {
+		d = caddyfile.NewTestDispenser("gojinn ./app.wasm {\n " + line + "\n}")
+		_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseCaddyfile_MQTTSubscriptions(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		mqtt_broker tcp://localhost:1883
+		mqtt_client_id edge-01
+		mqtt_max_tenants 2
+		api_key globex
+		mqtt_subscribe sensors/# ./ingest.wasm
+		mqtt_subscribe fleet/+/devices/+/telemetry ./telemetry.wasm {
+			tenant {1}
+			tenants acme initech
+			qos 1
+		}
+		permissions {
+			mqtt_publish fleet/
+		}
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Len(t, g.MQTTSubs, 2)
+	assert.Equal(t, []string{"fleet/"}, g.Perms.MQTTPublish)
+
+	tenant, err := g.MQTTSubs[0].resolveTenant("sensors/a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultJobTenant, tenant)
+
+	sub := g.MQTTSubs[1]
+	assert.Equal(t, byte(1), sub.QoS)
+	assert.True(t, sub.dynamicTenant())
+
+	tenant, err = sub.resolveTenant("fleet/acme/devices/42/telemetry")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", tenant)
+
+	_, err = sub.resolveTenant("fleet/acme/devices/42")
+	assert.Error(t, err)
+
+	_, err = sub.resolveTenant("fleet/a.b/devices/42/telemetry")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"acme", "initech"}, sub.Tenants)
+	assert.Equal(t, 2, g.MQTTMaxTenants)
+	assert.NoError(t, g.acceptMQTTTenant(g.MQTTSubs[0], "anything"))
+	assert.ErrorIs(t, g.acceptMQTTTenant(sub, "mallory"), errMQTTTenant)
+	assert.NoError(t, g.acceptMQTTTenant(sub, "acme"))
+	assert.NoError(t, g.acceptMQTTTenant(sub, "globex"))
+	assert.NoError(t, g.acceptMQTTTenant(sub, "acme"))
+	assert.ErrorIs(t, g.acceptMQTTTenant(sub, "initech"), errMQTTTenant)
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		mqtt_subscribe a/b ./x.wasm {
+			qos 3
+		}
+	}`)
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.Error(t, err)
+
+	d = caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		mqtt_subscribe a/b ./x.wasm {
+			qos 1
+		}
+	}`)
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.ErrorContains(t, err, "requires mqtt_client_id")
+}
+
+func TestMQTTWildcards(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		captures []string
+		match    bool
+	}{
+		{"a/b", "a/b", nil, true},
+		{"a/b", "a/c", nil, false},
+		{"a/+", "a/b", []string{"b"}, true},
+		{"a/+", "a/b/c", nil, false},
+		{"a/+", "a", nil, false},
+		{"+/+/c", "x/y/c", []string{"x", "y"}, true},
+		{"a/+/c", "a//c", []string{""}, true},
+		{"a/#", "a/b/c", []string{"b/c"}, true},
+		{"a/#", "a", []string{""}, true},
+		{"#", "a/b", []string{"a/b"}, true},
+		{"+/devices/#", "acme/devices/1/temp", []string{"acme", "1/temp"}, true},
+		{"+/devices/#", "acme/sensors/1", nil, false},
+		{"$share/workers/a/+", "a/b", []string{"b"}, true},
+		{"$share/workers", "workers", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			captures, ok := mqttWildcards(tt.filter, tt.topic)
+			assert.Equal(t, tt.match, ok)
+			if tt.match {
+				assert.Equal(t, tt.captures, captures)
+			}
+		})
+	}
+}
+
+func TestMQTTSub_ResolveTenant(t *testing.T) {
+	tests := []struct {
+		name   string
+		sub    MQTTSub
+		topic  string
+		tenant string
+		err    string
+	}{
+		{"Default", MQTTSub{Topic: "a/#"}, "a/b", defaultJobTenant, ""},
+		{"Static", MQTTSub{Topic: "a/+", Tenant: "acme"}, "a/b", "acme", ""},
+		{"Single Level", MQTTSub{Topic: "t/+/data", Tenant: "{1}"}, "t/acme/data", "acme", ""},
+		{"Second Level", MQTTSub{Topic: "+/x/+", Tenant: "{2}"}, "eu/x/acme", "acme", ""},
+		{"Combined", MQTTSub{Topic: "+/+/data", Tenant: "{1}-{2}"}, "eu/acme/data", "eu-acme", ""},
+		{"Multi Level", MQTTSub{Topic: "t/#", Tenant: "{1}"}, "t/acme", "acme", ""},
+		{"Multi Level With Slash", MQTTSub{Topic: "t/#", Tenant: "{1}"}, "t/acme/data", "", "invalid tenant id"},
+		{"Out Of Range", MQTTSub{Topic: "t/+", Tenant: "{2}"}, "t/acme", "", "out of range"},
+		{"Zero Index", MQTTSub{Topic: "t/+", Tenant: "{0}"}, "t/acme", "", "out of range"},
+		{"No Match", MQTTSub{Topic: "t/+", Tenant: "{1}"}, "u/acme", "", "does not match"},
+		{"Invalid Characters", MQTTSub{Topic: "t/+", Tenant: "{1}"}, "t/a.b", "", "invalid tenant id"},
+		{"Empty Level", MQTTSub{Topic: "t/+/x", Tenant: "{1}"}, "t//x", "", "invalid tenant id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, err := tt.sub.resolveTenant(tt.topic)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.tenant, tenant)
+		})
+	}
+}
+
+func TestAcceptMQTTTenant(t *testing.T) {
+	g := &Gojinn{APIKeys: []string{"keyed"}, MQTTMaxTenants: 3}
+	g.tenants.Store("registered", &TenantConfig{})
+	static := MQTTSub{Topic: "t/+", Tenant: "fixed"}
+	dynamic := MQTTSub{Topic: "t/+", Tenant: "{1}", Tenants: []string{"listed", "spare"}}
+
+	// The cases run in order: every accepted dynamic tenant takes one of the
+	// three mqtt_max_tenants slots.
+	tests := []struct {
+		name   string
+		sub    MQTTSub
+		tenant string
+		ok     bool
+	}{
+		{"Static Subscription", static, "anyone", true},
+		{"Unknown Tenant", dynamic, "mallory", false},
+		{"Subscription List", dynamic, "listed", true},
+		{"API Key", dynamic, "keyed", true},
+		{"Tenant Registry", dynamic, "registered", true},
+		{"Already Provisioned", dynamic, "listed", true},
+		{"Over Limit", dynamic, "spare", false},
+		{"Static Over Limit", static, "fixed", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.acceptMQTTTenant(tt.sub, tt.tenant)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, errMQTTTenant)
+			}
+		})
+	}
+}
+
+type fakeMQTTMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+	qos     byte
+	id      uint16
+}
+
+func (m fakeMQTTMessage) Topic() string     { return m.topic }
+func (m fakeMQTTMessage) Payload() []byte   { return m.payload }
+func (m fakeMQTTMessage) Qos() byte         { return m.qos }
+func (m fakeMQTTMessage) MessageID() uint16 { return m.id }
+
+func TestMQTTMsgID(t *testing.T) {
+	msg := fakeMQTTMessage{topic: "t/acme", payload: []byte("21.5"), qos: 1, id: 7}
+	id := mqttMsgID("edge-01", msg)
+	assert.Equal(t, id, mqttMsgID("edge-01", msg), "Redeliveries dedupe on the same id")
+	assert.Contains(t, id, "edge-01")
+
+	reused := msg
+	reused.payload = []byte("22.0")
+	assert.NotEqual(t, id, mqttMsgID("edge-01", reused), "A reused packet id with new content is a new message")
+	assert.NotEqual(t, id, mqttMsgID("edge-02", msg))
+
+	msg.qos = 0
+	assert.Empty(t, mqttMsgID("edge-01", msg), "QoS 0 messages are never redelivered")
+}
+
+func TestParseCaddyfile_Functions(t *testing.T) {
+	input := `gojinn {
+		env REGION eu
+		functions {
+			users ./functions/users.wasm {
+				route /users/{id}
+				methods get PUT
+				env TABLE users
+				timeout 5s
+				pool_size 4
+				permissions {
+					kv_read users.
+				}
+				retry {
+					max_attempts 2
+				}
+			}
+			health ./functions/health.wasm
+		}
+		functions_dir ./functions
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, "./functions", g.FunctionsDir)
+	if assert.Len(t, g.Functions, 2) {
+		users := g.Functions[0]
+		assert.Equal(t, "users", users.Name)
+		assert.Equal(t, "./functions/users.wasm", users.WasmFile)
+		assert.Equal(t, "/users/{id}", users.Route)
+		assert.Equal(t, []string{"get", "PUT"}, users.Methods)
+		assert.Equal(t, map[string]string{"TABLE": "users"}, users.Env)
+		assert.Equal(t, caddy.Duration(5*time.Second), users.Timeout)
+		assert.Equal(t, 4, users.PoolSize)
+		assert.Equal(t, []string{"users."}, users.Perms.KVRead)
+		assert.Equal(t, 2, users.Retry.MaxAttempts)
+
+		health := g.Functions[1]
+		assert.Equal(t, "./functions/health.wasm", health.WasmFile)
+		assert.Nil(t, health.Perms)
+	}
+
+	d = caddyfile.NewTestDispenser(`gojinn {
+		functions {
+			users ./users.wasm {
+				memory 1GB
+			}
+		}
+	}`)
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.Error(t, err)
+}
+
+func TestParseCaddyfile_TenantDB(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		tenant_db {
+			max_open 8
+			migrations ./migrations
+			max_size 50MB
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, &TenantDBConfig{MaxOpen: 8, Migrations: "./migrations", MaxSize: "50MB"}, handler.(*Gojinn).TenantDB)
+
+	invalid := []string{
+		"tenant_db {\n max_open 0\n }",
+		"tenant_db {\n max_size huge\n }",
+		"tenant_db {\n path /tmp\n }",
+	}
+	for _, line := range invalid {
+		d = caddyfile.NewTestDispenser("gojinn ./app.wasm {\n " + line + "\n}")
+		_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseCaddyfile_Migrations(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		db_driver postgres
+		db_dsn postgres://localhost/app
+		migrations ./migrations
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, "./migrations", handler.(*Gojinn).Migrations)
+
+	d = caddyfile.NewTestDispenser("gojinn ./app.wasm {\n migrations\n}")
+	_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.Error(t, err)
+}
+
+func TestParseCaddyfile_Consensus(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+		consensus {
+			payments. {
+				mode CP
+				replicas 3
+			}
+			sessions. {
+				mode ap
+				stale_reads true
+			}
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, []ConsensusPolicy{
+		{Namespace: "payments.", Mode: ConsensusCP, Replicas: 3},
+		{Namespace: "sessions.", Mode: ConsensusAP, StaleReads: true},
+	}, handler.(*Gojinn).Consensus)
+
+	invalid := []string{
+		"consensus {\n x. {\n mode strict\n }\n }",
+		"consensus {\n x. {\n mode cp\n stale_reads true\n }\n }",
+		"consensus {\n x. {\n mode cp\n replicas 7\n }\n }",
+		"consensus {\n x. {\n mode cp\n quorum 2\n }\n }",
+	}
+	for _, line := range invalid {
+		d = caddyfile.NewTestDispenser("gojinn ./app.wasm {\n " + line + "\n}")
+		_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseCaddyfile_Actors(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn {
+		actors {
+			types counter cart
+			idle_timeout 2m
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, &ActorConfig{
+		Types:       []string{"counter", "cart"},
+		IdleTimeout: caddy.Duration(2 * time.Minute),
+		LeaseTTL:    caddy.Duration(defaultActorLease),
+	}, handler.(*Gojinn).Actors)
+
+	d = caddyfile.NewTestDispenser("gojinn {\n actors\n}")
+	handler, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+	assert.Equal(t, caddy.Duration(defaultActorIdle), handler.(*Gojinn).Actors.IdleTimeout)
+
+	invalid := []string{
+		"actors {\n types bad/type\n }",
+		"actors {\n idle_timeout soon\n }",
+		"actors {\n lease_ttl 100ms\n }",
+		"actors {\n mailbox 10\n }",
+	}
+	for _, line := range invalid {
+		d = caddyfile.NewTestDispenser("gojinn {\n " + line + "\n}")
+		_, err = parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseCaddyfile_WebSocket(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`gojinn ./chat.wasm {
+		cors_origin https://app.example
+		ws_origin https://app.example *.internal.example
+		permissions {
+			ws_rooms lobby game-
+		}
+	}`)
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: d})
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, []string{"https://app.example", "*.internal.example"}, g.WSOrigins)
+	assert.Equal(t, []string{"lobby", "game-"}, g.Perms.WSRooms)
+	assert.Equal(t, g.WSOrigins, g.wsAcceptOptions().OriginPatterns)
+
+	g.WSOrigins = nil
+	assert.Equal(t, []string{"https://app.example"}, g.wsAcceptOptions().OriginPatterns, "cors_origin is the fallback")
+}
@@ -0,0 +1,209 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	ConsensusCP = "cp"
+	ConsensusAP = "ap"
+
+	// maxStreamReplicas is the JetStream limit on replicas per stream.
+	maxStreamReplicas = 5
+)
+
+const (
+	kvCodeNoQuorum       = "no_quorum"
+	kvCodeCrossNamespace = "cross_namespace"
+)
+
+// kvNoQuorum is returned by host_kv_delete when a CP namespace cannot reach
+// a quorum.
+const kvNoQuorum = 3
+
+func (p *ConsensusPolicy) validate() error {
+	if p.Namespace == "" {
+		return fmt.Errorf("consensus namespace must not be empty")
+	}
+	p.Mode = strings.ToLower(p.Mode)
+	switch p.Mode {
+	case ConsensusCP:
+		if p.StaleReads {
+			return fmt.Errorf("consensus namespace %q: stale_reads is not allowed in cp mode", p.Namespace)
+		}
+	case ConsensusAP:
+	default:
+		return fmt.Errorf("consensus namespace %q: mode must be cp or ap, got %q", p.Namespace, p.Mode)
+	}
+	if p.Replicas < 0 || p.Replicas > maxStreamReplicas {
+		return fmt.Errorf("consensus namespace %q: replicas must be between 1 and %d", p.Namespace, maxStreamReplicas)
+	}
+	return nil
+}
+
+// leaderReads reports whether reads must go through the stream leader. Only
+// AP namespaces with stale_reads may be answered by any replica.
+func (p *ConsensusPolicy) leaderReads() bool {
+	return p.Mode == ConsensusCP || !p.StaleReads
+}
+
+// setupConsensus validates the namespaces and orders them longest first, so
+// the most specific namespace of a key wins.
+func (r *Gojinn) setupConsensus() error {
+	buckets := make(map[string]string)
+	for i := range r.Consensus {
+		p := &r.Consensus[i]
+		if err := p.validate(); err != nil {
+			return err
+		}
+		suffix := namespaceBucketSuffix(p.Namespace)
+		if other, ok := buckets[suffix]; ok {
+			return fmt.Errorf("consensus namespaces %q and %q map to the same bucket", other, p.Namespace)
+		}
+		buckets[suffix] = p.Namespace
+	}
+	sort.SliceStable(r.Consensus, func(i, j int) bool {
+		return len(r.Consensus[i].Namespace) > len(r.Consensus[j].Namespace)
+	})
+	return nil
+}
+
+func namespaceBucketSuffix(namespace string) string {
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			return c
+		}
+		return '_'
+	}, strings.ToUpper(strings.TrimRight(namespace, ".")))
+}
+
+func namespaceBucketName(tenantID string, p *ConsensusPolicy) string {
+	return tenantBucketName(tenantID) + "_NS_" + namespaceBucketSuffix(p.Namespace)
+}
+
+// consensusPolicy returns the namespace a key belongs to, nil for the
+// tenant's default bucket.
+func (r *Gojinn) consensusPolicy(key string) *ConsensusPolicy {
+	for i := range r.Consensus {
+		if strings.HasPrefix(key, r.Consensus[i].Namespace) {
+			return &r.Consensus[i]
+		}
+	}
+	return nil
+}
+
+// kvFor resolves the bucket holding key for the running invocation.
+func (r *Gojinn) kvFor(ctx context.Context, key string) (nats.KeyValue, *ConsensusPolicy, error) {
+	kv := invocationKV(ctx)
+	if kv == nil {
+		return nil, nil, &kvError{code: kvCodeUnavailable, err: errKVUnavailable}
+	}
+	policy := r.consensusPolicy(key)
+	if policy == nil {
+		return kv, nil, nil
+	}
+	nsKV, err := r.namespaceKV(invocationFromContext(ctx).tenantID, policy)
+	if err != nil {
+		return nil, policy, policyFailure(policy, err)
+	}
+	return nsKV, policy, nil
+}
+
+// kvForPrefix resolves the bucket for a list or watch. A prefix that covers
+// keys of more than one namespace is refused, since no single bucket and
+// policy answers for all of them.
+func (r *Gojinn) kvForPrefix(ctx context.Context, prefix string) (nats.KeyValue, *ConsensusPolicy, error) {
+	if r.consensusPolicy(prefix) == nil {
+		for _, p := range r.Consensus {
+			if strings.HasPrefix(p.Namespace, prefix) {
+				return nil, nil, kvErrorf(kvCodeCrossNamespace, "prefix %q spans the %q consensus namespace", prefix, p.Namespace)
+			}
+		}
+	}
+	return r.kvFor(ctx, prefix)
+}
+
+// namespaceKV opens the tenant's bucket for a namespace, creating it with the
+// namespace's replicas. Leader reads are enforced by turning off direct gets,
+// which any replica may answer.
+func (r *Gojinn) namespaceKV(tenantID string, p *ConsensusPolicy) (nats.KeyValue, error) {
+	bucket := namespaceBucketName(tenantID, p)
+	if kv, ok := r.namespaceKVs.Load(bucket); ok {
+		return kv.(nats.KeyValue), nil
+	}
+	if r.js == nil {
+		return nil, errKVUnavailable
+	}
+
+	if _, err := r.js.KeyValue(bucket); errors.Is(err, nats.ErrBucketNotFound) {
+		replicas := p.Replicas
+		if replicas == 0 {
+			replicas = r.ClusterReplicas
+		}
+		r.logger.Info("Provisioning consensus namespace bucket...",
+			zap.String("tenant", tenantID), zap.String("namespace", p.Namespace),
+			zap.String("mode", p.Mode), zap.Int("replicas", replicas))
+		_, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: fmt.Sprintf("%s namespace %q of %s", strings.ToUpper(p.Mode), p.Namespace, tenantID),
+			Storage:     nats.FileStorage,
+			History:     1,
+			Replicas:    replicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision namespace bucket: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	info, err := r.js.StreamInfo("KV_" + bucket)
+	if err != nil {
+		return nil, err
+	}
+	if cfg := info.Config; cfg.AllowDirect == p.leaderReads() || !cfg.AllowMsgTTL {
+		cfg.AllowDirect = !p.leaderReads()
+		cfg.AllowMsgTTL = true
+		if _, err := r.js.UpdateStream(&cfg); err != nil {
+			return nil, fmt.Errorf("failed to apply consensus policy to %s: %w", bucket, err)
+		}
+	}
+
+	// Bind after the update: the handle picks direct or leader gets when bound.
+	kv, err := r.js.KeyValue(bucket)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := r.namespaceKVs.LoadOrStore(bucket, kv)
+	return actual.(nats.KeyValue), nil
+}
+
+// policyFailure turns a lost quorum into the namespace's error code. CP
+// namespaces report no_quorum; AP namespaces report the store as unavailable.
+func policyFailure(p *ConsensusPolicy, err error) error {
+	if p == nil || !quorumLost(err) {
+		return err
+	}
+	if p.Mode == ConsensusCP {
+		return &kvError{code: kvCodeNoQuorum, err: fmt.Errorf("namespace %q has no quorum: %w", p.Namespace, err)}
+	}
+	return &kvError{code: kvCodeUnavailable, err: fmt.Errorf("namespace %q is unavailable: %w", p.Namespace, err)}
+}
+
+// quorumLost matches the errors JetStream returns when a stream has no
+// leader or cannot commit: the request times out or nobody answers it.
+func quorumLost(err error) bool {
+	var apiErr *nats.APIError
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrNoStreamResponse) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &apiErr) && (apiErr.ErrorCode == nats.JSErrCodeJetStreamNotAvailable || apiErr.Code == 503))
+}
@@ -0,0 +1,296 @@
+package gojinn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	CronOverlapSkip    = "skip"
+	CronOverlapQueue   = "queue"
+	CronOverlapReplace = "replace"
+
+	cronStatusQueued    = "queued"
+	cronStatusRunning   = "running"
+	cronStatusRetrying  = "retrying"
+	cronStatusSucceeded = "succeeded"
+	cronStatusFailed    = "failed"
+	cronStatusSkipped   = "skipped"
+	cronStatusReplaced  = "replaced"
+
+	defaultJobTenant   = "system"
+	cronHistoryLimit   = 50
+	cronCancelSubject  = "gojinn.cron.cancel"
+	defaultCronPayload = `{"event_type": "cron", "source": "gojinn_scheduler"}`
+)
+
+type CronRun struct {
+	Job         string     `json:"job"`
+	RunID       string     `json:"run_id"`
+	Tenant      string     `json:"tenant"`
+	WasmFile    string     `json:"wasm_file"`
+	Status      string     `json:"status"`
+	Sequence    uint64     `json:"sequence,omitempty"`
+	Attempts    uint64     `json:"attempts,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func (run *CronRun) inFlight() bool {
+	switch run.Status {
+	case cronStatusQueued, cronStatusRunning, cronStatusRetrying:
+		return true
+	}
+	return false
+}
+
+func (j CronJob) jobName() string {
+	if j.Name != "" {
+		return j.Name
+	}
+	return hashString(j.Schedule + "|" + j.WasmFile)[:12]
+}
+
+func (j CronJob) tenantID() string {
+	if j.Tenant != "" {
+		return j.Tenant
+	}
+	return defaultJobTenant
+}
+
+func (j CronJob) spec() string {
+	if j.Timezone != "" {
+		return "CRON_TZ=" + j.Timezone + " " + j.Schedule
+	}
+	return j.Schedule
+}
+
+func (j CronJob) payload() string {
+	if j.Payload != "" {
+		return j.Payload
+	}
+	return defaultCronPayload
+}
+
+func (r *Gojinn) startScheduler() error {
+	r.scheduler = cron.New(cron.WithSeconds())
+
+	for _, job := range r.CronJobs {
+		j := job
+		fn := r.functionFor(j.WasmFile)
+		if _, err := r.loadWasmSecurely(fn.wasmFile()); err != nil {
+			return fmt.Errorf("cron job security check failed for %s: %w", j.WasmFile, err)
+		}
+		if j.Timezone != "" {
+			if _, err := time.LoadLocation(j.Timezone); err != nil {
+				return fmt.Errorf("invalid timezone for cron job %s: %w", j.jobName(), err)
+			}
+		}
+		if err := r.ensureFunctionWorkers(j.tenantID(), fn); err != nil {
+			return fmt.Errorf("failed to provision workers for cron job %s: %w", j.jobName(), err)
+		}
+
+		_, err := r.scheduler.AddFunc(j.spec(), func() {
+			r.runBackgroundJob(j)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to schedule cron job: %v", err)
+		}
+		r.logger.Info("Cron job scheduled",
+			zap.String("job", j.jobName()),
+			zap.String("schedule", j.spec()),
+			zap.String("tenant", j.tenantID()),
+			zap.String("wasm", j.WasmFile))
+	}
+
+	if r.natsConn != nil {
+		_, err := r.natsConn.Subscribe(cronCancelSubject, func(m *nats.Msg) {
+			if cancel, ok := r.cronCancels.Load(string(m.Data)); ok {
+				r.logger.Info("Cancelling replaced cron run", zap.String("run_id", string(m.Data)))
+				cancel.(func())()
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to cron cancellations: %w", err)
+		}
+	}
+
+	r.scheduler.Start()
+	return nil
+}
+
+// resolveCronOverlap applies the job's overlap policy against the previous run
+// and reports whether a new run may be queued.
+func (r *Gojinn) resolveCronOverlap(job CronJob, kv nats.KeyValue, run *CronRun) bool {
+	last, err := loadCronRun(kv, job.jobName())
+	if err != nil || !last.inFlight() {
+		return true
+	}
+	// Every node fires the same tick. When another node already queued it,
+	// the run is not an overlap; the publish is dropped by JetStream dedupe.
+	if last.RunID == run.RunID {
+		return true
+	}
+
+	switch job.Overlap {
+	case CronOverlapSkip:
+		r.logger.Info("Cron run skipped, previous run still in flight",
+			zap.String("job", run.Job), zap.String("previous_run", last.RunID))
+		run.Status = cronStatusSkipped
+		r.saveCronRun(kv, run)
+		return false
+
+	case CronOverlapReplace:
+		if last.Status == cronStatusQueued && last.Sequence > 0 {
+			streamName := tenantStreamName(job.tenantID())
+			if err := r.js.DeleteMsg(streamName, last.Sequence); err != nil {
+				r.logger.Warn("Failed to drop queued cron run", zap.String("run_id", last.RunID), zap.Error(err))
+			}
+		}
+		if last.Status != cronStatusQueued && r.natsConn != nil {
+			_ = r.natsConn.Publish(cronCancelSubject, []byte(last.RunID))
+		}
+		now := time.Now().UTC()
+		last.Status = cronStatusReplaced
+		last.FinishedAt = &now
+		r.saveCronRun(kv, last)
+	}
+
+	return true
+}
+
+func (r *Gojinn) updateCronRunFromMsg(kv nats.KeyValue, m *nats.Msg, status string, attempts uint64, errMsg string) *CronRun {
+	job := m.Header.Get(headerCronJob)
+	runID := m.Header.Get(headerCronRun)
+	if kv == nil || job == "" || runID == "" {
+		return nil
+	}
+
+	run, err := findCronRun(kv, job, runID)
+	if err != nil {
+		run = &CronRun{Job: job, RunID: runID}
+	}
+	if run.Status == cronStatusReplaced {
+		return run
+	}
+
+	now := time.Now().UTC()
+	run.Status = status
+	run.Attempts = attempts
+	run.Error = errMsg
+	switch status {
+	case cronStatusRunning:
+		if run.StartedAt == nil {
+			run.StartedAt = &now
+		}
+	case cronStatusSucceeded, cronStatusFailed:
+		run.FinishedAt = &now
+	}
+
+	r.saveCronRun(kv, run)
+	return run
+}
+
+func cronLastKey(job string) string {
+	return fmt.Sprintf("cron.%s.last", job)
+}
+
+func cronHistoryKey(job string) string {
+	return fmt.Sprintf("cron.%s.history", job)
+}
+
+func loadCronRun(kv nats.KeyValue, job string) (*CronRun, error) {
+	entry, err := kv.Get(cronLastKey(job))
+	if err != nil {
+		return nil, err
+	}
+	var run CronRun
+	if err := json.Unmarshal(entry.Value(), &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func findCronRun(kv nats.KeyValue, job, runID string) (*CronRun, error) {
+	if last, err := loadCronRun(kv, job); err == nil && last.RunID == runID {
+		return last, nil
+	}
+
+	entry, err := kv.Get(cronHistoryKey(job))
+	if err != nil {
+		return nil, err
+	}
+	var history []CronRun
+	if err := json.Unmarshal(entry.Value(), &history); err != nil {
+		return nil, err
+	}
+	for i := range history {
+		if history[i].RunID == runID {
+			return &history[i], nil
+		}
+	}
+	return nil, nats.ErrKeyNotFound
+}
+
+func (r *Gojinn) saveCronRun(kv nats.KeyValue, run *CronRun) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+
+	last, err := loadCronRun(kv, run.Job)
+	if err != nil || last.RunID == run.RunID || !last.ScheduledAt.After(run.ScheduledAt) {
+		if _, err := kv.Put(cronLastKey(run.Job), data); err != nil {
+			r.logger.Warn("Failed to save cron run", zap.String("job", run.Job), zap.Error(err))
+		}
+	}
+
+	key := cronHistoryKey(run.Job)
+	for attempt := 0; attempt < 5; attempt++ {
+		var history []CronRun
+		var revision uint64
+
+		entry, err := kv.Get(key)
+		if err == nil {
+			revision = entry.Revision()
+			_ = json.Unmarshal(entry.Value(), &history)
+		} else if !errors.Is(err, nats.ErrKeyNotFound) {
+			r.logger.Warn("Failed to load cron history", zap.String("job", run.Job), zap.Error(err))
+			return
+		}
+
+		replaced := false
+		for i := range history {
+			if history[i].RunID == run.RunID {
+				history[i] = *run
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			history = append(history, *run)
+		}
+		if len(history) > cronHistoryLimit {
+			history = history[len(history)-cronHistoryLimit:]
+		}
+
+		historyJSON, _ := json.Marshal(history)
+		if revision == 0 {
+			_, err = kv.Create(key, historyJSON)
+		} else {
+			_, err = kv.Update(key, historyJSON, revision)
+		}
+		if err == nil {
+			return
+		}
+	}
+	r.logger.Warn("Failed to update cron history after retries", zap.String("job", run.Job))
+}
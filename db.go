@@ -1,29 +1,38 @@
 package gojinn
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/gojinn-io/gojinn/pkg/migrate"
 	_ "github.com/lib/pq"
+	"github.com/tetratelabs/wazero/api"
 	"go.uber.org/zap"
 	_ "modernc.org/sqlite"
 )
 
 func (r *Gojinn) setupDB() error {
 	if r.DBDriver == "" || r.DBDSN == "" {
+		if r.Migrations != "" {
+			return fmt.Errorf("migrations require db_driver and db_dsn")
+		}
 		return nil
 	}
 
-	driver := r.DBDriver
-	dsn := r.DBDSN
+	driver, dsn := migrate.Normalize(r.DBDriver, r.DBDSN)
 
-	if driver == "libsql" || driver == "sqlite3" {
-		driver = "sqlite"
-		if !strings.HasPrefix(dsn, "file:") && !strings.Contains(dsn, ":memory:") {
-			dsn = "file:" + dsn
+	if r.DBSyncURL != "" || r.DBSyncToken != "" {
+		if driver != "sqlite" {
+			return fmt.Errorf("db_sync_url and db_sync_token require a SQLite database")
+		}
+		if r.DBSyncURL != "" {
+			return r.setupReplica(dsn)
 		}
 	}
 
@@ -50,15 +59,38 @@ func (r *Gojinn) setupDB() error {
 		zap.String("driver", driver),
 		zap.Int("max_conns", maxConns))
 
+	var applied []string
+	if r.Migrations != "" {
+		if applied, err = r.migrateDB(driver); err != nil {
+			return err
+		}
+	}
+	if r.DBSyncToken != "" {
+		return r.setupPrimary(len(applied) > 0)
+	}
 	return nil
 }
 
-func (r *Gojinn) executeQueryToJSON(query string) ([]byte, error) {
-	if r.db == nil {
-		return nil, fmt.Errorf("database not configured on host")
+// migrateDB applies the pending migrations of the migrations directory before
+// any function can reach the database.
+func (r *Gojinn) migrateDB(driver string) ([]string, error) {
+	dialect, err := migrate.DialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	m := &migrate.Migrator{DB: r.db, Dialect: dialect, Dir: r.Migrations}
+	applied, err := m.Up(context.Background(), 0)
+	for _, version := range applied {
+		r.logger.Info("Database migration applied", zap.String("version", version))
 	}
+	if err != nil {
+		return applied, fmt.Errorf("migrations: %w", err)
+	}
+	return applied, nil
+}
 
-	rows, err := r.db.Query(query)
+func executeQueryToJSON(ctx context.Context, q dbQuerier, query string) ([]byte, error) {
+	rows, err := q.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -98,3 +130,228 @@ func (r *Gojinn) executeQueryToJSON(query string) ([]byte, error) {
 
 	return json.Marshal(tableData)
 }
+
+const (
+	DBModeQuery    = "query"
+	DBModeExec     = "exec"
+	DBModeBegin    = "begin"
+	DBModeCommit   = "commit"
+	DBModeRollback = "rollback"
+)
+
+var errDBUnavailable = errors.New("database not configured on host")
+
+// dbRequest is the JSON form of a host_db_query call. Args are bound as
+// placeholders, so guests never have to splice values into SQL.
+type dbRequest struct {
+	SQL  string `json:"sql,omitempty"`
+	Args []any  `json:"args,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+type dbColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable *bool  `json:"nullable,omitempty"`
+}
+
+// dbResponse answers a JSON request. Rows are positional and follow Columns.
+type dbResponse struct {
+	Columns      []dbColumn `json:"columns,omitempty"`
+	Rows         [][]any    `json:"rows,omitempty"`
+	RowsAffected int64      `json:"rows_affected,omitempty"`
+	LastInsertID int64      `json:"last_insert_id,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// dbQuerier is satisfied by both *sql.DB and *sql.Tx.
+type dbQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// parseDBRequest decodes a JSON request. Numbers are kept integral when they
+// have no fraction, since drivers store float64 arguments as REAL.
+func parseDBRequest(raw []byte) (dbRequest, error) {
+	var req dbRequest
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return req, fmt.Errorf("invalid db request: %w", err)
+	}
+	normalizeArgs(req.Args)
+	if req.Mode == "" {
+		req.Mode = DBModeQuery
+	}
+	return req, nil
+}
+
+func normalizeArgs(args []any) {
+	for i, arg := range args {
+		n, ok := arg.(json.Number)
+		if !ok {
+			continue
+		}
+		if v, err := n.Int64(); err == nil {
+			args[i] = v
+		} else if v, err := n.Float64(); err == nil {
+			args[i] = v
+		}
+	}
+}
+
+// executeDBRequest runs req inside the invocation's open transaction when
+// there is one. Transactions are bound to the invocation and rolled back
+// when the module exits without committing.
+func executeDBRequest(ctx context.Context, inv *invocation, req dbRequest) (*dbResponse, error) {
+	db, err := inv.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if inv.replica != nil && req.Mode != DBModeQuery {
+		return inv.replica.handle(ctx, inv, req)
+	}
+
+	switch req.Mode {
+	case DBModeBegin:
+		if inv.tx != nil {
+			return nil, errors.New("transaction already open")
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		inv.tx = tx
+		return &dbResponse{}, nil
+	case DBModeCommit, DBModeRollback:
+		if inv.tx == nil {
+			return nil, errors.New("no transaction open")
+		}
+		tx := inv.tx
+		inv.tx = nil
+		if req.Mode == DBModeCommit {
+			if err := tx.Commit(); err != nil {
+				return nil, err
+			}
+			if inv.primary != nil {
+				inv.primary.notify()
+			}
+			return &dbResponse{}, nil
+		}
+		return &dbResponse{}, tx.Rollback()
+	}
+
+	var q dbQuerier = db
+	if inv.tx != nil {
+		q = inv.tx
+	}
+
+	switch req.Mode {
+	case DBModeExec:
+		if inv.primary != nil {
+			resp, _, err := inv.primary.exec(ctx, q, []dbRequest{req})
+			return resp, err
+		}
+		res, err := q.ExecContext(ctx, req.SQL, req.Args...)
+		if err != nil {
+			return nil, err
+		}
+		out := &dbResponse{}
+		// Not every driver reports both values; missing ones stay zero.
+		out.RowsAffected, _ = res.RowsAffected()
+		out.LastInsertID, _ = res.LastInsertId()
+		return out, nil
+	case DBModeQuery:
+		var out *dbResponse
+		run := func(q dbQuerier) error {
+			rows, err := q.QueryContext(ctx, req.SQL, req.Args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			out, err = scanDBRows(rows)
+			return err
+		}
+		if inv.primary != nil {
+			err = inv.primary.track(ctx, q, req, run)
+		} else {
+			err = run(q)
+		}
+		return out, err
+	default:
+		return nil, fmt.Errorf("unknown db mode %q", req.Mode)
+	}
+}
+
+func scanDBRows(rows *sql.Rows) (*dbResponse, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dbResponse{Columns: make([]dbColumn, len(types)), Rows: make([][]any, 0)}
+	binary := make([]bool, len(types))
+	for i, ct := range types {
+		col := dbColumn{Name: ct.Name(), Type: strings.ToUpper(ct.DatabaseTypeName())}
+		if nullable, ok := ct.Nullable(); ok {
+			col.Nullable = &nullable
+		}
+		out.Columns[i] = col
+		binary[i] = strings.Contains(col.Type, "BLOB") || strings.Contains(col.Type, "BINARY") || col.Type == "BYTEA"
+	}
+
+	values := make([]any, len(types))
+	valuePtrs := make([]any, len(types))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
+		row := make([]any, len(values))
+		for i, val := range values {
+			// Binary columns stay []byte and are base64-encoded by JSON;
+			// text some drivers return as bytes is handed over as a string.
+			if b, ok := val.([]byte); ok && !binary[i] {
+				row[i] = string(b)
+			} else if ok {
+				row[i] = append([]byte(nil), b...)
+			} else {
+				row[i] = val
+			}
+		}
+		out.Rows = append(out.Rows, row)
+	}
+	return out, rows.Err()
+}
+
+// rollbackTx aborts a transaction the module left open.
+func (inv *invocation) rollbackTx() {
+	if inv == nil || inv.tx == nil {
+		return
+	}
+	_ = inv.tx.Rollback()
+	inv.tx = nil
+}
+
+// hostDBRequest serves the JSON form of host_db_query. Oversized results are
+// kept for host_db_result so exec statements are never repeated.
+func (r *Gojinn) hostDBRequest(ctx context.Context, mod api.Module, inv *invocation, raw []byte, outPtr, outMaxLen uint32) uint64 {
+	resp := &dbResponse{}
+	req, err := parseDBRequest(raw)
+	if err == nil {
+		resp, err = executeDBRequest(ctx, inv, req)
+	}
+	if err != nil {
+		r.logger.Debug("Host DB request failed", zap.String("mode", req.Mode), zap.Error(err))
+		resp = &dbResponse{Error: err.Error()}
+	}
+	out, _ := json.Marshal(resp)
+
+	size := writeSized(mod, outPtr, outMaxLen, out)
+	if inv != nil && size != blobNoData && size > uint64(outMaxLen) {
+		inv.pendingQuery = out
+	}
+	return size
+}
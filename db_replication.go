@@ -0,0 +1,837 @@
+package gojinn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	replicationLogTable  = "gojinn_replication_log"
+	replicationMetaTable = "gojinn_replication_meta"
+
+	// replicationRetention is how many log entries are kept. Replicas further
+	// behind than this start over from a snapshot.
+	replicationRetention = 100000
+	replicationPageSize  = 1000
+	replicationPollWait  = 20 * time.Second
+	replicationMaxWait   = 30 * time.Second
+	replicationCatchUp   = 2 * time.Second
+	replicationMaxRetry  = 30 * time.Second
+)
+
+var errPrimaryUnavailable = errors.New("primary database unavailable, replica is read-only")
+
+// replicationChange is one write recorded on the primary. Statements are
+// replayed as-is, so they should not depend on the clock or randomness.
+type replicationChange struct {
+	Seq  int64           `json:"seq"`
+	SQL  string          `json:"sql"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type replicationChanges struct {
+	Generation string              `json:"generation"`
+	Head       int64               `json:"head"`
+	Changes    []replicationChange `json:"changes"`
+}
+
+func ensureReplicationTables(ctx context.Context, q dbQuerier) error {
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS " + replicationLogTable + " (seq INTEGER PRIMARY KEY AUTOINCREMENT, stmt TEXT NOT NULL, args TEXT NOT NULL, created_at INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + replicationMetaTable + " (key TEXT PRIMARY KEY, value TEXT NOT NULL)",
+	} {
+		if _, err := q.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create replication tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordChange appends a write to the log inside the transaction that made
+// it, and trims the log every replicationPageSize entries.
+func recordChange(ctx context.Context, q dbQuerier, seq int64, stmt string, args []byte) (int64, error) {
+	var res sql.Result
+	var err error
+	if seq > 0 {
+		res, err = q.ExecContext(ctx, "INSERT INTO "+replicationLogTable+" (seq, stmt, args, created_at) VALUES (?, ?, ?, ?)", seq, stmt, string(args), time.Now().UnixMilli())
+	} else {
+		res, err = q.ExecContext(ctx, "INSERT INTO "+replicationLogTable+" (stmt, args, created_at) VALUES (?, ?, ?)", stmt, string(args), time.Now().UnixMilli())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to record change: %w", err)
+	}
+	if seq <= 0 {
+		if seq, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	}
+	if seq%replicationPageSize == 0 {
+		if _, err := q.ExecContext(ctx, "DELETE FROM "+replicationLogTable+" WHERE seq <= ?", seq-replicationRetention); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// readGeneration returns the replication generation of db and its last
+// logged sequence. A database without replication tables yields "", 0.
+func readGeneration(ctx context.Context, q *sql.DB) (string, int64) {
+	var generation string
+	var head int64
+	_ = q.QueryRowContext(ctx, "SELECT value FROM "+replicationMetaTable+" WHERE key = 'generation'").Scan(&generation)
+	_ = q.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM "+replicationLogTable).Scan(&head)
+	return generation, head
+}
+
+func newGeneration() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dbPrimary records the writes of exec requests so replicas can replay them.
+type dbPrimary struct {
+	db         *sql.DB
+	token      string
+	generation string
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// setupPrimary prepares the replication log. The generation changes whenever
+// the schema was migrated outside the log, which sends replicas back to a
+// fresh snapshot.
+func (r *Gojinn) setupPrimary(migrated bool) error {
+	ctx := context.Background()
+	if err := ensureReplicationTables(ctx, r.db); err != nil {
+		return err
+	}
+	generation, _ := readGeneration(ctx, r.db)
+	if generation == "" || migrated {
+		generation = newGeneration()
+		if _, err := r.db.ExecContext(ctx, "INSERT INTO "+replicationMetaTable+" (key, value) VALUES ('generation', ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", generation); err != nil {
+			return fmt.Errorf("failed to store replication generation: %w", err)
+		}
+	}
+	r.dbPrimary = &dbPrimary{db: r.db, token: r.DBSyncToken, generation: generation, changed: make(chan struct{})}
+	r.logger.Info("Database replication enabled (primary)", zap.String("generation", generation))
+	return nil
+}
+
+// notify wakes the replicas waiting for changes.
+func (p *dbPrimary) notify() {
+	p.mu.Lock()
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.mu.Unlock()
+}
+
+func (p *dbPrimary) changes() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+// exec runs writes and records them atomically. Inside a guest transaction
+// (q is a *sql.Tx) they become visible to replicas on commit.
+func (p *dbPrimary) exec(ctx context.Context, q dbQuerier, reqs []dbRequest) (*dbResponse, int64, error) {
+	tx, inTx := q.(*sql.Tx)
+	if !inTx {
+		var err error
+		if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+			return nil, 0, err
+		}
+		defer func() { _ = tx.Rollback() }()
+	}
+
+	out := &dbResponse{}
+	var seq int64
+	for _, req := range reqs {
+		if req.Mode != DBModeExec {
+			return nil, 0, fmt.Errorf("only exec requests can be forwarded, got %q", req.Mode)
+		}
+		res, err := tx.ExecContext(ctx, req.SQL, req.Args...)
+		if err != nil {
+			return nil, 0, err
+		}
+		n, _ := res.RowsAffected()
+		out.RowsAffected += n
+		out.LastInsertID, _ = res.LastInsertId()
+
+		args, _ := json.Marshal(req.Args)
+		if seq, err = recordChange(ctx, tx, 0, req.SQL, args); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if !inTx {
+		if err := tx.Commit(); err != nil {
+			return nil, 0, err
+		}
+		p.notify()
+	}
+	return out, seq, nil
+}
+
+// track runs a statement sent as a query and records it in the log when it
+// changed the database, such as INSERT ... RETURNING or DDL. Reads leave the
+// log untouched.
+func (p *dbPrimary) track(ctx context.Context, q dbQuerier, req dbRequest, run func(dbQuerier) error) error {
+	tx, inTx := q.(*sql.Tx)
+	if !inTx {
+		var err error
+		if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+	}
+
+	before, err := writeMark(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := run(tx); err != nil {
+		return err
+	}
+	after, err := writeMark(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if after != before {
+		args, _ := json.Marshal(req.Args)
+		if _, err := recordChange(ctx, tx, 0, req.SQL, args); err != nil {
+			return err
+		}
+	}
+
+	if !inTx {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if after != before {
+			p.notify()
+		}
+	}
+	return nil
+}
+
+// writeMark identifies the state of the connection: rows it changed so far
+// and the schema cookie, which DDL bumps.
+func writeMark(ctx context.Context, tx *sql.Tx) ([2]int64, error) {
+	var mark [2]int64
+	err := tx.QueryRowContext(ctx, "SELECT total_changes(), (SELECT schema_version FROM pragma_schema_version)").Scan(&mark[0], &mark[1])
+	return mark, err
+}
+
+// serveDBReplication answers the replicas of this node:
+//
+//	GET  /_sys/db/snapshot                          consistent copy of the database
+//	GET  /_sys/db/changes?generation=&after=&wait=  log entries after a sequence (long poll)
+//	POST /_sys/db/exec                              writes forwarded by a replica
+func (r *Gojinn) serveDBReplication(rw http.ResponseWriter, req *http.Request, rest string) {
+	p := r.dbPrimary
+	if p == nil {
+		http.Error(rw, "Database replication not enabled", http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && rest == "snapshot":
+		p.serveSnapshot(rw, req)
+	case req.Method == "GET" && rest == "changes":
+		p.serveChanges(rw, req)
+	case req.Method == "POST" && rest == "exec":
+		var payload struct {
+			Requests []dbRequest `json:"requests"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&payload); err != nil || len(payload.Requests) == 0 {
+			http.Error(rw, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		for _, fwd := range payload.Requests {
+			normalizeArgs(fwd.Args)
+		}
+		resp, seq, err := p.exec(req.Context(), p.db, payload.Requests)
+		if err != nil {
+			resp = &dbResponse{Error: err.Error()}
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"response": resp, "seq": seq})
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+func (p *dbPrimary) serveSnapshot(rw http.ResponseWriter, req *http.Request) {
+	tmp := filepath.Join(os.TempDir(), fmt.Sprintf("gojinn_replica_%s.db", newGeneration()))
+	defer os.Remove(tmp)
+
+	// VACUUM INTO reads one consistent state, log and generation included.
+	if _, err := p.db.ExecContext(req.Context(), "VACUUM INTO ?", tmp); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	rw.Header().Set("Content-Type", "application/vnd.sqlite3")
+	_, _ = io.Copy(rw, f)
+}
+
+func (p *dbPrimary) serveChanges(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	after, _ := strconv.ParseInt(q.Get("after"), 10, 64)
+	wait, _ := time.ParseDuration(q.Get("wait"))
+	wait = min(wait, replicationMaxWait)
+
+	var oldest int64
+	_ = p.db.QueryRowContext(req.Context(), "SELECT COALESCE(MIN(seq), 0) FROM "+replicationLogTable).Scan(&oldest)
+	if q.Get("generation") != p.generation || (oldest > 0 && after < oldest-1) {
+		writeJSON(rw, http.StatusConflict, replicationChanges{Generation: p.generation})
+		return
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		changed := p.changes()
+		out, err := p.readChanges(req.Context(), after)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(out.Changes) > 0 || wait <= 0 {
+			writeJSON(rw, http.StatusOK, out)
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			wait = 0
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *dbPrimary) readChanges(ctx context.Context, after int64) (*replicationChanges, error) {
+	out := &replicationChanges{Generation: p.generation, Changes: []replicationChange{}}
+	rows, err := p.db.QueryContext(ctx, "SELECT seq, stmt, args FROM "+replicationLogTable+" WHERE seq > ? ORDER BY seq LIMIT ?", after, replicationPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c replicationChange
+		var args string
+		if err := rows.Scan(&c.Seq, &c.SQL, &args); err != nil {
+			return nil, err
+		}
+		c.Args = json.RawMessage(args)
+		out.Changes = append(out.Changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = p.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM "+replicationLogTable).Scan(&out.Head)
+	return out, err
+}
+
+// dbReplica keeps a local copy of the primary's database. Functions read the
+// copy through a query_only pool; their writes are forwarded to the primary.
+type dbReplica struct {
+	url    string
+	token  string
+	write  *sql.DB
+	client *http.Client
+	logger *zap.Logger
+
+	mu          sync.Mutex
+	generation  string
+	applied     int64
+	head        int64
+	reachable   bool
+	lastContact time.Time
+	caughtUpAt  time.Time
+	lastError   string
+	progress    chan struct{}
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func (r *Gojinn) setupReplica(dsn string) error {
+	if r.DBSyncToken == "" {
+		return fmt.Errorf("db_sync_url requires db_sync_token")
+	}
+	if r.Migrations != "" {
+		return fmt.Errorf("migrations run on the primary; remove them from the replica")
+	}
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	write, err := sql.Open("sqlite", dsn+sep+"_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return fmt.Errorf("failed to open replica: %w", err)
+	}
+	write.SetMaxOpenConns(1)
+	if err := write.Ping(); err != nil {
+		write.Close()
+		return fmt.Errorf("failed to open replica: %w", err)
+	}
+
+	read, err := sql.Open("sqlite", dsn+sep+"_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+	if err != nil {
+		write.Close()
+		return fmt.Errorf("failed to open replica: %w", err)
+	}
+	read.SetMaxOpenConns(max(min(r.PoolSize, 20), 1))
+
+	rep := &dbReplica{
+		url:      strings.TrimSuffix(r.DBSyncURL, "/"),
+		token:    r.DBSyncToken,
+		write:    write,
+		client:   &http.Client{},
+		logger:   r.logger,
+		progress: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	rep.generation, rep.applied = readGeneration(context.Background(), write)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rep.stop = cancel
+	go rep.run(ctx)
+
+	r.db = read
+	r.dbReplica = rep
+	r.logger.Info("Database replication enabled (replica)",
+		zap.String("primary", rep.url),
+		zap.Int64("applied_seq", rep.applied))
+	return nil
+}
+
+func (rep *dbReplica) close() {
+	rep.stop()
+	<-rep.done
+	rep.write.Close()
+}
+
+// run follows the primary until close, retrying with backoff while it is
+// unreachable. The local copy keeps serving reads meanwhile.
+func (rep *dbReplica) run(ctx context.Context) {
+	defer close(rep.done)
+	backoff := time.Second
+	for ctx.Err() == nil {
+		if err := rep.sync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			rep.fail(err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, replicationMaxRetry)
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+func (rep *dbReplica) fail(err error) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.reachable || rep.lastError == "" {
+		rep.logger.Warn("Database replica lost the primary, serving reads only", zap.String("primary", rep.url), zap.Error(err))
+	}
+	rep.reachable = false
+	rep.lastError = err.Error()
+}
+
+func (rep *dbReplica) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rep.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rep.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return rep.client.Do(req)
+}
+
+// sync runs one round: a snapshot when the replica has no usable state, then
+// one long poll for changes.
+func (rep *dbReplica) sync(ctx context.Context) error {
+	rep.mu.Lock()
+	generation, applied := rep.generation, rep.applied
+	rep.mu.Unlock()
+
+	if generation == "" {
+		return rep.bootstrap(ctx)
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, replicationPollWait+10*time.Second)
+	defer cancel()
+	path := fmt.Sprintf("/_sys/db/changes?generation=%s&after=%d&wait=%s", generation, applied, replicationPollWait)
+	resp, err := rep.request(pollCtx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out replicationChanges
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return err
+		}
+	case http.StatusConflict:
+		rep.logger.Info("Database replica is out of date, fetching a new snapshot", zap.String("primary", rep.url))
+		rep.mu.Lock()
+		rep.generation = ""
+		rep.mu.Unlock()
+		return nil
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary answered %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if err := rep.apply(ctx, out.Changes); err != nil {
+		return err
+	}
+	rep.mu.Lock()
+	rep.head = out.Head
+	rep.markContact()
+	rep.mu.Unlock()
+	return nil
+}
+
+// markContact records a successful exchange. Called with mu held.
+func (rep *dbReplica) markContact() {
+	now := time.Now()
+	if !rep.reachable && rep.lastError != "" {
+		rep.logger.Info("Database replica reconnected to the primary", zap.String("primary", rep.url))
+	}
+	rep.reachable = true
+	rep.lastError = ""
+	rep.lastContact = now
+	if rep.applied >= rep.head {
+		rep.caughtUpAt = now
+	}
+}
+
+func (rep *dbReplica) apply(ctx context.Context, changes []replicationChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	tx, err := rep.write.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, c := range changes {
+		var args []any
+		if len(c.Args) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(c.Args))
+			dec.UseNumber()
+			if err := dec.Decode(&args); err != nil {
+				return fmt.Errorf("change %d: %w", c.Seq, err)
+			}
+			normalizeArgs(args)
+		}
+		if _, err := tx.ExecContext(ctx, c.SQL, args...); err != nil {
+			return fmt.Errorf("failed to replay change %d: %w", c.Seq, err)
+		}
+		if _, err := recordChange(ctx, tx, c.Seq, c.SQL, c.Args); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	rep.mu.Lock()
+	rep.applied = changes[len(changes)-1].Seq
+	close(rep.progress)
+	rep.progress = make(chan struct{})
+	rep.mu.Unlock()
+	return nil
+}
+
+// bootstrap replaces the local copy with a snapshot of the primary.
+func (rep *dbReplica) bootstrap(ctx context.Context) error {
+	resp, err := rep.request(ctx, "GET", "/_sys/db/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("snapshot failed with %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	tmp, err := os.CreateTemp("", "gojinn_snapshot_*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+
+	if err := restoreSnapshot(ctx, rep.write, tmp.Name()); err != nil {
+		return err
+	}
+	generation, applied := readGeneration(ctx, rep.write)
+	if generation == "" {
+		return fmt.Errorf("snapshot carries no replication generation")
+	}
+
+	rep.mu.Lock()
+	rep.generation, rep.applied, rep.head = generation, applied, applied
+	rep.markContact()
+	close(rep.progress)
+	rep.progress = make(chan struct{})
+	rep.mu.Unlock()
+	rep.logger.Info("Database replica restored from snapshot", zap.String("generation", generation), zap.Int64("seq", applied))
+	return nil
+}
+
+// restoreSnapshot swaps the whole schema and content of db for those of the
+// SQLite file at path in a single transaction, so readers never see a mix.
+func restoreSnapshot(ctx context.Context, db *sql.DB, path string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS snap", path); err != nil {
+		return fmt.Errorf("failed to attach snapshot: %w", err)
+	}
+	defer func() { _, _ = conn.ExecContext(context.Background(), "DETACH DATABASE snap") }()
+
+	type object struct{ kind, name, sql string }
+	list := func(tx *sql.Tx, query string) ([]object, error) {
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var out []object
+		for rows.Next() {
+			var o object
+			if err := rows.Scan(&o.kind, &o.name, &o.sql); err != nil {
+				return nil, err
+			}
+			out = append(out, o)
+		}
+		return out, rows.Err()
+	}
+	quote := func(name string) string { return `"` + strings.ReplaceAll(name, `"`, `""`) + `"` }
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	local, err := list(tx, "SELECT type, name, '' FROM main.sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	for _, o := range local {
+		if _, err := tx.ExecContext(ctx, "DROP "+strings.ToUpper(o.kind)+" IF EXISTS main."+quote(o.name)); err != nil {
+			return err
+		}
+	}
+
+	remote, err := list(tx, `SELECT type, name, sql FROM snap.sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END`)
+	if err != nil {
+		return err
+	}
+	hasSequence := false
+	for _, o := range remote {
+		if _, err := tx.ExecContext(ctx, o.sql); err != nil {
+			return fmt.Errorf("failed to restore %s %s: %w", o.kind, o.name, err)
+		}
+		if o.kind == "table" {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO main."+quote(o.name)+" SELECT * FROM snap."+quote(o.name)); err != nil {
+				return fmt.Errorf("failed to restore table %s: %w", o.name, err)
+			}
+			hasSequence = hasSequence || strings.Contains(strings.ToUpper(o.sql), "AUTOINCREMENT")
+		}
+	}
+	if hasSequence {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM main.sqlite_sequence"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO main.sqlite_sequence SELECT * FROM snap.sqlite_sequence"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handle runs the non-query requests of a function on a replica. Writes go
+// to the primary; a transaction is buffered and sent as one batch on commit.
+func (rep *dbReplica) handle(ctx context.Context, inv *invocation, req dbRequest) (*dbResponse, error) {
+	switch req.Mode {
+	case DBModeBegin:
+		if inv.batching {
+			return nil, errors.New("transaction already open")
+		}
+		inv.batching, inv.batch = true, nil
+		return &dbResponse{}, nil
+	case DBModeRollback:
+		if !inv.batching {
+			return nil, errors.New("no transaction open")
+		}
+		inv.batching, inv.batch = false, nil
+		return &dbResponse{}, nil
+	case DBModeCommit:
+		if !inv.batching {
+			return nil, errors.New("no transaction open")
+		}
+		batch := inv.batch
+		inv.batching, inv.batch = false, nil
+		if len(batch) == 0 {
+			return &dbResponse{}, nil
+		}
+		return rep.forward(ctx, batch)
+	case DBModeExec:
+		if inv.batching {
+			// Results are only known once the batch commits on the primary.
+			inv.batch = append(inv.batch, req)
+			return &dbResponse{}, nil
+		}
+		return rep.forward(ctx, []dbRequest{req})
+	}
+	return nil, fmt.Errorf("unknown db mode %q", req.Mode)
+}
+
+// forward sends writes to the primary and waits briefly for them to arrive
+// locally, so the function reads its own writes.
+func (rep *dbReplica) forward(ctx context.Context, reqs []dbRequest) (*dbResponse, error) {
+	body, _ := json.Marshal(map[string]interface{}{"requests": reqs})
+	resp, err := rep.request(ctx, "POST", "/_sys/db/exec", body)
+	if err != nil {
+		rep.fail(err)
+		return nil, errPrimaryUnavailable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%w: primary answered %d: %s", errPrimaryUnavailable, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var out struct {
+		Response dbResponse `json:"response"`
+		Seq      int64      `json:"seq"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Response.Error != "" {
+		return nil, errors.New(out.Response.Error)
+	}
+	rep.waitFor(ctx, out.Seq)
+	return &out.Response, nil
+}
+
+func (rep *dbReplica) waitFor(ctx context.Context, seq int64) {
+	timeout := time.NewTimer(replicationCatchUp)
+	defer timeout.Stop()
+	for {
+		rep.mu.Lock()
+		applied, progress := rep.applied, rep.progress
+		rep.mu.Unlock()
+		if applied >= seq {
+			return
+		}
+		select {
+		case <-progress:
+		case <-timeout.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dbReplicationStatus reports the replication role and lag for /_sys/status.
+func (r *Gojinn) dbReplicationStatus() map[string]interface{} {
+	if p := r.dbPrimary; p != nil {
+		_, head := readGeneration(context.Background(), p.db)
+		return map[string]interface{}{"role": "primary", "generation": p.generation, "head_seq": head}
+	}
+	rep := r.dbReplica
+	if rep == nil {
+		return nil
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	// Lag is how long the copy has been behind the primary, or out of
+	// contact with it.
+	lag := time.Duration(0)
+	if !rep.caughtUpAt.IsZero() && (!rep.reachable || rep.applied < rep.head) {
+		lag = time.Since(rep.caughtUpAt)
+	}
+	status := map[string]interface{}{
+		"role":              "replica",
+		"primary":           rep.url,
+		"primary_reachable": rep.reachable,
+		"read_only":         !rep.reachable,
+		"generation":        rep.generation,
+		"applied_seq":       rep.applied,
+		"primary_seq":       rep.head,
+		"lag_entries":       max(rep.head-rep.applied, 0),
+		"lag_seconds":       lag.Seconds(),
+	}
+	if !rep.lastContact.IsZero() {
+		status["last_contact"] = rep.lastContact.UTC()
+	}
+	if rep.lastError != "" {
+		status["error"] = rep.lastError
+	}
+	return status
+}
@@ -0,0 +1,362 @@
+package gojinn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	headerReplayedFrom = "Gojinn-Replayed-From"
+
+	dlqMaxStderr   = 64 * 1024
+	dlqDefaultList = 50
+	dlqMaxList     = 500
+)
+
+// DeadLetter is the envelope stored in DLQ_<TENANT>. It keeps everything
+// needed to requeue the original message unchanged.
+type DeadLetter struct {
+	JobID      uint64       `json:"job_id"`
+	Tenant     string       `json:"tenant"`
+	Function   string       `json:"function,omitempty"`
+	Version    string       `json:"version,omitempty"`
+	WasmFile   string       `json:"wasm_file"`
+	Subject    string       `json:"subject"`
+	Headers    nats.Header  `json:"headers,omitempty"`
+	Payload    []byte       `json:"payload"`
+	Error      string       `json:"error"`
+	Stderr     string       `json:"stderr,omitempty"`
+	Attempts   uint64       `json:"attempts"`
+	AttemptLog []JobAttempt `json:"attempt_log,omitempty"`
+	FailedAt   time.Time    `json:"failed_at"`
+}
+
+type deadLetterSummary struct {
+	Sequence uint64    `json:"seq"`
+	JobID    uint64    `json:"job_id"`
+	Function string    `json:"function,omitempty"`
+	WasmFile string    `json:"wasm_file"`
+	Error    string    `json:"error"`
+	Attempts uint64    `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func tenantDLQStreamName(tenantID string) string {
+	return fmt.Sprintf("DLQ_%s", strings.ToUpper(tenantID))
+}
+
+func tenantDLQSubject(tenantID string) string {
+	return fmt.Sprintf("gojinn.tenant.%s.dlq", tenantID)
+}
+
+func (r *Gojinn) ensureDLQStream(tenantID string) error {
+	stream := tenantDLQStreamName(tenantID)
+	if _, err := r.js.StreamInfo(stream); err == nil {
+		return nil
+	}
+	r.logger.Info("Provisioning Tenant Dead-Letter Stream...", zap.String("tenant", tenantID), zap.String("stream", stream))
+	_, err := r.js.AddStream(&nats.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{tenantDLQSubject(tenantID)},
+		Storage:   nats.FileStorage,
+		Retention: nats.LimitsPolicy,
+		Replicas:  r.ClusterReplicas,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to provision tenant dlq stream: %w", err)
+	}
+	return nil
+}
+
+// deadLetter moves an exhausted job into the tenant DLQ so it survives the
+// ack of the work-queue message.
+func (r *Gojinn) deadLetter(tenantID string, fn *function, m *nats.Msg, job *JobRecord, errMsg, stderr string) error {
+	if r.js == nil {
+		return fmt.Errorf("JetStream not initialized")
+	}
+	if err := r.ensureDLQStream(tenantID); err != nil {
+		return err
+	}
+
+	meta, err := m.Metadata()
+	if err != nil {
+		return err
+	}
+
+	if len(stderr) > dlqMaxStderr {
+		stderr = stderr[len(stderr)-dlqMaxStderr:]
+	}
+
+	entry := DeadLetter{
+		JobID:    meta.Sequence.Stream,
+		Tenant:   tenantID,
+		Function: fn.name(),
+		Version:  fn.version,
+		WasmFile: fn.wasmFile(),
+		Subject:  m.Subject,
+		Headers:  m.Header,
+		Payload:  m.Data,
+		Error:    errMsg,
+		Stderr:   stderr,
+		Attempts: meta.NumDelivered,
+		FailedAt: time.Now().UTC(),
+	}
+	if job != nil {
+		entry.AttemptLog = job.AttemptLog
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	msgID := fmt.Sprintf("dlq_%s_%d", tenantID, entry.JobID)
+	if _, err := r.js.Publish(tenantDLQSubject(tenantID), data, nats.MsgId(msgID)); err != nil {
+		return fmt.Errorf("failed to publish dead letter: %w", err)
+	}
+
+	r.logger.Warn("Job moved to dead-letter stream",
+		zap.String("tenant", tenantID),
+		zap.Uint64("job_id", entry.JobID),
+		zap.String("stream", tenantDLQStreamName(tenantID)))
+	return nil
+}
+
+func (r *Gojinn) listDeadLetters(tenantID string, after uint64, limit int) ([]deadLetterSummary, error) {
+	info, err := r.js.StreamInfo(tenantDLQStreamName(tenantID))
+	if err != nil {
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return []deadLetterSummary{}, nil
+		}
+		return nil, err
+	}
+
+	start := info.State.FirstSeq
+	if after >= start {
+		start = after + 1
+	}
+
+	items := []deadLetterSummary{}
+	for seq := start; seq <= info.State.LastSeq && len(items) < limit; seq++ {
+		entry, err := r.getDeadLetter(tenantID, seq)
+		if err != nil {
+			continue
+		}
+		items = append(items, deadLetterSummary{
+			Sequence: seq,
+			JobID:    entry.JobID,
+			Function: entry.Function,
+			WasmFile: entry.WasmFile,
+			Error:    entry.Error,
+			Attempts: entry.Attempts,
+			FailedAt: entry.FailedAt,
+		})
+	}
+	return items, nil
+}
+
+func (r *Gojinn) getDeadLetter(tenantID string, seq uint64) (*DeadLetter, error) {
+	raw, err := r.js.GetMsg(tenantDLQStreamName(tenantID), seq)
+	if err != nil {
+		return nil, err
+	}
+	var entry DeadLetter
+	if err := json.Unmarshal(raw.Data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// replayDeadLetter requeues the original message on its function topic and
+// removes it from the DLQ once JetStream has accepted the new job.
+func (r *Gojinn) replayDeadLetter(tenantID string, seq uint64) (*nats.PubAck, error) {
+	entry, err := r.getDeadLetter(tenantID, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	fn := r.functionFor(entry.WasmFile)
+	if base := r.lookupFunction(entry.Function); base != nil {
+		fn = r.pickVersion(base, "")
+	}
+	if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(r.functionTopic(tenantID, fn))
+	msg.Data = entry.Payload
+	for k, v := range entry.Headers {
+		if k == nats.MsgIdHdr {
+			continue
+		}
+		msg.Header[k] = v
+	}
+	msg.Header.Set(headerReplayedFrom, strconv.FormatUint(seq, 10))
+
+	pubAck, err := r.js.PublishMsg(msg, nats.MsgId(fmt.Sprintf("dlq_replay_%s_%d", tenantID, seq)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to requeue dead letter: %w", err)
+	}
+	r.trackQueuedJob(tenantID, fn, pubAck)
+
+	if err := r.js.DeleteMsg(tenantDLQStreamName(tenantID), seq); err != nil {
+		r.logger.Warn("Replayed dead letter could not be removed", zap.String("tenant", tenantID), zap.Uint64("seq", seq), zap.Error(err))
+	}
+
+	r.logger.Info("Dead letter replayed",
+		zap.String("tenant", tenantID),
+		zap.Uint64("dlq_seq", seq),
+		zap.Uint64("job_id", pubAck.Sequence))
+	return pubAck, nil
+}
+
+func (r *Gojinn) purgeDeadLetters(tenantID string, seq uint64) error {
+	stream := tenantDLQStreamName(tenantID)
+	if seq == 0 {
+		err := r.js.PurgeStream(stream)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return nil
+		}
+		return err
+	}
+	return r.js.DeleteMsg(stream, seq)
+}
+
+// serveDLQ handles the dead-letter API below /_sys/dlq and
+// /_sys/tenants/{tenant}/dlq:
+//
+//	GET    /              list entries (?after=<seq>&limit=<n>)
+//	GET    /{seq}         inspect one entry
+//	POST   /replay        requeue every entry
+//	POST   /{seq}/replay  requeue one entry
+//	DELETE /              purge the stream
+//	DELETE /{seq}         delete one entry
+func (r *Gojinn) serveDLQ(rw http.ResponseWriter, req *http.Request, scopedTenant, rest string) {
+	tenantID, ok := r.resolveSysTenant(rw, req, scopedTenant)
+	if !ok {
+		return
+	}
+	if r.js == nil {
+		http.Error(rw, "JetStream not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+
+	var seq uint64
+	if len(parts) > 0 && parts[0] != "replay" {
+		var err error
+		seq, err = strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || seq == 0 {
+			http.Error(rw, "Invalid dead letter sequence", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case req.Method == "GET" && len(parts) == 0:
+		after, _ := strconv.ParseUint(req.URL.Query().Get("after"), 10, 64)
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		if limit <= 0 {
+			limit = dlqDefaultList
+		}
+		if limit > dlqMaxList {
+			limit = dlqMaxList
+		}
+		items, err := r.listDeadLetters(tenantID, after, limit)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"tenant": tenantID,
+			"stream": tenantDLQStreamName(tenantID),
+			"items":  items,
+		})
+
+	case req.Method == "GET" && len(parts) == 1 && seq > 0:
+		entry, err := r.getDeadLetter(tenantID, seq)
+		if err != nil {
+			http.Error(rw, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		// Replays read the stored entry; the sealed secret is never shown.
+		if entry.Headers != nil {
+			entry.Headers = nats.Header(http.Header(entry.Headers).Clone())
+			entry.Headers.Del(headerCallbackSecret)
+		}
+		writeJSON(rw, http.StatusOK, entry)
+
+	case req.Method == "POST" && len(parts) == 2 && seq > 0 && parts[1] == "replay":
+		pubAck, err := r.replayDeadLetter(tenantID, seq)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, http.StatusAccepted, map[string]interface{}{
+			"status": "queued",
+			"job_id": pubAck.Sequence,
+			"tenant": tenantID,
+		})
+
+	case req.Method == "POST" && len(parts) == 1 && parts[0] == "replay":
+		replayed := []uint64{}
+		var failures []string
+		after := uint64(0)
+		for {
+			items, err := r.listDeadLetters(tenantID, after, dlqMaxList)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(items) == 0 {
+				break
+			}
+			for _, item := range items {
+				after = item.Sequence
+				pubAck, err := r.replayDeadLetter(tenantID, item.Sequence)
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%d: %v", item.Sequence, err))
+					continue
+				}
+				replayed = append(replayed, pubAck.Sequence)
+			}
+		}
+		writeJSON(rw, http.StatusAccepted, map[string]interface{}{
+			"status":   "queued",
+			"job_ids":  replayed,
+			"failures": failures,
+			"tenant":   tenantID,
+		})
+
+	case req.Method == "DELETE" && len(parts) <= 1:
+		if err := r.purgeDeadLetters(tenantID, seq); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"status": "purged",
+			"tenant": tenantID,
+		})
+
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
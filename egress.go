@@ -0,0 +1,256 @@
+package gojinn
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	defaultEgressTimeout     = 30 * time.Second
+	defaultEgressMaxResponse = "10MB"
+	maxEgressRedirects       = 5
+
+	EgressOK      = "ok"
+	EgressDenied  = "denied"
+	EgressTimeout = "timeout"
+	EgressQuota   = "quota"
+	EgressError   = "error"
+)
+
+var (
+	errEgressDenied  = errors.New("egress denied")
+	errEgressPrivate = errors.New("egress to private address denied")
+	cgnatPrefix      = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// EgressPolicy bounds the outbound requests functions make through
+// host_http_fetch and host_http_get.
+type EgressPolicy struct {
+	AllowPrivate bool           `json:"allow_private,omitempty"`
+	Timeout      caddy.Duration `json:"timeout,omitempty"`
+	MaxResponse  string         `json:"max_response,omitempty"`
+}
+
+func (p EgressPolicy) validate() error {
+	if p.MaxResponse != "" {
+		if _, err := humanize.ParseBytes(p.MaxResponse); err != nil {
+			return fmt.Errorf("invalid egress max_response: %v", err)
+		}
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("egress timeout must be positive")
+	}
+	return nil
+}
+
+func (p EgressPolicy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout)
+	}
+	return defaultEgressTimeout
+}
+
+func (p EgressPolicy) maxResponse() int64 {
+	limit := p.MaxResponse
+	if limit == "" {
+		limit = defaultEgressMaxResponse
+	}
+	n, err := humanize.ParseBytes(limit)
+	if err != nil {
+		n, _ = humanize.ParseBytes(defaultEgressMaxResponse)
+	}
+	return int64(n) //nolint:gosec
+}
+
+// egressAllowed reports whether outbound requests to hostname pass the
+// allow_host rules. Entries match the host exactly, except "*.example.com"
+// and ".example.com", which match any subdomain of example.com. An empty
+// allow list leaves egress unrestricted.
+func (r *Gojinn) egressAllowed(hostname string) bool {
+	if len(r.AllowedHosts) == 0 {
+		return true
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, host := range r.AllowedHosts {
+		host = strings.ToLower(strings.TrimPrefix(host, "*"))
+		if strings.HasPrefix(host, ".") {
+			if strings.HasSuffix(hostname, host) {
+				return true
+			}
+		} else if hostname == host {
+			return true
+		}
+	}
+	return false
+}
+
+// privateAddr reports whether ip belongs to loopback, private, link-local,
+// carrier-grade NAT, multicast or unspecified ranges.
+func privateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() || cgnatPrefix.Contains(ip)
+}
+
+// newEgressTransport builds the transport shared by guest requests. Private
+// destinations are rejected at dial time, after DNS resolution, so a public
+// name pointing at an internal address is caught as well. Environment proxies
+// are ignored because they would bypass that check.
+func (r *Gojinn) newEgressTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if !r.Egress.AllowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || privateAddr(ip) {
+				return fmt.Errorf("%w: %s", errEgressPrivate, host)
+			}
+			return nil
+		}
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// egressRequest is the request a guest passes to host_http_fetch.
+type egressRequest struct {
+	Method    string            `json:"method,omitempty"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      []byte            `json:"body,omitempty"`
+	TimeoutMs int               `json:"timeout_ms,omitempty"`
+}
+
+// egressResponse is returned to the guest. Failures carry Status 0 and Error.
+type egressResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// fetch performs a guest request under the egress policy: allow_host rules,
+// private address blocking, the per-call timeout, the response cap and the
+// tenant egress quota.
+func (r *Gojinn) fetch(ctx context.Context, in egressRequest) (*egressResponse, error) {
+	inv := invocationFromContext(ctx)
+	tenant := ""
+	if inv != nil {
+		tenant = inv.tenantID
+	}
+
+	outcome, sent, received := EgressError, 0, 0
+	defer func() { r.countEgress(tenant, outcome, sent, received) }()
+
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid url %q", in.URL)
+	}
+	if !r.egressAllowed(u.Hostname()) {
+		outcome = EgressDenied
+		return nil, fmt.Errorf("%w to %s", errEgressDenied, u.Hostname())
+	}
+
+	// The quota covers both directions: the request body is charged first
+	// and the response may only use what is left.
+	limit := r.Egress.maxResponse()
+	budget := r.egressBudget(inv)
+	if budget == 0 || (budget > 0 && int64(len(in.Body)) > budget) {
+		outcome = EgressQuota
+		return nil, fmt.Errorf("egress quota exhausted")
+	}
+	if budget > 0 {
+		budget -= int64(len(in.Body))
+		limit = min(limit, budget)
+	}
+
+	timeout := r.Egress.timeout()
+	if in.TimeoutMs > 0 {
+		timeout = min(timeout, time.Duration(in.TimeoutMs)*time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, cmp.Or(strings.ToUpper(in.Method), http.MethodGet), u.String(), bytes.NewReader(in.Body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range in.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		Transport: r.egressTransport,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if len(via) >= maxEgressRedirects {
+				return fmt.Errorf("too many redirects")
+			}
+			if !r.egressAllowed(next.URL.Hostname()) {
+				return fmt.Errorf("%w to %s", errEgressDenied, next.URL.Hostname())
+			}
+			return nil
+		},
+	}
+
+	sent = len(in.Body)
+	if inv != nil {
+		inv.egressBytes += uint64(sent)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		switch {
+		case errors.Is(err, errEgressPrivate), errors.Is(err, errEgressDenied):
+			outcome = EgressDenied
+		case errors.Is(err, context.DeadlineExceeded):
+			outcome = EgressTimeout
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	received = len(body)
+	if inv != nil {
+		inv.egressBytes += uint64(received)
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			outcome = EgressTimeout
+		}
+		return nil, err
+	}
+	if int64(received) > limit {
+		if budget >= 0 && limit == budget {
+			outcome = EgressQuota
+			return nil, fmt.Errorf("egress quota exhausted")
+		}
+		return nil, fmt.Errorf("response exceeds max_response (%d bytes)", limit)
+	}
+
+	outcome = EgressOK
+	return &egressResponse{Status: resp.StatusCode, Headers: resp.Header, Body: body}, nil
+}
@@ -0,0 +1,64 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// ErrFuelExhausted traps a guest that spent its whole fuel_limit.
+var ErrFuelExhausted = errors.New("fuel exhausted")
+
+// fuelMeter counts the fuel spent by one invocation. One unit is charged per
+// guest function call, and meterLoops turns every loop iteration into a
+// call, so the budget is independent of host load, unlike the wall-clock
+// timeout.
+type fuelMeter struct {
+	limit uint64
+	used  uint64
+}
+
+type fuelKey struct{}
+
+// withFuel attaches a fresh meter to an execution context. The meter is nil
+// when fuel metering is disabled.
+func (r *Gojinn) withFuel(ctx context.Context) (context.Context, *fuelMeter) {
+	if r.FuelLimit == 0 {
+		return ctx, nil
+	}
+	meter := &fuelMeter{limit: r.FuelLimit}
+	return context.WithValue(ctx, fuelKey{}, meter), meter
+}
+
+func (m *fuelMeter) spent() uint64 {
+	if m == nil {
+		return 0
+	}
+	return min(m.used, m.limit)
+}
+
+// fuelListener charges the meter found in the call context. Panicking with
+// ErrFuelExhausted unwinds the guest; wazero returns it wrapped, so callers
+// can detect it with errors.Is.
+type fuelListener struct{}
+
+func (fuelListener) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return fuelListener{}
+}
+
+func (fuelListener) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	meter, _ := ctx.Value(fuelKey{}).(*fuelMeter)
+	if meter == nil {
+		return
+	}
+	meter.used++
+	if meter.used > meter.limit {
+		panic(ErrFuelExhausted)
+	}
+}
+
+func (fuelListener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (fuelListener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
@@ -0,0 +1,335 @@
+package gojinn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errWasmMalformed = errors.New("malformed wasm binary")
+
+const (
+	wasmSectionCustom   = 0
+	wasmSectionType     = 1
+	wasmSectionImport   = 2
+	wasmSectionFunction = 3
+	wasmSectionCode     = 10
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+// meterLoops rewrites a module so every loop iteration calls an empty
+// function appended to it. fuelListener charges that call like any other,
+// so loops that never call a function still spend fuel. DWARF sections are
+// dropped because the inserted calls shift the code offsets they describe.
+func meterLoops(wasm []byte) ([]byte, error) {
+	if !bytes.HasPrefix(wasm, wasmHeader) {
+		return nil, fmt.Errorf("%w: unsupported header", errWasmMalformed)
+	}
+	out := append([]byte{}, wasmHeader...)
+	r := &wasmReader{b: wasm, off: len(wasmHeader)}
+
+	var imported, defined, tickType uint64
+	hasTypes, hasFuncs, hasCode := false, false, false
+	for r.off < len(r.b) && r.err == nil {
+		id := r.byte()
+		content := r.bytes(r.uleb())
+		if r.err != nil {
+			break
+		}
+
+		switch id {
+		case wasmSectionCustom:
+			name := (&wasmReader{b: content}).name()
+			if strings.HasPrefix(name, ".debug_") {
+				continue
+			}
+		case wasmSectionType:
+			s := &wasmReader{b: content}
+			tickType = s.uleb()
+			hasTypes = true
+			content = appendULEB(nil, tickType+1)
+			content = append(content, s.b[s.off:]...)
+			content = append(content, 0x60, 0x00, 0x00)
+		case wasmSectionImport:
+			imported = countFunctionImports(content)
+		case wasmSectionFunction:
+			if !hasTypes {
+				return nil, fmt.Errorf("%w: function section without types", errWasmMalformed)
+			}
+			s := &wasmReader{b: content}
+			defined = s.uleb()
+			hasFuncs = true
+			content = appendULEB(nil, defined+1)
+			content = append(content, s.b[s.off:]...)
+			content = appendULEB(content, tickType)
+		case wasmSectionCode:
+			hasCode = true
+			var err error
+			if content, err = meterCode(content, imported+defined); err != nil {
+				return nil, err
+			}
+		}
+
+		out = append(out, id)
+		out = appendULEB(out, uint64(len(content)))
+		out = append(out, content...)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if hasFuncs != hasCode {
+		return nil, fmt.Errorf("%w: function and code sections disagree", errWasmMalformed)
+	}
+	return out, nil
+}
+
+func countFunctionImports(section []byte) uint64 {
+	r := &wasmReader{b: section}
+	var funcs uint64
+	for n := r.uleb(); n > 0 && r.err == nil; n-- {
+		r.name()
+		r.name()
+		switch r.byte() {
+		case 0x00:
+			r.uleb()
+			funcs++
+		case 0x01:
+			r.sleb()
+			r.limits()
+		case 0x02:
+			r.limits()
+		case 0x03:
+			r.sleb()
+			r.byte()
+		case 0x04:
+			r.byte()
+			r.uleb()
+		}
+	}
+	return funcs
+}
+
+// meterCode inserts a call to tick at the start of every loop body and
+// appends the body of tick itself.
+func meterCode(section []byte, tick uint64) ([]byte, error) {
+	r := &wasmReader{b: section}
+	n := r.uleb()
+	call := appendULEB([]byte{0x10}, tick)
+
+	out := appendULEB(nil, n+1)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		body, err := meterBody(r.bytes(r.uleb()), call)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		out = appendULEB(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append(out, 0x02, 0x00, 0x0b), nil
+}
+
+func meterBody(body, call []byte) ([]byte, error) {
+	r := &wasmReader{b: body}
+	for n := r.uleb(); n > 0 && r.err == nil; n-- {
+		r.uleb()
+		r.sleb()
+	}
+
+	out := make([]byte, 0, len(body)+16)
+	last := 0
+	for r.off < len(r.b) && r.err == nil {
+		op := r.byte()
+		if err := r.skipImmediates(op); err != nil {
+			return nil, err
+		}
+		if op == 0x03 {
+			out = append(out, r.b[last:r.off]...)
+			out = append(out, call...)
+			last = r.off
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append(out, r.b[last:]...), nil
+}
+
+// skipImmediates advances past the immediates of op. Proposals wazero does
+// not run, such as exception handling or GC, are rejected.
+func (r *wasmReader) skipImmediates(op byte) error {
+	switch {
+	case op <= 0x01, op == 0x05, op == 0x0b, op == 0x0f, op == 0x1a, op == 0x1b,
+		op >= 0x45 && op <= 0xc4, op == 0xd1:
+	case op >= 0x02 && op <= 0x04:
+		r.sleb()
+	case op == 0x0c, op == 0x0d, op == 0x10, op == 0x12, op == 0xd2,
+		op >= 0x20 && op <= 0x26, op == 0x3f, op == 0x40:
+		r.uleb()
+	case op == 0x0e:
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			r.uleb()
+		}
+		r.uleb()
+	case op == 0x11, op == 0x13:
+		r.uleb()
+		r.uleb()
+	case op == 0x1c:
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			r.sleb()
+		}
+	case op >= 0x28 && op <= 0x3e:
+		r.memarg()
+	case op == 0x41, op == 0x42, op == 0xd0:
+		r.sleb()
+	case op == 0x43:
+		r.bytes(4)
+	case op == 0x44:
+		r.bytes(8)
+	case op == 0xfc:
+		return r.skipMisc(r.uleb())
+	case op == 0xfd:
+		return r.skipSIMD(r.uleb())
+	case op == 0xfe:
+		return r.skipAtomic(r.uleb())
+	default:
+		return fmt.Errorf("%w: unsupported opcode 0x%02x", errWasmMalformed, op)
+	}
+	return r.err
+}
+
+func (r *wasmReader) skipMisc(sub uint64) error {
+	switch {
+	case sub <= 7:
+	case sub == 9, sub == 11, sub == 13, sub >= 15 && sub <= 17:
+		r.uleb()
+	case sub == 8, sub == 10, sub == 12, sub == 14:
+		r.uleb()
+		r.uleb()
+	default:
+		return fmt.Errorf("%w: unsupported opcode 0xfc %d", errWasmMalformed, sub)
+	}
+	return r.err
+}
+
+func (r *wasmReader) skipSIMD(sub uint64) error {
+	switch {
+	case sub <= 11, sub == 92, sub == 93:
+		r.memarg()
+	case sub == 12, sub == 13:
+		r.bytes(16)
+	case sub >= 21 && sub <= 34:
+		r.byte()
+	case sub >= 84 && sub <= 91:
+		r.memarg()
+		r.byte()
+	case sub <= 0x113:
+	default:
+		return fmt.Errorf("%w: unsupported opcode 0xfd %d", errWasmMalformed, sub)
+	}
+	return r.err
+}
+
+func (r *wasmReader) skipAtomic(sub uint64) error {
+	switch {
+	case sub == 0x03:
+		r.byte()
+	case sub <= 0x02, sub >= 0x10 && sub <= 0x4e:
+		r.memarg()
+	default:
+		return fmt.Errorf("%w: unsupported opcode 0xfe %d", errWasmMalformed, sub)
+	}
+	return r.err
+}
+
+// wasmReader decodes the binary format. The first error sticks and makes
+// every later read return zero.
+type wasmReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *wasmReader) fail() {
+	if r.err == nil {
+		r.err = errWasmMalformed
+	}
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil || r.off >= len(r.b) {
+		r.fail()
+		return 0
+	}
+	b := r.b[r.off]
+	r.off++
+	return b
+}
+
+func (r *wasmReader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.b)-r.off) {
+		r.fail()
+		return nil
+	}
+	b := r.b[r.off : r.off+int(n)] //nolint:gosec
+	r.off += int(n)                //nolint:gosec
+	return b
+}
+
+func (r *wasmReader) uleb() uint64 {
+	var v uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b := r.byte()
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	r.fail()
+	return 0
+}
+
+func (r *wasmReader) sleb() {
+	for i := 0; i < 10; i++ {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	r.fail()
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.uleb()))
+}
+
+func (r *wasmReader) limits() {
+	flags := r.byte()
+	r.uleb()
+	if flags&0x01 != 0 {
+		r.uleb()
+	}
+}
+
+// memarg skips an alignment and offset, plus the memory index that the
+// multi-memory proposal flags with bit 6 of the alignment.
+func (r *wasmReader) memarg() {
+	if r.uleb()&0x40 != 0 {
+		r.uleb()
+	}
+	r.uleb()
+}
+
+func appendULEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
@@ -0,0 +1,387 @@
+package gojinn
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var validFunctionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// FunctionSpec declares one function served by the handler. Zero fields
+// inherit the handler-level env, permissions, timeout, pool size and retry
+// policy.
+type FunctionSpec struct {
+	Name     string            `json:"name"`
+	WasmFile string            `json:"wasm_file"`
+	Route    string            `json:"route,omitempty"`
+	Methods  []string          `json:"methods,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	Perms    *Permissions      `json:"permissions,omitempty"`
+	Timeout  caddy.Duration    `json:"timeout,omitempty"`
+	PoolSize int               `json:"pool_size,omitempty"`
+	Retry    *RetryPolicy      `json:"retry,omitempty"`
+}
+
+// function is a resolved FunctionSpec. Its key names the pool, topic and
+// worker consumer: declared functions use their name, while the handler's
+// own path and ad-hoc wasm references (cron, mqtt, host_enqueue) keep the
+// wasm hash so subjects created by earlier versions stay valid.
+type function struct {
+	owner   *Gojinn
+	spec    FunctionSpec
+	key     string
+	hashed  bool
+	version string
+
+	segments []string
+	prefix   bool
+}
+
+func (r *Gojinn) newFunction(spec FunctionSpec) (*function, error) {
+	if !validFunctionName.MatchString(spec.Name) {
+		return nil, fmt.Errorf("invalid function name %q", spec.Name)
+	}
+	if spec.WasmFile == "" {
+		return nil, fmt.Errorf("function %s has no wasm file", spec.Name)
+	}
+	if spec.Route == "" {
+		spec.Route = "/" + spec.Name + "/*"
+	}
+	for i, m := range spec.Methods {
+		spec.Methods[i] = strings.ToUpper(m)
+	}
+	if spec.Retry != nil {
+		if err := spec.Retry.validate(); err != nil {
+			return nil, fmt.Errorf("function %s: %w", spec.Name, err)
+		}
+	}
+
+	fn := &function{owner: r, spec: spec, key: spec.Name}
+	fn.segments, fn.prefix = parseRoute(spec.Route)
+	return fn, nil
+}
+
+// implicitFunction wraps a bare wasm path with the handler defaults.
+func (r *Gojinn) implicitFunction(wasmFile string) *function {
+	return &function{
+		owner:  r,
+		spec:   FunctionSpec{Name: strings.TrimSuffix(filepath.Base(wasmFile), ".wasm"), WasmFile: wasmFile},
+		key:    hashString(wasmFile),
+		hashed: true,
+		prefix: true,
+	}
+}
+
+func (f *function) name() string     { return f.spec.Name }
+func (f *function) wasmFile() string { return f.spec.WasmFile }
+
+func (f *function) env() map[string]string {
+	if len(f.spec.Env) == 0 {
+		return f.owner.Env
+	}
+	env := make(map[string]string, len(f.owner.Env)+len(f.spec.Env))
+	for k, v := range f.owner.Env {
+		env[k] = v
+	}
+	for k, v := range f.spec.Env {
+		env[k] = v
+	}
+	return env
+}
+
+func (f *function) perms() Permissions {
+	if f.spec.Perms != nil {
+		return *f.spec.Perms
+	}
+	return f.owner.Perms
+}
+
+func (f *function) timeout() time.Duration {
+	if f.spec.Timeout > 0 {
+		return time.Duration(f.spec.Timeout)
+	}
+	return time.Duration(f.owner.Timeout)
+}
+
+func (f *function) poolSize() int {
+	if f.spec.PoolSize > 0 {
+		return f.spec.PoolSize
+	}
+	return f.owner.PoolSize
+}
+
+func (f *function) retry() RetryPolicy {
+	if f.spec.Retry != nil {
+		return *f.spec.Retry
+	}
+	return f.owner.Retry
+}
+
+// id distinguishes the pinned versions of a function from each other and
+// from its live module.
+func (f *function) id() string {
+	if f.version != "" {
+		return f.key + "-" + f.version
+	}
+	return f.key
+}
+
+func (f *function) queueGroup(tenantID string) string {
+	key := f.key
+	if f.hashed {
+		key = key[:12]
+	}
+	if f.version != "" {
+		key += "-" + f.version
+	}
+	return fmt.Sprintf("WORKERS_%s_%s", tenantID, key)
+}
+
+// parseRoute splits a route pattern into segments. A trailing "*" matches
+// any remainder, including none; "{name}" matches exactly one segment.
+func parseRoute(route string) ([]string, bool) {
+	segments := splitPath(route)
+	if n := len(segments); n > 0 && segments[n-1] == "*" {
+		return segments[:n-1], true
+	}
+	return segments, false
+}
+
+func splitPath(p string) []string {
+	var out []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (f *function) match(path string) (map[string]string, bool) {
+	parts := splitPath(path)
+	if len(parts) < len(f.segments) || (!f.prefix && len(parts) != len(f.segments)) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, seg := range f.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[1:len(seg)-1]] = parts[i]
+			continue
+		}
+		if seg != parts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (f *function) allowsMethod(method string) bool {
+	return len(f.spec.Methods) == 0 || slices.Contains(f.spec.Methods, method)
+}
+
+// setupFunctions builds the routing table from the functions block, the
+// functions directory and the handler path, in that order of precedence.
+func (r *Gojinn) setupFunctions() error {
+	routes, err := r.buildRoutes()
+	if err != nil {
+		return err
+	}
+
+	var def *function
+	if r.Path != "" {
+		def = r.implicitFunction(r.Path)
+	}
+
+	r.functionsMu.Lock()
+	r.routes = routes
+	r.defaultFn = def
+	r.functionsMu.Unlock()
+	return nil
+}
+
+func (r *Gojinn) buildRoutes() ([]*function, error) {
+	var routes []*function
+	seen := make(map[string]bool)
+
+	for _, spec := range r.Functions {
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate function name: %s", spec.Name)
+		}
+		fn, err := r.newFunction(spec)
+		if err != nil {
+			return nil, err
+		}
+		seen[spec.Name] = true
+		routes = append(routes, fn)
+	}
+
+	if r.FunctionsDir == "" {
+		return routes, nil
+	}
+
+	entries, err := os.ReadDir(r.FunctionsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions_dir: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".wasm" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".wasm")
+		if seen[name] {
+			continue
+		}
+		fn, err := r.newFunction(FunctionSpec{Name: name, WasmFile: filepath.Join(r.FunctionsDir, entry.Name())})
+		if err != nil {
+			r.logger.Warn("Skipping module in functions_dir", zap.String("file", entry.Name()), zap.Error(err))
+			continue
+		}
+		seen[name] = true
+		routes = append(routes, fn)
+	}
+	return routes, nil
+}
+
+// reloadFunctions rescans functions_dir so modules dropped into it are served
+// after a hot reload. On failure the current table is kept.
+func (r *Gojinn) reloadFunctions() {
+	routes, err := r.buildRoutes()
+	if err != nil {
+		r.logger.Error("Failed to rebuild function routes, keeping previous table", zap.Error(err))
+		return
+	}
+	r.functionsMu.Lock()
+	r.routes = routes
+	r.functionsMu.Unlock()
+}
+
+// servedFunctions lists every function reachable over HTTP.
+func (r *Gojinn) servedFunctions() []*function {
+	r.functionsMu.RLock()
+	defer r.functionsMu.RUnlock()
+
+	fns := slices.Clone(r.routes)
+	if r.defaultFn != nil {
+		fns = append(fns, r.defaultFn)
+	}
+	return fns
+}
+
+// routeFunction picks the first function whose route and methods match the
+// request, falling back to the handler path. The status is 0 on a match,
+// 405 when only the method was rejected and 404 otherwise.
+func (r *Gojinn) routeFunction(req *http.Request) (*function, map[string]string, int) {
+	r.functionsMu.RLock()
+	defer r.functionsMu.RUnlock()
+
+	methodMismatch := false
+	for _, fn := range r.routes {
+		params, ok := fn.match(req.URL.Path)
+		if !ok {
+			continue
+		}
+		if !fn.allowsMethod(req.Method) {
+			methodMismatch = true
+			continue
+		}
+		return fn, params, 0
+	}
+
+	if r.defaultFn != nil {
+		return r.defaultFn, nil, 0
+	}
+	if methodMismatch {
+		return nil, nil, http.StatusMethodNotAllowed
+	}
+	return nil, nil, http.StatusNotFound
+}
+
+func (r *Gojinn) servedDefault() *function {
+	r.functionsMu.RLock()
+	defer r.functionsMu.RUnlock()
+	return r.defaultFn
+}
+
+func (r *Gojinn) lookupFunction(name string) *function {
+	r.functionsMu.RLock()
+	defer r.functionsMu.RUnlock()
+
+	for _, fn := range r.routes {
+		if fn.name() == name {
+			return fn
+		}
+	}
+	return nil
+}
+
+// functionFor resolves a reference used by cron jobs, MQTT subscriptions and
+// host_enqueue: a declared function name, or a wasm path.
+// Served functions run their current version.
+func (r *Gojinn) functionFor(ref string) *function {
+	if fn := r.resolveServed(ref); fn != nil {
+		return fn
+	}
+	if cached, ok := r.implicitFns.Load(ref); ok {
+		return cached.(*function)
+	}
+	fn, _ := r.implicitFns.LoadOrStore(ref, r.implicitFunction(ref))
+	return fn.(*function)
+}
+
+// resolveServed resolves ref to a function served over HTTP, or nil.
+func (r *Gojinn) resolveServed(ref string) *function {
+	if fn := r.lookupFunction(ref); fn != nil {
+		return r.pickVersion(fn, "")
+	}
+
+	r.functionsMu.RLock()
+	for _, fn := range r.routes {
+		if fn.wasmFile() == ref {
+			r.functionsMu.RUnlock()
+			return r.pickVersion(fn, "")
+		}
+	}
+	def := r.defaultFn
+	r.functionsMu.RUnlock()
+
+	if def != nil && def.wasmFile() == ref {
+		return r.pickVersion(def, "")
+	}
+	return nil
+}
+
+// declaredFunction resolves ref only when the configuration declares it: a
+// served function, or the module of a cron job or MQTT subscription. Guests
+// use it so they cannot make the host load arbitrary files.
+func (r *Gojinn) declaredFunction(ref string) *function {
+	if fn := r.resolveServed(ref); fn != nil {
+		return fn
+	}
+	for _, job := range r.CronJobs {
+		if job.WasmFile == ref {
+			return r.functionFor(ref)
+		}
+	}
+	for _, sub := range r.MQTTSubs {
+		if sub.WasmFile == ref {
+			return r.functionFor(ref)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,11 @@
 package gojinn
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +18,7 @@ import (
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 	"github.com/robfig/cron/v3"
+	"github.com/tetratelabs/wazero"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
@@ -38,11 +39,20 @@ type Permissions struct {
 	KVWrite []string `json:"kv_write,omitempty"`
 	S3Read  []string `json:"s3_read,omitempty"`
 	S3Write []string `json:"s3_write,omitempty"`
+
+	MQTTPublish []string `json:"mqtt_publish,omitempty"`
+	WSRooms     []string `json:"ws_rooms,omitempty"`
 }
+
+// ConsensusPolicy stores the KV keys starting with Namespace in a bucket of
+// their own. Mode "cp" reads through the stream leader and reports a lost
+// quorum as no_quorum; mode "ap" with StaleReads serves reads from any
+// replica, including a partitioned local one.
 type ConsensusPolicy struct {
 	Namespace  string `json:"namespace"`
 	Mode       string `json:"mode"`
 	StaleReads bool   `json:"stale_reads"`
+	Replicas   int    `json:"replicas,omitempty"`
 }
 
 type Gojinn struct {
@@ -54,6 +64,21 @@ type Gojinn struct {
 	PoolSize    int               `json:"pool_size,omitempty"`
 	DebugSecret string            `json:"debug_secret,omitempty"`
 
+	Functions    []FunctionSpec `json:"functions,omitempty"`
+	FunctionsDir string         `json:"functions_dir,omitempty"`
+	routes       []*function
+	defaultFn    *function
+	implicitFns  sync.Map
+	functionsMu  sync.RWMutex
+	manifests    map[string]*versionManifest
+	versionsMu   sync.RWMutex
+
+	CompilationCache string `json:"compilation_cache,omitempty"`
+	compilationCache wazero.CompilationCache
+	compiledModules  sync.Map
+	pools            map[string]*sandboxPool
+	poolsMu          sync.Mutex
+
 	RecordCrashes bool   `json:"record_crashes,omitempty"`
 	CrashPath     string `json:"crash_path,omitempty"`
 
@@ -82,16 +107,29 @@ type Gojinn struct {
 	DBDriver string `json:"db_driver,omitempty"`
 	DBDSN    string `json:"db_dsn,omitempty"`
 
+	// Migrations is a directory of versioned SQL files applied to the host
+	// database during Provision.
+	Migrations string `json:"migrations,omitempty"`
+
+	// DBSyncURL turns the node into a read replica of the Gojinn node at that
+	// address. DBSyncToken authenticates replicas; set alone, it makes the
+	// node a primary that replicas can follow.
 	DBSyncURL   string `json:"db_sync_url,omitempty"`
 	DBSyncToken string `json:"db_sync_token,omitempty"`
+	dbPrimary   *dbPrimary
+	dbReplica   *dbReplica
 
-	kv nats.KeyValue
+	// TenantDB replaces the shared database with a private SQLite file per
+	// tenant. Invocations without a tenant keep using db_driver/db_dsn.
+	TenantDB  *TenantDBConfig `json:"tenant_db,omitempty"`
+	tenantDBs *tenantDBPool
 
 	db      *sql.DB
 	logger  *zap.Logger
 	metrics *gojinnMetrics
 
-	Storage blob.Provider
+	StorageConfig *StorageConfig `json:"storage,omitempty"`
+	Storage       blob.Provider  `json:"-"`
 
 	CronJobs  []CronJob `json:"cron_jobs,omitempty"`
 	scheduler *cron.Cron
@@ -103,6 +141,11 @@ type Gojinn struct {
 	MQTTSubs     []MQTTSub `json:"mqtt_subs,omitempty"`
 	mqttClient   mqtt.Client
 
+	// MQTTMaxTenants caps the tenants provisioned from {N} topic placeholders.
+	MQTTMaxTenants int `json:"mqtt_max_tenants,omitempty"`
+	mqttTenantsMu  sync.Mutex
+	mqttTenants    map[string]struct{}
+
 	AIProvider string `json:"ai_provider,omitempty"`
 	AIModel    string `json:"ai_model,omitempty"`
 	AIEndpoint string `json:"ai_endpoint,omitempty"`
@@ -110,17 +153,40 @@ type Gojinn struct {
 	aiCache    sync.Map
 
 	APIKeys      []string `json:"api_keys,omitempty"`
+	AdminKeys    []string `json:"admin_keys,omitempty"`
 	AllowedHosts []string `json:"allowed_hosts,omitempty"`
 	CorsOrigins  []string `json:"cors_origins,omitempty"`
+	WSOrigins    []string `json:"ws_origins,omitempty"`
+
+	Egress          EgressPolicy `json:"egress,omitempty"`
+	egressTransport *http.Transport
 
 	RateLimit  float64 `json:"rate_limit,omitempty"`
 	RateBurst  int     `json:"rate_burst,omitempty"`
 	limiters   map[string]*rate.Limiter
 	limitersMu sync.Mutex
 
+	tenants       sync.Map
+	tenantKVTTL   sync.Map
+	namespaceKVs  sync.Map
+	tenantsKV     nats.KeyValue
+	usageKV       nats.KeyValue
+	tenantWatcher nats.KeyWatcher
+
 	tenantSubs map[string][]*nats.Subscription
+	workerSets map[string]struct{}
 	subsMu     sync.Mutex
 
+	cronCancels sync.Map
+
+	Retry RetryPolicy `json:"retry,omitempty"`
+
+	JobResultTTL       caddy.Duration `json:"job_result_ttl,omitempty"`
+	JobResultMaxOutput string         `json:"job_result_max_output,omitempty"`
+	jobBuckets         sync.Map
+	callbackSub        *nats.Subscription
+	callbackKey        []byte
+
 	ClusterName  string   `json:"cluster_name,omitempty"`
 	ClusterPort  int      `json:"cluster_port,omitempty"`
 	ClusterPeers []string `json:"cluster_peers,omitempty"`
@@ -128,6 +194,16 @@ type Gojinn struct {
 	ClusterReplicas int               `json:"cluster_replicas,omitempty"`
 	Consensus       []ConsensusPolicy `json:"consensus,omitempty"`
 
+	Actors       *ActorConfig `json:"actors,omitempty"`
+	actorsKV     nats.KeyValue
+	actorNode    string
+	actors       map[string]*actorInstance
+	actorTimers  map[string]actorTimer
+	actorsMu     sync.Mutex
+	actorsWG     sync.WaitGroup
+	actorSub     *nats.Subscription
+	actorWatcher nats.KeyWatcher
+
 	StoreCipherKey string `json:"store_cipher_key,omitempty"`
 
 	ServerName string `json:"server_name,omitempty"`
@@ -148,6 +224,9 @@ func (*Gojinn) CaddyModule() caddy.ModuleInfo {
 func (r *Gojinn) Provision(ctx caddy.Context) error {
 	r.logger = ctx.Logger()
 	r.tenantSubs = make(map[string][]*nats.Subscription)
+	r.workerSets = make(map[string]struct{})
+	r.pools = make(map[string]*sandboxPool)
+	r.manifests = make(map[string]*versionManifest)
 
 	if r.SentryDSN != "" {
 		errSentry := sentry.Init(sentry.ClientOptions{
@@ -177,12 +256,19 @@ func (r *Gojinn) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	if err := r.setupCompilationCache(); err != nil {
+		return err
+	}
+
 	if err := r.setupMetrics(ctx); err != nil {
 		return err
 	}
 	if err := r.setupDB(); err != nil {
 		return fmt.Errorf("failed to setup database: %w", err)
 	}
+	if err := r.setupTenantDBs(); err != nil {
+		return fmt.Errorf("failed to setup tenant databases: %w", err)
+	}
 
 	if r.ClusterName == "" {
 		r.ClusterName = "gojinn-cluster"
@@ -192,102 +278,107 @@ func (r *Gojinn) Provision(ctx caddy.Context) error {
 		r.ClusterReplicas = 1
 	}
 
-	if err := r.startEmbeddedNATS(); err != nil {
+	if r.PoolSize <= 0 {
+		r.PoolSize = 2
+	}
+	if r.Timeout == 0 {
+		r.Timeout = caddy.Duration(60 * time.Second)
+	}
+	if err := r.Retry.validate(); err != nil {
 		return err
 	}
-
-	if len(r.CronJobs) > 0 {
-		r.scheduler = cron.New(cron.WithSeconds())
-		for _, job := range r.CronJobs {
-			j := job
-			if _, err := r.loadWasmSecurely(j.WasmFile); err != nil {
-				return fmt.Errorf("cron job security check failed for %s: %w", j.WasmFile, err)
-			}
-			_, err := r.scheduler.AddFunc(j.Schedule, func() {
-				r.logger.Warn("Cron jobs execution disabled pending Multi-Tenant rewrite", zap.String("wasm", j.WasmFile))
-			})
-			if err != nil {
-				return fmt.Errorf("failed to schedule cron job: %v", err)
-			}
-			r.logger.Info("Cron job scheduled", zap.String("schedule", j.Schedule), zap.String("wasm", j.WasmFile))
+	if err := r.Egress.validate(); err != nil {
+		return err
+	}
+	if err := r.setupConsensus(); err != nil {
+		return err
+	}
+	if r.Actors != nil {
+		if err := r.Actors.validate(); err != nil {
+			return err
 		}
-		r.scheduler.Start()
 	}
+	r.egressTransport = r.newEgressTransport()
 
-	if r.MQTTBroker != "" {
-		for _, sub := range r.MQTTSubs {
-			if _, err := r.loadWasmSecurely(sub.WasmFile); err != nil {
-				return fmt.Errorf("mqtt handler security check failed for %s: %w", sub.WasmFile, err)
-			}
+	if err := r.setupFunctions(); err != nil {
+		return err
+	}
+	for _, fn := range r.activeFunctions() {
+		if _, err := r.warmPool(fn); err != nil {
+			return fmt.Errorf("function security check failed for %s: %w", fn.wasmFile(), err)
 		}
+	}
 
-		opts := mqtt.NewClientOptions()
-		opts.AddBroker(r.MQTTBroker)
-		if r.MQTTClientID != "" {
-			opts.SetClientID(r.MQTTClientID)
-		}
-		if r.MQTTUsername != "" {
-			opts.SetUsername(r.MQTTUsername)
-		}
-		if r.MQTTPassword != "" {
-			opts.SetPassword(r.MQTTPassword)
-		}
+	if err := r.startEmbeddedNATS(); err != nil {
+		return err
+	}
 
-		opts.OnConnect = func(c mqtt.Client) {
-			r.logger.Info("MQTT Connected", zap.String("broker", r.MQTTBroker))
-			for _, sub := range r.MQTTSubs {
-				s := sub
-				token := c.Subscribe(s.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-					r.logger.Warn("MQTT execution disabled pending Multi-Tenant rewrite", zap.String("topic", s.Topic))
-				})
-				if token.Wait() && token.Error() != nil {
-					r.logger.Error("MQTT Subscribe Error", zap.Error(token.Error()))
-				} else {
-					r.logger.Info("MQTT Subscribed", zap.String("topic", s.Topic))
-				}
-			}
-		}
-		opts.OnConnectionLost = func(c mqtt.Client, err error) {
-			r.logger.Warn("MQTT Connection Lost", zap.Error(err))
-		}
-		r.mqttClient = mqtt.NewClient(opts)
-		if token := r.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-			r.logger.Error("MQTT Initial Connect Failed", zap.Error(token.Error()))
+	if err := r.startCallbackDispatcher(); err != nil {
+		return err
+	}
+
+	if err := r.startTenantRegistry(); err != nil {
+		return err
+	}
+
+	if r.Actors != nil {
+		if err := r.setupActors(); err != nil {
+			return err
 		}
 	}
 
-	if r.PoolSize <= 0 {
-		r.PoolSize = 2
+	if err := r.setupStorage(); err != nil {
+		return fmt.Errorf("failed to setup blob storage: %w", err)
 	}
-	if r.Timeout == 0 {
-		r.Timeout = caddy.Duration(60 * time.Second)
+
+	if len(r.CronJobs) > 0 {
+		if err := r.startScheduler(); err != nil {
+			return err
+		}
+	}
+
+	if r.MQTTBroker != "" {
+		if err := r.startMQTT(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (r *Gojinn) EnsureTenantWorkers(tenantID string) error {
+	for _, fn := range r.servedFunctions() {
+		if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Gojinn) ensureFunctionWorkers(tenantID string, fn *function) error {
 	r.subsMu.Lock()
 	defer r.subsMu.Unlock()
 
-	if _, exists := r.tenantSubs[tenantID]; exists {
+	setKey := tenantID + "/" + fn.id()
+	if _, exists := r.workerSets[setKey]; exists {
 		return nil
 	}
 
-	r.logger.Info("Provisioning Dynamic WASM Workers for Tenant...", zap.String("tenant", tenantID), zap.Int("workers", r.PoolSize))
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		return err
+	}
 
-	wasmBytes, err := r.loadWasmSecurely(r.Path)
+	r.logger.Info("Provisioning Dynamic WASM Workers for Tenant...", zap.String("tenant", tenantID), zap.String("function", fn.name()), zap.String("wasm", fn.wasmFile()), zap.Int("workers", fn.poolSize()))
+
+	wasmBytes, err := r.loadWasmSecurely(fn.wasmFile())
 	if err != nil {
 		return fmt.Errorf("failed to load wasm for tenant: %w", err)
 	}
 
-	topic := fmt.Sprintf("gojinn.tenant.%s.exec.>", tenantID)
-	streamName := fmt.Sprintf("WORKER_%s", strings.ToUpper(tenantID))
-
 	var subs []*nats.Subscription
 
-	for i := 0; i < r.PoolSize; i++ {
-		sub, err := r.startTenantWorker(tenantID, streamName, i, topic, wasmBytes)
+	for i := 0; i < fn.poolSize(); i++ {
+		sub, err := r.startTenantWorker(tenantID, fn, i, wasmBytes)
 		if err != nil {
 			r.logger.Error("Failed to start tenant worker subscriber", zap.String("tenant", tenantID), zap.Error(err))
 			continue
@@ -295,8 +386,9 @@ func (r *Gojinn) EnsureTenantWorkers(tenantID string) error {
 		subs = append(subs, sub)
 	}
 
-	r.tenantSubs[tenantID] = subs
-	r.logger.Info("Tenant Workers Provisioned Successfully!", zap.String("tenant", tenantID), zap.Int("count", len(subs)))
+	r.tenantSubs[tenantID] = append(r.tenantSubs[tenantID], subs...)
+	r.workerSets[setKey] = struct{}{}
+	r.logger.Info("Tenant Workers Provisioned Successfully!", zap.String("tenant", tenantID), zap.String("function", fn.name()), zap.Int("count", len(subs)))
 	return nil
 }
 
@@ -304,6 +396,21 @@ func (r *Gojinn) Cleanup() error {
 	if r.SentryDSN != "" {
 		sentry.Flush(2 * time.Second)
 	}
+	if r.scheduler != nil {
+		r.scheduler.Stop()
+	}
+	if r.tenantWatcher != nil {
+		_ = r.tenantWatcher.Stop()
+	}
+	if r.Storage != nil {
+		_ = r.Storage.Close()
+	}
+	if r.egressTransport != nil {
+		r.egressTransport.CloseIdleConnections()
+	}
+	if r.Actors != nil {
+		r.stopActors()
+	}
 	if r.natsConn != nil {
 		if err := r.natsConn.Drain(); err != nil {
 			r.logger.Warn("NATS Drain error", zap.Error(err))
@@ -316,29 +423,45 @@ func (r *Gojinn) Cleanup() error {
 	if r.mqttClient != nil && r.mqttClient.IsConnected() {
 		r.mqttClient.Disconnect(250)
 	}
-	if r.scheduler != nil {
-		r.scheduler.Stop()
+	if r.dbReplica != nil {
+		r.dbReplica.close()
 	}
 	if r.db != nil {
 		r.db.Close()
 	}
+	if r.tenantDBs != nil {
+		r.tenantDBs.close()
+	}
+	r.closePools()
+	if r.compilationCache != nil {
+		_ = r.compilationCache.Close(context.Background())
+	}
 	return nil
 }
 
-func (r *Gojinn) getLimiter(key string) *rate.Limiter {
+// getLimiter returns the limiter of a tenant, retuning it when the tenant's
+// rate settings changed since it was created.
+func (r *Gojinn) getLimiter(key string, limit float64, burst int) *rate.Limiter {
+	if burst == 0 {
+		burst = int(limit)
+	}
+	if burst == 0 {
+		burst = 1
+	}
+
 	r.limitersMu.Lock()
 	defer r.limitersMu.Unlock()
 	limiter, exists := r.limiters[key]
 	if !exists {
-		burst := r.RateBurst
-		if burst == 0 {
-			burst = int(r.RateLimit)
-		}
-		if burst == 0 {
-			burst = 1
-		}
-		limiter = rate.NewLimiter(rate.Limit(r.RateLimit), burst)
+		limiter = rate.NewLimiter(rate.Limit(limit), burst)
 		r.limiters[key] = limiter
+		return limiter
+	}
+	if limiter.Limit() != rate.Limit(limit) {
+		limiter.SetLimit(rate.Limit(limit))
+	}
+	if limiter.Burst() != burst {
+		limiter.SetBurst(burst)
 	}
 	return limiter
 }
@@ -349,4 +472,12 @@ type HttpContext struct {
 	W      http.ResponseWriter
 	R      *http.Request
 	WSConn *websocket.Conn
+
+	// rejected is set when a failed upgrade already answered the request.
+	rejected bool
+}
+
+func withHTTPContext(ctx context.Context, rw http.ResponseWriter, req *http.Request) (context.Context, *HttpContext) {
+	hc := &HttpContext{W: rw, R: req}
+	return context.WithValue(ctx, wsContextKey{}, hc), hc
 }
@@ -1,15 +1,37 @@
 package gojinn
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/coder/websocket"
+	"github.com/gojinn-io/gojinn/pkg/blob"
+	"github.com/gojinn-io/gojinn/pkg/blob/fs"
+	"github.com/gojinn-io/gojinn/pkg/blob/mem"
+	"github.com/gojinn-io/gojinn/pkg/migrate"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func compileTestWasm(t *testing.T, sourceCode, outName string) string {
@@ -130,3 +152,2090 @@ func TestProvision_GracefulInvalidConfig(t *testing.T) {
 
 	_ = r.Cleanup()
 }
+
+func TestRunSyncJob_WarmPoolRefreshesOnChange(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+import ("io"; "os")
+func main() { in, _ := io.ReadAll(os.Stdin); os.Stdout.Write(append([]byte("v1:"), in...)) }`, "pool.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4226,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	err := r.Provision(ctx)
+	assert.NoError(t, err)
+	defer func() { _ = r.Cleanup() }()
+
+	assert.Equal(t, 1, r.idleSandboxes()["pool"], "Pool should be warmed during Provision")
+
+	out, err := r.runSyncJob(context.Background(), r.functionFor(wasmPath), "ping")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1:ping", out)
+	assert.Equal(t, 1, r.idleSandboxes()["pool"], "Sandbox should be returned to the pool")
+
+	v2 := compileTestWasm(t, `package main
+import ("io"; "os")
+func main() { in, _ := io.ReadAll(os.Stdin); os.Stdout.Write(append([]byte("v2:"), in...)) }`, "pool.wasm")
+	v2Bytes, err := os.ReadFile(v2)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(wasmPath, v2Bytes, 0644))
+	future := time.Now().Add(2 * time.Second)
+	assert.NoError(t, os.Chtimes(wasmPath, future, future))
+
+	time.Sleep(poolStatInterval + 100*time.Millisecond)
+
+	out, err = r.runSyncJob(context.Background(), r.functionFor(wasmPath), "ping")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2:ping", out)
+}
+
+func TestFuelLimit_TrapsWithDistinctError(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+import ("fmt"; "os")
+//go:noinline
+func fib(n int) int { if n < 2 { return n }; return fib(n-1) + fib(n-2) }
+func main() { fmt.Fprint(os.Stdout, fib(25)) }`, "fib.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		PoolSize:  1,
+		NatsPort:  4234,
+		DataDir:   t.TempDir(),
+		FuelLimit: 100_000_000,
+		Timeout:   caddy.Duration(20 * time.Second),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	out, err := r.runSyncJob(context.Background(), r.functionFor(wasmPath), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "75025", out)
+
+	r.FuelLimit = 10_000
+	_, err = r.runSyncJob(context.Background(), r.functionFor(wasmPath), "")
+	assert.ErrorIs(t, err, ErrFuelExhausted)
+	assert.Equal(t, FailureFuel, classifyFailure(context.Background(), err, false))
+
+	// A loop without calls must spend fuel too, not just run into timeout.
+	spinPath := compileTestWasm(t, `package main
+var sink int
+func main() { for i := 0; ; i++ { sink = i } }`, "spin.wasm")
+	_, err = r.runSyncJob(context.Background(), r.functionFor(spinPath), "")
+	assert.ErrorIs(t, err, ErrFuelExhausted)
+
+	// try/end from the exception-handling proposal cannot be rewritten.
+	unmeterable := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+		0x03, 0x02, 0x01, 0x00,
+		0x0a, 0x07, 0x01, 0x05, 0x00, 0x06, 0x40, 0x0b, 0x0b,
+	}
+	_, err = r.createWazeroRuntime(unmeterable)
+	assert.ErrorIs(t, err, errWasmMalformed, "Modules that cannot be metered are refused")
+}
+
+func TestHostKV_IsolatedPerInvocation(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func host_kv_set(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_get
+func host_kv_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	key := []byte("owner")
+	host_kv_set(uint32(uintptr(unsafe.Pointer(&key[0]))), uint32(len(key)), uint32(uintptr(unsafe.Pointer(&in[0]))), uint32(len(in)))
+
+	buf := make([]byte, 64)
+	n := host_kv_get(uint32(uintptr(unsafe.Pointer(&key[0]))), uint32(len(key)), uint32(uintptr(unsafe.Pointer(&buf[0]))), 64)
+	if n == 0xFFFFFFFF {
+		os.Stdout.Write([]byte("<missing>"))
+		return
+	}
+	os.Stdout.Write(buf[:n])
+}`, "kv.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 4,
+		NatsPort: 4227,
+		DataDir:  t.TempDir(),
+		Perms: Permissions{
+			KVRead:  []string{"*"},
+			KVWrite: []string{"*"},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	tenants := []string{"alpha", "beta"}
+	invocations := map[string]*invocation{}
+	for _, tenant := range tenants {
+		kv, err := r.EnsureTenantResources(tenant)
+		assert.NoError(t, err)
+		invocations[tenant] = r.newInvocation(tenant, kv, r.functionFor(wasmPath))
+	}
+
+	results := make(chan [2]string, 20)
+	for i := 0; i < 20; i++ {
+		tenant := tenants[i%2]
+		go func() {
+			out, err := r.runSyncJob(withInvocation(context.Background(), invocations[tenant]), r.functionFor(wasmPath), tenant)
+			if err != nil {
+				out = err.Error()
+			}
+			results <- [2]string{tenant, out}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		res := <-results
+		assert.Equal(t, res[0], res[1], "Invocation must only see its own tenant bucket")
+	}
+
+	for _, tenant := range tenants {
+		entry, err := invocations[tenant].kv.Get("owner")
+		assert.NoError(t, err)
+		assert.Equal(t, tenant, string(entry.Value()))
+	}
+
+	out, err := r.runSyncJob(context.Background(), r.functionFor(wasmPath), "orphan")
+	assert.NoError(t, err)
+	assert.Equal(t, "<missing>", out, "Executions without a tenant invocation must not reach any KV bucket")
+}
+
+func TestTenantRegistry_GrantsAndQuotas(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func host_kv_set(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_get
+func host_kv_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+func ptr(b []byte) uint32 { return uint32(uintptr(unsafe.Pointer(&b[0]))) }
+
+func roundTrip(key string) string {
+	k, v := []byte(key), []byte("v")
+	host_kv_set(ptr(k), uint32(len(k)), ptr(v), 1)
+	buf := make([]byte, 8)
+	n := host_kv_get(ptr(k), uint32(len(k)), ptr(buf), 8)
+	if n == 0xFFFFFFFF {
+		return "-"
+	}
+	return string(buf[:n])
+}
+
+func main() {
+	os.Stdout.Write([]byte(roundTrip("shared.k") + roundTrip("private.k")))
+}`, "tenant.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		PoolSize:  1,
+		NatsPort:  4235,
+		DataDir:   t.TempDir(),
+		APIKeys:   []string{"acme"},
+		AdminKeys: []string{"root"},
+		Perms: Permissions{
+			KVRead:  []string{"*"},
+			KVWrite: []string{"*"},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	do := func(method, path, key, body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		return rec, r.ServeHTTP(rec, req, nil)
+	}
+
+	rec, err := do("GET", "/", "acme", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "vv", rec.Body.String(), "Unregistered tenants keep the function permissions")
+
+	tenant := `{"grants": {"kv_read": ["shared."], "kv_write": ["shared."]}, "daily": {"invocations": 2}, "max_timeout": "5s"}`
+	rec, _ = do("PUT", "/_sys/tenants/acme", "acme", tenant)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Tenants must not edit their own registry entry")
+
+	rec, _ = do("PUT", "/_sys/tenants/acme", "root", tenant)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec, _ = do("GET", "/_sys/tenants/acme", "acme", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"kv_write":["shared."]`)
+
+	rec, err = do("GET", "/", "acme", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "v-", rec.Body.String(), "Tenant grants narrow the function permissions")
+
+	_, err = do("GET", "/", "acme", "")
+	assert.NoError(t, err)
+
+	_, err = do("GET", "/", "acme", "")
+	var herr caddyhttp.HandlerError
+	if assert.ErrorAs(t, err, &herr) {
+		assert.Equal(t, http.StatusTooManyRequests, herr.StatusCode)
+		assert.Contains(t, herr.Err.Error(), "daily invocations quota exceeded")
+	}
+
+	job := CronJob{Name: "nightly", Schedule: "0 0 0 1 1 *", WasmFile: wasmPath, Tenant: "acme"}
+	r.runBackgroundJob(job)
+	kv, err := r.EnsureTenantResources("acme")
+	assert.NoError(t, err)
+	run, err := loadCronRun(kv, job.Name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, cronStatusFailed, run.Status, "Cron runs are held to the tenant quota")
+		assert.Contains(t, run.Error, "daily invocations quota exceeded")
+	}
+
+	rec, _ = do("GET", "/_sys/tenants/acme/usage", "acme", "")
+	var usage struct {
+		Day TenantUsage `json:"day"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+	assert.Equal(t, uint64(2), usage.Day.Invocations)
+	assert.Positive(t, usage.Day.CPUTime)
+
+	rec, _ = do("PUT", "/_sys/tenants/acme", "root", `{"max_memory": "64KB"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, err = do("GET", "/", "acme", "")
+	assert.ErrorContains(t, err, "max_memory")
+
+	rec, _ = do("DELETE", "/_sys/tenants/acme", "root", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec, err = do("GET", "/", "acme", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "vv", rec.Body.String())
+}
+
+func TestBlob_PermissionsPrefixAndStreams(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_s3_put
+func host_s3_put(kPtr, kLen, bPtr, bLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_get
+func host_s3_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_head
+func host_s3_head(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_list
+func host_s3_list(pPtr, pLen, cPtr, cLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_delete
+func host_s3_delete(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_open
+func host_s3_open(kPtr, kLen, mode uint32) uint32
+
+//go:wasmimport gojinn host_s3_read
+func host_s3_read(handle, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_write
+func host_s3_write(handle, ptr, length uint32) uint32
+
+//go:wasmimport gojinn host_s3_close
+func host_s3_close(handle uint32) uint32
+
+func ptr(b []byte) uint32 { return uint32(uintptr(unsafe.Pointer(&b[0]))) }
+
+func main() {
+	buf := make([]byte, 1024)
+	key, body := []byte("public/a.txt"), []byte("hello")
+	fmt.Fprintln(os.Stdout, host_s3_put(ptr(key), uint32(len(key)), ptr(body), uint32(len(body))))
+	secret := []byte("secret/a.txt")
+	fmt.Fprintln(os.Stdout, host_s3_put(ptr(secret), uint32(len(secret)), ptr(body), uint32(len(body))))
+	fmt.Fprintln(os.Stdout, host_s3_get(ptr(key), uint32(len(key)), ptr(buf), 2))
+
+	n := host_s3_head(ptr(key), uint32(len(key)), ptr(buf), 1024)
+	fmt.Fprintln(os.Stdout, string(buf[:n]))
+
+	big := []byte("public/big.bin")
+	h := host_s3_open(ptr(big), uint32(len(big)), 1)
+	chunk := make([]byte, 4096)
+	for i := range chunk {
+		chunk[i] = 'x'
+	}
+	for i := 0; i < 3; i++ {
+		host_s3_write(h, ptr(chunk), uint32(len(chunk)))
+	}
+	fmt.Fprintln(os.Stdout, host_s3_close(h))
+
+	h = host_s3_open(ptr(big), uint32(len(big)), 0)
+	total := 0
+	for {
+		n := host_s3_read(h, ptr(buf), 256)
+		if n == 0 || n == 0xFFFFFFFF {
+			break
+		}
+		total += int(n)
+	}
+	host_s3_close(h)
+	fmt.Fprintln(os.Stdout, total)
+
+	prefix := []byte("public/")
+	n = host_s3_list(ptr(prefix), uint32(len(prefix)), 0, 0, ptr(buf), 1024)
+	fmt.Fprintln(os.Stdout, string(buf[:n]))
+
+	fmt.Fprintln(os.Stdout, host_s3_delete(ptr(key), uint32(len(key))))
+	fmt.Fprint(os.Stdout, host_s3_head(ptr(key), uint32(len(key)), ptr(buf), 1024))
+}`, "blob.wasm")
+
+	store := mem.New()
+	assert.NoError(t, store.Put(context.Background(), "beta/public/a.txt", []byte("other tenant")))
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4236,
+		DataDir:  t.TempDir(),
+		Storage:  store,
+		Perms: Permissions{
+			S3Read:  []string{"public/"},
+			S3Write: []string{"public/"},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	kv, err := r.EnsureTenantResources("alpha")
+	assert.NoError(t, err)
+	inv := r.newInvocation("alpha", kv, r.functionFor(wasmPath))
+	out, err := r.runSyncJob(withInvocation(context.Background(), inv), r.functionFor(wasmPath), "alpha")
+	assert.NoError(t, err)
+
+	lines := strings.Split(out, "\n")
+	if !assert.Len(t, lines, 9, out) {
+		return
+	}
+	assert.Equal(t, "0", lines[0], "Writes under an allowed prefix succeed")
+	assert.Equal(t, "2", lines[1], "Writes outside S3Write are denied")
+	assert.Equal(t, "5", lines[2], "A short buffer reports the needed size instead of truncating")
+	var info blob.ObjectInfo
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &info))
+	assert.Equal(t, "public/a.txt", info.Key)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "0", lines[4])
+	assert.Equal(t, "12288", lines[5], "Streams move objects larger than the guest buffer")
+	assert.Contains(t, lines[6], `"key":"public/big.bin"`)
+	assert.NotContains(t, lines[6], "alpha/", "Listings hide the tenant prefix")
+	assert.Equal(t, "0", lines[7])
+	assert.Equal(t, "4294967295", lines[8])
+
+	_, err = store.Stat(context.Background(), "alpha/public/big.bin")
+	assert.NoError(t, err, "Keys are stored under the tenant prefix")
+	_, err = store.Stat(context.Background(), "public/big.bin")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+	other, _ := store.Get(context.Background(), "beta/public/a.txt")
+	assert.Equal(t, "other tenant", string(other))
+
+	for i := 0; i <= blob.PageSize; i++ {
+		assert.NoError(t, store.Put(context.Background(), fmt.Sprintf("alpha/public/p/%04d", i), nil))
+	}
+	listCtx := withInvocation(context.Background(), inv)
+	page, err := r.listBlobs(listCtx, "public/p/", "")
+	assert.NoError(t, err)
+	assert.Len(t, page.Objects, blob.PageSize)
+	assert.Equal(t, "public/p/0999", page.NextCursor, "Cursors hide the tenant prefix")
+
+	page, err = r.listBlobs(listCtx, "public/p/", page.NextCursor)
+	assert.NoError(t, err)
+	if assert.Len(t, page.Objects, 1) {
+		assert.Equal(t, "public/p/1000", page.Objects[0].Key)
+	}
+	assert.Empty(t, page.NextCursor)
+
+	_, err = r.listBlobs(listCtx, "public/p/", "secret/a.txt")
+	assert.ErrorIs(t, err, errBlobCursor, "Cursors cannot leave the listed prefix")
+}
+
+func TestStorage_Providers(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main; func main() {}`, "noop.wasm")
+
+	ports := map[string]int{StorageFS: 4237, StorageMem: 4238, StorageJetStream: 4239}
+	for driver, port := range ports {
+		t.Run(driver, func(t *testing.T) {
+			r := &Gojinn{
+				Path:          wasmPath,
+				PoolSize:      1,
+				NatsPort:      port,
+				DataDir:       t.TempDir(),
+				StorageConfig: &StorageConfig{Driver: driver},
+			}
+			ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+			if !assert.NoError(t, r.Provision(ctx)) {
+				return
+			}
+			defer func() { _ = r.Cleanup() }()
+
+			bg := context.Background()
+			for _, key := range []string{"acme/b.txt", "acme/a.txt", "acme/docs/c.txt", "other/d.txt"} {
+				assert.NoError(t, r.Storage.Put(bg, key, []byte(key)))
+			}
+			assert.NoError(t, r.Storage.Put(bg, "acme/a.txt", []byte("overwritten")))
+
+			data, err := r.Storage.Get(bg, "acme/a.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "overwritten", string(data))
+
+			info, err := r.Storage.Stat(bg, "acme/docs/c.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len("acme/docs/c.txt")), info.Size)
+
+			page, err := r.Storage.List(bg, "acme/", "")
+			assert.NoError(t, err)
+			var keys []string
+			for _, obj := range page.Objects {
+				keys = append(keys, obj.Key)
+			}
+			assert.Equal(t, []string{"acme/a.txt", "acme/b.txt", "acme/docs/c.txt"}, keys)
+
+			page, err = r.Storage.List(bg, "acme/", "acme/b.txt")
+			assert.NoError(t, err)
+			assert.Len(t, page.Objects, 1, "The cursor resumes after the last key")
+
+			assert.NoError(t, r.Storage.Delete(bg, "acme/a.txt"))
+			assert.NoError(t, r.Storage.Delete(bg, "acme/a.txt"), "Deleting a missing key is not an error")
+			_, err = r.Storage.Get(bg, "acme/a.txt")
+			assert.ErrorIs(t, err, blob.ErrNotFound)
+
+			large := bytes.Repeat([]byte("0123456789"), 300_000)
+			assert.NoError(t, r.Storage.PutStream(bg, "acme/large.bin", bytes.NewReader(large), int64(len(large))))
+			body, err := r.Storage.GetStream(bg, "acme/large.bin")
+			if assert.NoError(t, err) {
+				streamed, _ := io.ReadAll(body)
+				_ = body.Close()
+				assert.Equal(t, large, streamed)
+			}
+
+			failing := io.MultiReader(bytes.NewReader(large[:1024]), iotest.ErrReader(errors.New("client went away")))
+			assert.Error(t, r.Storage.PutStream(bg, "acme/partial.bin", failing, -1))
+			_, err = r.Storage.Stat(bg, "acme/partial.bin")
+			assert.ErrorIs(t, err, blob.ErrNotFound, "A failed stream must not leave a partial object")
+
+			_, err = r.Storage.PresignGet(bg, "acme/large.bin", time.Minute)
+			assert.ErrorIs(t, err, blob.ErrPresignUnsupported)
+		})
+	}
+
+	root := t.TempDir()
+	store, err := fs.New(root)
+	assert.NoError(t, err)
+	assert.Error(t, store.Put(context.Background(), "../escape.txt", []byte("x")))
+	assert.NoError(t, store.Put(context.Background(), "k", []byte("x")))
+	staged, _ := os.ReadDir(filepath.Join(root, ".staging"))
+	assert.Empty(t, staged, "Atomic writes leave no temporary files behind")
+}
+
+func TestJobStatus_LongPollReturnsResult(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import "os"
+
+func main() {
+	os.Stdout.Write([]byte("done"))
+}`, "job.wasm")
+
+	r := &Gojinn{
+		Path:               wasmPath,
+		NatsPort:           4228,
+		DataDir:            t.TempDir(),
+		JobResultMaxOutput: "2B",
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest("POST", "/work", strings.NewReader("{}"))
+	req.Header.Set("X-Gojinn-Async", "true")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, r.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	var queued struct {
+		JobID     uint64 `json:"job_id"`
+		StatusURL string `json:"status_url"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued))
+	assert.NotZero(t, queued.JobID)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, r.ServeHTTP(rec, httptest.NewRequest("GET", queued.StatusURL+"?wait=10s", nil), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var job JobRecord
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, jobStatusSucceeded, job.Status)
+	assert.Equal(t, uint64(1), job.Attempts)
+	assert.Equal(t, "do", job.Output)
+	assert.Equal(t, 4, job.OutputBytes)
+	assert.True(t, job.OutputTruncated)
+	assert.NotNil(t, job.FinishedAt)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, r.ServeHTTP(rec, httptest.NewRequest("GET", "/_sys/tenants/someone_else/jobs/1", nil), nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Other tenants need an admin key")
+}
+
+func TestJobCallback_SignedDelivery(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import "os"
+
+func main() {
+	os.Stdout.Write([]byte("ok"))
+}`, "callback.wasm")
+
+	delivered := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodies <- body
+		delivered <- req
+	}))
+	defer receiver.Close()
+
+	r := &Gojinn{
+		Path:         wasmPath,
+		NatsPort:     4229,
+		DataDir:      t.TempDir(),
+		APIKeys:      []string{"sk_cb_tenant"},
+		AllowedHosts: []string{"127.0.0.1"},
+		Egress:       EgressPolicy{AllowPrivate: true},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest("POST", "/work", strings.NewReader("{}"))
+	req.Header.Set("X-Gojinn-Async", "true")
+	req.Header.Set("X-Gojinn-Callback-URL", "http://evil.example.com/hook")
+	req.Header.Set("X-API-Key", "sk_cb_tenant")
+	assert.Error(t, r.ServeHTTP(httptest.NewRecorder(), req, nil), "Callbacks outside allow_host must be rejected")
+
+	req = httptest.NewRequest("POST", "/work", strings.NewReader("{}"))
+	req.Header.Set("X-Gojinn-Async", "true")
+	req.Header.Set("X-Gojinn-Callback-URL", receiver.URL+"/hook")
+	req.Header.Set("X-Gojinn-Callback-Secret", "s3cr3t")
+	req.Header.Set("X-API-Key", "sk_cb_tenant")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, r.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	select {
+	case got := <-delivered:
+		body := <-bodies
+		timestamp := got.Header.Get("X-Gojinn-Timestamp")
+		assert.Equal(t, "sha256="+signCallback("s3cr3t", timestamp, body), got.Header.Get("X-Gojinn-Signature"))
+		assert.Equal(t, jobStatusSucceeded, got.Header.Get("X-Gojinn-Job-Status"))
+
+		var job JobRecord
+		assert.NoError(t, json.Unmarshal(body, &job))
+		assert.Equal(t, "ok", job.Output)
+		assert.NotContains(t, string(body), "sk_cb_tenant", "API keys never reach callback receivers")
+		assert.Equal(t, r.tenantLabel("sk_cb_tenant"), job.Tenant)
+		assert.Equal(t, job.Tenant, got.Header.Get("X-Gojinn-Tenant"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("callback was not delivered")
+	}
+
+	sealed, err := r.sealCallbackSecret("s3cr3t")
+	assert.NoError(t, err)
+	opened, err := r.openCallbackSecret(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", opened)
+
+	blocked := &Gojinn{}
+	blocked.egressTransport = blocked.newEgressTransport()
+	assert.ErrorIs(t, blocked.validateCallbackURL("http://169.254.169.254/latest/meta-data"), errEgressPrivate)
+	retry, err := blocked.deliverCallback(callbackDelivery{
+		URL: "http://localhost:" + strings.Split(receiver.URL, ":")[2] + "/hook",
+		Job: &JobRecord{ID: 1},
+	})
+	assert.ErrorIs(t, err, errEgressPrivate, "Names resolving to private addresses are refused at dial time")
+	assert.False(t, retry)
+}
+
+func TestEgressAllowed_ExactAndSuffix(t *testing.T) {
+	r := &Gojinn{AllowedHosts: []string{"api.stripe.com", "*.githubusercontent.com", ".example.org"}}
+	assert.True(t, r.egressAllowed("api.stripe.com"))
+	assert.True(t, r.egressAllowed("API.Stripe.com."))
+	assert.False(t, r.egressAllowed("api.stripe.com.evil.io"), "Entries are not substrings")
+	assert.False(t, r.egressAllowed("evilapi.stripe.com"))
+	assert.True(t, r.egressAllowed("raw.githubusercontent.com"))
+	assert.False(t, r.egressAllowed("githubusercontent.com"), "Wildcards only match subdomains")
+	assert.True(t, r.egressAllowed("a.b.example.org"))
+	assert.False(t, r.egressAllowed("notexample.org"))
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00::1", "fe80::1", "::ffff:10.0.0.1"} {
+		assert.True(t, privateAddr(netip.MustParseAddr(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "1.1.1.1", "2606:4700::1111"} {
+		assert.False(t, privateAddr(netip.MustParseAddr(ip)), ip)
+	}
+}
+
+func TestHostHTTPFetch_EgressPolicy(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_http_fetch
+func host_http_fetch(reqPtr, reqLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_http_response
+func host_http_response(outPtr, outMaxLen uint32) uint32
+
+func ptr(b []byte) uint32 { return uint32(uintptr(unsafe.Pointer(&b[0]))) }
+
+func main() {
+	req, _ := io.ReadAll(os.Stdin)
+	buf := make([]byte, 128)
+	n := host_http_fetch(ptr(req), uint32(len(req)), ptr(buf), 128)
+	if n > 128 && n != 0xFFFFFFFF {
+		buf = make([]byte, n)
+		n = host_http_response(ptr(buf), n)
+	}
+	os.Stdout.Write(buf[:n])
+}`, "fetch.wasm")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/large":
+			_, _ = w.Write(bytes.Repeat([]byte("x"), 4096))
+		default:
+			body, _ := io.ReadAll(req.Body)
+			w.Header().Set("X-Echo", req.Header.Get("X-Token"))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(append([]byte(req.Method+":"), body...))
+		}
+	}))
+	defer upstream.Close()
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4240,
+		DataDir:  t.TempDir(),
+		Egress:   EgressPolicy{MaxResponse: "1KB"},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	tenant := "acme"
+	fetch := func(req string) egressResponse {
+		inv := r.newInvocation(tenant, nil, r.functionFor(wasmPath))
+		out, err := r.runSyncJob(withInvocation(context.Background(), inv), r.functionFor(wasmPath), req)
+		assert.NoError(t, err)
+		var resp egressResponse
+		assert.NoError(t, json.Unmarshal([]byte(out), &resp), out)
+		return resp
+	}
+
+	resp := fetch(`{"url": "` + upstream.URL + `/echo"}`)
+	assert.Contains(t, resp.Error, "private address", "Private destinations are blocked by default")
+
+	r.Egress.AllowPrivate = true
+	r.egressTransport = r.newEgressTransport()
+
+	body := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("payload ", 20)))
+	resp = fetch(`{"method": "post", "url": "` + upstream.URL + `/echo", "headers": {"X-Token": "t1"}, "body": "` + body + `"}`)
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, http.StatusCreated, resp.Status)
+	assert.Equal(t, "t1", resp.Headers["X-Echo"][0])
+	assert.Equal(t, "POST:"+strings.Repeat("payload ", 20), string(resp.Body), "Responses larger than the guest buffer are collected with host_http_response")
+
+	resp = fetch(`{"url": "` + upstream.URL + `/large"}`)
+	assert.Contains(t, resp.Error, "max_response")
+
+	resp = fetch(`{"url": "` + upstream.URL + `/slow", "timeout_ms": 50}`)
+	assert.Contains(t, resp.Error, "deadline exceeded")
+
+	tenant = "metered"
+	r.tenants.Store(tenant, &TenantConfig{Daily: &TenantQuota{EgressBytes: 100}})
+	post := func(payload string) egressResponse {
+		body := base64.StdEncoding.EncodeToString([]byte(payload))
+		return fetch(`{"method": "post", "url": "` + upstream.URL + `/echo", "body": "` + body + `"}`)
+	}
+	resp = post(strings.Repeat("u", 160))
+	assert.Contains(t, resp.Error, "egress quota", "Request bodies count against egress_bytes")
+	resp = post("ping")
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, "POST:ping", string(resp.Body))
+	resp = post(strings.Repeat("u", 80))
+	assert.Contains(t, resp.Error, "egress quota", "13 bytes were used, so an 80 byte body leaves no room for its echo")
+	assert.Equal(t, 2.0, testutil.ToFloat64(r.metrics.egressRequests.WithLabelValues("metered", EgressQuota)))
+	tenant = "acme"
+
+	r.AllowedHosts = []string{"api.example.com"}
+	resp = fetch(`{"url": "` + upstream.URL + `/echo"}`)
+	assert.Contains(t, resp.Error, "egress denied to 127.0.0.1")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(r.metrics.egressRequests.WithLabelValues("acme", EgressDenied)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.egressRequests.WithLabelValues("acme", EgressTimeout)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.egressRequests.WithLabelValues("acme", EgressOK)))
+
+	r.APIKeys = []string{"sk_live_4f9a"}
+	tenant = "sk_live_4f9a"
+	fetch(`{"url": "` + upstream.URL + `/echo"}`)
+	label := r.tenantLabel(tenant)
+	assert.NotContains(t, label, "sk_live", "Raw API keys never appear in metric labels")
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.egressRequests.WithLabelValues(label, EgressDenied)))
+}
+
+func TestCallbackBackoff_Capped(t *testing.T) {
+	assert.Equal(t, time.Second, callbackBackoff(1))
+	assert.Equal(t, 8*time.Second, callbackBackoff(4))
+	assert.Equal(t, callbackMaxBackoff, callbackBackoff(20))
+}
+
+func TestDLQ_ReplayAndPurge(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"io"
+	"os"
+)
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	os.Stdout.Write(in)
+}`, "dlq.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		NatsPort:  4230,
+		DataDir:   t.TempDir(),
+		AdminKeys: []string{"root"},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	tenant := "acme"
+	sealed, err := r.sealCallbackSecret("s3cr3t")
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "s3cr3t")
+	assert.NoError(t, r.ensureDLQStream(tenant))
+	for i := 0; i < 2; i++ {
+		entry, _ := json.Marshal(DeadLetter{
+			JobID:    uint64(100 + i),
+			Tenant:   tenant,
+			WasmFile: wasmPath,
+			Subject:  r.functionTopic(tenant, r.functionFor(wasmPath)),
+			Headers:  nats.Header{"X-Trace": []string{"abc"}, headerCallbackSecret: []string{sealed}},
+			Payload:  []byte(`{"fixed":true}`),
+			Error:    "boom",
+			Attempts: 5,
+		})
+		_, err := r.js.Publish(tenantDLQSubject(tenant), entry)
+		assert.NoError(t, err)
+	}
+
+	base := "/_sys/tenants/" + tenant + "/dlq"
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", "root")
+		assert.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, r.ServeHTTP(rec, httptest.NewRequest("DELETE", base, nil), nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Without api_keys, other tenants' dead letters need an admin key")
+
+	var list struct {
+		Items []deadLetterSummary `json:"items"`
+	}
+	rec = do("GET", base)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Items, 2)
+	assert.Equal(t, "boom", list.Items[0].Error)
+
+	var entry DeadLetter
+	rec = do("GET", fmt.Sprintf("%s/%d", base, list.Items[0].Sequence))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entry))
+	assert.Equal(t, "abc", entry.Headers.Get("X-Trace"))
+	assert.Empty(t, entry.Headers.Get(headerCallbackSecret), "Callback secrets are not exposed by the DLQ API")
+
+	var replayed struct {
+		JobID uint64 `json:"job_id"`
+	}
+	rec = do("POST", fmt.Sprintf("%s/%d/replay", base, list.Items[0].Sequence))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &replayed))
+
+	rec = do("GET", fmt.Sprintf("/_sys/tenants/%s/jobs/%d?wait=10s", tenant, replayed.JobID))
+	var job JobRecord
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, jobStatusSucceeded, job.Status)
+	assert.Equal(t, `{"fixed":true}`, job.Output)
+
+	rec = do("GET", base)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Items, 1, "Replayed entries leave the DLQ")
+
+	assert.Equal(t, http.StatusOK, do("DELETE", base).Code)
+	rec = do("GET", base)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Empty(t, list.Items)
+}
+
+func TestCron_TickFiredByEveryNodeRunsOnce(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+import ("os"; "time")
+func main() { time.Sleep(300 * time.Millisecond); os.Stdout.Write([]byte("tick")) }`, "cron.wasm")
+
+	yearly := "0 0 0 1 1 *"
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4247,
+		DataDir:  t.TempDir(),
+		CronJobs: []CronJob{
+			{Name: "replace", Schedule: yearly, WasmFile: wasmPath, Overlap: CronOverlapReplace},
+			{Name: "skip", Schedule: yearly, WasmFile: wasmPath, Overlap: CronOverlapSkip},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	kv, err := r.EnsureTenantResources(defaultJobTenant)
+	assert.NoError(t, err)
+
+	for _, job := range r.CronJobs {
+		// Two nodes firing the same tick share its run ID, so both calls
+		// must land within one second.
+		time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+		r.runBackgroundJob(job)
+		r.runBackgroundJob(job)
+
+		run, err := loadCronRun(kv, job.Name)
+		if assert.NoError(t, err) {
+			assert.True(t, run.inFlight(), "%s: the second node must not skip or replace the tick, got %s", job.Name, run.Status)
+		}
+
+		assert.Eventually(t, func() bool {
+			run, err := loadCronRun(kv, job.Name)
+			return err == nil && run.Status == cronStatusSucceeded
+		}, 10*time.Second, 50*time.Millisecond, "%s: the tick must run instead of overlapping itself", job.Name)
+
+		entry, err := kv.Get(cronHistoryKey(job.Name))
+		if assert.NoError(t, err) {
+			var history []CronRun
+			assert.NoError(t, json.Unmarshal(entry.Value(), &history))
+			assert.Len(t, history, 1, job.Name)
+		}
+	}
+}
+
+func TestRetryPolicy_Delays(t *testing.T) {
+	linear := RetryPolicy{}
+	assert.Equal(t, 3*time.Second, linear.baseDelay(3), "Zero value keeps the linear 1s steps")
+	assert.Equal(t, MaxRetries, linear.maxAttempts())
+
+	fixed := RetryPolicy{Backoff: BackoffFixed, Delay: caddy.Duration(2 * time.Second)}
+	assert.Equal(t, 2*time.Second, fixed.baseDelay(7))
+
+	exp := RetryPolicy{Backoff: BackoffExponential, Delay: caddy.Duration(time.Second), MaxDelay: caddy.Duration(30 * time.Second), Jitter: 0.5}
+	assert.Equal(t, 8*time.Second, exp.baseDelay(4))
+	assert.Equal(t, 30*time.Second, exp.baseDelay(6))
+	assert.Equal(t, 30*time.Second, exp.baseDelay(200))
+	for i := 0; i < 20; i++ {
+		d := exp.nextDelay(4)
+		assert.True(t, d >= 4*time.Second && d <= 8*time.Second, d.String())
+	}
+}
+
+func TestRetryPolicy_NonRetryableFailureDeadLettersImmediately(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import "os"
+
+func main() {
+	os.Stderr.Write([]byte("bad input"))
+	os.Exit(1)
+}`, "fail.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		NatsPort:  4231,
+		DataDir:   t.TempDir(),
+		CrashPath: t.TempDir(),
+		AdminKeys: []string{"root"},
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     BackoffFixed,
+			Delay:       caddy.Duration(100 * time.Millisecond),
+			RetryOn:     []string{FailureTimeout, FailureTrap},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	pubAck, err := r.runAsyncJob(context.Background(), "acme", wasmPath, "{}", nil, "")
+	assert.NoError(t, err)
+
+	info, err := r.js.ConsumerInfo(tenantStreamName("acme"), fmt.Sprintf("WORKERS_acme_%s", hashString(wasmPath)[:12]))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, info.Config.MaxDeliver)
+	assert.Len(t, info.Config.BackOff, 2)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", fmt.Sprintf("/_sys/tenants/acme/jobs/%d?wait=10s", pubAck.Sequence), nil)
+	req.Header.Set("X-API-Key", "root")
+	assert.NoError(t, r.ServeHTTP(rec, req, nil))
+
+	var job JobRecord
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, jobStatusDead, job.Status)
+	assert.Equal(t, uint64(1), job.Attempts)
+	if assert.Len(t, job.AttemptLog, 1) {
+		assert.Equal(t, FailureFunctionError, job.AttemptLog[0].Class)
+	}
+
+	items, err := r.listDeadLetters("acme", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+}
+
+func TestFunctions_RoutingAndPerFunctionWorkers(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"io"
+	"os"
+)
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	os.Stdout.Write([]byte(os.Getenv("FN") + "|"))
+	os.Stdout.Write(in)
+}`, "fn.wasm")
+
+	wasmBytes, err := os.ReadFile(wasmPath)
+	assert.NoError(t, err)
+	fnDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(fnDir, "orders.wasm"), wasmBytes, 0644))
+
+	r := &Gojinn{
+		NatsPort:     4232,
+		DataDir:      t.TempDir(),
+		CrashPath:    t.TempDir(),
+		Env:          map[string]string{"FN": "inherited"},
+		FunctionsDir: fnDir,
+		Functions: []FunctionSpec{{
+			Name:     "users",
+			WasmFile: wasmPath,
+			Route:    "/users/{id}",
+			Methods:  []string{"GET"},
+			Env:      map[string]string{"FN": "users"},
+			PoolSize: 1,
+		}},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		rw.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	do := func(req *http.Request) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		return rec, r.ServeHTTP(rec, req, next)
+	}
+
+	assert.NotNil(t, r.declaredFunction("users"))
+	assert.NotNil(t, r.declaredFunction(wasmPath))
+	assert.Nil(t, r.declaredFunction("/etc/other.wasm"), "host_enqueue only reaches declared functions")
+	_, loaded := r.implicitFns.Load("/etc/other.wasm")
+	assert.False(t, loaded)
+
+	rec, err := do(httptest.NewRequest("GET", "/users/42", nil))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "users|"), rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"params":{"id":"42"}`)
+
+	_, err = do(httptest.NewRequest("POST", "/users/42", nil))
+	var herr caddyhttp.HandlerError
+	if assert.ErrorAs(t, err, &herr) {
+		assert.Equal(t, http.StatusMethodNotAllowed, herr.StatusCode)
+	}
+
+	rec, err = do(httptest.NewRequest("GET", "/orders/recent", nil))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "inherited|"), rec.Body.String())
+
+	rec, err = do(httptest.NewRequest("GET", "/unrouted", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	idle := r.idleSandboxes()
+	assert.Contains(t, idle, "users")
+	assert.Contains(t, idle, "orders")
+
+	asyncReq := httptest.NewRequest("POST", "/orders", strings.NewReader("{}"))
+	asyncReq.Header.Set("X-Gojinn-Async", "true")
+	rec, err = do(asyncReq)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	var queued struct {
+		JobID    uint64 `json:"job_id"`
+		Tenant   string `json:"tenant"`
+		Function string `json:"function"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued))
+	assert.Equal(t, "orders", queued.Function)
+
+	_, err = r.js.ConsumerInfo(tenantStreamName(queued.Tenant), "WORKERS_"+queued.Tenant+"_orders")
+	assert.NoError(t, err, "Workers should be keyed by function name")
+
+	rec, err = do(httptest.NewRequest("GET", fmt.Sprintf("/_sys/jobs/%d?wait=10s", queued.JobID), nil))
+	assert.NoError(t, err)
+	var job JobRecord
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, jobStatusSucceeded, job.Status)
+	assert.Equal(t, "orders", job.Function)
+	assert.True(t, strings.HasPrefix(job.Output, "inherited|"), job.Output)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(fnDir, "billing.wasm"), wasmBytes, 0644))
+	rec, err = do(httptest.NewRequest("GET", "/billing", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, rec.Code, "New modules are only picked up on reload")
+
+	assert.NoError(t, r.ReloadWorkers())
+	rec, err = do(httptest.NewRequest("GET", "/billing", nil))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "inherited|"), rec.Body.String())
+}
+
+func TestFunctionVersions_CanaryAndRollback(t *testing.T) {
+	v1 := compileTestWasm(t, `package main; import "os"; func main() { os.Stdout.Write([]byte("v1")) }`, "users.wasm")
+	v2 := compileTestWasm(t, `package main; import "os"; func main() { os.Stdout.Write([]byte("v2")) }`, "users.wasm")
+	v2Bytes, err := os.ReadFile(v2)
+	assert.NoError(t, err)
+
+	fnDir := t.TempDir()
+	v1Bytes, err := os.ReadFile(v1)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(fnDir, "users.wasm"), v1Bytes, 0644))
+
+	r := &Gojinn{
+		NatsPort:     4233,
+		DataDir:      t.TempDir(),
+		FunctionsDir: fnDir,
+		PoolSize:     1,
+		APIKeys:      []string{"tenant-key", "admin-key"},
+		AdminKeys:    []string{"admin-key"},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	callAs := func(key, pin string) string {
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.Header.Set("X-API-Key", key)
+		if pin != "" {
+			req.Header.Set(headerFunctionVersion, pin)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec.Body.String()
+	}
+	call := func(pin string) string { return callAs("tenant-key", pin) }
+	send := func(key, method, path string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/_sys/functions/users/"+path, body)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+	manage := func(method, path string, body io.Reader) versionManifest {
+		rec := send("admin-key", method, path, body)
+		assert.Less(t, rec.Code, 300, rec.Body.String())
+		var m versionManifest
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &m))
+		return m
+	}
+
+	assert.Equal(t, "v1", call(""))
+
+	rec := send("tenant-key", "POST", "versions?alias=prod", bytes.NewReader(v2Bytes))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Tenant keys cannot deploy functions shared by every tenant")
+	rec = send("tenant-key", "POST", "rollback", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, http.StatusOK, send("tenant-key", "GET", "versions", nil).Code)
+	assert.Equal(t, "v1", call(""))
+
+	m := manage("POST", "versions?alias=canary&weight=50", bytes.NewReader(v2Bytes))
+	assert.Len(t, m.Versions, 2, "Canary deploy should snapshot the live module as prod")
+	assert.Equal(t, map[string]int{AliasProd: 50, AliasCanary: 50}, m.Weights)
+	assert.FileExists(t, filepath.Join(r.DataDir, "functions", "users", m.version(AliasCanary).Digest+".wasm"))
+
+	assert.Equal(t, "v2", call(AliasCanary))
+	assert.Equal(t, "v1", call(AliasProd))
+
+	seen := map[string]bool{}
+	for i := 0; i < 40; i++ {
+		seen[call("")] = true
+	}
+	assert.True(t, seen["v1"] && seen["v2"], "Traffic should be split between prod and canary")
+
+	m = manage("POST", "rollback", nil)
+	assert.Empty(t, m.Weights)
+	assert.Equal(t, "v1", call(""))
+
+	m = manage("POST", "versions?alias=prod", bytes.NewReader(v2Bytes))
+	assert.Equal(t, "v2", call(""))
+	assert.Len(t, m.ProdHistory, 1)
+
+	m = manage("POST", "rollback", nil)
+	assert.Equal(t, "v1", call(""))
+
+	var v2ID string
+	for _, v := range m.Versions {
+		if v.ID != m.Aliases[AliasProd] {
+			v2ID = v.ID
+		}
+	}
+	assert.NotEmpty(t, v2ID)
+	assert.Equal(t, "v1", call(v2ID), "Tenants cannot pin rolled-back version ids")
+	assert.Equal(t, "v2", callAs("admin-key", v2ID))
+
+	assert.Equal(t, 2, len(manage("GET", "versions", nil).Versions))
+}
+
+func TestHostDBQuery_ParamsAndTransactions(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_db_query
+func host_db_query(qPtr, qLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_db_result
+func host_db_result(outPtr, outMaxLen uint32) uint32
+
+func ptr(b []byte) uint32 { return uint32(uintptr(unsafe.Pointer(&b[0]))) }
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	var calls []string
+	_ = json.Unmarshal(in, &calls)
+	out := make([]json.RawMessage, 0, len(calls))
+	for _, call := range calls {
+		q := []byte(call)
+		buf := make([]byte, 64)
+		n := host_db_query(ptr(q), uint32(len(q)), ptr(buf), 64)
+		if n > 64 && n != 0xFFFFFFFF {
+			buf = make([]byte, n)
+			n = host_db_result(ptr(buf), n)
+		}
+		out = append(out, buf[:n])
+	}
+	res, _ := json.Marshal(out)
+	os.Stdout.Write(res)
+}`, "db.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4241,
+		DataDir:  t.TempDir(),
+		DBDriver: "sqlite",
+		DBDSN:    filepath.Join(t.TempDir(), "app.db"),
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	run := func(calls ...string) []json.RawMessage {
+		in, _ := json.Marshal(calls)
+		inv := r.newInvocation("acme", nil, r.functionFor(wasmPath))
+		out, err := r.runSyncJob(withInvocation(context.Background(), inv), r.functionFor(wasmPath), string(in))
+		assert.NoError(t, err)
+		var results []json.RawMessage
+		assert.NoError(t, json.Unmarshal([]byte(out), &results), out)
+		assert.Len(t, results, len(calls))
+		return results
+	}
+	decode := func(raw json.RawMessage) dbResponse {
+		var resp dbResponse
+		assert.NoError(t, json.Unmarshal(raw, &resp), string(raw))
+		return resp
+	}
+
+	res := run(
+		`{"mode": "exec", "sql": "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT NOT NULL, score REAL)"}`,
+		`{"mode": "exec", "sql": "INSERT INTO notes (body, score) VALUES (?, ?)", "args": ["it's \"quoted\"", 1.5]}`,
+		`{"sql": "SELECT id, body, score FROM notes WHERE id = ?", "args": [1]}`,
+	)
+	insert := decode(res[1])
+	assert.Empty(t, insert.Error)
+	assert.Equal(t, int64(1), insert.RowsAffected)
+	assert.Equal(t, int64(1), insert.LastInsertID)
+
+	rows := decode(res[2])
+	assert.Empty(t, rows.Error)
+	assert.Equal(t, []string{"id", "body", "score"}, []string{rows.Columns[0].Name, rows.Columns[1].Name, rows.Columns[2].Name})
+	assert.Equal(t, "INTEGER", rows.Columns[0].Type)
+	assert.Equal(t, [][]any{{1.0, `it's "quoted"`, 1.5}}, rows.Rows, "Args are bound, so quotes need no escaping")
+
+	res = run(
+		`{"mode": "begin"}`,
+		`{"mode": "exec", "sql": "INSERT INTO notes (body) VALUES (?)", "args": ["rolled back"]}`,
+		`{"mode": "rollback"}`,
+		`{"mode": "begin"}`,
+		`{"mode": "exec", "sql": "INSERT INTO notes (body) VALUES (?)", "args": ["committed"]}`,
+		`{"mode": "commit"}`,
+		`{"mode": "begin"}`,
+		`{"mode": "exec", "sql": "INSERT INTO notes (body) VALUES (?)", "args": ["left open"]}`,
+	)
+	for _, raw := range res {
+		assert.Empty(t, decode(raw).Error)
+	}
+
+	res = run(
+		`{"sql": "SELECT body FROM notes ORDER BY id"}`,
+		`{"sql": "SELECT * FROM missing WHERE name = 'x'"}`,
+		`{"mode": "commit"}`,
+		`SELECT COUNT(*) AS n FROM notes`,
+		`SELECT * FROM "it's missing"`,
+	)
+	assert.Equal(t, [][]any{{`it's "quoted"`}, {"committed"}}, decode(res[0]).Rows, "Transactions left open are rolled back when the module exits")
+	assert.Contains(t, decode(res[1]).Error, "no such table")
+	assert.Equal(t, "no transaction open", decode(res[2]).Error)
+	assert.JSONEq(t, `[{"n": 2}]`, string(res[3]), "Raw SQL keeps the legacy row format")
+
+	var legacy []map[string]string
+	assert.NoError(t, json.Unmarshal(res[4], &legacy), "Legacy errors are valid JSON even with quotes")
+	assert.Contains(t, legacy[0]["error"], "it's missing")
+}
+
+func TestTenantDB_IsolationMigrationsAndQuota(t *testing.T) {
+	migrations := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(migrations, "001_notes.sql"), []byte("CREATE TABLE notes (body TEXT NOT NULL);"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(migrations, "002_seed.sql"), []byte("INSERT INTO notes (body) VALUES ('welcome');"), 0644))
+
+	r := &Gojinn{
+		DataDir:  t.TempDir(),
+		TenantDB: &TenantDBConfig{MaxOpen: 1, Migrations: migrations, MaxSize: "64KB"},
+		logger:   zap.NewNop(),
+	}
+	assert.NoError(t, r.setupTenantDBs())
+	defer r.tenantDBs.close()
+	ctx := context.Background()
+
+	query := func(tenant, mode, sql string, args ...any) *dbResponse {
+		inv := r.newInvocation(tenant, nil, nil)
+		defer inv.finish()
+		resp, err := executeDBRequest(ctx, inv, dbRequest{Mode: mode, SQL: sql, Args: args})
+		if err != nil {
+			return &dbResponse{Error: err.Error()}
+		}
+		return resp
+	}
+
+	assert.Empty(t, query("acme", DBModeExec, "INSERT INTO notes (body) VALUES (?)", "acme only").Error)
+	assert.Equal(t, [][]any{{"welcome"}, {"acme only"}}, query("acme", DBModeQuery, "SELECT body FROM notes").Rows)
+	assert.Equal(t, [][]any{{"welcome"}}, query("globex", DBModeQuery, "SELECT body FROM notes").Rows, "Each tenant gets its own migrated file")
+	assert.FileExists(t, filepath.Join(r.DataDir, "tenants", "acme", "db.sqlite"))
+	assert.Equal(t, 1, r.tenantDBs.lru.Len(), "Idle handles beyond max_open are closed")
+
+	// Reopening after eviction must not re-run migrations.
+	assert.Equal(t, [][]any{{"welcome"}, {"acme only"}}, query("acme", DBModeQuery, "SELECT body FROM notes").Rows)
+
+	resp := query("acme", DBModeExec, "INSERT INTO notes (body) VALUES (?)", strings.Repeat("x", 128*1024))
+	assert.Contains(t, resp.Error, "full", "Writes past max_size are rejected")
+
+	r.tenants.Store("acme", &TenantConfig{ID: "acme", MaxDBSize: "1MB"})
+	assert.Empty(t, query("acme", DBModeExec, "INSERT INTO notes (body) VALUES (?)", strings.Repeat("x", 128*1024)).Error, "max_db_size overrides the default quota")
+
+	assert.Contains(t, query("bad.id", DBModeQuery, "SELECT 1").Error, "invalid tenant id")
+
+	stage := t.TempDir()
+	assert.NoError(t, r.snapshotTenantDBs(stage))
+	assert.FileExists(t, filepath.Join(stage, "acme", "db.sqlite"))
+	assert.FileExists(t, filepath.Join(stage, "globex", "db.sqlite"))
+}
+
+func TestMigrations_ProvisionAndRevert(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, sql string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644))
+	}
+	write("0001_users.up.sql", "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);")
+	write("0001_users.down.sql", "DROP TABLE users;")
+	write("0002_seed.up.sql", "INSERT INTO users (name) VALUES ('ana'); INSERT INTO users (name) VALUES ('bia');")
+	write("0002_seed.down.sql", "DELETE FROM users;")
+
+	r := &Gojinn{
+		DBDriver:   "sqlite3",
+		DBDSN:      filepath.Join(t.TempDir(), "app.db"),
+		Migrations: dir,
+		PoolSize:   1,
+		logger:     zap.NewNop(),
+	}
+	assert.NoError(t, r.setupDB(), "Pending migrations are applied while provisioning")
+	defer r.db.Close()
+
+	var n int
+	assert.NoError(t, r.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n))
+	assert.Equal(t, 2, n)
+
+	m := &migrate.Migrator{DB: r.db, Dialect: migrate.SQLite, Dir: dir}
+	applied, err := m.Up(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, applied, "Applied versions are tracked")
+
+	write("0003_broken.up.sql", "CREATE TABLE audit (id INTEGER); INSERT INTO nowhere VALUES (1);")
+	_, err = m.Up(context.Background(), 0)
+	assert.ErrorContains(t, err, "0003_broken.up.sql")
+	_, err = r.db.Exec("SELECT * FROM audit")
+	assert.Error(t, err, "A failed migration is rolled back as a whole")
+	assert.NoError(t, os.Remove(filepath.Join(dir, "0003_broken.up.sql")))
+
+	reverted, err := m.Down(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0002_seed"}, reverted)
+	assert.NoError(t, r.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n))
+	assert.Equal(t, 0, n)
+
+	states, err := m.Status(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, states, 2)
+	assert.True(t, states[0].Applied)
+	assert.False(t, states[1].Applied)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "0001_users.up.sql")))
+	_, err = migrate.Load(dir)
+	assert.ErrorContains(t, err, "no up file")
+
+	r = &Gojinn{Migrations: dir, logger: zap.NewNop()}
+	assert.ErrorContains(t, r.setupDB(), "require db_driver")
+}
+
+func TestDBReplication_PrimaryAndReplica(t *testing.T) {
+	migrations := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(migrations, "0001_items.up.sql"), []byte("CREATE TABLE items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL);"), 0644))
+
+	primary := &Gojinn{
+		DBDriver:    "sqlite",
+		DBDSN:       filepath.Join(t.TempDir(), "primary.db"),
+		DBSyncToken: "sync-secret",
+		Migrations:  migrations,
+		PoolSize:    2,
+		logger:      zap.NewNop(),
+	}
+	assert.NoError(t, primary.setupDB())
+	defer primary.db.Close()
+
+	ctx := context.Background()
+	exec := func(r *Gojinn, inv *invocation, mode, sql string, args ...any) (*dbResponse, error) {
+		if inv == nil {
+			inv = r.newInvocation("", nil, nil)
+			defer inv.finish()
+		}
+		return executeDBRequest(ctx, inv, dbRequest{Mode: mode, SQL: sql, Args: args})
+	}
+	count := func(r *Gojinn) int {
+		resp, err := exec(r, nil, DBModeQuery, "SELECT name FROM items")
+		if err != nil {
+			return -1
+		}
+		return len(resp.Rows)
+	}
+	names := func(r *Gojinn) []any {
+		resp, err := exec(r, nil, DBModeQuery, "SELECT name FROM items ORDER BY id")
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var out []any
+		for _, row := range resp.Rows {
+			out = append(out, row[0])
+		}
+		return out
+	}
+
+	_, err := exec(primary, nil, DBModeExec, "INSERT INTO items (name) VALUES (?)", "before replica")
+	assert.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = primary.ServeHTTP(w, req, nil)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/_sys/db/snapshot")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Replication endpoints require the sync token")
+
+	replica := &Gojinn{
+		DBDriver:    "libsql",
+		DBDSN:       filepath.Join(t.TempDir(), "replica.db"),
+		DBSyncURL:   srv.URL,
+		DBSyncToken: "sync-secret",
+		PoolSize:    2,
+		logger:      zap.NewNop(),
+	}
+	assert.NoError(t, replica.setupDB())
+	defer func() {
+		replica.dbReplica.close()
+		replica.db.Close()
+	}()
+
+	assert.Eventually(t, func() bool { return count(replica) == 1 }, 5*time.Second, 20*time.Millisecond, "The replica starts from a snapshot")
+
+	_, err = exec(primary, nil, DBModeExec, "INSERT INTO items (name) VALUES (?)", "streamed")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return count(replica) == 2 }, 5*time.Second, 20*time.Millisecond, "Changes are pulled from the primary")
+
+	res, err := exec(replica, nil, DBModeExec, "INSERT INTO items (name) VALUES (?)", "forwarded")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), res.LastInsertID)
+	assert.Equal(t, []any{"before replica", "streamed", "forwarded"}, names(replica), "Forwarded writes are readable right away")
+
+	inv := replica.newInvocation("", nil, nil)
+	_, err = exec(replica, inv, DBModeBegin, "")
+	assert.NoError(t, err)
+	_, err = exec(replica, inv, DBModeExec, "INSERT INTO items (name) VALUES (?)", "batched 1")
+	assert.NoError(t, err)
+	_, err = exec(replica, inv, DBModeExec, "INSERT INTO items (name) VALUES (?)", "batched 2")
+	assert.NoError(t, err)
+	assert.Len(t, names(primary), 3, "Replica transactions are sent on commit")
+	_, err = exec(replica, inv, DBModeCommit, "")
+	assert.NoError(t, err)
+	inv.finish()
+	assert.Equal(t, names(primary), names(replica))
+
+	res, err = exec(primary, nil, DBModeQuery, "INSERT INTO items (name) VALUES (?) RETURNING id", "returned")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{int64(6)}, res.Rows[0])
+	_, err = exec(primary, nil, DBModeQuery, "DELETE FROM items WHERE name = ? RETURNING id", "batched 1")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]any{"before replica", "streamed", "forwarded", "batched 2", "returned"}, names(replica))
+	}, 5*time.Second, 20*time.Millisecond, "Writes sent as queries reach the replicas")
+
+	_, err = exec(replica, nil, DBModeQuery, "DELETE FROM items")
+	assert.Error(t, err, "Functions cannot write to the local copy")
+
+	status := replica.dbReplicationStatus()
+	assert.Equal(t, "replica", status["role"])
+	assert.Equal(t, true, status["primary_reachable"])
+	assert.Equal(t, int64(0), status["lag_entries"])
+	assert.Equal(t, "primary", primary.dbReplicationStatus()["role"])
+
+	srv.CloseClientConnections()
+	srv.Close()
+
+	_, err = exec(replica, nil, DBModeExec, "INSERT INTO items (name) VALUES (?)", "lost")
+	assert.ErrorIs(t, err, errPrimaryUnavailable)
+	assert.Len(t, names(replica), 5, "Reads keep working without the primary")
+	assert.Eventually(t, func() bool { return replica.dbReplicationStatus()["primary_reachable"] == false }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, true, replica.dbReplicationStatus()["read_only"])
+}
+
+func TestMutex_LeasesFencingAndRelease(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_mutex_acquire
+func host_mutex_acquire(kPtr, kLen, ttlMillis, waitMillis uint32) uint64
+
+func main() {
+	key := []byte("job")
+	token := host_mutex_acquire(uint32(uintptr(unsafe.Pointer(&key[0]))), uint32(len(key)), 60000, 0)
+	os.Stdout.Write([]byte(strconv.FormatUint(token, 10)))
+}`, "mutex.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		PoolSize: 1,
+		NatsPort: 4242,
+		DataDir:  t.TempDir(),
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	kv, err := r.EnsureTenantResources("acme")
+	assert.NoError(t, err)
+	a := r.newInvocation("acme", kv, nil)
+	b := r.newInvocation("acme", kv, nil)
+
+	first, err := a.lock(context.Background(), "orders", 200*time.Millisecond, 0)
+	assert.NoError(t, err)
+	assert.NotZero(t, first)
+
+	_, err = b.lock(context.Background(), "orders", time.Second, 0)
+	assert.ErrorIs(t, err, errMutexHeld)
+	assert.ErrorIs(t, b.unlock("orders"), errMutexLost, "Only the owner can unlock")
+
+	again, err := a.lock(context.Background(), "orders", 200*time.Millisecond, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, first, again, "Locking again keeps the fencing token")
+	assert.NoError(t, a.renew("orders", 200*time.Millisecond))
+
+	start := time.Now()
+	second, err := b.lock(context.Background(), "orders", time.Second, 2*time.Second)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond, "The waiter gets the lock once the lease expires")
+	assert.Greater(t, second, first, "Fencing tokens grow with every owner")
+
+	assert.ErrorIs(t, a.renew("orders", time.Second), errMutexLost)
+	assert.ErrorIs(t, a.unlock("orders"), errMutexLost)
+	assert.NoError(t, b.unlock("orders"))
+
+	third, err := a.lock(context.Background(), "orders", time.Second, 0)
+	assert.NoError(t, err)
+	assert.Greater(t, third, second)
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := b.lock(context.Background(), "orders", time.Second, 2*time.Second)
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	a.finish()
+	assert.NoError(t, <-waited, "Ending the invocation releases its locks")
+	b.finish()
+
+	run := func() string {
+		inv := r.newInvocation("acme", kv, r.functionFor(wasmPath))
+		out, err := r.runSyncJob(withInvocation(context.Background(), inv), r.functionFor(wasmPath), "")
+		assert.NoError(t, err)
+		return out
+	}
+	guestFirst, _ := strconv.ParseUint(run(), 10, 64)
+	guestSecond, _ := strconv.ParseUint(run(), 10, 64)
+	assert.NotZero(t, guestFirst)
+	assert.Greater(t, guestSecond, guestFirst, "A guest that never unlocks must not block the next invocation")
+}
+
+func TestHostKV_Operations(t *testing.T) {
+	r := &Gojinn{
+		NatsPort: 4243,
+		DataDir:  t.TempDir(),
+		Perms: Permissions{
+			KVRead:  []string{"*"},
+			KVWrite: []string{"users.", "counter", "session"},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	kv, err := r.EnsureTenantResources("acme")
+	assert.NoError(t, err)
+	invCtx := withInvocation(context.Background(), r.newInvocation("acme", kv, nil))
+	rev := func(n uint64) *uint64 { return &n }
+	do := func(req kvRequest) (*kvResponse, string) {
+		resp, err := r.executeKVRequest(invCtx, req)
+		var kvErr *kvError
+		if errors.As(err, &kvErr) {
+			return nil, kvErr.code
+		}
+		assert.NoError(t, err)
+		return resp, ""
+	}
+
+	put, code := do(kvRequest{Op: KVOpPut, Key: "users.1", Value: "ana", Revision: rev(0)})
+	assert.Empty(t, code)
+	_, code = do(kvRequest{Op: KVOpPut, Key: "users.1", Value: "bia", Revision: rev(0)})
+	assert.Equal(t, kvCodeConflict, code, "Create-only put must fail on an existing key")
+	_, code = do(kvRequest{Op: KVOpPut, Key: "users.1", Value: "bia", Revision: rev(put.Revision + 100)})
+	assert.Equal(t, kvCodeConflict, code)
+	swapped, code := do(kvRequest{Op: KVOpPut, Key: "users.1", Value: "bia", Revision: rev(put.Revision)})
+	assert.Empty(t, code)
+	got, _ := do(kvRequest{Op: KVOpGet, Key: "users.1"})
+	assert.Equal(t, "bia", got.Value)
+	assert.Equal(t, swapped.Revision, got.Revision)
+
+	_, code = do(kvRequest{Op: KVOpPut, Key: "admin", Value: "x"})
+	assert.Equal(t, kvCodeDenied, code)
+
+	for i := 2; i <= 5; i++ {
+		_, code = do(kvRequest{Op: KVOpPut, Key: fmt.Sprintf("users.%d", i), Value: "u"})
+		assert.Empty(t, code)
+	}
+	page, _ := do(kvRequest{Op: KVOpList, Prefix: "users.", Limit: 3})
+	assert.Equal(t, []string{"users.1", "users.2", "users.3"}, page.Keys)
+	page, _ = do(kvRequest{Op: KVOpList, Prefix: "users.", Limit: 3, Cursor: page.Cursor})
+	assert.Equal(t, []string{"users.4", "users.5"}, page.Keys)
+	assert.Empty(t, page.Cursor)
+
+	_, code = do(kvRequest{Op: KVOpDelete, Key: "users.5", Revision: rev(1)})
+	assert.Equal(t, kvCodeConflict, code)
+	_, code = do(kvRequest{Op: KVOpDelete, Key: "users.5"})
+	assert.Empty(t, code)
+	_, code = do(kvRequest{Op: KVOpGet, Key: "users.5"})
+	assert.Equal(t, kvCodeNotFound, code)
+	_, code = do(kvRequest{Op: KVOpPut, Key: "users.5", Value: "back", Revision: rev(0)})
+	assert.Empty(t, code, "A deleted key can be created again")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, code := do(kvRequest{Op: KVOpIncr, Key: "counter", Delta: 2})
+			assert.Empty(t, code)
+		}()
+	}
+	wg.Wait()
+	counter, _ := do(kvRequest{Op: KVOpGet, Key: "counter"})
+	assert.Equal(t, "20", counter.Value)
+
+	_, code = do(kvRequest{Op: KVOpPut, Key: "session", Value: "token", TTLMs: 1000, Revision: rev(0)})
+	assert.Empty(t, code)
+	_, code = do(kvRequest{Op: KVOpPut, Key: "session", Value: "other", TTLMs: 1000, Revision: rev(0)})
+	assert.Equal(t, kvCodeConflict, code)
+	assert.Eventually(t, func() bool {
+		_, code := do(kvRequest{Op: KVOpGet, Key: "session"})
+		return code == kvCodeNotFound
+	}, 5*time.Second, 100*time.Millisecond, "Keys written with a TTL expire")
+
+	head, _ := do(kvRequest{Op: KVOpPut, Key: "users.9", Value: "latest"})
+	watched := make(chan *kvResponse, 1)
+	go func() {
+		resp, _ := do(kvRequest{Op: KVOpWatch, Prefix: "users.", After: head.Revision, TimeoutMs: 5000})
+		watched <- resp
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, _ = do(kvRequest{Op: KVOpPut, Key: "users.2", Value: "changed"})
+	changes := <-watched
+	if assert.Len(t, changes.Events, 1) {
+		assert.Equal(t, "users.2", changes.Events[0].Key)
+		assert.Equal(t, "changed", changes.Events[0].Value)
+		assert.Equal(t, changes.Events[0].Revision, changes.Revision)
+	}
+
+	idle, _ := do(kvRequest{Op: KVOpWatch, Key: "users.1", After: changes.Revision, TimeoutMs: 200})
+	assert.Empty(t, idle.Events, "A watch with nothing new returns empty after its timeout")
+	assert.Equal(t, changes.Revision, idle.Revision)
+}
+
+func TestConsensus_NamespaceBuckets(t *testing.T) {
+	r := &Gojinn{
+		NatsPort: 4244,
+		DataDir:  t.TempDir(),
+		Perms: Permissions{
+			KVRead:  []string{"*"},
+			KVWrite: []string{"*"},
+		},
+		Consensus: []ConsensusPolicy{
+			{Namespace: "pay.", Mode: "cp"},
+			{Namespace: "pay.audit.", Mode: "ap", StaleReads: true},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	assert.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	kv, err := r.EnsureTenantResources("acme")
+	assert.NoError(t, err)
+	invCtx := withInvocation(context.Background(), r.newInvocation("acme", kv, nil))
+	do := func(req kvRequest) (*kvResponse, string) {
+		resp, err := r.executeKVRequest(invCtx, req)
+		var kvErr *kvError
+		if errors.As(err, &kvErr) {
+			return nil, kvErr.code
+		}
+		assert.NoError(t, err)
+		return resp, ""
+	}
+
+	for _, key := range []string{"pay.42", "pay.audit.1", "plain"} {
+		_, code := do(kvRequest{Op: KVOpPut, Key: key, Value: key})
+		assert.Empty(t, code)
+		got, _ := do(kvRequest{Op: KVOpGet, Key: key})
+		assert.Equal(t, key, got.Value)
+	}
+
+	cp, err := r.js.StreamInfo("KV_STATE_ACME_NS_PAY")
+	assert.NoError(t, err)
+	assert.False(t, cp.Config.AllowDirect, "CP namespaces read through the stream leader")
+	ap, err := r.js.StreamInfo("KV_STATE_ACME_NS_PAY_AUDIT")
+	assert.NoError(t, err)
+	assert.True(t, ap.Config.AllowDirect, "AP namespaces with stale reads may read from any replica")
+
+	_, err = kv.Get("pay.42")
+	assert.ErrorIs(t, err, nats.ErrKeyNotFound, "Namespaced keys must not land in the default bucket")
+	entry, err := kv.Get("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(entry.Value()))
+
+	page, code := do(kvRequest{Op: KVOpList, Prefix: "pay."})
+	assert.Empty(t, code)
+	assert.Equal(t, []string{"pay.42"}, page.Keys, "The most specific namespace owns pay.audit.")
+	_, code = do(kvRequest{Op: KVOpList, Prefix: "pa"})
+	assert.Equal(t, kvCodeCrossNamespace, code)
+
+	lost := policyFailure(&r.Consensus[1], nats.ErrTimeout)
+	var kvErr *kvError
+	if assert.ErrorAs(t, lost, &kvErr) {
+		assert.Equal(t, kvCodeNoQuorum, kvErr.code)
+	}
+	assert.ErrorAs(t, policyFailure(&r.Consensus[0], nats.ErrNoResponders), &kvErr)
+	assert.Equal(t, kvCodeUnavailable, kvErr.code)
+	assert.Equal(t, nats.ErrKeyNotFound, policyFailure(&r.Consensus[1], nats.ErrKeyNotFound))
+}
+
+func TestActors_SendGivesUpOnFullMailbox(t *testing.T) {
+	r := &Gojinn{}
+	inst := &actorInstance{mailbox: make(chan *actorMessage)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := r.sendActor(ctx, inst, &actorMessage{input: []byte("x")})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, inst.inflight)
+}
+
+func TestActors_PlacementStateAlarmsAndPassivation(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_actor_state
+func host_actor_state(outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_state
+func host_actor_set_state(ptr, length uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_alarm
+func host_actor_set_alarm(delayMillis uint64) uint32
+
+func main() {
+	input, _ := io.ReadAll(os.Stdin)
+	var req struct {
+		Body  string `+"`json:\"body\"`"+`
+		Actor struct {
+			Alarm bool `+"`json:\"alarm\"`"+`
+		} `+"`json:\"actor\"`"+`
+	}
+	_ = json.Unmarshal(input, &req)
+
+	buf := make([]byte, 64)
+	n := host_actor_state(uint32(uintptr(unsafe.Pointer(&buf[0]))), 64)
+	count := 0
+	if n != 0xFFFFFFFF {
+		count, _ = strconv.Atoi(string(buf[:n]))
+	}
+	switch {
+	case req.Actor.Alarm:
+		count += 100
+	case req.Body == "fail":
+		count = -1
+		defer os.Exit(1)
+	case req.Body == "alarm":
+		host_actor_set_alarm(200)
+	default:
+		count++
+	}
+	state := []byte(strconv.Itoa(count))
+	host_actor_set_state(uint32(uintptr(unsafe.Pointer(&state[0]))), uint32(len(state)))
+	os.Stdout.Write(state)
+}`, "counter.wasm")
+
+	node := func() *Gojinn {
+		r := &Gojinn{
+			Functions: []FunctionSpec{{Name: "counter", WasmFile: wasmPath, PoolSize: 1}},
+			NatsPort:  4245,
+			DataDir:   t.TempDir(),
+			Actors:    &ActorConfig{IdleTimeout: caddy.Duration(500 * time.Millisecond)},
+		}
+		ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+		assert.NoError(t, r.Provision(ctx))
+		return r
+	}
+	a := node()
+	defer func() { _ = a.Cleanup() }()
+	b := node()
+	defer func() { _ = b.Cleanup() }()
+
+	call := func(r *Gojinn, path, body string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		err := r.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		}))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.StatusCode, ""
+		}
+		assert.NoError(t, err)
+		return rec.Code, rec.Body.String()
+	}
+	active := func(r *Gojinn) int {
+		r.actorsMu.Lock()
+		defer r.actorsMu.Unlock()
+		return len(r.actors)
+	}
+
+	code, _ := call(a, "/actors/unknown/x", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call(a, "/actors/counter/bad.id", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	for i := 1; i <= 3; i++ {
+		_, out := call(a, "/actors/counter/c1", "")
+		assert.Equal(t, strconv.Itoa(i), out)
+	}
+	_, out := call(b, "/actors/counter/c1", "")
+	assert.Equal(t, "4", out, "The other node forwards to the live instance")
+	assert.Equal(t, 1, active(a))
+	assert.Equal(t, 0, active(b))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(r *Gojinn) {
+			defer wg.Done()
+			call(r, "/actors/counter/c1", "")
+		}([]*Gojinn{a, b}[i%2])
+	}
+	wg.Wait()
+	_, out = call(a, "/actors/counter/c1", "")
+	assert.Equal(t, "15", out, "Messages are handled one at a time")
+
+	code, _ = call(b, "/actors/counter/c1", "fail")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	_, out = call(b, "/actors/counter/c1", "")
+	assert.Equal(t, "16", out, "A failed message does not checkpoint its state")
+
+	kv, err := a.EnsureTenantResources("192_0_2_1")
+	assert.NoError(t, err)
+	entry, err := kv.Get("actor.counter.c1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "16", string(entry.Value()))
+	}
+
+	_, out = call(a, "/actors/counter/c1", "alarm")
+	assert.Equal(t, "16", out)
+	assert.Eventually(t, func() bool {
+		entry, err := kv.Get("actor.counter.c1")
+		return err == nil && string(entry.Value()) == "116"
+	}, 5*time.Second, 50*time.Millisecond, "The alarm runs the actor once")
+
+	assert.Eventually(t, func() bool {
+		_, err := a.actorsKV.Get(actorRef{Tenant: "192_0_2_1", Type: "counter", ID: "c1"}.leaseKey())
+		return active(a) == 0 && errors.Is(err, nats.ErrKeyNotFound)
+	}, 5*time.Second, 50*time.Millisecond, "Idle actors are passivated and release their placement")
+
+	_, out = call(b, "/actors/counter/c1", "")
+	assert.Equal(t, "117", out, "A reactivated actor resumes from its checkpoint")
+	assert.Equal(t, 1, active(b))
+	assert.Equal(t, 0, active(a))
+
+	code, out = call(a, "/other", "")
+	assert.Equal(t, http.StatusTeapot, code, out)
+}
+
+func TestWebSocket_RoomsAcrossNodes(t *testing.T) {
+	wasmPath := compileTestWasm(t, `package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_ws_upgrade
+func host_ws_upgrade() uint32
+
+//go:wasmimport gojinn host_ws_receive
+func host_ws_receive(outPtr, outMaxLen uint32) uint64
+
+//go:wasmimport gojinn host_ws_send
+func host_ws_send(ptr, length, flags uint32) uint32
+
+//go:wasmimport gojinn host_ws_close
+func host_ws_close(code, reasonPtr, reasonLen uint32) uint32
+
+//go:wasmimport gojinn host_ws_join
+func host_ws_join(roomPtr, roomLen uint32) uint32
+
+//go:wasmimport gojinn host_ws_publish
+func host_ws_publish(roomPtr, roomLen, ptr, length, flags uint32) uint32
+
+func ptr(s string) uint32 { return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))) }
+
+func main() {
+	if host_ws_upgrade() != 1 {
+		fmt.Print(`+"`"+`{"status": 400, "body": "not a websocket"}`+"`"+`)
+		os.Exit(0)
+	}
+	ready := fmt.Sprintf("ready %d %d", host_ws_join(ptr("lobby"), 5), host_ws_join(ptr("secret"), 6))
+	host_ws_send(ptr(ready), uint32(len(ready)), 0)
+
+	buf := make([]byte, 16)
+	for {
+		n := host_ws_receive(uint32(uintptr(unsafe.Pointer(&buf[0]))), uint32(len(buf)))
+		if n == ^uint64(0) {
+			return
+		}
+		size := uint32(n)
+		if size > uint32(len(buf)) {
+			buf = make([]byte, size)
+			continue
+		}
+		msg := string(buf[:size])
+		switch {
+		case n>>32&1 == 1:
+			host_ws_send(ptr(msg), size, 1)
+		case msg == "bye":
+			host_ws_close(4000, ptr("bye"), 3)
+			return
+		default:
+			host_ws_publish(ptr("lobby"), 5, ptr(msg), size, 2)
+		}
+	}
+}`, "chat.wasm")
+
+	node := func(origins ...string) *httptest.Server {
+		r := &Gojinn{
+			Path:      wasmPath,
+			NatsPort:  4246,
+			DataDir:   t.TempDir(),
+			Perms:     Permissions{WSRooms: []string{"lobby"}},
+			WSOrigins: origins,
+		}
+		ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+		assert.NoError(t, r.Provision(ctx))
+		t.Cleanup(func() { _ = r.Cleanup() })
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_ = r.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				return nil
+			}))
+		}))
+	}
+	srvA := node("https://app.example")
+	defer srvA.Close()
+	srvB := node()
+	defer srvB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dial := func(srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+		opts := &websocket.DialOptions{HTTPHeader: http.Header{}}
+		if origin != "" {
+			opts.HTTPHeader.Set("Origin", origin)
+		}
+		return websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/chat", opts)
+	}
+	read := func(c *websocket.Conn) (websocket.MessageType, string) {
+		typ, data, err := c.Read(ctx)
+		assert.NoError(t, err)
+		return typ, string(data)
+	}
+
+	_, resp, err := dial(srvA, "https://evil.example")
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Origins outside ws_origin are rejected")
+	}
+
+	cA, _, err := dial(srvA, "https://app.example")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = cA.CloseNow() }()
+	cB, _, err := dial(srvB, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = cB.CloseNow() }()
+
+	_, msg := read(cA)
+	assert.Equal(t, "ready 0 2", msg, "Rooms outside ws_rooms are denied")
+	_, msg = read(cB)
+	assert.Equal(t, "ready 0 2", msg)
+
+	assert.NoError(t, cA.Write(ctx, websocket.MessageText, []byte("hello from node A to the lobby")))
+	typ, msg := read(cB)
+	assert.Equal(t, websocket.MessageText, typ)
+	assert.Equal(t, "hello from node A to the lobby", msg, "Room messages reach sockets on other nodes")
+
+	assert.NoError(t, cA.Write(ctx, websocket.MessageBinary, []byte{0, 1, 2}))
+	typ, msg = read(cA)
+	assert.Equal(t, websocket.MessageBinary, typ, "The publisher is excluded from its own message")
+	assert.Equal(t, string([]byte{0, 1, 2}), msg)
+
+	assert.NoError(t, cB.Write(ctx, websocket.MessageText, []byte("bye")))
+	_, _, err = cB.Read(ctx)
+	assert.Equal(t, websocket.StatusCode(4000), websocket.CloseStatus(err))
+
+	assert.NoError(t, cA.Close(websocket.StatusNormalClosure, ""))
+}
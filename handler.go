@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -50,12 +51,31 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 				"memory_limit": r.MemoryLimit,
 				"fuel_limit":   r.FuelLimit,
 				"nats_status":  "disconnected",
+				"warm_pool":    r.idleSandboxes(),
 				"topic":        "gojinn.tenant.*.exec.>",
 			}
 
+			var functions []map[string]interface{}
+			for _, fn := range r.servedFunctions() {
+				functions = append(functions, map[string]interface{}{
+					"name":      fn.name(),
+					"route":     fn.spec.Route,
+					"methods":   fn.spec.Methods,
+					"wasm_file": fn.wasmFile(),
+					"pool_size": fn.poolSize(),
+				})
+			}
+			status["functions"] = functions
+
 			if r.natsConn != nil {
 				status["nats_status"] = r.natsConn.Status().String()
 			}
+			if db := r.dbReplicationStatus(); db != nil {
+				status["database"] = db
+			}
+			if r.Actors != nil {
+				status["actors"] = r.actorStatus()
+			}
 
 			rw.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(rw).Encode(status); err != nil {
@@ -64,6 +84,48 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 			return nil
 		}
 
+		if strings.HasPrefix(req.URL.Path, "/_sys/db/") {
+			r.serveDBReplication(rw, req, strings.TrimPrefix(req.URL.Path, "/_sys/db/"))
+			return nil
+		}
+
+		if req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/_sys/jobs/") {
+			r.serveJobStatus(rw, req, "", strings.TrimPrefix(req.URL.Path, "/_sys/jobs/"))
+			return nil
+		}
+
+		if req.URL.Path == "/_sys/dlq" || strings.HasPrefix(req.URL.Path, "/_sys/dlq/") {
+			r.serveDLQ(rw, req, "", strings.TrimPrefix(req.URL.Path, "/_sys/dlq"))
+			return nil
+		}
+
+		if req.URL.Path == "/_sys/tenants" {
+			r.serveTenants(rw, req, "")
+			return nil
+		}
+		if strings.HasPrefix(req.URL.Path, "/_sys/tenants/") {
+			parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/_sys/tenants/"), "/", 3)
+			if req.Method == "GET" && len(parts) == 3 && parts[1] == "jobs" && parts[0] != "" {
+				r.serveJobStatus(rw, req, parts[0], parts[2])
+				return nil
+			}
+			if len(parts) >= 2 && parts[1] == "dlq" && parts[0] != "" {
+				rest := ""
+				if len(parts) == 3 {
+					rest = parts[2]
+				}
+				r.serveDLQ(rw, req, parts[0], rest)
+				return nil
+			}
+			r.serveTenants(rw, req, strings.TrimPrefix(req.URL.Path, "/_sys/tenants/"))
+			return nil
+		}
+
+		if strings.HasPrefix(req.URL.Path, "/_sys/functions/") {
+			r.serveFunctionVersions(rw, req, strings.TrimPrefix(req.URL.Path, "/_sys/functions/"))
+			return nil
+		}
+
 		if req.Method == "POST" && req.URL.Path == "/_sys/patch" {
 			var patch struct {
 				PoolSize int  `json:"pool_size"`
@@ -113,25 +175,52 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 				return nil
 			}
 
-			_ = json.NewEncoder(rw).Encode(map[string]string{
+			resp := map[string]string{
 				"status": "success",
 				"msg":    "Global Snapshot generated successfully",
 				"file":   snapshotPath,
-			})
+			}
+			if r.Storage != nil {
+				key, err := r.uploadSnapshot(req.Context(), snapshotPath)
+				if err != nil {
+					r.logger.Error("Snapshot upload failed", zap.Error(err))
+					resp["upload_error"] = err.Error()
+				} else {
+					resp["key"] = key
+					if url, err := r.Storage.PresignGet(req.Context(), key, time.Hour); err == nil {
+						resp["url"] = url
+					}
+				}
+			}
+			_ = json.NewEncoder(rw).Encode(resp)
 			return nil
 		}
 
 		if req.Method == "POST" && req.URL.Path == "/_sys/restore" {
 			var payload struct {
 				File string `json:"file"`
+				Key  string `json:"key"`
 			}
 			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
 				http.Error(rw, "Invalid JSON payload", 400)
 				return nil
 			}
 
+			if payload.Key != "" {
+				if r.Storage == nil {
+					http.Error(rw, "Blob storage not configured", 400)
+					return nil
+				}
+				file, err := r.downloadSnapshot(req.Context(), payload.Key)
+				if err != nil {
+					http.Error(rw, err.Error(), 400)
+					return nil
+				}
+				payload.File = file
+			}
+
 			if payload.File == "" {
-				http.Error(rw, "Missing 'file' parameter", 400)
+				http.Error(rw, "Missing 'file' or 'key' parameter", 400)
 				return nil
 			}
 
@@ -156,76 +245,93 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 		}
 	}
 
+	if r.Actors != nil && strings.HasPrefix(req.URL.Path, actorsRoute) {
+		return r.serveActor(rw, req)
+	}
+
+	fn, params, routeStatus := r.routeFunction(req)
+	if fn == nil {
+		if routeStatus == http.StatusMethodNotAllowed {
+			return caddyhttp.Error(routeStatus, fmt.Errorf("method %s not allowed", req.Method))
+		}
+		return next.ServeHTTP(rw, req)
+	}
+	fn = r.pickVersion(fn, r.versionPin(fn, req))
+	if fn.version != "" {
+		rw.Header().Set(headerFunctionVersion, fn.version)
+	}
+
 	tenantID, err := r.extractTenantAndHandleMiddleware(rw, req)
 	if err != nil {
 		return err
 	}
 
-	_, err = r.EnsureTenantResources(tenantID)
+	if err := r.checkQuota(tenantID); err != nil {
+		return caddyhttp.Error(http.StatusTooManyRequests, err)
+	}
+
+	tenantKV, err := r.EnsureTenantResources(tenantID)
 	if err != nil {
 		r.logger.Error("Failed to provision tenant resources", zap.Error(err))
 		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("infrastructure failure: %v", err))
 	}
 
-	if r.js != nil {
-		tenantKV, kvErr := r.js.KeyValue("STATE_" + tenantID)
-		if kvErr == nil {
-			r.kv = tenantKV
-		} else {
-			r.logger.Warn("Failed to bind tenant KV store", zap.Error(kvErr))
-		}
-	}
-
 	if r.metrics != nil {
-		r.metrics.active.WithLabelValues(r.Path).Inc()
-		defer r.metrics.active.WithLabelValues(r.Path).Dec()
+		r.metrics.active.WithLabelValues(fn.name()).Inc()
+		defer r.metrics.active.WithLabelValues(fn.name()).Dec()
 	}
 
 	bodyBytes, _ := io.ReadAll(req.Body)
 	req.Body.Close()
 
+	isAsync := req.Header.Get("X-Gojinn-Async") == "true"
+
+	callbackURL := req.Header.Get("X-Gojinn-Callback-URL")
+	callbackSecret := req.Header.Get("X-Gojinn-Callback-Secret")
+	if callbackURL != "" || callbackSecret != "" {
+		if isAsync && callbackURL != "" {
+			if err := r.validateCallbackURL(callbackURL); err != nil {
+				return caddyhttp.Error(http.StatusBadRequest, err)
+			}
+		}
+		req.Header = req.Header.Clone()
+		req.Header.Del("X-Gojinn-Callback-URL")
+		req.Header.Del("X-Gojinn-Callback-Secret")
+	}
+
 	reqPayload := struct {
 		Method  string              `json:"method"`
 		URI     string              `json:"uri"`
 		Headers map[string][]string `json:"headers"`
 		Body    string              `json:"body"`
+		Params  map[string]string   `json:"params,omitempty"`
 	}{
 		Method:  req.Method,
 		URI:     req.RequestURI,
 		Headers: req.Header,
 		Body:    string(bodyBytes),
+		Params:  params,
 	}
 	inputJSON, _ := json.Marshal(reqPayload)
 
-	isAsync := req.Header.Get("X-Gojinn-Async") == "true"
-
 	if !isAsync {
-		stdout, err := r.runSyncJob(req.Context(), r.Path, string(inputJSON))
+		invCtx, httpCtx := withHTTPContext(req.Context(), rw, req)
+		invCtx = withInvocation(invCtx, r.newInvocation(tenantID, tenantKV, fn))
+		stdout, err := r.runSyncJob(invCtx, fn, string(inputJSON))
+		if httpCtx.WSConn != nil || httpCtx.rejected {
+			// The upgrade either hijacked the connection or already
+			// answered the handshake; there is no response left to write.
+			if err != nil {
+				r.logger.Warn("WebSocket function failed", zap.Error(err))
+			}
+			return nil
+		}
 		if err != nil {
 			r.logger.Error("Sync execution failed", zap.Error(err))
 			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
 
-		var sdkResp struct {
-			Status  int                 `json:"status"`
-			Headers map[string][]string `json:"headers"`
-			Body    string              `json:"body"`
-		}
-
-		rw.Header().Set("X-Powered-By", "Gojinn Sovereign Cloud")
-
-		if err := json.Unmarshal([]byte(stdout), &sdkResp); err == nil && sdkResp.Status != 0 {
-			for k, v := range sdkResp.Headers {
-				for _, val := range v {
-					rw.Header().Add(k, val)
-				}
-			}
-			rw.WriteHeader(sdkResp.Status)
-			rw.Write([]byte(sdkResp.Body))
-		} else {
-			rw.WriteHeader(http.StatusOK)
-			rw.Write([]byte(stdout))
-		}
+		r.writeFunctionResponse(rw, stdout)
 		return nil
 	}
 
@@ -233,16 +339,30 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("JetStream not ready"))
 	}
 
-	_ = r.EnsureTenantWorkers(tenantID)
+	_ = r.ensureFunctionWorkers(tenantID, fn)
+
+	topic := r.functionTopic(tenantID, fn)
 
-	topic := r.getFunctionTopic(tenantID)
+	msg := nats.NewMsg(topic)
+	msg.Data = inputJSON
+	if callbackURL != "" {
+		msg.Header.Set(headerCallbackURL, callbackURL)
+		if callbackSecret != "" {
+			sealed, err := r.sealCallbackSecret(callbackSecret)
+			if err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, err)
+			}
+			msg.Header.Set(headerCallbackSecret, sealed)
+		}
+	}
 
-	pubAck, err := r.js.Publish(topic, inputJSON, nats.MsgId(fmt.Sprintf("%d", time.Now().UnixNano())))
+	pubAck, err := r.js.PublishMsg(msg, nats.MsgId(fmt.Sprintf("%d", time.Now().UnixNano())))
 
 	if err != nil {
 		r.logger.Error("Failed to Persist Job (JetStream)", zap.Error(err))
 		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("persistence failed: %v", err))
 	}
+	r.trackQueuedJob(tenantID, fn, pubAck)
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Header().Set("X-Gojinn-Job-ID", fmt.Sprintf("%d", pubAck.Sequence))
@@ -250,16 +370,63 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 	rw.WriteHeader(http.StatusAccepted)
 
 	resp := map[string]interface{}{
-		"status": "queued",
-		"job_id": pubAck.Sequence,
-		"stream": pubAck.Stream,
-		"tenant": tenantID,
-		"msg":    "Job persisted to isolated tenant queue.",
+		"status":     "queued",
+		"job_id":     pubAck.Sequence,
+		"stream":     pubAck.Stream,
+		"tenant":     tenantID,
+		"function":   fn.name(),
+		"version":    fn.version,
+		"status_url": fmt.Sprintf("/_sys/jobs/%d", pubAck.Sequence),
+		"msg":        "Job persisted to isolated tenant queue.",
 	}
 
 	return json.NewEncoder(rw).Encode(resp)
 }
 
+// writeFunctionResponse turns the stdout of a module into the HTTP response.
+// Output that is not an SDK response object is sent as is with status 200.
+func (r *Gojinn) writeFunctionResponse(rw http.ResponseWriter, stdout string) {
+	var sdkResp struct {
+		Status  int                 `json:"status"`
+		Headers map[string][]string `json:"headers"`
+		Body    string              `json:"body"`
+	}
+
+	rw.Header().Set("X-Powered-By", "Gojinn Sovereign Cloud")
+
+	if err := json.Unmarshal([]byte(stdout), &sdkResp); err == nil && sdkResp.Status != 0 {
+		for k, v := range sdkResp.Headers {
+			for _, val := range v {
+				rw.Header().Add(k, val)
+			}
+		}
+		rw.WriteHeader(sdkResp.Status)
+		rw.Write([]byte(sdkResp.Body))
+	} else {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(stdout))
+	}
+}
+
+// resolveSysTenant authenticates a /_sys request like a regular invocation.
+// An explicit tenant in the path is honoured for admin keys, and otherwise
+// only when it is the caller's own tenant. Without API keys that tenant is
+// derived from the client IP, so other tenants need an admin key.
+func (r *Gojinn) resolveSysTenant(rw http.ResponseWriter, req *http.Request, scopedTenant string) (string, bool) {
+	if key := requestAPIKey(req); scopedTenant != "" && key != "" && slices.Contains(r.AdminKeys, key) {
+		return scopedTenant, true
+	}
+	tenantID, err := r.extractTenantAndHandleMiddleware(rw, req)
+	if err != nil {
+		return "", false
+	}
+	if scopedTenant != "" && scopedTenant != tenantID {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return tenantID, true
+}
+
 func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *http.Request) (string, error) {
 	origin := req.Header.Get("Origin")
 	if len(r.CorsOrigins) > 0 && origin != "" {
@@ -273,7 +440,7 @@ func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *h
 		if allowed {
 			rw.Header().Set("Access-Control-Allow-Origin", origin)
 			rw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-			rw.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Gojinn-Debug, traceparent, X-Gojinn-Async")
+			rw.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Gojinn-Debug, traceparent, X-Gojinn-Async, X-Gojinn-Callback-URL, X-Gojinn-Callback-Secret, X-Gojinn-Version")
 			rw.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
 		if req.Method == "OPTIONS" {
@@ -283,13 +450,7 @@ func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *h
 	}
 	tenantID := ""
 	if len(r.APIKeys) > 0 {
-		clientKey := req.Header.Get("X-API-Key")
-		if clientKey == "" {
-			authHeader := req.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				clientKey = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
+		clientKey := requestAPIKey(req)
 		authorized := false
 		for _, k := range r.APIKeys {
 			if clientKey == k {
@@ -316,8 +477,12 @@ func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *h
 		tenantID = strings.ReplaceAll(tenantID, "[", "")
 		tenantID = strings.ReplaceAll(tenantID, "]", "")
 	}
-	if r.RateLimit > 0 {
-		limiter := r.getLimiter(tenantID)
+	rateLimit, rateBurst := r.RateLimit, r.RateBurst
+	if cfg := r.tenantConfig(tenantID); cfg != nil && cfg.RateLimit > 0 {
+		rateLimit, rateBurst = cfg.RateLimit, cfg.RateBurst
+	}
+	if rateLimit > 0 {
+		limiter := r.getLimiter(tenantID, rateLimit, rateBurst)
 		if !limiter.Allow() {
 			rw.WriteHeader(http.StatusTooManyRequests)
 			return "", fmt.Errorf("rate limit exceeded")
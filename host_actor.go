@@ -0,0 +1,67 @@
+package gojinn
+
+import (
+	"context"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// exportActorFunctions exposes the state and alarm of the actor a module is
+// running as. Changes are staged and only checkpointed when the module
+// succeeds. Outside of an actor every call fails.
+func (r *Gojinn) exportActorFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.actor == nil || len(inv.actor.next) == 0 {
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			stack[0] = writeSized(mod, uint32(stack[0]), uint32(stack[1]), inv.actor.next)
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_actor_state").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			//nolint:gosec
+			state, ok := mod.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+			if inv == nil || inv.actor == nil || !ok || len(state) > maxActorState {
+				stack[0] = 0
+				return
+			}
+			inv.actor.next = append([]byte(nil), state...)
+			inv.actor.dirty = true
+			stack[0] = 1
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_actor_set_state").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.actor == nil {
+				stack[0] = 0
+				return
+			}
+			//nolint:gosec
+			at := time.Now().Add(time.Duration(int64(stack[0])) * time.Millisecond)
+			inv.actor.alarmAt, inv.actor.alarmSet = &at, true
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI64}, []api.ValueType{i32}).
+		Export("host_actor_set_alarm").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.actor == nil {
+				stack[0] = 0
+				return
+			}
+			inv.actor.alarmAt, inv.actor.alarmSet = nil, true
+			stack[0] = 1
+		}), []api.ValueType{}, []api.ValueType{i32}).
+		Export("host_actor_cancel_alarm")
+}
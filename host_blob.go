@@ -0,0 +1,434 @@
+package gojinn
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gojinn-io/gojinn/pkg/blob"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+)
+
+const (
+	blobOK     = 0
+	blobFailed = 1
+	blobDenied = 2
+
+	// blobNoData is returned by the calls that normally return a length.
+	blobNoData = 0xFFFFFFFF
+
+	blobModeRead  = 0
+	blobModeWrite = 1
+
+	maxBlobStreams = 16
+	maxBlobChunk   = 1 << 20
+
+	defaultPresignTTL = 15 * time.Minute
+	maxPresignTTL     = 7 * 24 * time.Hour
+)
+
+var (
+	errBlobUnavailable     = errors.New("blob storage not configured")
+	errBlobStreamAbandoned = errors.New("blob stream discarded before close")
+	errBlobCursor          = errors.New("blob list cursor outside the listed prefix")
+)
+
+func s3Read(p Permissions) []string  { return p.S3Read }
+func s3Write(p Permissions) []string { return p.S3Write }
+
+// blobStream is an object opened with host_s3_open. Read streams pull chunks
+// from the provider; write streams pipe chunks into a PutStream running in the
+// background, which only stores the object once the stream is closed.
+type blobStream struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+	done   chan error
+}
+
+// abort discards the stream. A pending write is never stored.
+func (s *blobStream) abort() {
+	if s.reader != nil {
+		_ = s.reader.Close()
+	}
+	if s.writer != nil {
+		_ = s.writer.CloseWithError(errBlobStreamAbandoned)
+	}
+}
+
+// blobAccess resolves the tenant-scoped storage key of a guest key after
+// checking the capability. Guests never see the tenant prefix.
+func (r *Gojinn) blobAccess(ctx context.Context, key string, capability func(Permissions) []string) (string, uint64, error) {
+	inv := invocationFromContext(ctx)
+	if r.Storage == nil || inv == nil {
+		return "", blobFailed, errBlobUnavailable
+	}
+	if !r.permitted(ctx, key, capability) {
+		r.logger.Warn("Security Violation: Module tried to access unauthorized blob key", zap.String("key", key))
+		return "", blobDenied, errors.New("blob access denied")
+	}
+	return inv.blobPrefix + key, blobOK, nil
+}
+
+// writeSized copies data to guest memory when it fits. Otherwise nothing is
+// written and the needed size is returned, so the guest can retry with a
+// larger buffer or switch to a stream.
+func writeSized(mod api.Module, outPtr, outMaxLen uint32, data []byte) uint64 {
+	//nolint:gosec
+	size := uint32(len(data))
+	if size > outMaxLen {
+		return uint64(size)
+	}
+	if !mod.Memory().Write(outPtr, data) {
+		return blobNoData
+	}
+	return uint64(size)
+}
+
+func readString(mod api.Module, ptr, length uint32) (string, bool) {
+	b, ok := mod.Memory().Read(ptr, length)
+	return string(b), ok
+}
+
+func (r *Gojinn) exportBlobFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobFailed
+				return
+			}
+			fullKey, code, err := r.blobAccess(ctx, key, s3Write)
+			if err != nil {
+				stack[0] = code
+				return
+			}
+			//nolint:gosec
+			body, ok := mod.Memory().Read(uint32(stack[2]), uint32(stack[3]))
+			if !ok {
+				stack[0] = blobFailed
+				return
+			}
+			if err := r.Storage.Put(ctx, fullKey, body); err != nil {
+				r.logger.Error("s3 put failed", zap.Error(err))
+				stack[0] = blobFailed
+				return
+			}
+			stack[0] = blobOK
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_put").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			fullKey, _, err := r.blobAccess(ctx, key, s3Read)
+			if err != nil {
+				stack[0] = blobNoData
+				return
+			}
+			data, err := r.Storage.Get(ctx, fullKey)
+			if err != nil {
+				if !errors.Is(err, blob.ErrNotFound) {
+					r.logger.Error("s3 get failed", zap.Error(err))
+				}
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			stack[0] = writeSized(mod, uint32(stack[2]), uint32(stack[3]), data)
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_get").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobFailed
+				return
+			}
+			fullKey, code, err := r.blobAccess(ctx, key, s3Write)
+			if err != nil {
+				stack[0] = code
+				return
+			}
+			if err := r.Storage.Delete(ctx, fullKey); err != nil {
+				r.logger.Error("s3 delete failed", zap.Error(err))
+				stack[0] = blobFailed
+				return
+			}
+			stack[0] = blobOK
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_delete").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			fullKey, _, err := r.blobAccess(ctx, key, s3Read)
+			if err != nil {
+				stack[0] = blobNoData
+				return
+			}
+			info, err := r.Storage.Stat(ctx, fullKey)
+			if err != nil {
+				if !errors.Is(err, blob.ErrNotFound) {
+					r.logger.Error("s3 head failed", zap.Error(err))
+				}
+				stack[0] = blobNoData
+				return
+			}
+			info.Key = key
+			out, _ := json.Marshal(info)
+			//nolint:gosec
+			stack[0] = writeSized(mod, uint32(stack[2]), uint32(stack[3]), out)
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_head").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			prefix, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			cursor, ok := readString(mod, uint32(stack[2]), uint32(stack[3]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			page, err := r.listBlobs(ctx, prefix, cursor)
+			if err != nil {
+				stack[0] = blobNoData
+				return
+			}
+			out, _ := json.Marshal(page)
+			//nolint:gosec
+			stack[0] = writeSized(mod, uint32(stack[4]), uint32(stack[5]), out)
+		}), []api.ValueType{i32, i32, i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_list").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			stream, err := r.openBlobStream(ctx, key, uint32(stack[2])) //nolint:gosec
+			if err != nil {
+				if !errors.Is(err, blob.ErrNotFound) {
+					r.logger.Warn("s3 open failed", zap.String("key", key), zap.Error(err))
+				}
+				stack[0] = blobNoData
+				return
+			}
+			stack[0] = uint64(stream)
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_open").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			handle, outPtr, outMaxLen := uint32(stack[0]), uint32(stack[1]), uint32(stack[2])
+			s := invocationFromContext(ctx).stream(handle)
+			if s == nil || s.reader == nil {
+				stack[0] = blobNoData
+				return
+			}
+			buf := make([]byte, min(outMaxLen, maxBlobChunk))
+			n, err := io.ReadFull(s.reader, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				r.logger.Error("s3 stream read failed", zap.Error(err))
+				stack[0] = blobNoData
+				return
+			}
+			if !mod.Memory().Write(outPtr, buf[:n]) {
+				stack[0] = blobNoData
+				return
+			}
+			stack[0] = uint64(n) //nolint:gosec
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_read").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			handle := uint32(stack[0])
+			s := invocationFromContext(ctx).stream(handle)
+			if s == nil || s.writer == nil {
+				stack[0] = blobFailed
+				return
+			}
+			//nolint:gosec
+			chunk, ok := mod.Memory().Read(uint32(stack[1]), uint32(stack[2]))
+			if !ok {
+				stack[0] = blobFailed
+				return
+			}
+			if _, err := s.writer.Write(chunk); err != nil {
+				r.logger.Error("s3 stream write failed", zap.Error(err))
+				stack[0] = blobFailed
+				return
+			}
+			stack[0] = blobOK
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_write").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			handle := uint32(stack[0])
+			if err := r.closeBlobStream(ctx, handle); err != nil {
+				r.logger.Error("s3 stream close failed", zap.Error(err))
+				stack[0] = blobFailed
+				return
+			}
+			stack[0] = blobOK
+		}), []api.ValueType{i32}, []api.ValueType{i32}).
+		Export("host_s3_close").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			url, err := r.presignBlob(ctx, key, uint32(stack[2]), uint32(stack[3])) //nolint:gosec
+			if err != nil {
+				if !errors.Is(err, blob.ErrPresignUnsupported) {
+					r.logger.Warn("s3 presign failed", zap.String("key", key), zap.Error(err))
+				}
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			stack[0] = writeSized(mod, uint32(stack[4]), uint32(stack[5]), []byte(url))
+		}), []api.ValueType{i32, i32, i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_s3_presign")
+}
+
+// listBlobs returns one page of the tenant's keys under prefix. Keys and
+// cursors are relative to the tenant, so the guest cursor is re-rooted and
+// must stay under the listed prefix.
+func (r *Gojinn) listBlobs(ctx context.Context, prefix, cursor string) (*blob.ListResult, error) {
+	fullPrefix, _, err := r.blobAccess(ctx, prefix, s3Read)
+	if err != nil {
+		return nil, err
+	}
+	tenantPrefix := invocationFromContext(ctx).blobPrefix
+	if cursor != "" {
+		cursor = tenantPrefix + cursor
+		if !strings.HasPrefix(cursor, fullPrefix) {
+			return nil, errBlobCursor
+		}
+	}
+
+	page, err := r.Storage.List(ctx, fullPrefix, cursor)
+	if err != nil {
+		r.logger.Error("s3 list failed", zap.Error(err))
+		return nil, err
+	}
+	for i := range page.Objects {
+		page.Objects[i].Key = strings.TrimPrefix(page.Objects[i].Key, tenantPrefix)
+	}
+	if page.Objects == nil {
+		page.Objects = []blob.ObjectInfo{}
+	}
+	page.NextCursor = strings.TrimPrefix(page.NextCursor, tenantPrefix)
+	return page, nil
+}
+
+// openBlobStream opens key for reading or writing and returns its handle.
+func (r *Gojinn) openBlobStream(ctx context.Context, key string, mode uint32) (uint32, error) {
+	capability := s3Read
+	if mode == blobModeWrite {
+		capability = s3Write
+	} else if mode != blobModeRead {
+		return 0, errors.New("invalid stream mode")
+	}
+	fullKey, _, err := r.blobAccess(ctx, key, capability)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == blobModeRead {
+		reader, err := r.Storage.GetStream(ctx, fullKey)
+		if err != nil {
+			return 0, err
+		}
+		handle, err := invocationFromContext(ctx).addStream(&blobStream{reader: reader})
+		if err != nil {
+			_ = reader.Close()
+		}
+		return handle, err
+	}
+
+	pr, pw := io.Pipe()
+	s := &blobStream{writer: pw, done: make(chan error, 1)}
+	handle, err := invocationFromContext(ctx).addStream(s)
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		err := r.Storage.PutStream(ctx, fullKey, pr, -1)
+		// Unblocks guest writes if the provider gave up before reading everything.
+		_ = pr.CloseWithError(cmp.Or(err, io.ErrClosedPipe))
+		s.done <- err
+	}()
+	return handle, nil
+}
+
+// closeBlobStream releases a handle. Closing a write stream stores the object.
+func (r *Gojinn) closeBlobStream(ctx context.Context, handle uint32) error {
+	inv := invocationFromContext(ctx)
+	s := inv.removeStream(handle)
+	if s == nil {
+		return errors.New("unknown stream handle")
+	}
+	if s.reader != nil {
+		return s.reader.Close()
+	}
+	_ = s.writer.Close()
+	return <-s.done
+}
+
+// presignBlob returns a URL that lets a client download (mode 0) or upload
+// (mode 1) the key without going through the function.
+func (r *Gojinn) presignBlob(ctx context.Context, key string, mode, ttlSeconds uint32) (string, error) {
+	capability := s3Read
+	if mode == blobModeWrite {
+		capability = s3Write
+	} else if mode != blobModeRead {
+		return "", errors.New("invalid presign mode")
+	}
+	fullKey, _, err := r.blobAccess(ctx, key, capability)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttl == 0 {
+		ttl = defaultPresignTTL
+	}
+	ttl = min(ttl, maxPresignTTL)
+
+	if mode == blobModeWrite {
+		return r.Storage.PresignPut(ctx, fullKey, ttl)
+	}
+	return r.Storage.PresignGet(ctx, fullKey, ttl)
+}
@@ -1,14 +1,12 @@
 package gojinn
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
-	"time"
 
-	"github.com/coder/websocket"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"go.uber.org/zap"
@@ -27,7 +25,7 @@ func isAllowed(item string, allowedList []string) bool {
 }
 
 func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) error {
-	_, err := engine.NewHostModuleBuilder("gojinn").
+	builder := engine.NewHostModuleBuilder("gojinn").
 		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
@@ -64,11 +62,29 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 				stack[0] = 0
 				return
 			}
-			query := string(qBytes)
 
-			jsonBytes, err := r.executeQueryToJSON(query)
+			inv := invocationFromContext(ctx)
+			if trimmed := bytes.TrimSpace(qBytes); len(trimmed) > 0 && trimmed[0] == '{' {
+				stack[0] = r.hostDBRequest(ctx, mod, inv, trimmed, outPtr, outMaxLen)
+				return
+			}
+
+			// Raw SQL strings keep the original row-map format.
+			db, err := inv.database(ctx)
+			var jsonBytes []byte
+			if err == nil {
+				run := func(q dbQuerier) (err error) {
+					jsonBytes, err = executeQueryToJSON(ctx, q, string(qBytes))
+					return err
+				}
+				if inv.primary != nil {
+					err = inv.primary.track(ctx, db, dbRequest{SQL: string(qBytes)}, run)
+				} else {
+					err = run(db)
+				}
+			}
 			if err != nil {
-				jsonBytes = []byte(fmt.Sprintf(`[{"error": "%s"}]`, err.Error()))
+				jsonBytes, _ = json.Marshal([]map[string]string{{"error": err.Error()}})
 			}
 
 			//nolint:gosec
@@ -88,6 +104,22 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
 		Export("host_db_query").
 		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.pendingQuery == nil {
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[0]), uint32(stack[1])
+			size := writeSized(mod, outPtr, outMaxLen, inv.pendingQuery)
+			if size <= uint64(outMaxLen) {
+				inv.pendingQuery = nil
+			}
+			stack[0] = size
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_db_result").
+		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
 			keyPtr := uint32(stack[0])
@@ -104,7 +136,7 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			key := string(kBytes)
 
-			if !isAllowed(key, r.Perms.KVWrite) {
+			if !r.permitted(ctx, key, kvWrite) {
 				r.logger.Warn("Security Violation: Module tried to write unauthorized KV key", zap.String("key", key))
 				return
 			}
@@ -115,13 +147,13 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			val := string(vBytes)
 
-			if r.kv == nil {
-				r.logger.Error("KV Store not ready yet")
+			kv, _, err := r.kvFor(ctx, key)
+			if err != nil {
+				r.logger.Error("KV Store not ready yet", zap.Error(err))
 				return
 			}
 
-			_, err := r.kv.PutString(key, val)
-			if err != nil {
+			if _, err := kv.PutString(key, val); err != nil {
 				r.logger.Error("KV Put Failed", zap.String("key", key), zap.Error(err))
 			}
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{}).
@@ -144,18 +176,19 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			key := string(kBytes)
 
-			if !isAllowed(key, r.Perms.KVRead) {
+			if !r.permitted(ctx, key, kvRead) {
 				r.logger.Warn("Security Violation: Module tried to read unauthorized KV key", zap.String("key", key))
 				stack[0] = 0xFFFFFFFFFFFFFFFF
 				return
 			}
 
-			if r.kv == nil {
+			kv, _, err := r.kvFor(ctx, key)
+			if err != nil {
 				stack[0] = 0xFFFFFFFFFFFFFFFF
 				return
 			}
 
-			entry, err := r.kv.Get(key)
+			entry, err := kv.Get(key)
 			if err != nil {
 				stack[0] = 0xFFFFFFFFFFFFFFFF
 				return
@@ -180,176 +213,44 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
-			keyPtr := uint32(stack[0])
-			//nolint:gosec
-			keyLen := uint32(stack[1])
+			filePtr := uint32(stack[0])
 			//nolint:gosec
-			ttlSeconds := uint32(stack[2])
-
-			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
-			if !ok {
-				stack[0] = 0
-				return
-			}
-			lockKey := "mutex_" + string(kBytes)
-
-			if r.kv == nil {
-				r.logger.Error("KV Store not ready for mutex")
-				stack[0] = 0
-				return
-			}
-
-			_, err := r.kv.Create(lockKey, []byte(fmt.Sprintf("%d", time.Now().UnixNano())))
-
-			if err != nil {
-				stack[0] = 0
-				return
-			}
-
-			_ = ttlSeconds
-
-			stack[0] = 1
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_mutex_lock").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			fileLen := uint32(stack[1])
 			//nolint:gosec
-			keyPtr := uint32(stack[0])
+			payloadPtr := uint32(stack[2])
 			//nolint:gosec
-			keyLen := uint32(stack[1])
-
-			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
-			if !ok {
-				stack[0] = 0
-				return
-			}
-			lockKey := "mutex_" + string(kBytes)
-
-			if r.kv == nil {
-				stack[0] = 0
-				return
-			}
-
-			err := r.kv.Delete(lockKey)
-			if err != nil {
-				stack[0] = 0
-				return
-			}
+			payloadLen := uint32(stack[3])
 
-			stack[0] = 1
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_mutex_unlock").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
-			//nolint:gosec
-			keyPtr := uint32(stack[0])
-			//nolint:gosec
-			keyLen := uint32(stack[1])
-			//nolint:gosec
-			bodyPtr := uint32(stack[2])
-			//nolint:gosec
-			bodyLen := uint32(stack[3])
-			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			fBytes, ok := mod.Memory().Read(filePtr, fileLen)
 			if !ok {
 				stack[0] = 1
 				return
 			}
-			key := string(kBytes)
-
-			if r.Storage == nil {
-				r.logger.Error("S3 storage provider not configured")
-				stack[0] = 1
-				return
-			}
+			wasmFile := string(fBytes)
 
-			bBytes, ok := mod.Memory().Read(bodyPtr, bodyLen)
+			pBytes, ok := mod.Memory().Read(payloadPtr, payloadLen)
 			if !ok {
 				stack[0] = 1
 				return
 			}
+			payload := string(pBytes)
 
-			err := r.Storage.Put(ctx, key, bBytes)
-			if err != nil {
-				r.logger.Error("s3 put failed", zap.Error(err))
+			inv := invocationFromContext(ctx)
+			if inv == nil {
+				r.logger.Error("host_enqueue called outside of a tenant invocation")
 				stack[0] = 1
-			} else {
-				stack[0] = 0
-			}
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_s3_put").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
-			//nolint:gosec
-			keyPtr := uint32(stack[0])
-			//nolint:gosec
-			keyLen := uint32(stack[1])
-			//nolint:gosec
-			outPtr := uint32(stack[2])
-			//nolint:gosec
-			outMaxLen := uint32(stack[3])
-
-			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
-			if !ok {
-				stack[0] = 0
-				return
-			}
-			key := string(kBytes)
-
-			if r.Storage == nil {
-				r.logger.Error("S3 storage provider not configured")
-				stack[0] = 0
-				return
-			}
-
-			valBytes, err := r.Storage.Get(ctx, key)
-			if err != nil {
-				r.logger.Error("s3 get failed", zap.Error(err))
-				stack[0] = 0
-				return
-			}
-
-			//nolint:gosec
-			bytesToWrite := uint32(len(valBytes))
-			if bytesToWrite > outMaxLen {
-				bytesToWrite = outMaxLen
-			}
-
-			if !mod.Memory().Write(outPtr, valBytes[:bytesToWrite]) {
-				stack[0] = 0
 				return
 			}
-
-			stack[0] = uint64(bytesToWrite)
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_s3_get").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
-			//nolint:gosec
-			filePtr := uint32(stack[0])
-			//nolint:gosec
-			fileLen := uint32(stack[1])
-			//nolint:gosec
-			payloadPtr := uint32(stack[2])
-			//nolint:gosec
-			payloadLen := uint32(stack[3])
-
-			fBytes, ok := mod.Memory().Read(filePtr, fileLen)
-			if !ok {
+			if r.declaredFunction(wasmFile) == nil {
+				r.logger.Warn("Security Violation: host_enqueue refused an undeclared module", zap.String("file", wasmFile))
 				stack[0] = 1
 				return
 			}
-			wasmFile := string(fBytes)
 
-			pBytes, ok := mod.Memory().Read(payloadPtr, payloadLen)
-			if !ok {
+			if _, err := r.runAsyncJob(ctx, inv.tenantID, wasmFile, payload, nil, ""); err != nil {
 				stack[0] = 1
 				return
 			}
-			payload := string(pBytes)
-
-			go func() {
-				r.runAsyncJob(context.Background(), wasmFile, payload)
-			}()
 
 			r.logger.Info("Job enqueued in background", zap.String("file", wasmFile))
 			stack[0] = 0
@@ -397,139 +298,51 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}).
 		Export("host_ask_ai").
 		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
-			val := ctx.Value(wsContextKey{})
-			if val == nil {
-				r.logger.Error("WS Upgrade called without HTTP context")
-				stack[0] = 0
-				return
-			}
-
-			httpCtx := val.(*HttpContext)
-
-			c, err := websocket.Accept(httpCtx.W, httpCtx.R, &websocket.AcceptOptions{
-				InsecureSkipVerify: true,
-			})
-			if err != nil {
-				r.logger.Error("Failed to accept websocket", zap.Error(err))
-				stack[0] = 0
-				return
-			}
-
-			httpCtx.WSConn = c
-			stack[0] = 1
-		}), []api.ValueType{}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_ws_upgrade").
-		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
-			outPtr := uint32(stack[0])
+			topicPtr := uint32(stack[0])
 			//nolint:gosec
-			outMaxLen := uint32(stack[1])
-
-			val := ctx.Value(wsContextKey{})
-			if val == nil {
-				stack[0] = 0
-				return
-			}
-			httpCtx := val.(*HttpContext)
-			if httpCtx.WSConn == nil {
-				stack[0] = 0
-				return
-			}
-
-			_, msgBytes, err := httpCtx.WSConn.Read(ctx)
-			if err != nil {
-				stack[0] = 0
-				return
-			}
-
+			topicLen := uint32(stack[1])
 			//nolint:gosec
-			bytesToWrite := uint32(len(msgBytes))
-			if bytesToWrite > outMaxLen {
-				bytesToWrite = outMaxLen
-			}
-
-			if !mod.Memory().Write(outPtr, msgBytes[:bytesToWrite]) {
-				stack[0] = 0
-				return
-			}
-
-			stack[0] = uint64(bytesToWrite)
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}).
-		Export("host_ws_read").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			payloadPtr := uint32(stack[2])
 			//nolint:gosec
-			msgPtr := uint32(stack[0])
+			payloadLen := uint32(stack[3])
 			//nolint:gosec
-			msgLen := uint32(stack[1])
+			qos := byte(stack[4])
+			retained := uint32(stack[5]) != 0 //nolint:gosec
 
-			val := ctx.Value(wsContextKey{})
-			if val == nil {
-				return
-			}
-			httpCtx := val.(*HttpContext)
-			if httpCtx.WSConn == nil {
-				return
-			}
-
-			msgBytes, ok := mod.Memory().Read(msgPtr, msgLen)
+			tBytes, ok := mod.Memory().Read(topicPtr, topicLen)
 			if !ok {
+				stack[0] = 1
 				return
 			}
+			topic := string(tBytes)
 
-			err := httpCtx.WSConn.Write(ctx, websocket.MessageText, msgBytes)
-			if err != nil {
-				r.logger.Error("WS Write failed", zap.Error(err))
-			}
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{}).
-		Export("host_ws_write").
-		NewFunctionBuilder().
-		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
-			//nolint:gosec
-			urlPtr := uint32(stack[0])
-			//nolint:gosec
-			urlLen := uint32(stack[1])
-			//nolint:gosec
-			outPtr := uint32(stack[2])
-			//nolint:gosec
-			outMaxLen := uint32(stack[3])
-
-			uBytes, ok := mod.Memory().Read(urlPtr, urlLen)
+			pBytes, ok := mod.Memory().Read(payloadPtr, payloadLen)
 			if !ok {
-				stack[0] = 0
-				return
-			}
-			urlStr := string(uBytes)
-
-			resp, err := http.Get(urlStr)
-			if err != nil {
-				r.logger.Error("Host HTTP Get failed", zap.Error(err))
-				stack[0] = 0
+				stack[0] = 1
 				return
 			}
-			defer resp.Body.Close()
-
-			bodyBytes, _ := io.ReadAll(resp.Body)
 
-			//nolint:gosec
-			bytesToWrite := uint32(len(bodyBytes))
-
-			if bytesToWrite > outMaxLen {
-				bytesToWrite = outMaxLen
-				bodyBytes = bodyBytes[:bytesToWrite]
-			}
-
-			if !mod.Memory().Write(outPtr, bodyBytes) {
-				stack[0] = 0
+			if err := r.publishMQTT(ctx, topic, append([]byte(nil), pBytes...), qos, retained); err != nil {
+				r.logger.Warn("MQTT publish from module failed", zap.String("topic", topic), zap.Error(err))
+				stack[0] = 1
 				return
 			}
-
-			stack[0] = uint64(bytesToWrite)
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}).
-		Export("host_http_get").
-		Instantiate(ctx)
-
+			stack[0] = 0
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_mqtt_publish")
+
+	for _, export := range []func(wazero.HostModuleBuilder) wazero.HostModuleBuilder{
+		r.exportBlobFunctions,
+		r.exportHTTPFunctions,
+		r.exportMutexFunctions,
+		r.exportKVFunctions,
+		r.exportActorFunctions,
+		r.exportWSFunctions,
+	} {
+		builder = export(builder)
+	}
+	_, err := builder.Instantiate(ctx)
 	return err
 }
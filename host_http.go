@@ -0,0 +1,98 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+)
+
+// fetchInvalid is returned by host_http_fetch when the request cannot be read
+// and by host_http_response when no response is pending.
+const fetchInvalid = 0xFFFFFFFF
+
+func (r *Gojinn) exportHTTPFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			urlStr, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[2]), uint32(stack[3])
+			if !ok {
+				stack[0] = 0
+				return
+			}
+
+			resp, err := r.fetch(ctx, egressRequest{Method: http.MethodGet, URL: urlStr})
+			if err != nil {
+				r.logger.Warn("Host HTTP Get failed", zap.String("url", urlStr), zap.Error(err))
+				stack[0] = 0
+				return
+			}
+
+			body := resp.Body
+			//nolint:gosec
+			if uint32(len(body)) > outMaxLen {
+				body = body[:outMaxLen]
+			}
+			if !mod.Memory().Write(outPtr, body) {
+				stack[0] = 0
+				return
+			}
+			stack[0] = uint64(len(body))
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{api.ValueTypeI64}).
+		Export("host_http_get").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			raw, ok := mod.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[2]), uint32(stack[3])
+			var req egressRequest
+			if !ok || json.Unmarshal(raw, &req) != nil {
+				stack[0] = fetchInvalid
+				return
+			}
+
+			resp, err := r.fetch(ctx, req)
+			if err != nil {
+				r.logger.Warn("Host HTTP Fetch failed", zap.String("url", req.URL), zap.Error(err))
+				resp = &egressResponse{Error: err.Error()}
+			}
+			out, _ := json.Marshal(resp)
+
+			size := writeSized(mod, outPtr, outMaxLen, out)
+			//nolint:gosec
+			if size != blobNoData && size > uint64(outMaxLen) {
+				// Kept for host_http_response, so the guest can collect the
+				// response with a larger buffer without repeating the request.
+				if inv := invocationFromContext(ctx); inv != nil {
+					inv.pendingFetch = out
+				}
+			}
+			stack[0] = size
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_http_fetch").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.pendingFetch == nil {
+				stack[0] = fetchInvalid
+				return
+			}
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[0]), uint32(stack[1])
+			size := writeSized(mod, outPtr, outMaxLen, inv.pendingFetch)
+			if size <= uint64(outMaxLen) {
+				inv.pendingFetch = nil
+			}
+			stack[0] = size
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_http_response")
+}
@@ -0,0 +1,458 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+)
+
+const (
+	KVOpGet    = "get"
+	KVOpPut    = "put"
+	KVOpDelete = "delete"
+	KVOpList   = "list"
+	KVOpIncr   = "incr"
+	KVOpWatch  = "watch"
+
+	defaultKVListLimit = 100
+	maxKVListLimit     = 1000
+	maxKVWatchEvents   = 100
+	maxKVWatchTimeout  = 30 * time.Second
+	kvIncrAttempts     = 16
+)
+
+// Error codes of kvResponse, so guests can tell a lost race from a failure.
+const (
+	kvCodeNotFound    = "not_found"
+	kvCodeConflict    = "conflict"
+	kvCodeDenied      = "denied"
+	kvCodeInvalid     = "invalid"
+	kvCodeUnavailable = "unavailable"
+)
+
+type kvError struct {
+	code string
+	err  error
+}
+
+func (e *kvError) Error() string { return e.err.Error() }
+func (e *kvError) Unwrap() error { return e.err }
+
+func kvErrorf(code, format string, args ...any) error {
+	return &kvError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// kvRequest is the JSON accepted by host_kv_op. Revision is a pointer so that
+// 0 ("the key must not exist") differs from "no condition".
+type kvRequest struct {
+	Op        string  `json:"op"`
+	Key       string  `json:"key,omitempty"`
+	Value     string  `json:"value,omitempty"`
+	Revision  *uint64 `json:"revision,omitempty"`
+	TTLMs     int64   `json:"ttl_ms,omitempty"`
+	Prefix    string  `json:"prefix,omitempty"`
+	Cursor    string  `json:"cursor,omitempty"`
+	Limit     int     `json:"limit,omitempty"`
+	Delta     int64   `json:"delta,omitempty"`
+	After     uint64  `json:"after,omitempty"`
+	TimeoutMs int64   `json:"timeout_ms,omitempty"`
+}
+
+type kvEvent struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+	Op       string `json:"op"`
+}
+
+type kvResponse struct {
+	Value    string    `json:"value,omitempty"`
+	Revision uint64    `json:"revision,omitempty"`
+	Keys     []string  `json:"keys,omitempty"`
+	Cursor   string    `json:"cursor,omitempty"`
+	Events   []kvEvent `json:"events,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Code     string    `json:"code,omitempty"`
+}
+
+// enableKVTTL lets the tenant bucket accept per-key TTLs. Buckets keep one
+// revision per key, so an expired value never uncovers an older one.
+func (g *Gojinn) enableKVTTL(bucket string) {
+	if _, done := g.tenantKVTTL.LoadOrStore(bucket, struct{}{}); done {
+		return
+	}
+	stream := "KV_" + bucket
+	info, err := g.js.StreamInfo(stream)
+	if err != nil || info.Config.AllowMsgTTL {
+		return
+	}
+	cfg := info.Config
+	cfg.AllowMsgTTL = true
+	if _, err := g.js.UpdateStream(&cfg); err != nil {
+		g.logger.Warn("Failed to enable per-key TTL on KV bucket", zap.String("bucket", bucket), zap.Error(err))
+	}
+}
+
+func (r *Gojinn) executeKVRequest(ctx context.Context, req kvRequest) (*kvResponse, error) {
+	if invocationKV(ctx) == nil {
+		return nil, &kvError{code: kvCodeUnavailable, err: errKVUnavailable}
+	}
+
+	switch req.Op {
+	case KVOpGet, KVOpPut, KVOpDelete, KVOpIncr:
+		if req.Key == "" {
+			return nil, kvErrorf(kvCodeInvalid, "%s requires a key", req.Op)
+		}
+		capability := kvWrite
+		if req.Op == KVOpGet {
+			capability = kvRead
+		}
+		if !r.permitted(ctx, req.Key, capability) {
+			r.logger.Warn("Security Violation: Module tried to access unauthorized KV key", zap.String("key", req.Key), zap.String("op", req.Op))
+			return nil, kvErrorf(kvCodeDenied, "access to key %q denied", req.Key)
+		}
+	}
+
+	var kv nats.KeyValue
+	var policy *ConsensusPolicy
+	var err error
+	if req.Op == KVOpList || (req.Op == KVOpWatch && req.Key == "") {
+		kv, policy, err = r.kvForPrefix(ctx, req.Prefix)
+	} else {
+		kv, policy, err = r.kvFor(ctx, req.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.runKVRequest(ctx, kv, req)
+	return resp, policyFailure(policy, err)
+}
+
+func (r *Gojinn) runKVRequest(ctx context.Context, kv nats.KeyValue, req kvRequest) (*kvResponse, error) {
+	switch req.Op {
+	case KVOpGet:
+		entry, err := kv.Get(req.Key)
+		if err != nil {
+			return nil, kvFailure(err)
+		}
+		return &kvResponse{Value: string(entry.Value()), Revision: entry.Revision()}, nil
+	case KVOpPut:
+		rev, err := r.kvPut(kv, req.Key, []byte(req.Value), req.Revision, time.Duration(req.TTLMs)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return &kvResponse{Revision: rev}, nil
+	case KVOpDelete:
+		var opts []nats.DeleteOpt
+		if req.Revision != nil {
+			opts = append(opts, nats.LastRevision(*req.Revision))
+		}
+		if err := kv.Delete(req.Key, opts...); err != nil {
+			return nil, kvFailure(err)
+		}
+		return &kvResponse{}, nil
+	case KVOpIncr:
+		return r.kvIncr(kv, req)
+	case KVOpList:
+		return r.kvList(ctx, kv, req)
+	case KVOpWatch:
+		return r.kvWatch(ctx, kv, req)
+	}
+	return nil, kvErrorf(kvCodeInvalid, "unknown kv op %q", req.Op)
+}
+
+// kvPut writes a value, conditionally on revision when one is given. TTLs go
+// through a direct publish because the KV API has no per-key expiry.
+func (r *Gojinn) kvPut(kv nats.KeyValue, key string, value []byte, revision *uint64, ttl time.Duration) (uint64, error) {
+	if ttl < 0 {
+		return 0, kvErrorf(kvCodeInvalid, "ttl must not be negative")
+	}
+	if ttl == 0 {
+		var rev uint64
+		var err error
+		switch {
+		case revision == nil:
+			rev, err = kv.Put(key, value)
+		case *revision == 0:
+			rev, err = kv.Create(key, value)
+		default:
+			rev, err = kv.Update(key, value, *revision)
+		}
+		if err != nil {
+			return 0, kvFailure(err)
+		}
+		return rev, nil
+	}
+	if ttl < time.Second {
+		return 0, kvErrorf(kvCodeInvalid, "ttl must be at least 1s")
+	}
+	if r.js == nil {
+		return 0, &kvError{code: kvCodeUnavailable, err: errKVUnavailable}
+	}
+
+	subject := "$KV." + kv.Bucket() + "." + key
+	opts := []nats.PubOpt{nats.MsgTTL(ttl)}
+	if revision != nil {
+		expected := *revision
+		if expected == 0 {
+			// Like Create, a key whose last operation was a delete is free.
+			last, err := r.js.GetLastMsg("KV_"+kv.Bucket(), subject)
+			switch {
+			case errors.Is(err, nats.ErrMsgNotFound):
+			case err != nil:
+				return 0, kvFailure(err)
+			case last.Header.Get("KV-Operation") == "":
+				return 0, kvErrorf(kvCodeConflict, "key %q already exists", key)
+			default:
+				expected = last.Sequence
+			}
+		}
+		opts = append(opts, nats.ExpectLastSequencePerSubject(expected))
+	}
+	ack, err := r.js.Publish(subject, value, opts...)
+	if err != nil {
+		return 0, kvFailure(err)
+	}
+	return ack.Sequence, nil
+}
+
+// kvIncr adds delta to an integer value with compare-and-swap, retrying when
+// another writer got there first. A missing key counts as 0.
+func (r *Gojinn) kvIncr(kv nats.KeyValue, req kvRequest) (*kvResponse, error) {
+	delta := req.Delta
+	if delta == 0 {
+		delta = 1
+	}
+	for range kvIncrAttempts {
+		var current int64
+		var revision uint64
+		entry, err := kv.Get(req.Key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return nil, kvFailure(err)
+		default:
+			current, err = strconv.ParseInt(strings.TrimSpace(string(entry.Value())), 10, 64)
+			if err != nil {
+				return nil, kvErrorf(kvCodeInvalid, "value of %q is not an integer", req.Key)
+			}
+			revision = entry.Revision()
+		}
+
+		next := current + delta
+		rev, err := r.kvPut(kv, req.Key, []byte(strconv.FormatInt(next, 10)), &revision, time.Duration(req.TTLMs)*time.Millisecond)
+		var kvErr *kvError
+		if errors.As(err, &kvErr) && kvErr.code == kvCodeConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &kvResponse{Value: strconv.FormatInt(next, 10), Revision: rev}, nil
+	}
+	return nil, kvErrorf(kvCodeConflict, "too much contention on %q", req.Key)
+}
+
+// kvList returns the keys under prefix in lexical order, limit at a time.
+// Cursor is the last key of the previous page.
+func (r *Gojinn) kvList(ctx context.Context, kv nats.KeyValue, req kvRequest) (*kvResponse, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultKVListLimit
+	}
+	limit = min(limit, maxKVListLimit)
+
+	lister, err := kv.ListKeys(nats.Context(ctx))
+	if err != nil {
+		return nil, kvFailure(err)
+	}
+	defer func() { _ = lister.Stop() }()
+
+	var keys []string
+	for key := range lister.Keys() {
+		if !strings.HasPrefix(key, req.Prefix) || key <= req.Cursor || !r.permitted(ctx, key, kvRead) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	resp := &kvResponse{Keys: keys}
+	if len(keys) > limit {
+		resp.Keys = keys[:limit]
+		resp.Cursor = keys[limit-1]
+	}
+	return resp, nil
+}
+
+// kvWatch waits for changes under prefix, or to key, newer than After. It
+// returns as soon as there is at least one change, or empty when the timeout
+// passes. Pass the returned revision as After to resume.
+func (r *Gojinn) kvWatch(ctx context.Context, kv nats.KeyValue, req kvRequest) (*kvResponse, error) {
+	pattern := nats.AllKeys
+	match := func(key string) bool { return strings.HasPrefix(key, req.Prefix) }
+	if req.Key != "" {
+		pattern = req.Key
+		match = func(key string) bool { return key == req.Key }
+	} else if strings.HasSuffix(req.Prefix, ".") {
+		pattern = req.Prefix + nats.AllKeys
+	}
+	if req.Key != "" && !r.permitted(ctx, req.Key, kvRead) {
+		return nil, kvErrorf(kvCodeDenied, "access to key %q denied", req.Key)
+	}
+
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout <= 0 || timeout > maxKVWatchTimeout {
+		timeout = maxKVWatchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	watcher, err := kv.Watch(pattern, nats.Context(ctx))
+	if err != nil {
+		return nil, kvFailure(err)
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	resp := &kvResponse{Revision: req.After}
+	caughtUp := false
+	for {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return resp, nil
+			}
+			if entry == nil {
+				// End of the current values; from here on only new writes arrive.
+				caughtUp = true
+			} else if entry.Revision() > req.After && match(entry.Key()) && r.permitted(ctx, entry.Key(), kvRead) {
+				ev := kvEvent{Key: entry.Key(), Revision: entry.Revision(), Op: "put"}
+				if entry.Operation() == nats.KeyValuePut {
+					ev.Value = string(entry.Value())
+				} else {
+					ev.Op = "delete"
+				}
+				resp.Events = append(resp.Events, ev)
+				resp.Revision = max(resp.Revision, ev.Revision)
+			}
+			if len(resp.Events) >= maxKVWatchEvents || (caughtUp && len(resp.Events) > 0) {
+				return resp, nil
+			}
+		case <-ctx.Done():
+			return resp, nil
+		}
+	}
+}
+
+func kvFailure(err error) error {
+	var apiErr *nats.APIError
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound), errors.Is(err, nats.ErrKeyDeleted):
+		return &kvError{code: kvCodeNotFound, err: err}
+	case errors.Is(err, nats.ErrKeyExists):
+		return &kvError{code: kvCodeConflict, err: err}
+	case errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence:
+		return &kvError{code: kvCodeConflict, err: err}
+	}
+	return err
+}
+
+// hostKVRequest runs a host_kv_op request. Results that do not fit the guest
+// buffer are kept for host_kv_result.
+func (r *Gojinn) hostKVRequest(ctx context.Context, mod api.Module, raw []byte, outPtr, outMaxLen uint32) uint64 {
+	var req kvRequest
+	var resp *kvResponse
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		err = kvErrorf(kvCodeInvalid, "invalid kv request: %v", err)
+	} else {
+		resp, err = r.executeKVRequest(ctx, req)
+	}
+	if err != nil {
+		resp = &kvResponse{Error: err.Error()}
+		var kvErr *kvError
+		if errors.As(err, &kvErr) {
+			resp.Code = kvErr.code
+		}
+	}
+
+	out, _ := json.Marshal(resp)
+	size := writeSized(mod, outPtr, outMaxLen, out)
+	if inv := invocationFromContext(ctx); inv != nil && size > uint64(outMaxLen) && size != blobNoData {
+		inv.pendingKV = out
+	}
+	return size
+}
+
+func (r *Gojinn) exportKVFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				stack[0] = blobFailed
+				return
+			}
+			if !r.permitted(ctx, key, kvWrite) {
+				r.logger.Warn("Security Violation: Module tried to delete unauthorized KV key", zap.String("key", key))
+				stack[0] = blobDenied
+				return
+			}
+			kv, policy, err := r.kvFor(ctx, key)
+			if err == nil {
+				err = policyFailure(policy, kv.Delete(key))
+			}
+			var kvErr *kvError
+			switch {
+			case err == nil:
+				stack[0] = blobOK
+			case errors.As(err, &kvErr) && kvErr.code == kvCodeNoQuorum:
+				stack[0] = kvNoQuorum
+			default:
+				stack[0] = blobFailed
+			}
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_kv_delete").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			raw, ok := mod.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[2]), uint32(stack[3])
+			if !ok {
+				stack[0] = blobNoData
+				return
+			}
+			stack[0] = r.hostKVRequest(ctx, mod, raw, outPtr, outMaxLen)
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_kv_op").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.pendingKV == nil {
+				stack[0] = blobNoData
+				return
+			}
+			//nolint:gosec
+			outPtr, outMaxLen := uint32(stack[0]), uint32(stack[1])
+			size := writeSized(mod, outPtr, outMaxLen, inv.pendingKV)
+			if size <= uint64(outMaxLen) {
+				inv.pendingKV = nil
+			}
+			stack[0] = size
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_kv_result")
+}
@@ -0,0 +1,89 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+)
+
+// exportMutexFunctions exposes leases on the tenant's KV bucket. Locks belong
+// to the invocation that took them and are released when it ends.
+func (r *Gojinn) exportMutexFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+
+	lockFailed := func(key string, err error) {
+		if !errors.Is(err, errMutexHeld) && !errors.Is(err, context.DeadlineExceeded) {
+			r.logger.Warn("Mutex lock failed", zap.String("key", key), zap.Error(err))
+		}
+	}
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			// Non-blocking lock kept for guests built against the first ABI.
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			ttl := time.Duration(uint32(stack[2])) * time.Second
+			if !ok {
+				stack[0] = 0
+				return
+			}
+			if _, err := invocationFromContext(ctx).lock(ctx, key, ttl, 0); err != nil {
+				lockFailed(key, err)
+				stack[0] = 0
+				return
+			}
+			stack[0] = 1
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_mutex_lock").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			ttl := time.Duration(uint32(stack[2])) * time.Millisecond
+			//nolint:gosec
+			wait := time.Duration(uint32(stack[3])) * time.Millisecond
+			if !ok {
+				stack[0] = 0
+				return
+			}
+			token, err := invocationFromContext(ctx).lock(ctx, key, ttl, wait)
+			if err != nil {
+				lockFailed(key, err)
+				stack[0] = 0
+				return
+			}
+			stack[0] = token
+		}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{api.ValueTypeI64}).
+		Export("host_mutex_acquire").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			ttl := time.Duration(uint32(stack[2])) * time.Millisecond
+			if !ok || invocationFromContext(ctx).renew(key, ttl) != nil {
+				stack[0] = 0
+				return
+			}
+			stack[0] = 1
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_mutex_renew").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			key, ok := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			if !ok || invocationFromContext(ctx).unlock(key) != nil {
+				stack[0] = 0
+				return
+			}
+			stack[0] = 1
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_mutex_unlock")
+}
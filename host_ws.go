@@ -0,0 +1,191 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+
+	"github.com/coder/websocket"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+)
+
+func wsStatus(err error) uint64 {
+	switch {
+	case err == nil:
+		return wsOK
+	case errors.Is(err, errWSDenied):
+		return wsDenied
+	default:
+		return wsFailed
+	}
+}
+
+// exportWSFunctions exposes the WebSocket connection of the request a module
+// serves and the cluster-wide rooms built on core NATS subjects.
+func (r *Gojinn) exportWSFunctions(b wazero.HostModuleBuilder) wazero.HostModuleBuilder {
+	i32 := api.ValueTypeI32
+	i64 := api.ValueTypeI64
+
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			if _, err := r.upgradeWS(ctx); err != nil {
+				r.logger.Error("Failed to accept websocket", zap.Error(err))
+				stack[0] = 0
+				return
+			}
+			stack[0] = 1
+		}), []api.ValueType{}, []api.ValueType{i32}).
+		Export("host_ws_upgrade").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			outPtr, outMax := uint32(stack[0]), uint32(stack[1])
+
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.ws == nil {
+				stack[0] = 0
+				return
+			}
+			f, err := inv.ws.receive(ctx, outMax)
+			if err != nil {
+				stack[0] = 0
+				return
+			}
+			// host_ws_read predates host_ws_receive and truncates large frames.
+			inv.ws.mu.Lock()
+			inv.ws.pending = nil
+			inv.ws.mu.Unlock()
+
+			data := f.data
+			//nolint:gosec
+			if uint32(len(data)) > outMax {
+				data = data[:outMax]
+			}
+			if !mod.Memory().Write(outPtr, data) {
+				stack[0] = 0
+				return
+			}
+			stack[0] = uint64(len(data))
+		}), []api.ValueType{i32, i32}, []api.ValueType{i64}).
+		Export("host_ws_read").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.ws == nil {
+				return
+			}
+			//nolint:gosec
+			msg, ok := mod.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+			if !ok {
+				return
+			}
+			if err := inv.ws.send(websocket.MessageText, msg); err != nil {
+				r.logger.Error("WS Write failed", zap.Error(err))
+			}
+		}), []api.ValueType{i32, i32}, []api.ValueType{}).
+		Export("host_ws_write").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			outPtr, outMax := uint32(stack[0]), uint32(stack[1])
+
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.ws == nil {
+				stack[0] = wsClosed
+				return
+			}
+			f, err := inv.ws.receive(ctx, outMax)
+			if err != nil {
+				stack[0] = wsClosed
+				return
+			}
+			var kind uint64
+			if f.typ == websocket.MessageBinary {
+				kind = wsBinaryFrame
+			}
+			//nolint:gosec
+			size := uint32(len(f.data))
+			if size <= outMax && !mod.Memory().Write(outPtr, f.data) {
+				stack[0] = wsClosed
+				return
+			}
+			stack[0] = kind | uint64(size)
+		}), []api.ValueType{i32, i32}, []api.ValueType{i64}).
+		Export("host_ws_receive").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			//nolint:gosec
+			msg, ok := mod.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+			if inv == nil || inv.ws == nil || !ok {
+				stack[0] = 0
+				return
+			}
+			typ := websocket.MessageText
+			if uint32(stack[2])&wsFlagBinary != 0 {
+				typ = websocket.MessageBinary
+			}
+			if err := inv.ws.send(typ, msg); err != nil {
+				r.logger.Debug("WS send failed", zap.Error(err))
+				stack[0] = 0
+				return
+			}
+			stack[0] = 1
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_ws_send").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFromContext(ctx)
+			if inv == nil || inv.ws == nil {
+				stack[0] = 0
+				return
+			}
+			//nolint:gosec
+			code := websocket.StatusCode(uint32(stack[0]))
+			//nolint:gosec
+			reason, _ := readString(mod, uint32(stack[1]), uint32(stack[2]))
+			if err := inv.ws.close(code, reason); err != nil {
+				r.logger.Debug("WS close failed", zap.Error(err))
+			}
+			stack[0] = 1
+		}), []api.ValueType{i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_ws_close").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			room, _ := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			err := r.joinRoom(ctx, room)
+			if err != nil {
+				r.logger.Debug("WS join failed", zap.String("room", room), zap.Error(err))
+			}
+			stack[0] = wsStatus(err)
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_ws_join").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			room, _ := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			stack[0] = wsStatus(r.leaveRoom(ctx, room))
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		Export("host_ws_leave").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			room, _ := readString(mod, uint32(stack[0]), uint32(stack[1]))
+			//nolint:gosec
+			msg, ok := mod.Memory().Read(uint32(stack[2]), uint32(stack[3]))
+			if !ok {
+				stack[0] = wsFailed
+				return
+			}
+			//nolint:gosec
+			err := r.publishRoom(ctx, room, msg, uint32(stack[4]))
+			if err != nil {
+				r.logger.Debug("WS publish failed", zap.String("room", room), zap.Error(err))
+			}
+			stack[0] = wsStatus(err)
+		}), []api.ValueType{i32, i32, i32, i32, i32}, []api.ValueType{i32}).
+		Export("host_ws_publish")
+}
@@ -0,0 +1,185 @@
+package gojinn
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type invocationKey struct{}
+
+// invocation carries the tenant-bound resources of a single module execution.
+// Host functions resolve it from their context instead of reading shared
+// handler state, so concurrent tenants never observe each other's handles.
+type invocation struct {
+	tenantID   string
+	kv         nats.KeyValue
+	db         *sql.DB
+	tx         *sql.Tx
+	tenantDBs  *tenantDBPool
+	primary    *dbPrimary
+	replica    *dbReplica
+	batch      []dbRequest
+	batching   bool
+	ownsDB     bool
+	blobPrefix string
+	perms      Permissions
+	tenant     *TenantConfig
+
+	egressBytes  uint64
+	egressLimit  int64
+	egressLoaded bool
+	pendingFetch []byte
+	pendingQuery []byte
+	pendingKV    []byte
+
+	streamsMu  sync.Mutex
+	streams    map[uint32]*blobStream
+	nextStream uint32
+
+	ownerID string
+	locksMu sync.Mutex
+	locks   map[string]heldLock
+
+	actor *actorInstance
+	ws    *wsSession
+}
+
+func (r *Gojinn) newInvocation(tenantID string, kv nats.KeyValue, fn *function) *invocation {
+	perms := r.Perms
+	if fn != nil {
+		perms = fn.perms()
+	}
+	inv := &invocation{
+		tenantID:   tenantID,
+		kv:         kv,
+		db:         r.db,
+		blobPrefix: tenantID + "/",
+		perms:      perms,
+		tenant:     r.tenantConfig(tenantID),
+	}
+	if r.tenantDBs != nil && tenantID != "" {
+		// Opened lazily by the first database call.
+		inv.db = nil
+		inv.tenantDBs = r.tenantDBs
+	} else {
+		inv.primary = r.dbPrimary
+		inv.replica = r.dbReplica
+	}
+	return inv
+}
+
+// timeout lowers d to the tenant's max_timeout.
+func (inv *invocation) timeout(d time.Duration) time.Duration {
+	if inv != nil && inv.tenant != nil && inv.tenant.MaxTimeout > 0 {
+		return min(d, time.Duration(inv.tenant.MaxTimeout))
+	}
+	return d
+}
+
+func withInvocation(ctx context.Context, inv *invocation) context.Context {
+	return context.WithValue(ctx, invocationKey{}, inv)
+}
+
+func invocationFromContext(ctx context.Context) *invocation {
+	inv, _ := ctx.Value(invocationKey{}).(*invocation)
+	return inv
+}
+
+// invocationPerms returns the permissions of the function being executed,
+// or the handler defaults outside of an invocation.
+func (r *Gojinn) invocationPerms(ctx context.Context) Permissions {
+	if inv := invocationFromContext(ctx); inv != nil {
+		return inv.perms
+	}
+	return r.Perms
+}
+
+// permitted reports whether item passes both the permissions of the running
+// function and the grants of its tenant. capability selects the list to check.
+func (r *Gojinn) permitted(ctx context.Context, item string, capability func(Permissions) []string) bool {
+	if !isAllowed(item, capability(r.invocationPerms(ctx))) {
+		return false
+	}
+	if inv := invocationFromContext(ctx); inv != nil && inv.tenant != nil && inv.tenant.Grants != nil {
+		return isAllowed(item, capability(*inv.tenant.Grants))
+	}
+	return true
+}
+
+func (inv *invocation) addStream(s *blobStream) (uint32, error) {
+	if inv == nil {
+		return 0, errBlobUnavailable
+	}
+	inv.streamsMu.Lock()
+	defer inv.streamsMu.Unlock()
+	if len(inv.streams) >= maxBlobStreams {
+		return 0, errors.New("too many open blob streams")
+	}
+	if inv.streams == nil {
+		inv.streams = make(map[uint32]*blobStream)
+	}
+	inv.nextStream++
+	inv.streams[inv.nextStream] = s
+	return inv.nextStream, nil
+}
+
+func (inv *invocation) stream(handle uint32) *blobStream {
+	if inv == nil {
+		return nil
+	}
+	inv.streamsMu.Lock()
+	defer inv.streamsMu.Unlock()
+	return inv.streams[handle]
+}
+
+func (inv *invocation) removeStream(handle uint32) *blobStream {
+	if inv == nil {
+		return nil
+	}
+	inv.streamsMu.Lock()
+	defer inv.streamsMu.Unlock()
+	s := inv.streams[handle]
+	delete(inv.streams, handle)
+	return s
+}
+
+// finish releases what the module left behind: open streams, held locks, an
+// uncommitted transaction and its tenant database handle.
+func (inv *invocation) finish() {
+	inv.discardStreams()
+	inv.releaseLocks()
+	inv.rollbackTx()
+	inv.releaseDB()
+	inv.closeWS()
+}
+
+// discardStreams drops the streams a module left open. Unclosed writes are
+// never stored.
+func (inv *invocation) discardStreams() {
+	if inv == nil {
+		return
+	}
+	inv.streamsMu.Lock()
+	defer inv.streamsMu.Unlock()
+	for handle, s := range inv.streams {
+		s.abort()
+		delete(inv.streams, handle)
+	}
+}
+
+func kvRead(p Permissions) []string      { return p.KVRead }
+func kvWrite(p Permissions) []string     { return p.KVWrite }
+func mqttPublish(p Permissions) []string { return p.MQTTPublish }
+func wsRooms(p Permissions) []string     { return p.WSRooms }
+
+func invocationKV(ctx context.Context) nats.KeyValue {
+	if inv := invocationFromContext(ctx); inv != nil {
+		return inv.kv
+	}
+	return nil
+}
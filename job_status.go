@@ -0,0 +1,360 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusSucceeded = "succeeded"
+	jobStatusFailed    = "failed"
+	jobStatusDead      = "dead"
+
+	defaultJobResultTTL       = 24 * time.Hour
+	defaultJobResultMaxOutput = "256KB"
+	maxJobWait                = 60 * time.Second
+	maxJobAttemptLog          = 20
+)
+
+// JobRecord is the externally visible state of an async invocation, keyed by
+// the JetStream sequence returned to the caller as job_id.
+type JobRecord struct {
+	ID              uint64       `json:"job_id"`
+	Tenant          string       `json:"tenant"`
+	Function        string       `json:"function,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	WasmFile        string       `json:"wasm_file"`
+	Status          string       `json:"status"`
+	Attempts        uint64       `json:"attempts"`
+	Error           string       `json:"error,omitempty"`
+	AttemptLog      []JobAttempt `json:"attempt_log,omitempty"`
+	Output          string       `json:"output,omitempty"`
+	OutputBytes     int          `json:"output_bytes"`
+	OutputTruncated bool         `json:"output_truncated,omitempty"`
+	QueuedAt        time.Time    `json:"queued_at"`
+	StartedAt       *time.Time   `json:"started_at,omitempty"`
+	FinishedAt      *time.Time   `json:"finished_at,omitempty"`
+	UpdatedAt       time.Time    `json:"updated_at"`
+}
+
+type JobAttempt struct {
+	Attempt uint64    `json:"attempt"`
+	Class   string    `json:"class,omitempty"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+func (j *JobRecord) terminal() bool {
+	return j.Status == jobStatusSucceeded || j.Status == jobStatusDead
+}
+
+func jobKey(id uint64) string {
+	return fmt.Sprintf("job.%d", id)
+}
+
+func tenantJobsBucketName(tenantID string) string {
+	return fmt.Sprintf("JOBS_%s", strings.ToUpper(tenantID))
+}
+
+func (r *Gojinn) jobResultTTL() time.Duration {
+	if r.JobResultTTL > 0 {
+		return time.Duration(r.JobResultTTL)
+	}
+	return defaultJobResultTTL
+}
+
+func (r *Gojinn) jobResultMaxOutput() int {
+	limit := r.JobResultMaxOutput
+	if limit == "" {
+		limit = defaultJobResultMaxOutput
+	}
+	n, err := humanize.ParseBytes(limit)
+	if err != nil {
+		n, _ = humanize.ParseBytes(defaultJobResultMaxOutput)
+	}
+	return int(n)
+}
+
+// jobsKV returns the tenant bucket holding job records. Entries expire with
+// the bucket TTL, so finished results are not kept forever.
+func (r *Gojinn) jobsKV(tenantID string) (nats.KeyValue, error) {
+	if cached, ok := r.jobBuckets.Load(tenantID); ok {
+		return cached.(nats.KeyValue), nil
+	}
+	if r.js == nil {
+		return nil, fmt.Errorf("JetStream not initialized")
+	}
+
+	bucket := tenantJobsBucketName(tenantID)
+	kv, err := r.js.KeyValue(bucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: fmt.Sprintf("Async job results for %s", tenantID),
+			Storage:     nats.FileStorage,
+			History:     1,
+			TTL:         r.jobResultTTL(),
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision tenant jobs bucket: %w", err)
+		}
+	}
+
+	r.jobBuckets.Store(tenantID, kv)
+	return kv, nil
+}
+
+// trackQueuedJob records a freshly published job. A worker may already have
+// picked it up, in which case its record is newer and is left untouched.
+func (r *Gojinn) trackQueuedJob(tenantID string, fn *function, pubAck *nats.PubAck) {
+	if pubAck == nil || pubAck.Duplicate {
+		return
+	}
+	kv, err := r.jobsKV(tenantID)
+	if err != nil {
+		r.logger.Warn("Job status unavailable", zap.String("tenant", tenantID), zap.Error(err))
+		return
+	}
+
+	now := time.Now().UTC()
+	rec := &JobRecord{
+		ID:        pubAck.Sequence,
+		Tenant:    tenantID,
+		Function:  fn.name(),
+		Version:   fn.version,
+		WasmFile:  fn.wasmFile(),
+		Status:    jobStatusQueued,
+		QueuedAt:  now,
+		UpdatedAt: now,
+	}
+	data, _ := json.Marshal(rec)
+	_, _ = kv.Create(jobKey(rec.ID), data)
+}
+
+// updateJob applies fn to the stored record of job id, creating it when the
+// queued entry has not been written yet.
+func (r *Gojinn) updateJob(tenantID string, f *function, id uint64, fn func(*JobRecord)) *JobRecord {
+	kv, err := r.jobsKV(tenantID)
+	if err != nil {
+		r.logger.Warn("Job status unavailable", zap.String("tenant", tenantID), zap.Error(err))
+		return nil
+	}
+
+	rec, err := loadJob(kv, id)
+	if err != nil {
+		now := time.Now().UTC()
+		rec = &JobRecord{ID: id, Tenant: tenantID, Function: f.name(), Version: f.version, WasmFile: f.wasmFile(), QueuedAt: now}
+	}
+	fn(rec)
+	rec.UpdatedAt = time.Now().UTC()
+
+	data, _ := json.Marshal(rec)
+	if _, err := kv.Put(jobKey(id), data); err != nil {
+		r.logger.Warn("Failed to store job status", zap.String("tenant", tenantID), zap.Uint64("job_id", id), zap.Error(err))
+	}
+	return rec
+}
+
+func (r *Gojinn) jobStarted(tenantID string, fn *function, id, attempt uint64) {
+	r.updateJob(tenantID, fn, id, func(rec *JobRecord) {
+		now := time.Now().UTC()
+		rec.Status = jobStatusRunning
+		rec.Attempts = attempt
+		rec.StartedAt = &now
+		rec.FinishedAt = nil
+	})
+}
+
+func (r *Gojinn) jobFailed(tenantID string, fn *function, id, attempt uint64, class, errMsg string) *JobRecord {
+	return r.updateJob(tenantID, fn, id, func(rec *JobRecord) {
+		now := time.Now().UTC()
+		rec.Status = jobStatusFailed
+		rec.Attempts = attempt
+		rec.Error = errMsg
+		rec.AttemptLog = append(rec.AttemptLog, JobAttempt{Attempt: attempt, Class: class, Error: errMsg, At: now})
+		if len(rec.AttemptLog) > maxJobAttemptLog {
+			rec.AttemptLog = rec.AttemptLog[len(rec.AttemptLog)-maxJobAttemptLog:]
+		}
+		rec.FinishedAt = &now
+	})
+}
+
+func (r *Gojinn) jobDead(tenantID string, fn *function, id uint64) *JobRecord {
+	return r.updateJob(tenantID, fn, id, func(rec *JobRecord) {
+		rec.Status = jobStatusDead
+	})
+}
+
+func (r *Gojinn) jobSucceeded(tenantID string, fn *function, id, attempt uint64, output string) *JobRecord {
+	limit := r.jobResultMaxOutput()
+	return r.updateJob(tenantID, fn, id, func(rec *JobRecord) {
+		now := time.Now().UTC()
+		rec.Status = jobStatusSucceeded
+		rec.Attempts = attempt
+		rec.Error = ""
+		rec.OutputBytes = len(output)
+		rec.OutputTruncated = len(output) > limit
+		if rec.OutputTruncated {
+			output = output[:limit]
+		}
+		rec.Output = output
+		rec.FinishedAt = &now
+	})
+}
+
+func loadJob(kv nats.KeyValue, id uint64) (*JobRecord, error) {
+	entry, err := kv.Get(jobKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var rec JobRecord
+	if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// serveJobStatus answers GET /_sys/jobs/{id} and
+// GET /_sys/tenants/{tenant}/jobs/{id}. With ?wait=<duration> the request
+// blocks until the job reaches a terminal state; with Accept:
+// text/event-stream every state change is streamed.
+func (r *Gojinn) serveJobStatus(rw http.ResponseWriter, req *http.Request, scopedTenant, rawID string) {
+	tenantID, ok := r.resolveSysTenant(rw, req, scopedTenant)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil || id == 0 {
+		http.Error(rw, "Invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	if r.js == nil {
+		http.Error(rw, "JetStream not ready", http.StatusServiceUnavailable)
+		return
+	}
+	kv, err := r.js.KeyValue(tenantJobsBucketName(tenantID))
+	if err != nil {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	rec, err := loadJob(kv, id)
+	if err != nil {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	var wait time.Duration
+	if raw := req.URL.Query().Get("wait"); raw != "" {
+		wait, err = time.ParseDuration(raw)
+		if err != nil || wait < 0 {
+			http.Error(rw, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if wait > maxJobWait {
+		wait = maxJobWait
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		if wait == 0 {
+			wait = maxJobWait
+		}
+		r.streamJobStatus(rw, req, kv, rec, wait)
+		return
+	}
+
+	if wait > 0 && !rec.terminal() {
+		ctx, cancel := context.WithTimeout(req.Context(), wait)
+		defer cancel()
+		_ = watchJob(ctx, kv, id, func(latest *JobRecord) bool {
+			rec = latest
+			return latest.terminal()
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(rec)
+}
+
+func (r *Gojinn) streamJobStatus(rw http.ResponseWriter, req *http.Request, kv nats.KeyValue, rec *JobRecord, wait time.Duration) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+
+	send := func(j *JobRecord) {
+		data, _ := json.Marshal(j)
+		fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", j.Status, data)
+		flusher.Flush()
+	}
+
+	send(rec)
+	if rec.terminal() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), wait)
+	defer cancel()
+
+	lastUpdate := rec.UpdatedAt
+	_ = watchJob(ctx, kv, rec.ID, func(latest *JobRecord) bool {
+		if !latest.UpdatedAt.After(lastUpdate) {
+			return false
+		}
+		lastUpdate = latest.UpdatedAt
+		send(latest)
+		return latest.terminal()
+	})
+}
+
+// watchJob feeds every stored version of job id to fn until fn returns true
+// or ctx expires.
+func watchJob(ctx context.Context, kv nats.KeyValue, id uint64, fn func(*JobRecord) bool) error {
+	watcher, err := kv.Watch(jobKey(id), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			if entry == nil || entry.Operation() != nats.KeyValuePut {
+				continue
+			}
+			var rec JobRecord
+			if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+				continue
+			}
+			if fn(&rec) {
+				return nil
+			}
+		}
+	}
+}
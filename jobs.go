@@ -13,30 +13,98 @@ import (
 	"go.uber.org/zap"
 )
 
-func (r *Gojinn) runBackgroundJob(wasmFile string) {
+const (
+	headerCronJob = "Gojinn-Cron-Job"
+	headerCronRun = "Gojinn-Cron-Run"
+)
+
+func (r *Gojinn) runBackgroundJob(job CronJob) {
 	ctx, span := otel.Tracer("gojinn-scheduler").Start(context.Background(), "cron_trigger")
 	defer span.End()
 
-	cronPayload := `{"event_type": "cron", "source": "gojinn_scheduler"}`
+	tenantID := job.tenantID()
+	kv, err := r.EnsureTenantResources(tenantID)
+	if err != nil {
+		r.logger.Error("Cron trigger failed to provision tenant", zap.String("job", job.jobName()), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "tenant provisioning failed")
+		return
+	}
+
+	scheduledAt := time.Now().UTC().Truncate(time.Second)
+	run := &CronRun{
+		Job:         job.jobName(),
+		RunID:       fmt.Sprintf("%s-%d", job.jobName(), scheduledAt.Unix()),
+		Tenant:      tenantID,
+		WasmFile:    job.WasmFile,
+		Status:      cronStatusQueued,
+		ScheduledAt: scheduledAt,
+	}
 
-	r.runAsyncJob(ctx, wasmFile, cronPayload)
+	if err := r.checkQuota(tenantID); err != nil {
+		r.logger.Warn("Cron run rejected by tenant quota", zap.String("job", run.Job), zap.String("tenant", tenantID), zap.Error(err))
+		run.Status = cronStatusFailed
+		run.Error = err.Error()
+		r.saveCronRun(kv, run)
+		return
+	}
+
+	if !r.resolveCronOverlap(job, kv, run) {
+		return
+	}
+
+	header := nats.Header{}
+	header.Set(headerCronJob, run.Job)
+	header.Set(headerCronRun, run.RunID)
+
+	// The run ID doubles as the JetStream dedupe ID so that every node of the
+	// cluster firing the same tick produces a single execution.
+	pubAck, err := r.runAsyncJob(ctx, tenantID, job.WasmFile, job.payload(), header, "cron_"+run.RunID)
+	if err != nil {
+		run.Status = cronStatusFailed
+		run.Error = err.Error()
+		r.saveCronRun(kv, run)
+		return
+	}
+	if pubAck.Duplicate {
+		return
+	}
+
+	run.Sequence = pubAck.Sequence
+	r.saveCronRun(kv, run)
 }
 
-func (r *Gojinn) runAsyncJob(ctx context.Context, wasmFile, payload string) {
+// runAsyncJob queues payload for the function named or located by ref.
+func (r *Gojinn) runAsyncJob(ctx context.Context, tenantID, ref, payload string, header nats.Header, msgID string) (*nats.PubAck, error) {
+	fn := r.functionFor(ref)
 	tracer := otel.Tracer("gojinn-publisher")
 	ctx, span := tracer.Start(ctx, "publish_async_job")
 	defer span.End()
 
 	if r.js == nil {
 		err := fmt.Errorf("JetStream not ready")
-		r.logger.Error("Cannot queue async job", zap.String("file", wasmFile), zap.Error(err))
+		r.logger.Error("Cannot queue async job", zap.String("function", fn.name()), zap.Error(err))
 
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return
+		return nil, err
+	}
+
+	if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+		r.logger.Error("Cannot provision workers for async job", zap.String("function", fn.name()), zap.String("tenant", tenantID), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "worker provisioning failed")
+		return nil, err
 	}
 
-	topic := fmt.Sprintf("gojinn.exec.%s", hashString(wasmFile))
+	topic := r.functionTopic(tenantID, fn)
+
+	jobHeaders := map[string][]string{
+		"X-Source": {"internal"},
+	}
+	for k, v := range header {
+		jobHeaders[k] = v
+	}
 
 	jobPayload := struct {
 		Method  string              `json:"method"`
@@ -44,12 +112,10 @@ func (r *Gojinn) runAsyncJob(ctx context.Context, wasmFile, payload string) {
 		Headers map[string][]string `json:"headers"`
 		Body    string              `json:"body"`
 	}{
-		Method: "ASYNC",
-		URI:    "internal://async/job",
-		Headers: map[string][]string{
-			"X-Source": {"internal"},
-		},
-		Body: payload,
+		Method:  "ASYNC",
+		URI:     "internal://async/job",
+		Headers: jobHeaders,
+		Body:    payload,
 	}
 
 	jobBytes, err := json.Marshal(jobPayload)
@@ -57,29 +123,39 @@ func (r *Gojinn) runAsyncJob(ctx context.Context, wasmFile, payload string) {
 		r.logger.Error("Failed to marshal async job", zap.Error(err))
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "json marshal failed")
-		return
+		return nil, err
 	}
 
-	msgID := fmt.Sprintf("job_%d", time.Now().UnixNano())
+	if msgID == "" {
+		msgID = fmt.Sprintf("job_%d", time.Now().UnixNano())
+	}
 
 	msg := nats.NewMsg(topic)
 	msg.Data = jobBytes
+	for k, v := range header {
+		msg.Header[k] = v
+	}
 
 	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(msg.Header))
 
-	_, err = r.js.PublishMsg(msg, nats.MsgId(msgID))
+	pubAck, err := r.js.PublishMsg(msg, nats.MsgId(msgID))
 	if err != nil {
 		r.logger.Error("Failed to persist async job",
-			zap.String("file", wasmFile),
+			zap.String("function", fn.name()),
 			zap.Error(err))
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "nats publish failed")
-		return
+		return nil, err
 	}
+	r.trackQueuedJob(tenantID, fn, pubAck)
 
 	r.logger.Info("Async Job Persisted & Queued",
-		zap.String("file", wasmFile),
+		zap.String("function", fn.name()),
+		zap.String("tenant", tenantID),
 		zap.String("msg_id", msgID),
+		zap.Uint64("seq", pubAck.Sequence),
 		zap.String("trace_id", span.SpanContext().TraceID().String()),
 	)
+
+	return pubAck, nil
 }
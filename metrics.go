@@ -1,7 +1,11 @@
 package gojinn
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,6 +16,13 @@ type gojinnMetrics struct {
 	active     *prometheus.GaugeVec
 	queueDepth *prometheus.GaugeVec
 	jobsTotal  *prometheus.CounterVec
+
+	sandboxStarts *prometheus.CounterVec
+	compileCache  *prometheus.CounterVec
+	fuelUsed      *prometheus.HistogramVec
+
+	egressRequests *prometheus.CounterVec
+	egressBytes    *prometheus.CounterVec
 }
 
 func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
@@ -22,7 +33,7 @@ func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
 		Name:    "gojinn_function_duration_seconds",
 		Help:    "Time taken to execute the WASM function",
 		Buckets: prometheus.DefBuckets,
-	}, []string{"path", "status"})
+	}, []string{"function", "status"})
 
 	if err := registry.Register(duration); err != nil {
 		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
@@ -37,7 +48,7 @@ func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
 	active := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "gojinn_active_sandboxes",
 		Help: "Number of WASM sandboxes currently running",
-	}, []string{"path"})
+	}, []string{"function"})
 
 	if err := registry.Register(active); err != nil {
 		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
@@ -67,7 +78,7 @@ func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
 	jobsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gojinn_worker_jobs_total",
 		Help: "Total number of worker jobs processed by status",
-	}, []string{"status"})
+	}, []string{"function", "status"})
 
 	if err := registry.Register(jobsTotal); err != nil {
 		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
@@ -79,5 +90,118 @@ func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
 		r.metrics.jobsTotal = jobsTotal
 	}
 
+	sandboxStarts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_sandbox_starts_total",
+		Help: "Synchronous executions by sandbox origin (warm from pool or cold built on demand)",
+	}, []string{"function", "kind"})
+
+	if err := registry.Register(sandboxStarts); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.sandboxStarts = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register sandboxStarts metric: %v", err)
+		}
+	} else {
+		r.metrics.sandboxStarts = sandboxStarts
+	}
+
+	compileCache := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_compile_cache_total",
+		Help: "Module compilations served by the shared compilation cache",
+	}, []string{"result"})
+
+	if err := registry.Register(compileCache); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.compileCache = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register compileCache metric: %v", err)
+		}
+	} else {
+		r.metrics.compileCache = compileCache
+	}
+
+	fuelUsed := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gojinn_function_fuel_used",
+		Help:    "Fuel units (guest function calls and loop iterations) spent per invocation when fuel_limit is set",
+		Buckets: prometheus.ExponentialBuckets(1000, 10, 7),
+	}, []string{"function"})
+
+	if err := registry.Register(fuelUsed); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.fuelUsed = are.ExistingCollector.(*prometheus.HistogramVec)
+		} else {
+			return fmt.Errorf("failed to register fuelUsed metric: %v", err)
+		}
+	} else {
+		r.metrics.fuelUsed = fuelUsed
+	}
+
+	egressRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_egress_requests_total",
+		Help: "Outbound HTTP requests made by functions, by tenant and outcome",
+	}, []string{"tenant", "outcome"})
+
+	if err := registry.Register(egressRequests); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.egressRequests = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register egressRequests metric: %v", err)
+		}
+	} else {
+		r.metrics.egressRequests = egressRequests
+	}
+
+	egressBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_egress_bytes_total",
+		Help: "Bytes sent and received by function outbound HTTP requests",
+	}, []string{"tenant", "direction"})
+
+	if err := registry.Register(egressBytes); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.egressBytes = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register egressBytes metric: %v", err)
+		}
+	} else {
+		r.metrics.egressBytes = egressBytes
+	}
+
 	return nil
 }
+
+func (r *Gojinn) observeDuration(fn *function, status string, start time.Time) {
+	if r.metrics != nil {
+		r.metrics.duration.WithLabelValues(fn.name(), status).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (r *Gojinn) countJob(fn *function, status string) {
+	if r.metrics != nil {
+		r.metrics.jobsTotal.WithLabelValues(fn.name(), status).Inc()
+	}
+}
+
+func (r *Gojinn) observeFuel(fn *function, meter *fuelMeter) {
+	if r.metrics != nil && meter != nil {
+		r.metrics.fuelUsed.WithLabelValues(fn.name()).Observe(float64(meter.spent()))
+	}
+}
+
+// tenantLabel names a tenant in metric labels. A tenant identified by a raw
+// api_key is reported as a short hash, so /metrics never exposes credentials.
+func (r *Gojinn) tenantLabel(tenant string) string {
+	if tenant == "" || !slices.Contains(r.APIKeys, tenant) {
+		return tenant
+	}
+	sum := sha256.Sum256([]byte(tenant))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+func (r *Gojinn) countEgress(tenant, outcome string, sent, received int) {
+	if r.metrics != nil {
+		tenant = r.tenantLabel(tenant)
+		r.metrics.egressRequests.WithLabelValues(tenant, outcome).Inc()
+		r.metrics.egressBytes.WithLabelValues(tenant, "out").Add(float64(sent))
+		r.metrics.egressBytes.WithLabelValues(tenant, "in").Add(float64(received))
+	}
+}
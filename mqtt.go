@@ -0,0 +1,326 @@
+package gojinn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	headerMQTTTopic = "Gojinn-MQTT-Topic"
+
+	mqttPublishTimeout = 5 * time.Second
+
+	defaultMQTTMaxTenants = 100
+
+	mqttPersistAttempts = 4
+	mqttPersistBackoff  = 250 * time.Millisecond
+)
+
+var (
+	errMQTTTenant = errors.New("mqtt tenant not accepted")
+
+	mqttTenantPlaceholder = regexp.MustCompile(`\{(\d+)\}`)
+	validTenantID         = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+type mqttEvent struct {
+	EventType string `json:"event_type"`
+	Source    string `json:"source"`
+	Topic     string `json:"topic"`
+	Payload   string `json:"payload"`
+	Encoding  string `json:"encoding,omitempty"`
+	QoS       byte   `json:"qos"`
+	Retained  bool   `json:"retained"`
+	Duplicate bool   `json:"duplicate"`
+	MessageID uint16 `json:"message_id"`
+}
+
+func (s MQTTSub) dynamicTenant() bool {
+	return mqttTenantPlaceholder.MatchString(s.Tenant)
+}
+
+// resolveTenant maps a concrete topic to its tenant. Placeholders such as {1}
+// are replaced with the matching wildcard level of the subscription filter.
+func (s MQTTSub) resolveTenant(topic string) (string, error) {
+	if s.Tenant == "" {
+		return defaultJobTenant, nil
+	}
+	if !s.dynamicTenant() {
+		return s.Tenant, nil
+	}
+
+	captures, ok := mqttWildcards(s.Topic, topic)
+	if !ok {
+		return "", fmt.Errorf("topic %s does not match filter %s", topic, s.Topic)
+	}
+
+	var resolveErr error
+	tenantID := mqttTenantPlaceholder.ReplaceAllStringFunc(s.Tenant, func(ph string) string {
+		idx, _ := strconv.Atoi(ph[1 : len(ph)-1])
+		if idx < 1 || idx > len(captures) {
+			resolveErr = fmt.Errorf("tenant placeholder %s out of range for filter %s", ph, s.Topic)
+			return ""
+		}
+		return captures[idx-1]
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	if !validTenantID.MatchString(tenantID) {
+		return "", fmt.Errorf("invalid tenant id %q resolved from topic %s", tenantID, topic)
+	}
+	return tenantID, nil
+}
+
+// acceptMQTTTenant guards tenants taken from a topic. Publishers must not be
+// able to create streams and worker pools at will, so a {N} placeholder only
+// resolves to tenants in the registry, in api_keys or in the subscription's
+// tenants list, and at most mqtt_max_tenants of them are provisioned.
+func (r *Gojinn) acceptMQTTTenant(sub MQTTSub, tenantID string) error {
+	if !sub.dynamicTenant() {
+		return nil
+	}
+	if !slices.Contains(sub.Tenants, tenantID) && !slices.Contains(r.APIKeys, tenantID) && r.tenantConfig(tenantID) == nil {
+		return fmt.Errorf("%w: %s is not a known tenant", errMQTTTenant, tenantID)
+	}
+
+	r.mqttTenantsMu.Lock()
+	defer r.mqttTenantsMu.Unlock()
+	if _, ok := r.mqttTenants[tenantID]; ok {
+		return nil
+	}
+	limit := r.MQTTMaxTenants
+	if limit <= 0 {
+		limit = defaultMQTTMaxTenants
+	}
+	if len(r.mqttTenants) >= limit {
+		return fmt.Errorf("%w: more than %d tenants from mqtt topics", errMQTTTenant, limit)
+	}
+	if r.mqttTenants == nil {
+		r.mqttTenants = make(map[string]struct{})
+	}
+	r.mqttTenants[tenantID] = struct{}{}
+	return nil
+}
+
+// mqttWildcards returns the topic levels captured by the '+' and '#'
+// wildcards of filter, or false when the topic does not match.
+func mqttWildcards(filter, topic string) ([]string, bool) {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return nil, false
+		}
+		filter = parts[2]
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	var captures []string
+
+	for i, level := range f {
+		if level == "#" {
+			return append(captures, strings.Join(t[i:], "/")), true
+		}
+		if i >= len(t) {
+			return nil, false
+		}
+		if level == "+" {
+			captures = append(captures, t[i])
+			continue
+		}
+		if level != t[i] {
+			return nil, false
+		}
+	}
+	return captures, len(f) == len(t)
+}
+
+// validateMQTT rejects QoS 1/2 subscriptions without a client id. The broker
+// only redelivers unacknowledged messages to a persistent session, and that
+// needs a stable client id.
+func (r *Gojinn) validateMQTT() error {
+	if r.MQTTClientID != "" {
+		return nil
+	}
+	for _, sub := range r.MQTTSubs {
+		if sub.QoS > 0 {
+			return fmt.Errorf("mqtt_subscribe %s: qos %d requires mqtt_client_id", sub.Topic, sub.QoS)
+		}
+	}
+	return nil
+}
+
+func (r *Gojinn) startMQTT() error {
+	if err := r.validateMQTT(); err != nil {
+		return err
+	}
+	persistent := false
+	for _, sub := range r.MQTTSubs {
+		fn := r.functionFor(sub.WasmFile)
+		if _, err := r.loadWasmSecurely(fn.wasmFile()); err != nil {
+			return fmt.Errorf("mqtt handler security check failed for %s: %w", sub.WasmFile, err)
+		}
+		if !sub.dynamicTenant() {
+			tenantID, _ := sub.resolveTenant(sub.Topic)
+			if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+				return fmt.Errorf("failed to provision workers for mqtt topic %s: %w", sub.Topic, err)
+			}
+		}
+		if sub.QoS > 0 {
+			persistent = true
+		}
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(r.MQTTBroker)
+	if r.MQTTClientID != "" {
+		opts.SetClientID(r.MQTTClientID)
+		if persistent {
+			opts.SetCleanSession(false)
+		}
+	}
+	if r.MQTTUsername != "" {
+		opts.SetUsername(r.MQTTUsername)
+	}
+	if r.MQTTPassword != "" {
+		opts.SetPassword(r.MQTTPassword)
+	}
+
+	// Messages are acknowledged only after JetStream has persisted the job,
+	// so QoS 1/2 deliveries are never lost between the broker and the queue.
+	opts.SetAutoAckDisabled(true)
+
+	opts.OnConnect = func(c mqtt.Client) {
+		r.logger.Info("MQTT Connected", zap.String("broker", r.MQTTBroker))
+		for _, sub := range r.MQTTSubs {
+			s := sub
+			token := c.Subscribe(s.Topic, s.QoS, func(client mqtt.Client, msg mqtt.Message) {
+				r.handleMQTTMessage(s, msg)
+			})
+			if token.Wait() && token.Error() != nil {
+				r.logger.Error("MQTT Subscribe Error", zap.Error(token.Error()))
+			} else {
+				r.logger.Info("MQTT Subscribed", zap.String("topic", s.Topic), zap.Uint8("qos", s.QoS))
+			}
+		}
+	}
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		r.logger.Warn("MQTT Connection Lost", zap.Error(err))
+	}
+	r.mqttClient = mqtt.NewClient(opts)
+	if token := r.mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		r.logger.Error("MQTT Initial Connect Failed", zap.Error(token.Error()))
+	}
+	return nil
+}
+
+func (r *Gojinn) handleMQTTMessage(sub MQTTSub, msg mqtt.Message) {
+	ctx, span := otel.Tracer("gojinn-mqtt").Start(context.Background(), "mqtt_trigger")
+	defer span.End()
+
+	tenantID, err := sub.resolveTenant(msg.Topic())
+	if err == nil {
+		err = r.acceptMQTTTenant(sub, tenantID)
+	}
+	if err == nil {
+		err = r.checkQuota(tenantID)
+	}
+	if err != nil {
+		r.logger.Warn("Dropping MQTT message for unroutable or over-quota tenant", zap.String("topic", msg.Topic()), zap.Error(err))
+		span.RecordError(err)
+		msg.Ack()
+		return
+	}
+
+	event := mqttEvent{
+		EventType: "mqtt",
+		Source:    "gojinn_mqtt",
+		Topic:     msg.Topic(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		MessageID: msg.MessageID(),
+	}
+	if utf8.Valid(msg.Payload()) {
+		event.Payload = string(msg.Payload())
+	} else {
+		event.Payload = base64.StdEncoding.EncodeToString(msg.Payload())
+		event.Encoding = "base64"
+	}
+	eventJSON, _ := json.Marshal(event)
+
+	header := nats.Header{}
+	header.Set(headerMQTTTopic, msg.Topic())
+
+	// A message that is never acknowledged is only redelivered after the
+	// session reconnects, so transient JetStream errors are retried here.
+	delay := mqttPersistBackoff
+	for attempt := 1; ; attempt++ {
+		if _, err = r.runAsyncJob(ctx, tenantID, sub.WasmFile, string(eventJSON), header, mqttMsgID(r.MQTTClientID, msg)); err == nil || attempt == mqttPersistAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		r.logger.Error("MQTT message not persisted, withholding ack",
+			zap.String("topic", msg.Topic()),
+			zap.String("tenant", tenantID),
+			zap.Error(err))
+		span.SetStatus(codes.Error, "jetstream publish failed")
+		return
+	}
+
+	msg.Ack()
+}
+
+// mqttMsgID derives the JetStream dedupe id of a QoS 1/2 message, so a
+// redelivery of a message that was queued but not acknowledged is dropped.
+// Packet ids are reused once acknowledged, so the topic and payload are part
+// of the id too. QoS 0 messages are never redelivered and get no id.
+func mqttMsgID(clientID string, msg mqtt.Message) string {
+	if msg.Qos() == 0 || msg.MessageID() == 0 {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(msg.Topic()))
+	h.Write([]byte{0})
+	h.Write(msg.Payload())
+	return fmt.Sprintf("mqtt_%s_%d_%s", clientID, msg.MessageID(), hex.EncodeToString(h.Sum(nil)[:8]))
+}
+
+func (r *Gojinn) publishMQTT(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	if r.mqttClient == nil || !r.mqttClient.IsConnected() {
+		return fmt.Errorf("mqtt client not connected")
+	}
+	if qos > 2 {
+		return fmt.Errorf("invalid mqtt qos: %d", qos)
+	}
+	if !r.permitted(ctx, topic, mqttPublish) {
+		return fmt.Errorf("mqtt publish to %s not permitted", topic)
+	}
+
+	token := r.mqttClient.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("mqtt publish to %s timed out", topic)
+	}
+	return token.Error()
+}
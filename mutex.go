@@ -0,0 +1,201 @@
+package gojinn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	mutexKeyPrefix  = "mutex_"
+	defaultMutexTTL = 30 * time.Second
+	maxMutexTTL     = time.Hour
+	mutexPollMin    = 10 * time.Millisecond
+	mutexPollMax    = 250 * time.Millisecond
+)
+
+var (
+	errKVUnavailable = errors.New("key-value store unavailable")
+	errMutexHeld     = errors.New("mutex held by another owner")
+	errMutexLost     = errors.New("mutex lease lost")
+)
+
+// mutexLease is the value stored under a lock key. Expired leases stay in the
+// bucket until the next owner replaces them with a compare-and-set.
+type mutexLease struct {
+	Owner     string `json:"owner"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// heldLock is a lock owned by the invocation. revision is the last write of
+// the lease, token the write that acquired it.
+type heldLock struct {
+	token    uint64
+	revision uint64
+}
+
+func mutexTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return defaultMutexTTL
+	}
+	return min(ttl, maxMutexTTL)
+}
+
+// owner identifies the invocation in the leases it writes.
+func (inv *invocation) owner() string {
+	if inv.ownerID == "" {
+		b := make([]byte, 12)
+		_, _ = rand.Read(b)
+		inv.ownerID = inv.tenantID + ":" + hex.EncodeToString(b)
+	}
+	return inv.ownerID
+}
+
+// tryLock takes key when it is free, expired or already held by inv. The
+// fencing token is the bucket revision of the acquiring write, so it grows with
+// every new owner.
+func (inv *invocation) tryLock(key string, ttl time.Duration) (uint64, error) {
+	kv := inv.kv
+	lease := mutexLease{Owner: inv.owner(), ExpiresAt: time.Now().Add(ttl).UnixNano()}
+
+	entry, err := kv.Get(mutexKeyPrefix + key)
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+		rev, err := kv.Create(mutexKeyPrefix+key, mustJSON(lease))
+		if err != nil {
+			return 0, errMutexHeld
+		}
+		return inv.acquired(key, rev, rev), nil
+	case err != nil:
+		return 0, err
+	}
+
+	var current mutexLease
+	_ = json.Unmarshal(entry.Value(), &current)
+	if current.Owner == lease.Owner {
+		// Locking again extends the lease and keeps the token.
+		inv.locksMu.Lock()
+		held, ok := inv.locks[key]
+		inv.locksMu.Unlock()
+		rev, err := kv.Update(mutexKeyPrefix+key, mustJSON(lease), entry.Revision())
+		if !ok || err != nil {
+			return 0, errMutexLost
+		}
+		return inv.acquired(key, held.token, rev), nil
+	}
+	if time.Now().UnixNano() < current.ExpiresAt {
+		return 0, errMutexHeld
+	}
+	rev, err := kv.Update(mutexKeyPrefix+key, mustJSON(lease), entry.Revision())
+	if err != nil {
+		return 0, errMutexHeld
+	}
+	return inv.acquired(key, rev, rev), nil
+}
+
+func (inv *invocation) acquired(key string, token, rev uint64) uint64 {
+	inv.locksMu.Lock()
+	defer inv.locksMu.Unlock()
+	if inv.locks == nil {
+		inv.locks = make(map[string]heldLock)
+	}
+	inv.locks[key] = heldLock{token: token, revision: rev}
+	return token
+}
+
+// lock retries tryLock until it succeeds, wait elapses or ctx ends.
+func (inv *invocation) lock(ctx context.Context, key string, ttl, wait time.Duration) (uint64, error) {
+	if inv == nil || inv.kv == nil {
+		return 0, errKVUnavailable
+	}
+	ttl = mutexTTL(ttl)
+	deadline := time.Now().Add(wait)
+	delay := mutexPollMin
+	for {
+		token, err := inv.tryLock(key, ttl)
+		if !errors.Is(err, errMutexHeld) {
+			return token, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, err
+		}
+		timer := time.NewTimer(min(delay, remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+		delay = min(delay*2, mutexPollMax)
+	}
+}
+
+// renew extends a lease the invocation still owns. It fails once another
+// owner has taken the lock over.
+func (inv *invocation) renew(key string, ttl time.Duration) error {
+	if inv == nil || inv.kv == nil {
+		return errKVUnavailable
+	}
+	inv.locksMu.Lock()
+	held, ok := inv.locks[key]
+	inv.locksMu.Unlock()
+	if !ok {
+		return errMutexLost
+	}
+
+	lease := mutexLease{Owner: inv.owner(), ExpiresAt: time.Now().Add(mutexTTL(ttl)).UnixNano()}
+	rev, err := inv.kv.Update(mutexKeyPrefix+key, mustJSON(lease), held.revision)
+	inv.locksMu.Lock()
+	defer inv.locksMu.Unlock()
+	if err != nil {
+		delete(inv.locks, key)
+		return errMutexLost
+	}
+	inv.locks[key] = heldLock{token: held.token, revision: rev}
+	return nil
+}
+
+// unlock deletes the lease if it is still the one the invocation wrote.
+func (inv *invocation) unlock(key string) error {
+	if inv == nil || inv.kv == nil {
+		return errKVUnavailable
+	}
+	inv.locksMu.Lock()
+	held, ok := inv.locks[key]
+	delete(inv.locks, key)
+	inv.locksMu.Unlock()
+	if !ok {
+		return errMutexLost
+	}
+	if err := inv.kv.Delete(mutexKeyPrefix+key, nats.LastRevision(held.revision)); err != nil {
+		return errMutexLost
+	}
+	return nil
+}
+
+// releaseLocks unlocks whatever the module still holds when it ends.
+func (inv *invocation) releaseLocks() {
+	if inv == nil {
+		return
+	}
+	inv.locksMu.Lock()
+	keys := make([]string, 0, len(inv.locks))
+	for key := range inv.locks {
+		keys = append(keys, key)
+	}
+	inv.locksMu.Unlock()
+	for _, key := range keys {
+		_ = inv.unlock(key)
+	}
+}
+
+func mustJSON(v any) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gojinn-io/gojinn/pkg/blob"
+)
+
+// stagingDir guarda os arquivos temporários das escritas atômicas. Fica dentro
+// da raiz para que o rename final nunca cruze sistemas de arquivos.
+const stagingDir = ".staging"
+
+// Storage implementa blob.Provider sobre o sistema de arquivos local. Cada
+// chave vira um arquivo sob a raiz, usando "/" como separador de diretórios.
+type Storage struct {
+	root string
+}
+
+// New cria o provedor, garantindo que o diretório raiz exista.
+func New(root string) (*Storage, error) {
+	root = filepath.Clean(root)
+	if err := os.MkdirAll(filepath.Join(root, stagingDir), 0o755); err != nil {
+		return nil, fmt.Errorf("blob fs: %w", err)
+	}
+	return &Storage{root: root}, nil
+}
+
+// path converte a chave em um caminho dentro da raiz, recusando chaves que
+// escapariam dela ou colidiriam com o diretório de staging.
+func (s *Storage) path(key string) (string, error) {
+	if key == "" || strings.HasSuffix(key, "/") || path.Clean("/"+key) != "/"+key {
+		return "", fmt.Errorf("blob fs: invalid key %q", key)
+	}
+	if key == stagingDir || strings.HasPrefix(key, stagingDir+"/") {
+		return "", fmt.Errorf("blob fs: reserved key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put implementa blob.Provider.
+func (s *Storage) Put(ctx context.Context, key string, data []byte) error {
+	return s.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutStream implementa blob.Provider. O conteúdo é gravado em um arquivo
+// temporário, sincronizado e então renomeado, para que leitores nunca vejam
+// objetos parciais.
+func (s *Storage) PutStream(_ context.Context, key string, r io.Reader, _ int64) error {
+	dest, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(s.root, stagingDir), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Get implementa blob.Provider.
+func (s *Storage) Get(_ context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return data, nil
+}
+
+// GetStream implementa blob.Provider.
+func (s *Storage) GetStream(_ context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return f, nil
+}
+
+// PresignGet implementa blob.Provider. Arquivos locais não têm URL própria.
+func (s *Storage) PresignGet(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// PresignPut implementa blob.Provider.
+func (s *Storage) PresignPut(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// Delete implementa blob.Provider e remove os diretórios que ficarem vazios.
+func (s *Storage) Delete(_ context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat implementa blob.Provider.
+func (s *Storage) Stat(_ context.Context, key string) (*blob.ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if fi.IsDir() {
+		return nil, blob.ErrNotFound
+	}
+	return &blob.ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime().UTC()}, nil
+}
+
+// List implementa blob.Provider. Apenas o diretório que contém o prefixo é
+// percorrido, não a raiz inteira.
+func (s *Storage) List(_ context.Context, prefix, cursor string) (*blob.ListResult, error) {
+	base := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		base = filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+prefix[:i])))
+	}
+
+	var objects []blob.ObjectInfo
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == stagingDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, blob.ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blob.Paginate(objects, prefix, cursor, blob.PageSize), nil
+}
+
+// Close implementa blob.Provider.
+func (s *Storage) Close() error {
+	return nil
+}
+
+func mapError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", blob.ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package jetstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gojinn-io/gojinn/pkg/blob"
+	"github.com/nats-io/nats.go"
+)
+
+// Config define o bucket do Object Store e o fator de replicação no cluster.
+type Config struct {
+	Bucket   string
+	Replicas int
+}
+
+// Storage implementa blob.Provider sobre o Object Store do JetStream, de modo
+// que os blobs são replicados entre os nós do cluster como os demais dados.
+type Storage struct {
+	store nats.ObjectStore
+}
+
+// New vincula o bucket existente ou o cria com a configuração informada.
+func New(js nats.JetStreamContext, cfg Config) (*Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("blob jetstream: bucket not configured")
+	}
+	if cfg.Replicas <= 0 {
+		cfg.Replicas = 1
+	}
+
+	store, err := js.ObjectStore(cfg.Bucket)
+	if err != nil {
+		store, err = js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:      cfg.Bucket,
+			Description: "Gojinn blob storage",
+			Storage:     nats.FileStorage,
+			Replicas:    cfg.Replicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("blob jetstream: %w", err)
+		}
+	}
+	return &Storage{store: store}, nil
+}
+
+// Put implementa blob.Provider.
+func (s *Storage) Put(_ context.Context, key string, data []byte) error {
+	_, err := s.store.PutBytes(key, data)
+	return err
+}
+
+// Get implementa blob.Provider.
+func (s *Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.store.GetBytes(key, nats.Context(ctx))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return data, nil
+}
+
+// PutStream implementa blob.Provider. O Object Store divide o conteúdo em
+// chunks e só publica o objeto quando o leitor termina sem erro.
+func (s *Storage) PutStream(ctx context.Context, key string, r io.Reader, _ int64) error {
+	_, err := s.store.Put(&nats.ObjectMeta{Name: key}, r, nats.Context(ctx))
+	return err
+}
+
+// GetStream implementa blob.Provider.
+func (s *Storage) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.store.Get(key, nats.Context(ctx))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return obj, nil
+}
+
+// PresignGet implementa blob.Provider. O Object Store só é acessível via NATS.
+func (s *Storage) PresignGet(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// PresignPut implementa blob.Provider.
+func (s *Storage) PresignPut(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// Delete implementa blob.Provider.
+func (s *Storage) Delete(_ context.Context, key string) error {
+	if err := s.store.Delete(key); err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Stat implementa blob.Provider.
+func (s *Storage) Stat(ctx context.Context, key string) (*blob.ObjectInfo, error) {
+	info, err := s.store.GetInfo(key, nats.Context(ctx))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	obj := objectInfo(info)
+	return &obj, nil
+}
+
+// List implementa blob.Provider. O Object Store só lista o bucket inteiro,
+// então a paginação é feita localmente.
+func (s *Storage) List(ctx context.Context, prefix, cursor string) (*blob.ListResult, error) {
+	infos, err := s.store.List(nats.Context(ctx))
+	if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+		return nil, err
+	}
+
+	objects := make([]blob.ObjectInfo, 0, len(infos))
+	for _, info := range infos {
+		objects = append(objects, objectInfo(info))
+	}
+	return blob.Paginate(objects, prefix, cursor, blob.PageSize), nil
+}
+
+// Close implementa blob.Provider. A conexão NATS pertence ao runtime.
+func (s *Storage) Close() error {
+	return nil
+}
+
+func objectInfo(info *nats.ObjectInfo) blob.ObjectInfo {
+	return blob.ObjectInfo{
+		Key:          info.Name,
+		Size:         int64(info.Size), //nolint:gosec
+		ETag:         info.Digest,
+		LastModified: info.ModTime,
+	}
+}
+
+func mapError(err error) error {
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return fmt.Errorf("%w: %v", blob.ErrNotFound, err)
+	}
+	return err
+}
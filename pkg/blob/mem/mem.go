@@ -0,0 +1,132 @@
+package mem
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gojinn-io/gojinn/pkg/blob"
+)
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// Storage implementa blob.Provider inteiramente em memória. Indicado para
+// testes e desenvolvimento: o conteúdo é perdido quando o processo termina.
+type Storage struct {
+	mu      sync.RWMutex
+	objects map[string]object
+}
+
+// New cria um provedor em memória vazio.
+func New() *Storage {
+	return &Storage{objects: make(map[string]object)}
+}
+
+// Put implementa blob.Provider. Os dados são copiados.
+func (s *Storage) Put(_ context.Context, key string, data []byte) error {
+	sum := md5.Sum(data) //nolint:gosec // ETag, não uso criptográfico
+	obj := object{
+		data:    append([]byte(nil), data...),
+		etag:    hex.EncodeToString(sum[:]),
+		modTime: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = obj
+	return nil
+}
+
+// Get implementa blob.Provider.
+func (s *Storage) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return append([]byte(nil), obj.data...), nil
+}
+
+// PutStream implementa blob.Provider. O conteúdo é lido inteiro antes de ser
+// publicado, então falhas de leitura não deixam objetos parciais.
+func (s *Storage) PutStream(ctx context.Context, key string, r io.Reader, _ int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key, data)
+}
+
+// GetStream implementa blob.Provider.
+func (s *Storage) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// PresignGet implementa blob.Provider. Objetos em memória não têm URL própria.
+func (s *Storage) PresignGet(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// PresignPut implementa blob.Provider.
+func (s *Storage) PresignPut(context.Context, string, time.Duration) (string, error) {
+	return "", blob.ErrPresignUnsupported
+}
+
+// Delete implementa blob.Provider.
+func (s *Storage) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// Stat implementa blob.Provider.
+func (s *Storage) Stat(_ context.Context, key string) (*blob.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	info := obj.info(key)
+	return &info, nil
+}
+
+// List implementa blob.Provider.
+func (s *Storage) List(_ context.Context, prefix, cursor string) (*blob.ListResult, error) {
+	s.mu.RLock()
+	objects := make([]blob.ObjectInfo, 0, len(s.objects))
+	for key, obj := range s.objects {
+		objects = append(objects, obj.info(key))
+	}
+	s.mu.RUnlock()
+
+	return blob.Paginate(objects, prefix, cursor, blob.PageSize), nil
+}
+
+// Close implementa blob.Provider.
+func (s *Storage) Close() error {
+	return nil
+}
+
+func (o object) info(key string) blob.ObjectInfo {
+	return blob.ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ETag:         o.etag,
+		LastModified: o.modTime,
+	}
+}
@@ -0,0 +1,29 @@
+package blob
+
+import (
+	"sort"
+	"strings"
+)
+
+// PageSize é o tamanho padrão das páginas de List nos provedores locais.
+const PageSize = 1000
+
+// Paginate monta uma página de List a partir de todos os objetos conhecidos
+// pelo provedor. O cursor é a última chave da página anterior, o que mantém a
+// paginação estável mesmo quando objetos são criados entre as chamadas.
+func Paginate(objects []ObjectInfo, prefix, cursor string, limit int) *ListResult {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	result := &ListResult{}
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, prefix) || obj.Key <= cursor {
+			continue
+		}
+		if len(result.Objects) == limit {
+			result.NextCursor = result.Objects[limit-1].Key
+			break
+		}
+		result.Objects = append(result.Objects, obj)
+	}
+	return result
+}
@@ -2,8 +2,33 @@ package blob
 
 import (
 	"context"
+	"errors"
+	"io"
+	"time"
 )
 
+var (
+	// ErrNotFound é retornado quando a chave não existe no provedor.
+	ErrNotFound = errors.New("blob: object not found")
+
+	// ErrPresignUnsupported é retornado por provedores sem acesso HTTP direto.
+	ErrPresignUnsupported = errors.New("blob: presigned URLs not supported by this provider")
+)
+
+// ObjectInfo descreve um objeto armazenado, sem o seu conteúdo.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ListResult é uma página de uma listagem. NextCursor vazio indica a última página.
+type ListResult struct {
+	Objects    []ObjectInfo `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
 // Provider define a interface soberana para armazenamento de objetos (blobs).
 // Esta abstração permite que o Gojinn troque entre AWS S3, MinIO, Google Cloud Storage
 // ou até mesmo o sistema de arquivos local sem alterar a lógica do runtime.
@@ -14,6 +39,31 @@ type Provider interface {
 	// Get recupera os dados associados à chave do provedor.
 	Get(ctx context.Context, key string) ([]byte, error)
 
+	// PutStream armazena o conteúdo lido de r sem carregá-lo inteiro em memória.
+	// size é o tamanho esperado, ou -1 quando desconhecido. Se r falhar, nada é
+	// armazenado.
+	PutStream(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// GetStream abre a chave para leitura incremental. Quem chama deve fechar o leitor.
+	GetStream(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// PresignGet gera uma URL temporária para baixar a chave diretamente do provedor.
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+
+	// PresignPut gera uma URL temporária para enviar a chave diretamente ao provedor.
+	PresignPut(ctx context.Context, key string, ttl time.Duration) (string, error)
+
+	// Delete remove a chave. Remover uma chave inexistente não é erro.
+	Delete(ctx context.Context, key string) error
+
+	// Stat retorna os metadados da chave, ou ErrNotFound.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// List retorna as chaves com o prefixo informado em ordem lexicográfica,
+	// a partir do cursor devolvido pela página anterior. O cursor é sempre a
+	// última chave dessa página, para que possa ser reescrito com a chave.
+	List(ctx context.Context, prefix, cursor string) (*ListResult, error)
+
 	// Close encerra quaisquer conexões ativas com o provedor (opcional, mas boa prática de SRE).
 	Close() error
 }
@@ -3,13 +3,28 @@ package s3
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gojinn-io/gojinn/pkg/blob"
+)
+
+const (
+	// listPageSize é o tamanho máximo de cada página de List.
+	listPageSize = 1000
+
+	// partSize é o tamanho de cada parte do multipart upload usado por PutStream.
+	// O S3 exige no mínimo 5 MiB por parte, exceto a última.
+	partSize = 8 << 20
 )
 
 // Config contém as credenciais e parâmetros de conexão com o S3.
@@ -24,6 +39,9 @@ type Config struct {
 // Storage implementa a interface blob.Provider para AWS S3 ou MinIO.
 type Storage struct {
 	config Config
+
+	mu     sync.Mutex
+	client *s3.Client
 }
 
 // New cria uma nova instância do provedor S3.
@@ -31,11 +49,19 @@ func New(cfg Config) *Storage {
 	return &Storage{config: cfg}
 }
 
+// getClient devolve o client em cache, criando-o na primeira chamada. Falhas
+// não ficam em cache, então a próxima chamada tenta de novo.
 func (s *Storage) getClient(ctx context.Context) (*s3.Client, error) {
 	if s.config.Bucket == "" {
 		return nil, fmt.Errorf("s3_bucket not configured")
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(s.config.Region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
@@ -52,9 +78,10 @@ func (s *Storage) getClient(ctx context.Context) (*s3.Client, error) {
 		cfg.BaseEndpoint = aws.String(s.config.Endpoint)
 	}
 
-	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+	s.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.UsePathStyle = true
-	}), nil
+	})
+	return s.client, nil
 }
 
 // Put implementa blob.Provider.
@@ -84,13 +111,227 @@ func (s *Storage) Get(ctx context.Context, key string) ([]byte, error) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
 	defer resp.Body.Close()
 
 	return io.ReadAll(resp.Body)
 }
 
+// PutStream implementa blob.Provider. Objetos menores que uma parte vão em um
+// único PutObject; os demais usam multipart upload, abortado em caso de erro.
+func (s *Storage) PutStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.config.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(buf[:n]),
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	parts, err := s.uploadParts(ctx, client, upload.UploadId, key, r, buf, n)
+	if err != nil {
+		_, _ = client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.config.Bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// uploadParts envia a primeira parte já lida (buf[:n]) e as seguintes até o fim de r.
+func (s *Storage) uploadParts(ctx context.Context, client *s3.Client, uploadID *string, key string, r io.Reader, buf []byte, n int) ([]types.CompletedPart, error) {
+	var parts []types.CompletedPart
+	for number := int32(1); n > 0; number++ {
+		resp, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.config.Bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(number),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, types.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int32(number)})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// GetStream implementa blob.Provider.
+func (s *Storage) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return resp.Body, nil
+}
+
+// PresignGet implementa blob.Provider.
+func (s *Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// PresignPut implementa blob.Provider.
+func (s *Storage) PresignPut(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := s3.NewPresignClient(client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// Delete implementa blob.Provider.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Stat implementa blob.Provider usando HeadObject.
+func (s *Storage) Stat(ctx context.Context, key string) (*blob.ObjectInfo, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	info := &blob.ObjectInfo{
+		Key:  key,
+		Size: aws.ToInt64(resp.ContentLength),
+		ETag: strings.Trim(aws.ToString(resp.ETag), `"`),
+	}
+	if resp.LastModified != nil {
+		info.LastModified = *resp.LastModified
+	}
+	return info, nil
+}
+
+// List implementa blob.Provider. Como nos provedores locais, o cursor é a
+// última chave da página anterior, passada ao S3 como StartAfter.
+func (s *Storage) List(ctx context.Context, prefix, cursor string) (*blob.ListResult, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.config.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(listPageSize),
+	}
+	if cursor != "" {
+		input.StartAfter = aws.String(cursor)
+	}
+
+	resp, err := client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &blob.ListResult{}
+	for _, obj := range resp.Contents {
+		info := blob.ObjectInfo{
+			Key:  aws.ToString(obj.Key),
+			Size: aws.ToInt64(obj.Size),
+			ETag: strings.Trim(aws.ToString(obj.ETag), `"`),
+		}
+		if obj.LastModified != nil {
+			info.LastModified = *obj.LastModified
+		}
+		result.Objects = append(result.Objects, info)
+	}
+	if aws.ToBool(resp.IsTruncated) && len(result.Objects) > 0 {
+		result.NextCursor = result.Objects[len(result.Objects)-1].Key
+	}
+	return result, nil
+}
+
+// mapError traduz as respostas 404 do S3 para blob.ErrNotFound.
+func mapError(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %v", blob.ErrNotFound, err)
+	}
+	return err
+}
+
 // Close satisfaz a interface (neste caso, o client da AWS não exige fechamento manual).
 func (s *Storage) Close() error {
 	return nil
@@ -0,0 +1,292 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Table records the applied versions.
+const Table = "gojinn_migrations"
+
+type Dialect struct {
+	Name string
+
+	placeholder func(n int) string
+	versionType string
+}
+
+var (
+	SQLite   = Dialect{Name: "sqlite", placeholder: func(int) string { return "?" }, versionType: "TEXT"}
+	Postgres = Dialect{Name: "postgres", placeholder: func(n int) string { return fmt.Sprintf("$%d", n) }, versionType: "VARCHAR(255)"}
+	MySQL    = Dialect{Name: "mysql", placeholder: func(int) string { return "?" }, versionType: "VARCHAR(255)"}
+)
+
+// Normalize maps the driver aliases accepted by db_driver to the registered
+// database/sql driver and prefixes bare SQLite paths with "file:".
+func Normalize(driver, dsn string) (string, string) {
+	switch driver {
+	case "libsql", "sqlite3":
+		driver = "sqlite"
+	case "postgresql":
+		driver = "postgres"
+	}
+	if driver == "sqlite" && !strings.HasPrefix(dsn, "file:") && !strings.Contains(dsn, ":memory:") {
+		dsn = "file:" + dsn
+	}
+	return driver, dsn
+}
+
+func DialectFor(driver string) (Dialect, error) {
+	driver, _ = Normalize(driver, "")
+	switch driver {
+	case "sqlite":
+		return SQLite, nil
+	case "postgres":
+		return Postgres, nil
+	case "mysql":
+		return MySQL, nil
+	}
+	return Dialect{}, fmt.Errorf("migrations do not support driver %q", driver)
+}
+
+// Migration is one version of the schema. Files are named <version>.up.sql
+// and <version>.down.sql; a plain <version>.sql is an up-only migration.
+type Migration struct {
+	Version string
+	Up      string
+	Down    string
+}
+
+// Load reads the migrations of dir, ordered by version.
+func Load(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[string]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		version, kind := strings.TrimSuffix(name, ".sql"), "up"
+		if v, ok := strings.CutSuffix(version, ".up"); ok {
+			version = v
+		} else if v, ok := strings.CutSuffix(version, ".down"); ok {
+			version, kind = v, "down"
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		path := filepath.Join(dir, name)
+		if kind == "down" {
+			m.Down = path
+		} else if m.Up != "" {
+			return nil, fmt.Errorf("migration %s has more than one up file", version)
+		} else {
+			m.Up = path
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %s has a down file but no up file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Status struct {
+	Version   string `json:"version"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+
+	// Missing marks a version recorded in the database whose files are gone.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// Migrator applies the migrations of Dir to DB. Each version runs in its own
+// transaction together with its row in Table. MySQL commits DDL implicitly,
+// so a failed MySQL migration may be left half applied.
+type Migrator struct {
+	DB      *sql.DB
+	Dialect Dialect
+	Dir     string
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.DB.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version %s PRIMARY KEY, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		Table, m.Dialect.versionType))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", Table, err)
+	}
+	return nil
+}
+
+// applied returns the recorded versions and when they were applied.
+func (m *Migrator) applied(ctx context.Context) (map[string]string, error) {
+	rows, err := m.DB.QueryContext(ctx, "SELECT version, applied_at FROM "+Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]string)
+	for rows.Next() {
+		var version string
+		var at sql.NullString
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		out[version] = at.String
+	}
+	return out, rows.Err()
+}
+
+// Up applies pending migrations in order, at most steps of them when steps is
+// positive. It returns the versions it applied.
+func (m *Migrator) Up(ctx context.Context, steps int) ([]string, error) {
+	migrations, err := Load(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, mig := range migrations {
+		if steps > 0 && len(done) == steps {
+			break
+		}
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		ran, err := m.run(ctx, mig.Version, mig.Up, true)
+		if err != nil {
+			return done, err
+		}
+		if ran {
+			done = append(done, mig.Version)
+		}
+	}
+	return done, nil
+}
+
+// Down reverts the most recently applied migrations, one when steps is not
+// positive. It returns the versions it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]string, error) {
+	if steps <= 0 {
+		steps = 1
+	}
+	migrations, err := Load(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		mig := migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return done, fmt.Errorf("migration %s has no down file", mig.Version)
+		}
+		if _, err := m.run(ctx, mig.Version, mig.Down, false); err != nil {
+			return done, err
+		}
+		done = append(done, mig.Version)
+	}
+	return done, nil
+}
+
+// Status lists every known version, including recorded ones without files.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	migrations, err := Load(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Status, 0, len(migrations))
+	for _, mig := range migrations {
+		at, ok := applied[mig.Version]
+		out = append(out, Status{Version: mig.Version, Applied: ok, AppliedAt: at})
+		delete(applied, mig.Version)
+	}
+	for version, at := range applied {
+		out = append(out, Status{Version: version, Applied: true, AppliedAt: at, Missing: true})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// run executes one script and records the change. On the way up the version
+// row is inserted first, so a node racing another on the same database blocks
+// on the key and then skips the version instead of running it twice.
+func (m *Migrator) run(ctx context.Context, version, path string, up bool) (bool, error) {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	arg := m.Dialect.placeholder(1)
+	if up {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+Table+" (version) VALUES ("+arg+")", version); err != nil {
+			_ = tx.Rollback()
+			var n int
+			if m.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+Table+" WHERE version = "+arg, version).Scan(&n) == nil && n > 0 {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to record migration %s: %w", version, err)
+		}
+	}
+	if strings.TrimSpace(string(script)) != "" {
+		if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+			return false, fmt.Errorf("migration %s failed: %w", filepath.Base(path), err)
+		}
+	}
+	if !up {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+Table+" WHERE version = "+arg, version); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
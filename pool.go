@@ -0,0 +1,241 @@
+package gojinn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"go.uber.org/zap"
+)
+
+const poolStatInterval = time.Second
+
+type sandboxPool struct {
+	key        string
+	name       string
+	path       string
+	wasm       []byte
+	modTime    time.Time
+	generation uint64
+	idle       chan *EnginePair
+
+	mu        sync.Mutex
+	checkedAt time.Time
+}
+
+func (r *Gojinn) setupCompilationCache() error {
+	if r.CompilationCache == "disk" {
+		dir := filepath.Join(r.DataDir, "wasm_cache")
+		cache, err := wazero.NewCompilationCacheWithDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to open compilation cache at %s: %w", dir, err)
+		}
+		r.compilationCache = cache
+		return nil
+	}
+	r.compilationCache = wazero.NewCompilationCache()
+	return nil
+}
+
+// warmPool loads the module of fn and fills its pool with pool_size ready
+// sandboxes. The first sandbox is built synchronously so configuration errors
+// surface to the caller.
+func (r *Gojinn) warmPool(fn *function) (*sandboxPool, error) {
+	path := fn.wasmFile()
+	size := fn.poolSize()
+	wasmBytes, err := r.loadWasmSecurely(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	first, err := r.createWazeroRuntime(wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	r.poolsMu.Lock()
+	var generation uint64
+	if old, ok := r.pools[fn.id()]; ok {
+		generation = old.generation + 1
+		defer old.drain()
+	}
+	pool := &sandboxPool{
+		key:        fn.id(),
+		name:       fn.name(),
+		path:       path,
+		wasm:       wasmBytes,
+		modTime:    modTime,
+		generation: generation,
+		idle:       make(chan *EnginePair, size),
+		checkedAt:  time.Now(),
+	}
+	pool.idle <- first
+	r.pools[fn.id()] = pool
+	r.poolsMu.Unlock()
+
+	go func() {
+		for i := 1; i < size; i++ {
+			pair, err := r.createWazeroRuntime(wasmBytes)
+			if err != nil {
+				r.logger.Warn("Failed to pre-warm sandbox", zap.String("function", fn.name()), zap.Error(err))
+				return
+			}
+			if !r.isCurrentPool(pool) {
+				_ = pair.Runtime.Close(context.Background())
+				return
+			}
+			select {
+			case pool.idle <- pair:
+			default:
+				_ = pair.Runtime.Close(context.Background())
+				return
+			}
+		}
+		r.logger.Info("Sandbox pool warmed", zap.String("function", fn.name()), zap.Int("size", size), zap.Uint64("generation", generation))
+	}()
+
+	return pool, nil
+}
+
+func (r *Gojinn) getPool(fn *function) (*sandboxPool, error) {
+	r.poolsMu.Lock()
+	pool, ok := r.pools[fn.id()]
+	r.poolsMu.Unlock()
+
+	if !ok || pool.path != fn.wasmFile() {
+		return r.warmPool(fn)
+	}
+
+	if pool.changedOnDisk() {
+		r.logger.Info("Module changed on disk, refreshing sandbox pool", zap.String("function", fn.name()))
+		refreshed, err := r.warmPool(fn)
+		if err != nil {
+			r.logger.Error("Failed to refresh sandbox pool, keeping previous module", zap.String("function", fn.name()), zap.Error(err))
+			return pool, nil
+		}
+		return refreshed, nil
+	}
+	return pool, nil
+}
+
+func (r *Gojinn) acquireSandbox(fn *function) (*sandboxPool, *EnginePair, error) {
+	pool, err := r.getPool(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case pair := <-pool.idle:
+		if r.metrics != nil {
+			r.metrics.sandboxStarts.WithLabelValues(fn.name(), "warm").Inc()
+		}
+		return pool, pair, nil
+	default:
+	}
+
+	if r.metrics != nil {
+		r.metrics.sandboxStarts.WithLabelValues(fn.name(), "cold").Inc()
+	}
+	pair, err := r.createWazeroRuntime(pool.wasm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, pair, nil
+}
+
+func (r *Gojinn) isCurrentPool(pool *sandboxPool) bool {
+	r.poolsMu.Lock()
+	defer r.poolsMu.Unlock()
+
+	current, ok := r.pools[pool.key]
+	return ok && current == pool
+}
+
+func (r *Gojinn) releaseSandbox(pool *sandboxPool, pair *EnginePair) {
+	if r.isCurrentPool(pool) {
+		select {
+		case pool.idle <- pair:
+			return
+		default:
+		}
+	}
+	_ = pair.Runtime.Close(context.Background())
+}
+
+// refreshPools rebuilds the pool of every active function and drops pools
+// whose function or version is no longer served.
+func (r *Gojinn) refreshPools() {
+	served := make(map[string]bool)
+	for _, fn := range r.activeFunctions() {
+		served[fn.id()] = true
+		if _, err := r.warmPool(fn); err != nil {
+			r.logger.Error("Failed to refresh sandbox pool", zap.String("function", fn.name()), zap.Error(err))
+		}
+	}
+
+	r.poolsMu.Lock()
+	defer r.poolsMu.Unlock()
+	for key, pool := range r.pools {
+		if !served[key] {
+			pool.drain()
+			delete(r.pools, key)
+		}
+	}
+}
+
+func (r *Gojinn) closePools() {
+	r.poolsMu.Lock()
+	defer r.poolsMu.Unlock()
+
+	for key, pool := range r.pools {
+		pool.drain()
+		delete(r.pools, key)
+	}
+}
+
+func (r *Gojinn) idleSandboxes() map[string]int {
+	r.poolsMu.Lock()
+	defer r.poolsMu.Unlock()
+
+	idle := make(map[string]int, len(r.pools))
+	for _, pool := range r.pools {
+		idle[pool.name] = len(pool.idle)
+	}
+	return idle
+}
+
+func (p *sandboxPool) changedOnDisk() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checkedAt) < poolStatInterval {
+		return false
+	}
+	p.checkedAt = time.Now()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(p.modTime)
+}
+
+func (p *sandboxPool) drain() {
+	for {
+		select {
+		case pair := <-p.idle:
+			_ = pair.Runtime.Close(context.Background())
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	BackoffFixed       = "fixed"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+
+	FailureTimeout       = "timeout"
+	FailureOutputQuota   = "output_quota"
+	FailureTrap          = "trap"
+	FailureFuel          = "fuel_exhausted"
+	FailureFunctionError = "function_error"
+
+	defaultRetryDelay    = time.Second
+	defaultRetryMaxDelay = 5 * time.Minute
+	ackGracePeriod       = 5 * time.Second
+	maxConsumerBackoffs  = 32
+)
+
+var failureClasses = []string{FailureTimeout, FailureOutputQuota, FailureTrap, FailureFuel, FailureFunctionError}
+
+// RetryPolicy controls how failed async executions are redelivered. The zero
+// value keeps the historical behaviour: MaxRetries attempts, linear 1s steps.
+type RetryPolicy struct {
+	MaxAttempts int            `json:"max_attempts,omitempty"`
+	Backoff     string         `json:"backoff,omitempty"`
+	Delay       caddy.Duration `json:"delay,omitempty"`
+	MaxDelay    caddy.Duration `json:"max_delay,omitempty"`
+	Jitter      float64        `json:"jitter,omitempty"`
+	RetryOn     []string       `json:"retry_on,omitempty"`
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return MaxRetries
+}
+
+func (p RetryPolicy) retryable(class string) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	return slices.Contains(p.RetryOn, class)
+}
+
+// baseDelay is the wait before the next attempt after the given failed
+// attempt, without jitter.
+func (p RetryPolicy) baseDelay(attempt uint64) time.Duration {
+	delay := time.Duration(p.Delay)
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	maxDelay := time.Duration(p.MaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	var d time.Duration
+	switch p.Backoff {
+	case BackoffFixed:
+		d = delay
+	case BackoffExponential:
+		factor := math.Pow(2, float64(attempt-1))
+		if factor > float64(maxDelay/delay) {
+			return maxDelay
+		}
+		d = delay * time.Duration(factor)
+	default:
+		d = delay * time.Duration(attempt)
+	}
+	if d > maxDelay || d <= 0 {
+		return maxDelay
+	}
+	return d
+}
+
+// nextDelay applies jitter by shaving a random share of the base delay, so
+// the configured max_delay is never exceeded.
+func (p RetryPolicy) nextDelay(attempt uint64) time.Duration {
+	d := p.baseDelay(attempt)
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+func (p RetryPolicy) validate() error {
+	switch p.Backoff {
+	case "", BackoffFixed, BackoffLinear, BackoffExponential:
+	default:
+		return fmt.Errorf("invalid retry backoff: %s", p.Backoff)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	for _, class := range p.RetryOn {
+		if !slices.Contains(failureClasses, class) {
+			return fmt.Errorf("invalid retry_on class: %s", class)
+		}
+	}
+	return nil
+}
+
+// classifyFailure maps an execution error to one of the retry_on classes.
+func classifyFailure(ctx context.Context, err error, quotaExceeded bool) string {
+	if quotaExceeded {
+		return FailureOutputQuota
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+	if errors.Is(err, ErrFuelExhausted) {
+		return FailureFuel
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case sys.ExitCodeDeadlineExceeded:
+			return FailureTimeout
+		case sys.ExitCodeContextCanceled:
+			return FailureTrap
+		}
+		return FailureFunctionError
+	}
+	return FailureTrap
+}
+
+// ensureWorkerConsumer creates or updates the durable consumer behind a
+// worker queue group, so retry policy changes apply to existing consumers
+// instead of clashing with them.
+func (r *Gojinn) ensureWorkerConsumer(fn *function, streamName, durable, topic string) error {
+	policy := fn.retry()
+	ackWait := fn.timeout() + ackGracePeriod
+
+	var backoff []time.Duration
+	for attempt := 1; attempt < policy.maxAttempts() && attempt <= maxConsumerBackoffs; attempt++ {
+		backoff = append(backoff, ackWait+policy.baseDelay(uint64(attempt)))
+	}
+
+	// The server uses the first backoff step as the ack wait.
+	if len(backoff) > 0 {
+		ackWait = backoff[0]
+	}
+
+	cfg := &nats.ConsumerConfig{
+		Durable:        durable,
+		DeliverGroup:   durable,
+		FilterSubject:  topic,
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckWait:        ackWait,
+		MaxDeliver:     policy.maxAttempts() + 1,
+		BackOff:        backoff,
+		DeliverSubject: nats.NewInbox(),
+	}
+
+	info, err := r.js.ConsumerInfo(streamName, durable)
+	if err != nil {
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return err
+		}
+		_, err = r.js.AddConsumer(streamName, cfg)
+		return err
+	}
+
+	cfg.DeliverSubject = info.Config.DeliverSubject
+	if info.Config.MaxDeliver == cfg.MaxDeliver &&
+		info.Config.AckWait == cfg.AckWait &&
+		slices.Equal(info.Config.BackOff, cfg.BackOff) {
+		return nil
+	}
+	_, err = r.js.UpdateConsumer(streamName, cfg)
+	return err
+}
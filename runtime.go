@@ -6,6 +6,7 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
@@ -17,6 +18,9 @@ type EnginePair struct {
 func (r *Gojinn) createWazeroRuntime(wasmBytes []byte) (*EnginePair, error) {
 	ctxWazero := context.Background()
 	rConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if r.compilationCache != nil {
+		rConfig = rConfig.WithCompilationCache(r.compilationCache)
+	}
 
 	memLimit := r.MemoryLimit
 	if memLimit == "" {
@@ -41,10 +45,30 @@ func (r *Gojinn) createWazeroRuntime(wasmBytes []byte) (*EnginePair, error) {
 
 	wasi_snapshot_preview1.MustInstantiate(ctxWazero, engine)
 
-	code, err := engine.CompileModule(ctxWazero, wasmBytes)
+	compileCtx := ctxWazero
+	if r.FuelLimit > 0 {
+		compileCtx = experimental.WithFunctionListenerFactory(compileCtx, fuelListener{})
+		// A module whose loops cannot be metered could spin without
+		// spending fuel, so it is refused rather than run unmetered.
+		metered, err := meterLoops(wasmBytes)
+		if err != nil {
+			return nil, fmt.Errorf("fuel_limit cannot meter this module: %w", err)
+		}
+		wasmBytes = metered
+	}
+
+	code, err := engine.CompileModule(compileCtx, wasmBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile wasm binary: %w", err)
 	}
 
+	if r.metrics != nil {
+		result := "miss"
+		if _, seen := r.compiledModules.LoadOrStore(hashString(string(wasmBytes)), struct{}{}); seen {
+			result = "hit"
+		}
+		r.metrics.compileCache.WithLabelValues(result).Inc()
+	}
+
 	return &EnginePair{Runtime: engine, Code: code}, nil
 }
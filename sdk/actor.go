@@ -0,0 +1,65 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import (
+	"errors"
+	"time"
+)
+
+//go:wasmimport gojinn host_actor_state
+func host_actor_state(outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_state
+func host_actor_set_state(ptr, length uint32) uint32
+
+//go:wasmimport gojinn host_actor_set_alarm
+func host_actor_set_alarm(delayMillis uint64) uint32
+
+//go:wasmimport gojinn host_actor_cancel_alarm
+func host_actor_cancel_alarm() uint32
+
+// ErrNotActor is returned when the function was not invoked as an actor, or
+// the state is larger than 1MB.
+var ErrNotActor = errors.New("not running as an actor")
+
+type ActorService struct{}
+
+// Actor reads and changes the state of the actor being run. Changes are
+// checkpointed when the function exits successfully and dropped otherwise.
+var Actor = ActorService{}
+
+// State returns the state as of the last checkpoint, or what SetState stored
+// during this invocation. A new actor has no state.
+func (a ActorService) State() ([]byte, error) {
+	state, err := readSized(host_actor_state)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, nil
+	}
+	return state, err
+}
+
+// SetState replaces the state. An empty state deletes it.
+func (a ActorService) SetState(state []byte) error {
+	ptr, length := bytesPtr(state)
+	if host_actor_set_state(ptr, length) != 1 {
+		return ErrNotActor
+	}
+	return nil
+}
+
+// SetAlarm runs the actor again after delay, with Request.Actor.Alarm set.
+// An actor has at most one alarm; setting it again replaces it.
+func (a ActorService) SetAlarm(delay time.Duration) error {
+	if host_actor_set_alarm(uint64(max(delay.Milliseconds(), 0))) != 1 {
+		return ErrNotActor
+	}
+	return nil
+}
+
+func (a ActorService) CancelAlarm() error {
+	if host_actor_cancel_alarm() != 1 {
+		return ErrNotActor
+	}
+	return nil
+}
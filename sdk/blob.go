@@ -0,0 +1,224 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_s3_put
+func host_s3_put(kPtr, kLen, bPtr, bLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_get
+func host_s3_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_delete
+func host_s3_delete(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_head
+func host_s3_head(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_list
+func host_s3_list(pPtr, pLen, cPtr, cLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_open
+func host_s3_open(kPtr, kLen, mode uint32) uint32
+
+//go:wasmimport gojinn host_s3_read
+func host_s3_read(handle, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_s3_write
+func host_s3_write(handle, ptr, length uint32) uint32
+
+//go:wasmimport gojinn host_s3_close
+func host_s3_close(handle uint32) uint32
+
+//go:wasmimport gojinn host_s3_presign
+func host_s3_presign(kPtr, kLen, mode, ttlSeconds, outPtr, outMaxLen uint32) uint32
+
+const blobNoData = 0xFFFFFFFF
+
+var (
+	ErrBlobNotFound = errors.New("blob not found or access denied")
+	ErrBlobDenied   = errors.New("blob access denied")
+	ErrBlobFailed   = errors.New("blob operation failed")
+
+	ErrPresignUnavailable = errors.New("presigned URL denied or not supported by the storage provider")
+)
+
+type BlobStore struct{}
+
+var S3 = BlobStore{}
+
+func strPtr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func bytesPtr(b []byte) (uint32, uint32) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&b[0]))), uint32(len(b))
+}
+
+func blobStatus(code uint32) error {
+	switch code {
+	case 0:
+		return nil
+	case 2:
+		return ErrBlobDenied
+	default:
+		return ErrBlobFailed
+	}
+}
+
+// readSized calls a host function that returns the needed size when the
+// buffer is too small, growing the buffer until the result fits.
+func readSized(call func(outPtr, outMaxLen uint32) uint32) ([]byte, error) {
+	buffer := make([]byte, 4096)
+	for {
+		outPtr, capacity := bytesPtr(buffer)
+		n := call(outPtr, capacity)
+		if n == blobNoData {
+			return nil, ErrBlobNotFound
+		}
+		if n <= capacity {
+			return buffer[:n], nil
+		}
+		buffer = make([]byte, n)
+	}
+}
+
+func (s BlobStore) Put(key string, data []byte) error {
+	kPtr, kLen := strPtr(key)
+	bPtr, bLen := bytesPtr(data)
+	return blobStatus(host_s3_put(kPtr, kLen, bPtr, bLen))
+}
+
+func (s BlobStore) Get(key string) ([]byte, error) {
+	kPtr, kLen := strPtr(key)
+	return readSized(func(outPtr, outMaxLen uint32) uint32 {
+		return host_s3_get(kPtr, kLen, outPtr, outMaxLen)
+	})
+}
+
+func (s BlobStore) Delete(key string) error {
+	kPtr, kLen := strPtr(key)
+	return blobStatus(host_s3_delete(kPtr, kLen))
+}
+
+func (s BlobStore) Head(key string) (*ObjectInfo, error) {
+	kPtr, kLen := strPtr(key)
+	raw, err := readSized(func(outPtr, outMaxLen uint32) uint32 {
+		return host_s3_head(kPtr, kLen, outPtr, outMaxLen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// List returns one page of keys under prefix. Pass the previous page's
+// NextCursor to continue; an empty NextCursor marks the last page.
+func (s BlobStore) List(prefix, cursor string) (*ListPage, error) {
+	pPtr, pLen := strPtr(prefix)
+	cPtr, cLen := strPtr(cursor)
+	raw, err := readSized(func(outPtr, outMaxLen uint32) uint32 {
+		return host_s3_list(pPtr, pLen, cPtr, cLen, outPtr, outMaxLen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var page ListPage
+	if err := json.Unmarshal(raw, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Open streams an object without loading it whole into guest memory.
+func (s BlobStore) Open(key string) (io.ReadCloser, error) {
+	kPtr, kLen := strPtr(key)
+	handle := host_s3_open(kPtr, kLen, 0)
+	if handle == blobNoData {
+		return nil, ErrBlobNotFound
+	}
+	return &blobStream{handle: handle}, nil
+}
+
+// Create opens a write stream. The object is stored when it is closed.
+func (s BlobStore) Create(key string) (io.WriteCloser, error) {
+	kPtr, kLen := strPtr(key)
+	handle := host_s3_open(kPtr, kLen, 1)
+	if handle == blobNoData {
+		return nil, ErrBlobDenied
+	}
+	return &blobStream{handle: handle}, nil
+}
+
+// PresignGet returns a temporary URL that lets a client download the object
+// directly from the storage provider. ttl of 0 uses the host default.
+func (s BlobStore) PresignGet(key string, ttl time.Duration) (string, error) {
+	return s.presign(key, 0, ttl)
+}
+
+// PresignPut returns a temporary URL that lets a client upload the object
+// directly, without streaming it through the function.
+func (s BlobStore) PresignPut(key string, ttl time.Duration) (string, error) {
+	return s.presign(key, 1, ttl)
+}
+
+func (s BlobStore) presign(key string, mode uint32, ttl time.Duration) (string, error) {
+	kPtr, kLen := strPtr(key)
+	raw, err := readSized(func(outPtr, outMaxLen uint32) uint32 {
+		return host_s3_presign(kPtr, kLen, mode, uint32(ttl/time.Second), outPtr, outMaxLen)
+	})
+	if err != nil {
+		return "", ErrPresignUnavailable
+	}
+	return string(raw), nil
+}
+
+type blobStream struct {
+	handle uint32
+	eof    bool
+}
+
+func (b *blobStream) Read(p []byte) (int, error) {
+	if b.eof {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	outPtr, outMaxLen := bytesPtr(p)
+	n := host_s3_read(b.handle, outPtr, outMaxLen)
+	if n == blobNoData {
+		return 0, ErrBlobFailed
+	}
+	if n == 0 {
+		b.eof = true
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+func (b *blobStream) Write(p []byte) (int, error) {
+	ptr, length := bytesPtr(p)
+	if err := blobStatus(host_s3_write(b.handle, ptr, length)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *blobStream) Close() error {
+	return blobStatus(host_s3_close(b.handle))
+}
@@ -10,36 +10,117 @@ import (
 //go:wasmimport gojinn host_db_query
 func host_db_query(queryPtr uint32, queryLen uint32, outPtr uint32, outMaxLen uint32) uint32
 
+//go:wasmimport gojinn host_db_result
+func host_db_result(outPtr uint32, outMaxLen uint32) uint32
+
 type DBHandler struct{}
 
 var DB = DBHandler{}
 
-func (d DBHandler) Query(query string) ([]map[string]interface{}, error) {
-	ptr := unsafe.Pointer(unsafe.StringData(query))
-	queryPtr := uint32(uintptr(ptr))
-	queryLen := uint32(len(query))
+// Query runs a SELECT with placeholder args and returns each row keyed by
+// column name.
+func (d DBHandler) Query(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	res, err := d.QueryResult(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Maps(), nil
+}
 
-	capacity := uint32(65536)
+// QueryResult is like Query but keeps the column order and types.
+func (d DBHandler) QueryResult(query string, args ...interface{}) (*QueryResult, error) {
+	resp, err := dbCall(dbRequest{SQL: query, Args: args, Mode: "query"})
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResult{Columns: resp.Columns, Rows: resp.Rows}, nil
+}
 
-	buffer := make([]byte, capacity)
-	outPtr := uint32(uintptr(unsafe.Pointer(&buffer[0])))
+// Exec runs an INSERT, UPDATE, DELETE or DDL statement.
+func (d DBHandler) Exec(query string, args ...interface{}) (*ExecResult, error) {
+	resp, err := dbCall(dbRequest{SQL: query, Args: args, Mode: "exec"})
+	if err != nil {
+		return nil, err
+	}
+	return &ExecResult{RowsAffected: resp.RowsAffected, LastInsertID: resp.LastInsertID}, nil
+}
 
-	written := host_db_query(queryPtr, queryLen, outPtr, capacity)
+// Begin opens a transaction. Until Commit or Rollback, every DB call of the
+// function runs inside it; the host rolls it back if the function exits
+// without finishing it.
+func (d DBHandler) Begin() (*Tx, error) {
+	if _, err := dbCall(dbRequest{Mode: "begin"}); err != nil {
+		return nil, err
+	}
+	return &Tx{}, nil
+}
+
+type Tx struct{}
+
+func (t *Tx) Query(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	return DB.Query(query, args...)
+}
+
+func (t *Tx) Exec(query string, args ...interface{}) (*ExecResult, error) {
+	return DB.Exec(query, args...)
+}
+
+func (t *Tx) Commit() error {
+	_, err := dbCall(dbRequest{Mode: "commit"})
+	return err
+}
 
-	jsonBytes := buffer[:written]
-	var result []map[string]interface{}
+func (t *Tx) Rollback() error {
+	_, err := dbCall(dbRequest{Mode: "rollback"})
+	return err
+}
+
+type dbRequest struct {
+	SQL  string        `json:"sql,omitempty"`
+	Args []interface{} `json:"args,omitempty"`
+	Mode string        `json:"mode"`
+}
+
+type dbResponse struct {
+	Columns      []Column        `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+	RowsAffected int64           `json:"rows_affected"`
+	LastInsertID int64           `json:"last_insert_id"`
+	Error        string          `json:"error"`
+}
 
-	if err := json.Unmarshal(jsonBytes, &result); err != nil {
+func dbCall(req dbRequest) (*dbResponse, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
 		return nil, err
 	}
+	queryPtr := uint32(uintptr(unsafe.Pointer(&payload[0])))
+	queryLen := uint32(len(payload))
 
-	if len(result) > 0 {
-		if errMsg, ok := result[0]["error"]; ok {
-			return nil, jsonError(errMsg.(string))
-		}
+	capacity := uint32(65536)
+	buffer := make([]byte, capacity)
+	outPtr := uint32(uintptr(unsafe.Pointer(&buffer[0])))
+
+	written := host_db_query(queryPtr, queryLen, outPtr, capacity)
+	for written != 0xFFFFFFFF && written > capacity {
+		// The host keeps oversized results; collect them with a larger buffer.
+		capacity = written
+		buffer = make([]byte, capacity)
+		outPtr = uint32(uintptr(unsafe.Pointer(&buffer[0])))
+		written = host_db_result(outPtr, capacity)
+	}
+	if written == 0xFFFFFFFF {
+		return nil, jsonError("db request failed")
 	}
 
-	return result, nil
+	var resp dbResponse
+	if err := json.Unmarshal(buffer[:written], &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, jsonError(resp.Error)
+	}
+	return &resp, nil
 }
 
 type dbError struct {
@@ -2,11 +2,21 @@
 
 package sdk
 
-import "unsafe"
+import (
+	"encoding/json"
+	"errors"
+	"unsafe"
+)
 
 //go:wasmimport gojinn host_http_get
 func host_http_get(urlPtr, urlLen, outPtr, outMaxLen uint32) uint64
 
+//go:wasmimport gojinn host_http_fetch
+func host_http_fetch(reqPtr, reqLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_http_response
+func host_http_response(outPtr, outMaxLen uint32) uint32
+
 func HttpGet(url string) string {
 	uPtr := uintptr(unsafe.Pointer(unsafe.StringData(url)))
 	uLen := uint32(len(url))
@@ -23,3 +33,35 @@ func HttpGet(url string) string {
 
 	return string(buffer[:written])
 }
+
+// Fetch performs an outbound request subject to the host egress policy. A
+// request the host refused or could not complete returns the reason as error.
+func Fetch(req HTTPRequest) (*HTTPResponse, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := uint32(64 * 1024)
+	buffer := make([]byte, capacity)
+	n := host_http_fetch(uint32(uintptr(unsafe.Pointer(&payload[0]))), uint32(len(payload)), uint32(uintptr(unsafe.Pointer(&buffer[0]))), capacity)
+	if n == 0xFFFFFFFF {
+		return nil, errors.New("invalid fetch request")
+	}
+	if n > capacity {
+		buffer = make([]byte, n)
+		n = host_http_response(uint32(uintptr(unsafe.Pointer(&buffer[0]))), n)
+		if n == 0xFFFFFFFF {
+			return nil, errors.New("fetch response unavailable")
+		}
+	}
+
+	var resp HTTPResponse
+	if err := json.Unmarshal(buffer[:n], &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
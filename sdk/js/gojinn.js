@@ -85,11 +85,59 @@ export const logger = {
   warn: (msg) => IO.log(`[WARN] ${msg}`)
 };
 
+export class KVError extends Error {
+  constructor(message, code) {
+    super(message);
+    this.code = code; // "not_found" | "conflict" | "denied" | "invalid" | "unavailable"
+  }
+}
+
+// KV requests use the JSON format of host_kv_op. Javy cannot import host
+// functions itself, so the runtime must provide globalThis.__gojinn_host.kvOp.
+function kvCall(req) {
+  const host = globalThis.__gojinn_host;
+  if (!host || typeof host.kvOp !== "function") {
+    throw new KVError("KV is not available in this JS runtime", "unavailable");
+  }
+  const resp = JSON.parse(host.kvOp(JSON.stringify(req)));
+  if (resp.code || resp.error) {
+    throw new KVError(resp.error || resp.code, resp.code);
+  }
+  return resp;
+}
+
 export const kv = {
-  set: (key, value) => logger.warn(`KV.set('${key}') not supported in JS adapter yet`),
+  set: (key, value) => {
+    try {
+      kvCall({ op: "put", key, value: String(value) });
+    } catch (e) {
+      logger.warn(`KV.set('${key}') failed: ${e.message}`);
+    }
+  },
   get: (key) => {
-    logger.warn(`KV.get('${key}') not supported in JS adapter yet`);
-    return null;
+    try {
+      return kvCall({ op: "get", key }).value ?? "";
+    } catch (e) {
+      if (e.code !== "not_found") logger.warn(`KV.get('${key}') failed: ${e.message}`);
+      return null;
+    }
+  },
+  entry: (key) => {
+    const resp = kvCall({ op: "get", key });
+    return { key, value: resp.value ?? "", revision: resp.revision };
+  },
+  put: (key, value, ttlMs = 0) => kvCall({ op: "put", key, value: String(value), ttl_ms: ttlMs }).revision,
+  // revision 0 only writes when the key does not exist
+  compareAndSwap: (key, value, revision) => kvCall({ op: "put", key, value: String(value), revision }).revision,
+  delete: (key) => { kvCall({ op: "delete", key }); },
+  list: (prefix = "", cursor = "", limit = 0) => {
+    const resp = kvCall({ op: "list", prefix, cursor, limit });
+    return { keys: resp.keys || [], cursor: resp.cursor || "" };
+  },
+  incr: (key, delta = 1) => Number(kvCall({ op: "incr", key, delta }).value),
+  watch: (prefix, after = 0, timeoutMs = 0) => {
+    const resp = kvCall({ op: "watch", prefix, after, timeout_ms: timeoutMs });
+    return { events: resp.events || [], revision: resp.revision || after };
   }
 };
 
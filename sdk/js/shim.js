@@ -1,8 +1,9 @@
-import { handle, Request, Response, logger, kv } from './gojinn.js';
+import { handle, Request, Response, logger, kv, KVError } from './gojinn.js';
 globalThis.Gojinn = {
     handle,
     Request,
     Response,
     logger,
-    kv
+    kv,
+    KVError
 };
\ No newline at end of file
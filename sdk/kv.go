@@ -3,6 +3,10 @@
 package sdk
 
 import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
 	"unsafe"
 )
 
@@ -12,6 +16,22 @@ func host_kv_set(kPtr, kLen, vPtr, vLen uint32)
 //go:wasmimport gojinn host_kv_get
 func host_kv_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
 
+//go:wasmimport gojinn host_kv_delete
+func host_kv_delete(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_kv_op
+func host_kv_op(reqPtr, reqLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_kv_result
+func host_kv_result(outPtr, outMaxLen uint32) uint32
+
+var (
+	ErrKVNotFound = errors.New("kv key not found")
+	ErrKVConflict = errors.New("kv revision mismatch")
+	ErrKVDenied   = errors.New("kv access denied")
+	ErrKVFailed   = errors.New("kv operation failed")
+)
+
 type KVStore struct{}
 
 var KV = KVStore{}
@@ -41,3 +61,137 @@ func (k KVStore) Get(key string) (string, bool) {
 
 	return string(buffer[:retLen]), true
 }
+
+func (k KVStore) Delete(key string) error {
+	kPtr, kLen := strPtr(key)
+	switch host_kv_delete(kPtr, kLen) {
+	case 0:
+		return nil
+	case 2:
+		return ErrKVDenied
+	default:
+		return ErrKVFailed
+	}
+}
+
+// Entry returns the value of key with its revision, for CompareAndSwap.
+func (k KVStore) Entry(key string) (*KVEntry, error) {
+	resp, err := kvCall(kvRequest{Op: "get", Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return &KVEntry{Key: key, Value: resp.Value, Revision: resp.Revision}, nil
+}
+
+// Put stores value and returns its revision. A positive ttl (1s or more)
+// deletes the key once it elapses.
+func (k KVStore) Put(key, value string, ttl time.Duration) (uint64, error) {
+	resp, err := kvCall(kvRequest{Op: "put", Key: key, Value: value, TTLMs: ttl.Milliseconds()})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Revision, nil
+}
+
+// CompareAndSwap stores value only if key is still at revision, or does not
+// exist when revision is 0. It fails with ErrKVConflict otherwise.
+func (k KVStore) CompareAndSwap(key, value string, revision uint64) (uint64, error) {
+	resp, err := kvCall(kvRequest{Op: "put", Key: key, Value: value, Revision: &revision})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Revision, nil
+}
+
+// List returns up to limit keys starting with prefix. Pass the returned
+// cursor to get the next page; it is empty on the last one.
+func (k KVStore) List(prefix, cursor string, limit int) (*KVPage, error) {
+	resp, err := kvCall(kvRequest{Op: "list", Prefix: prefix, Cursor: cursor, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return &KVPage{Keys: resp.Keys, Cursor: resp.Cursor}, nil
+}
+
+// Incr atomically adds delta to an integer value, treating a missing key as 0.
+func (k KVStore) Incr(key string, delta int64) (int64, error) {
+	resp, err := kvCall(kvRequest{Op: "incr", Key: key, Delta: delta})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Value, 10, 64)
+}
+
+// Watch waits up to timeout for changes to keys starting with prefix made
+// after revision after. Pass the returned Revision as after to resume.
+func (k KVStore) Watch(prefix string, after uint64, timeout time.Duration) (*KVChanges, error) {
+	resp, err := kvCall(kvRequest{Op: "watch", Prefix: prefix, After: after, TimeoutMs: timeout.Milliseconds()})
+	if err != nil {
+		return nil, err
+	}
+	return &KVChanges{Events: resp.Events, Revision: resp.Revision}, nil
+}
+
+type kvRequest struct {
+	Op        string  `json:"op"`
+	Key       string  `json:"key,omitempty"`
+	Value     string  `json:"value,omitempty"`
+	Revision  *uint64 `json:"revision,omitempty"`
+	TTLMs     int64   `json:"ttl_ms,omitempty"`
+	Prefix    string  `json:"prefix,omitempty"`
+	Cursor    string  `json:"cursor,omitempty"`
+	Limit     int     `json:"limit,omitempty"`
+	Delta     int64   `json:"delta,omitempty"`
+	After     uint64  `json:"after,omitempty"`
+	TimeoutMs int64   `json:"timeout_ms,omitempty"`
+}
+
+type kvResponse struct {
+	Value    string    `json:"value"`
+	Revision uint64    `json:"revision"`
+	Keys     []string  `json:"keys"`
+	Cursor   string    `json:"cursor"`
+	Events   []KVEvent `json:"events"`
+	Error    string    `json:"error"`
+	Code     string    `json:"code"`
+}
+
+func kvCall(req kvRequest) (*kvResponse, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	pPtr, pLen := bytesPtr(payload)
+	buffer := make([]byte, 4096)
+	outPtr, capacity := bytesPtr(buffer)
+	written := host_kv_op(pPtr, pLen, outPtr, capacity)
+	for written != blobNoData && written > capacity {
+		// The host keeps oversized results; the op must not run twice.
+		buffer = make([]byte, written)
+		outPtr, capacity = bytesPtr(buffer)
+		written = host_kv_result(outPtr, capacity)
+	}
+	if written == blobNoData {
+		return nil, ErrKVFailed
+	}
+
+	var resp kvResponse
+	if err := json.Unmarshal(buffer[:written], &resp); err != nil {
+		return nil, err
+	}
+	switch resp.Code {
+	case "":
+	case "not_found":
+		return nil, ErrKVNotFound
+	case "conflict":
+		return nil, ErrKVConflict
+	case "denied":
+		return nil, ErrKVDenied
+	default:
+		return nil, errors.New(resp.Error)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
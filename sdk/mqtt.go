@@ -0,0 +1,29 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import "unsafe"
+
+//go:wasmimport gojinn host_mqtt_publish
+func host_mqtt_publish(tPtr, tLen, pPtr, pLen, qos, retained uint32) uint32
+
+type MQTTClient struct{}
+
+var MQTT = MQTTClient{}
+
+func (m MQTTClient) Publish(topic string, payload []byte, qos byte, retained bool) bool {
+	tPtr := uintptr(unsafe.Pointer(unsafe.StringData(topic)))
+	tLen := uint32(len(topic))
+
+	var pPtr uintptr
+	if len(payload) > 0 {
+		pPtr = uintptr(unsafe.Pointer(&payload[0]))
+	}
+
+	var ret uint32
+	if retained {
+		ret = 1
+	}
+
+	return host_mqtt_publish(uint32(tPtr), tLen, uint32(pPtr), uint32(len(payload)), uint32(qos), ret) == 0
+}
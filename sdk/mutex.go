@@ -2,18 +2,41 @@
 
 package sdk
 
-import "unsafe"
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
 
 //go:wasmimport gojinn host_mutex_lock
 func host_mutex_lock(kPtr uint32, kLen uint32, ttlSeconds uint32) uint32
 
+//go:wasmimport gojinn host_mutex_acquire
+func host_mutex_acquire(kPtr, kLen, ttlMillis, waitMillis uint32) uint64
+
+//go:wasmimport gojinn host_mutex_renew
+func host_mutex_renew(kPtr, kLen, ttlMillis uint32) uint32
+
 //go:wasmimport gojinn host_mutex_unlock
 func host_mutex_unlock(kPtr uint32, kLen uint32) uint32
 
+var (
+	ErrLockTimeout = errors.New("lock not acquired before the wait elapsed")
+	ErrLockLost    = errors.New("lock lease expired and was taken by another owner")
+)
+
 type MutexService struct{}
 
 var Mutex = MutexService{}
 
+// Lock is a lease held by the running invocation. Token grows with every new
+// owner of the key; pass it to downstream systems so they can reject writes
+// from a holder whose lease already expired.
+type Lock struct {
+	Key   string
+	Token uint64
+}
+
 func (m MutexService) TryLock(key string, ttlSeconds uint32) bool {
 	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
 	kLen := uint32(len(key))
@@ -22,6 +45,17 @@ func (m MutexService) TryLock(key string, ttlSeconds uint32) bool {
 	return success == 1
 }
 
+// Lock waits up to wait for key and holds it for ttl. A zero ttl means 30
+// seconds; a zero wait tries once.
+func (m MutexService) Lock(key string, ttl, wait time.Duration) (*Lock, error) {
+	kPtr, kLen := strPtr(key)
+	token := host_mutex_acquire(kPtr, kLen, millis(ttl), millis(wait))
+	if token == 0 {
+		return nil, ErrLockTimeout
+	}
+	return &Lock{Key: key, Token: token}, nil
+}
+
 func (m MutexService) Unlock(key string) bool {
 	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
 	kLen := uint32(len(key))
@@ -29,3 +63,29 @@ func (m MutexService) Unlock(key string) bool {
 	success := host_mutex_unlock(uint32(kPtr), kLen)
 	return success == 1
 }
+
+// Renew extends the lease by ttl from now.
+func (l *Lock) Renew(ttl time.Duration) error {
+	kPtr, kLen := strPtr(l.Key)
+	if host_mutex_renew(kPtr, kLen, millis(ttl)) != 1 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Unlock releases the lease. It fails with ErrLockLost when the lease had
+// already passed to another owner.
+func (l *Lock) Unlock() error {
+	kPtr, kLen := strPtr(l.Key)
+	if host_mutex_unlock(kPtr, kLen) != 1 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+func millis(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	return uint32(min(d.Milliseconds(), int64(^uint32(0))))
+}
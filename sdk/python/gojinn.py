@@ -54,6 +54,65 @@ class Logger:
 
 logger = Logger()
 
+try:
+    # CPython on WASI cannot import host functions itself; runtimes built
+    # with the gojinn bridge expose host_kv_op as this module.
+    import _gojinn_host
+except ImportError:
+    _gojinn_host = None
+
+class KVError(Exception):
+    def __init__(self, message, code=""):
+        super().__init__(message)
+        self.code = code  # "not_found" | "conflict" | "denied" | "invalid" | "unavailable"
+
+class KV:
+    def _call(self, req):
+        if _gojinn_host is None:
+            raise KVError("KV is not available in this Python runtime", "unavailable")
+        resp = json.loads(_gojinn_host.kv_op(json.dumps(req)))
+        if resp.get("code") or resp.get("error"):
+            raise KVError(resp.get("error") or resp.get("code"), resp.get("code", ""))
+        return resp
+
+    def get(self, key):
+        try:
+            return self._call({"op": "get", "key": key}).get("value", "")
+        except KVError as e:
+            if e.code == "not_found":
+                return None
+            raise
+
+    def set(self, key, value):
+        self.put(key, value)
+
+    def entry(self, key):
+        resp = self._call({"op": "get", "key": key})
+        return {"key": key, "value": resp.get("value", ""), "revision": resp.get("revision", 0)}
+
+    def put(self, key, value, ttl_ms=0):
+        return self._call({"op": "put", "key": key, "value": str(value), "ttl_ms": ttl_ms}).get("revision", 0)
+
+    def compare_and_swap(self, key, value, revision):
+        """Writes only if key is still at revision, or absent when revision is 0."""
+        return self._call({"op": "put", "key": key, "value": str(value), "revision": revision}).get("revision", 0)
+
+    def delete(self, key):
+        self._call({"op": "delete", "key": key})
+
+    def list(self, prefix="", cursor="", limit=0):
+        resp = self._call({"op": "list", "prefix": prefix, "cursor": cursor, "limit": limit})
+        return resp.get("keys", []), resp.get("cursor", "")
+
+    def incr(self, key, delta=1):
+        return int(self._call({"op": "incr", "key": key, "delta": delta})["value"])
+
+    def watch(self, prefix, after=0, timeout_ms=0):
+        resp = self._call({"op": "watch", "prefix": prefix, "after": after, "timeout_ms": timeout_ms})
+        return resp.get("events", []), resp.get("revision", after)
+
+kv = KV()
+
 def handle(handler_func):
     try:
         input_data = sys.stdin.read()
@@ -8,7 +8,14 @@ extern "C" {
     fn host_db_query(q_ptr: u32, q_len: u32, out_ptr: u32, out_max: u32) -> u32;
     fn host_kv_set(k_ptr: u32, k_len: u32, v_ptr: u32, v_len: u32);
     fn host_kv_get(k_ptr: u32, k_len: u32, out_ptr: u32, out_max: u32) -> u64;
+    fn host_kv_delete(k_ptr: u32, k_len: u32) -> u32;
+    fn host_kv_op(req_ptr: u32, req_len: u32, out_ptr: u32, out_max: u32) -> u32;
+    fn host_kv_result(out_ptr: u32, out_max: u32) -> u32;
     fn host_ask_ai(p_ptr: u32, p_len: u32, out_ptr: u32, out_max: u32) -> u64;
+    fn host_actor_state(out_ptr: u32, out_max: u32) -> u32;
+    fn host_actor_set_state(ptr: u32, len: u32) -> u32;
+    fn host_actor_set_alarm(delay_ms: u64) -> u32;
+    fn host_actor_cancel_alarm() -> u32;
 }
 
 
@@ -92,6 +99,165 @@ pub mod kv {
         let val = String::from_utf8_lossy(&buffer[..written as usize]).to_string();
         Some(val)
     }
+
+    const NO_DATA: u32 = 0xFFFFFFFF;
+
+    #[derive(Debug, PartialEq)]
+    pub enum Error {
+        NotFound,
+        Conflict,
+        Denied,
+        Failed(String),
+    }
+
+    #[derive(Debug, Deserialize)]
+    pub struct Entry {
+        #[serde(default)]
+        pub key: String,
+        #[serde(default)]
+        pub value: String,
+        #[serde(default)]
+        pub revision: u64,
+    }
+
+    #[derive(Debug, Deserialize)]
+    pub struct Event {
+        pub key: String,
+        #[serde(default)]
+        pub value: String,
+        pub revision: u64,
+        /// "put" or "delete"
+        pub op: String,
+    }
+
+    #[derive(Debug, Default, Deserialize)]
+    struct Reply {
+        #[serde(default)]
+        value: String,
+        #[serde(default)]
+        revision: u64,
+        #[serde(default)]
+        keys: Vec<String>,
+        #[serde(default)]
+        cursor: String,
+        #[serde(default)]
+        events: Vec<Event>,
+        #[serde(default)]
+        error: String,
+        #[serde(default)]
+        code: String,
+    }
+
+    fn call(req: serde_json::Value) -> Result<Reply, Error> {
+        let payload = req.to_string();
+        let mut buffer = vec![0u8; 4096];
+        let mut written = unsafe {
+            host_kv_op(
+                payload.as_ptr() as u32,
+                payload.len() as u32,
+                buffer.as_mut_ptr() as u32,
+                buffer.len() as u32,
+            )
+        };
+        // The host keeps oversized results; the op must not run twice.
+        while written != NO_DATA && written as usize > buffer.len() {
+            buffer = vec![0u8; written as usize];
+            written = unsafe { host_kv_result(buffer.as_mut_ptr() as u32, buffer.len() as u32) };
+        }
+        if written == NO_DATA {
+            return Err(Error::Failed("kv operation failed".to_string()));
+        }
+
+        let reply: Reply = serde_json::from_slice(&buffer[..written as usize])
+            .map_err(|e| Error::Failed(e.to_string()))?;
+        match reply.code.as_str() {
+            "" if reply.error.is_empty() => Ok(reply),
+            "not_found" => Err(Error::NotFound),
+            "conflict" => Err(Error::Conflict),
+            "denied" => Err(Error::Denied),
+            _ => Err(Error::Failed(reply.error)),
+        }
+    }
+
+    pub fn delete(key: &str) -> Result<(), Error> {
+        match unsafe { host_kv_delete(key.as_ptr() as u32, key.len() as u32) } {
+            0 => Ok(()),
+            2 => Err(Error::Denied),
+            _ => Err(Error::Failed("kv delete failed".to_string())),
+        }
+    }
+
+    /// Value of `key` with its revision, for `compare_and_swap`.
+    pub fn entry(key: &str) -> Result<Entry, Error> {
+        let reply = call(serde_json::json!({"op": "get", "key": key}))?;
+        Ok(Entry { key: key.to_string(), value: reply.value, revision: reply.revision })
+    }
+
+    /// Stores `value`; a `ttl_ms` of 1000 or more deletes the key once it elapses.
+    pub fn put(key: &str, value: &str, ttl_ms: u64) -> Result<u64, Error> {
+        let reply = call(serde_json::json!({"op": "put", "key": key, "value": value, "ttl_ms": ttl_ms}))?;
+        Ok(reply.revision)
+    }
+
+    /// Stores `value` only if `key` is still at `revision`, or absent when `revision` is 0.
+    pub fn compare_and_swap(key: &str, value: &str, revision: u64) -> Result<u64, Error> {
+        let reply = call(serde_json::json!({"op": "put", "key": key, "value": value, "revision": revision}))?;
+        Ok(reply.revision)
+    }
+
+    /// One page of keys under `prefix` and the cursor of the next page, empty on the last one.
+    pub fn list(prefix: &str, cursor: &str, limit: u32) -> Result<(Vec<String>, String), Error> {
+        let reply = call(serde_json::json!({"op": "list", "prefix": prefix, "cursor": cursor, "limit": limit}))?;
+        Ok((reply.keys, reply.cursor))
+    }
+
+    pub fn incr(key: &str, delta: i64) -> Result<i64, Error> {
+        let reply = call(serde_json::json!({"op": "incr", "key": key, "delta": delta}))?;
+        reply.value.parse().map_err(|_| Error::Failed("counter is not an integer".to_string()))
+    }
+
+    /// Waits up to `timeout_ms` for changes under `prefix` newer than `after`.
+    /// Returns the events and the revision to pass as `after` next time.
+    pub fn watch(prefix: &str, after: u64, timeout_ms: u64) -> Result<(Vec<Event>, u64), Error> {
+        let reply = call(serde_json::json!({"op": "watch", "prefix": prefix, "after": after, "timeout_ms": timeout_ms}))?;
+        Ok((reply.events, reply.revision))
+    }
+}
+
+/// State and alarm of the actor being run. Changes are checkpointed when the
+/// function exits successfully and dropped otherwise.
+pub mod actor {
+    use super::*;
+
+    /// The state as of the last checkpoint, `None` for a new actor or outside of one.
+    pub fn state() -> Option<Vec<u8>> {
+        let mut buffer = vec![0u8; 4096];
+        loop {
+            let n = unsafe { host_actor_state(buffer.as_mut_ptr() as u32, buffer.len() as u32) };
+            if n == u32::MAX {
+                return None;
+            }
+            if n as usize <= buffer.len() {
+                buffer.truncate(n as usize);
+                return Some(buffer);
+            }
+            buffer = vec![0u8; n as usize];
+        }
+    }
+
+    /// Replaces the state; an empty one deletes it. False outside of an actor.
+    pub fn set_state(state: &[u8]) -> bool {
+        unsafe { host_actor_set_state(state.as_ptr() as u32, state.len() as u32) == 1 }
+    }
+
+    /// Runs the actor again after `delay_ms`, replacing any pending alarm.
+    pub fn set_alarm(delay_ms: u64) -> bool {
+        unsafe { host_actor_set_alarm(delay_ms) == 1 }
+    }
+
+    pub fn cancel_alarm() -> bool {
+        unsafe { host_actor_cancel_alarm() == 1 }
+    }
 }
 
 pub mod ai {
@@ -123,6 +289,17 @@ pub struct Request {
     pub body: String,
     pub headers: Option<HashMap<String, Vec<String>>>,
     pub method: Option<String>,
+    pub actor: Option<ActorInfo>,
+}
+
+/// Set when the function runs as an actor; `alarm` marks runs started by an alarm.
+#[derive(Deserialize)]
+pub struct ActorInfo {
+    #[serde(rename = "type")]
+    pub kind: String,
+    pub id: String,
+    #[serde(default)]
+    pub alarm: bool,
 }
 
 #[derive(Serialize)]
@@ -137,7 +314,7 @@ pub fn read_input() -> Result<Request, String> {
     io::stdin().read_to_string(&mut buffer).map_err(|e| e.to_string())?;
     
     if buffer.trim().is_empty() {
-        return Ok(Request { body: "".to_string(), headers: None, method: None });
+        return Ok(Request { body: "".to_string(), headers: None, method: None, actor: None });
     }
 
     serde_json::from_str(&buffer).map_err(|e| e.to_string())
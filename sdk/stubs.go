@@ -2,26 +2,149 @@
 
 package sdk
 
-import "errors"
+import (
+	"errors"
+	"io"
+	"time"
+)
 
 type DBHandlerStub struct{}
 
-func (d DBHandlerStub) Query(query string) ([]map[string]interface{}, error) {
-	return nil, errors.New("cannot run sdk.DB on host machine (wasm only)")
+var errDBWasmOnly = errors.New("cannot run sdk.DB on host machine (wasm only)")
+
+func (d DBHandlerStub) Query(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	return nil, errDBWasmOnly
+}
+
+func (d DBHandlerStub) QueryResult(query string, args ...interface{}) (*QueryResult, error) {
+	return nil, errDBWasmOnly
+}
+
+func (d DBHandlerStub) Exec(query string, args ...interface{}) (*ExecResult, error) {
+	return nil, errDBWasmOnly
+}
+
+func (d DBHandlerStub) Begin() (*TxStub, error) { return nil, errDBWasmOnly }
+
+type TxStub struct{}
+
+func (t *TxStub) Query(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	return nil, errDBWasmOnly
+}
+
+func (t *TxStub) Exec(query string, args ...interface{}) (*ExecResult, error) {
+	return nil, errDBWasmOnly
 }
 
+func (t *TxStub) Commit() error   { return errDBWasmOnly }
+func (t *TxStub) Rollback() error { return errDBWasmOnly }
+
 var DB = DBHandlerStub{}
 
+var errKVWasmOnly = errors.New("cannot run sdk.KV on host machine (wasm only)")
+
 type KVStoreStub struct{}
 
-func (k KVStoreStub) Set(key, value string)         {}
-func (k KVStoreStub) Get(key string) (string, bool) { return "", false }
+func (k KVStoreStub) Set(key, value string)                       {}
+func (k KVStoreStub) Get(key string) (string, bool)               { return "", false }
+func (k KVStoreStub) Delete(key string) error                     { return errKVWasmOnly }
+func (k KVStoreStub) Entry(key string) (*KVEntry, error)          { return nil, errKVWasmOnly }
+func (k KVStoreStub) Incr(key string, delta int64) (int64, error) { return 0, errKVWasmOnly }
+func (k KVStoreStub) Put(key, value string, ttl time.Duration) (uint64, error) {
+	return 0, errKVWasmOnly
+}
+func (k KVStoreStub) CompareAndSwap(key, value string, revision uint64) (uint64, error) {
+	return 0, errKVWasmOnly
+}
+func (k KVStoreStub) List(prefix, cursor string, limit int) (*KVPage, error) {
+	return nil, errKVWasmOnly
+}
+func (k KVStoreStub) Watch(prefix string, after uint64, timeout time.Duration) (*KVChanges, error) {
+	return nil, errKVWasmOnly
+}
 
 var KV = KVStoreStub{}
 
+var errMutexWasmOnly = errors.New("cannot run sdk.Mutex on host machine (wasm only)")
+
 type MutexServiceStub struct{}
 
 func (m MutexServiceStub) TryLock(key string, ttlSeconds uint32) bool { return false }
 func (m MutexServiceStub) Unlock(key string) bool                     { return false }
+func (m MutexServiceStub) Lock(key string, ttl, wait time.Duration) (*LockStub, error) {
+	return nil, errMutexWasmOnly
+}
+
+type LockStub struct {
+	Key   string
+	Token uint64
+}
+
+func (l *LockStub) Renew(ttl time.Duration) error { return errMutexWasmOnly }
+func (l *LockStub) Unlock() error                 { return errMutexWasmOnly }
 
 var Mutex = MutexServiceStub{}
+
+type MQTTClientStub struct{}
+
+func (m MQTTClientStub) Publish(topic string, payload []byte, qos byte, retained bool) bool {
+	return false
+}
+
+var MQTT = MQTTClientStub{}
+
+var errBlobWasmOnly = errors.New("cannot run sdk.S3 on host machine (wasm only)")
+
+type BlobStoreStub struct{}
+
+func (s BlobStoreStub) Put(key string, data []byte) error             { return errBlobWasmOnly }
+func (s BlobStoreStub) Get(key string) ([]byte, error)                { return nil, errBlobWasmOnly }
+func (s BlobStoreStub) Delete(key string) error                       { return errBlobWasmOnly }
+func (s BlobStoreStub) Head(key string) (*ObjectInfo, error)          { return nil, errBlobWasmOnly }
+func (s BlobStoreStub) List(prefix, cursor string) (*ListPage, error) { return nil, errBlobWasmOnly }
+func (s BlobStoreStub) Open(key string) (io.ReadCloser, error)        { return nil, errBlobWasmOnly }
+func (s BlobStoreStub) Create(key string) (io.WriteCloser, error)     { return nil, errBlobWasmOnly }
+func (s BlobStoreStub) PresignGet(key string, ttl time.Duration) (string, error) {
+	return "", errBlobWasmOnly
+}
+func (s BlobStoreStub) PresignPut(key string, ttl time.Duration) (string, error) {
+	return "", errBlobWasmOnly
+}
+
+var S3 = BlobStoreStub{}
+
+var errActorWasmOnly = errors.New("cannot run sdk.Actor on host machine (wasm only)")
+
+type ActorStub struct{}
+
+func (a ActorStub) State() ([]byte, error)             { return nil, errActorWasmOnly }
+func (a ActorStub) SetState(state []byte) error        { return errActorWasmOnly }
+func (a ActorStub) SetAlarm(delay time.Duration) error { return errActorWasmOnly }
+func (a ActorStub) CancelAlarm() error                 { return errActorWasmOnly }
+
+var Actor = ActorStub{}
+
+var errWSWasmOnly = errors.New("cannot run sdk.WS on host machine (wasm only)")
+
+const (
+	WSBinary      uint32 = 1
+	WSExcludeSelf uint32 = 2
+)
+
+type WSFrame struct {
+	Data   []byte
+	Binary bool
+}
+
+type WebSocketStub struct{}
+
+func (w WebSocketStub) Upgrade() bool                                        { return false }
+func (w WebSocketStub) Receive() (WSFrame, error)                            { return WSFrame{}, errWSWasmOnly }
+func (w WebSocketStub) Send(data []byte) error                               { return errWSWasmOnly }
+func (w WebSocketStub) SendBinary(data []byte) error                         { return errWSWasmOnly }
+func (w WebSocketStub) Close(code int, reason string) error                  { return errWSWasmOnly }
+func (w WebSocketStub) Join(room string) error                               { return errWSWasmOnly }
+func (w WebSocketStub) Leave(room string) error                              { return errWSWasmOnly }
+func (w WebSocketStub) Publish(room string, data []byte, flags uint32) error { return errWSWasmOnly }
+
+var WS = WebSocketStub{}
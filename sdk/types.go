@@ -6,6 +6,16 @@ type Request struct {
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
 	TraceID string              `json:"trace_id,omitempty"`
+	Params  map[string]string   `json:"params,omitempty"`
+	Actor   *ActorInfo          `json:"actor,omitempty"`
+}
+
+// ActorInfo is set when the function runs as an actor. Alarm marks the
+// invocations started by an alarm instead of a request.
+type ActorInfo struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Alarm bool   `json:"alarm,omitempty"`
 }
 
 type Response struct {
@@ -13,3 +23,85 @@ type Response struct {
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
 }
+
+type ObjectInfo struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified"`
+}
+
+type ListPage struct {
+	Items      []ObjectInfo `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type HTTPRequest struct {
+	Method    string            `json:"method,omitempty"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      []byte            `json:"body,omitempty"`
+	TimeoutMs int               `json:"timeout_ms,omitempty"`
+}
+
+type HTTPResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+type Column struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable *bool  `json:"nullable,omitempty"`
+}
+
+type QueryResult struct {
+	Columns []Column        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Maps returns the rows keyed by column name.
+func (q *QueryResult) Maps() []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(q.Rows))
+	for _, row := range q.Rows {
+		entry := make(map[string]interface{}, len(q.Columns))
+		for i, col := range q.Columns {
+			if i < len(row) {
+				entry[col.Name] = row[i]
+			}
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+type ExecResult struct {
+	RowsAffected int64 `json:"rows_affected"`
+	LastInsertID int64 `json:"last_insert_id"`
+}
+
+type KVEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision"`
+}
+
+type KVPage struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+// KVEvent is one change seen by Watch. Op is "put" or "delete".
+type KVEvent struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+	Op       string `json:"op"`
+}
+
+type KVChanges struct {
+	Events   []KVEvent `json:"events"`
+	Revision uint64    `json:"revision"`
+}
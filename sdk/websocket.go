@@ -0,0 +1,132 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import "errors"
+
+//go:wasmimport gojinn host_ws_upgrade
+func host_ws_upgrade() uint32
+
+//go:wasmimport gojinn host_ws_receive
+func host_ws_receive(outPtr, outMaxLen uint32) uint64
+
+//go:wasmimport gojinn host_ws_send
+func host_ws_send(ptr, length, flags uint32) uint32
+
+//go:wasmimport gojinn host_ws_close
+func host_ws_close(code, reasonPtr, reasonLen uint32) uint32
+
+//go:wasmimport gojinn host_ws_join
+func host_ws_join(roomPtr, roomLen uint32) uint32
+
+//go:wasmimport gojinn host_ws_leave
+func host_ws_leave(roomPtr, roomLen uint32) uint32
+
+//go:wasmimport gojinn host_ws_publish
+func host_ws_publish(roomPtr, roomLen, ptr, length, flags uint32) uint32
+
+// Publish flags.
+const (
+	WSBinary      uint32 = 1 // deliver as a binary frame
+	WSExcludeSelf uint32 = 2 // skip the connection of the publisher
+)
+
+var (
+	ErrWSClosed     = errors.New("websocket closed")
+	ErrWSFailed     = errors.New("websocket operation failed")
+	ErrWSRoomDenied = errors.New("websocket room denied")
+)
+
+// WSFrame is a message received from the client.
+type WSFrame struct {
+	Data   []byte
+	Binary bool
+}
+
+type WebSocketService struct{}
+
+// WS accepts the WebSocket handshake of the request being served and talks
+// to the client. Rooms fan messages out to the sockets joined on every node.
+var WS = WebSocketService{}
+
+// Upgrade completes the handshake. It fails when the request is not a
+// WebSocket handshake or its Origin is not allowed.
+func (w WebSocketService) Upgrade() bool {
+	return host_ws_upgrade() == 1
+}
+
+// Receive blocks until the client sends a frame. It returns ErrWSClosed once
+// the client is gone or the function timeout is reached.
+func (w WebSocketService) Receive() (WSFrame, error) {
+	buffer := make([]byte, 4096)
+	for {
+		outPtr, capacity := bytesPtr(buffer)
+		n := host_ws_receive(outPtr, capacity)
+		if n == ^uint64(0) {
+			return WSFrame{}, ErrWSClosed
+		}
+		size := uint32(n)
+		if size > capacity {
+			buffer = make([]byte, size)
+			continue
+		}
+		return WSFrame{Data: buffer[:size], Binary: n>>32&1 == 1}, nil
+	}
+}
+
+func (w WebSocketService) Send(data []byte) error {
+	return w.send(data, 0)
+}
+
+func (w WebSocketService) SendBinary(data []byte) error {
+	return w.send(data, WSBinary)
+}
+
+func (w WebSocketService) send(data []byte, flags uint32) error {
+	ptr, length := bytesPtr(data)
+	if host_ws_send(ptr, length, flags) != 1 {
+		return ErrWSClosed
+	}
+	return nil
+}
+
+// Close sends a close frame with code and reason and leaves every room.
+func (w WebSocketService) Close(code int, reason string) error {
+	ptr, length := strPtr(reason)
+	if host_ws_close(uint32(code), ptr, length) != 1 {
+		return ErrWSFailed
+	}
+	return nil
+}
+
+// Join delivers every message published to room to this connection until it
+// leaves or closes. Room names use letters, digits, '-' and '_' and must be
+// allowed by the ws_rooms permission.
+func (w WebSocketService) Join(room string) error {
+	ptr, length := strPtr(room)
+	return wsStatus(host_ws_join(ptr, length))
+}
+
+func (w WebSocketService) Leave(room string) error {
+	ptr, length := strPtr(room)
+	return wsStatus(host_ws_leave(ptr, length))
+}
+
+// Publish sends data to every connection in room across the cluster. It
+// works without an upgraded connection too.
+func (w WebSocketService) Publish(room string, data []byte, flags uint32) error {
+	rPtr, rLen := strPtr(room)
+	ptr, length := bytesPtr(data)
+	return wsStatus(host_ws_publish(rPtr, rLen, ptr, length, flags))
+}
+
+func wsStatus(code uint32) error {
+	switch code {
+	case 0:
+		return nil
+	case 2:
+		return ErrWSRoomDenied
+	default:
+		return ErrWSFailed
+	}
+}
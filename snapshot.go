@@ -3,10 +3,12 @@ package gojinn
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -42,6 +44,12 @@ func (r *Gojinn) CreateGlobalSnapshot() (string, error) {
 		}
 	}
 
+	if r.tenantDBs != nil {
+		if err := r.snapshotTenantDBs(filepath.Join(stageDir, "tenants")); err != nil {
+			return "", err
+		}
+	}
+
 	r.logger.Info("Snapshotting NATS JetStream & KV Store...")
 	natsStorePath := filepath.Join(r.DataDir, "nats_store")
 	natsStagePath := filepath.Join(stageDir, "nats_store")
@@ -68,6 +76,91 @@ func (r *Gojinn) CreateGlobalSnapshot() (string, error) {
 	return snapshotPath, nil
 }
 
+// snapshotTenantDBs copies every tenant database on disk into stageDir with
+// VACUUM INTO, which yields a consistent copy while the database stays in use.
+func (r *Gojinn) snapshotTenantDBs(stageDir string) error {
+	ids, err := r.tenantDBs.tenants()
+	if err != nil {
+		return fmt.Errorf("failed to list tenant databases: %w", err)
+	}
+	r.logger.Info("Snapshotting Tenant Databases (VACUUM INTO)...", zap.Int("count", len(ids)))
+
+	ctx := context.Background()
+	for _, id := range ids {
+		if err := os.MkdirAll(filepath.Join(stageDir, id), 0755); err != nil {
+			return err
+		}
+		db, err := r.tenantDBs.acquire(ctx, id, r.tenantConfig(id))
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+		_, err = db.ExecContext(ctx, "VACUUM INTO ?", filepath.Join(stageDir, id, tenantDBFile))
+		r.tenantDBs.release(id)
+		if err != nil {
+			return fmt.Errorf("tenant %s: db vacuum into failed: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// snapshotBlobPrefix keeps snapshot archives apart from tenant objects, which
+// are always stored under "<tenant>/".
+const snapshotBlobPrefix = ".gojinn/snapshots/"
+
+// uploadSnapshot streams an archive to the blob store so it survives the loss
+// of the node that produced it.
+func (r *Gojinn) uploadSnapshot(ctx context.Context, snapshotPath string) (string, error) {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := snapshotBlobPrefix + filepath.Base(snapshotPath)
+	if err := r.Storage.PutStream(ctx, key, f, stat.Size()); err != nil {
+		return "", fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+	return key, nil
+}
+
+// downloadSnapshot fetches an archive uploaded by uploadSnapshot into the
+// local snapshot directory and returns its path.
+func (r *Gojinn) downloadSnapshot(ctx context.Context, key string) (string, error) {
+	name := strings.TrimPrefix(key, snapshotBlobPrefix)
+	if name == key || name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid snapshot key %q", key)
+	}
+
+	snapshotDir := filepath.Join(r.DataDir, "snapshots")
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+
+	body, err := r.Storage.GetStream(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	defer body.Close()
+
+	target := filepath.Join(snapshotDir, name)
+	out, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, body); err != nil {
+		_ = os.Remove(target)
+		return "", fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	return target, nil
+}
+
 func copyDir(src, dst string) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -181,6 +274,14 @@ func (r *Gojinn) RestoreGlobalSnapshot(archivePath string) error {
 		_ = copyFile(dbStage, dbTarget)
 	}
 
+	tenantsStage := filepath.Join(stageDir, "tenants")
+	if _, err := os.Stat(tenantsStage); err == nil {
+		r.logger.Info("Restoring Tenant Databases...")
+		tenantsTarget := filepath.Join(r.DataDir, "tenants")
+		_ = os.RemoveAll(tenantsTarget)
+		_ = copyDir(tenantsStage, tenantsTarget)
+	}
+
 	r.logger.Warn("Files successfully swapped! The server will now shut down to safely load the new state on the next boot.")
 	return nil
 }
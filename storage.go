@@ -0,0 +1,100 @@
+package gojinn
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gojinn-io/gojinn/pkg/blob/fs"
+	"github.com/gojinn-io/gojinn/pkg/blob/jetstream"
+	"github.com/gojinn-io/gojinn/pkg/blob/mem"
+	"github.com/gojinn-io/gojinn/pkg/blob/s3"
+	"go.uber.org/zap"
+)
+
+const (
+	StorageFS        = "fs"
+	StorageMem       = "mem"
+	StorageS3        = "s3"
+	StorageJetStream = "jetstream"
+
+	defaultBlobBucket = "GOJINN_BLOBS"
+)
+
+// StorageConfig selects the blob.Provider behind the host_s3_* functions.
+type StorageConfig struct {
+	Driver string `json:"driver,omitempty"`
+
+	// fs
+	Path string `json:"path,omitempty"`
+
+	// s3 and jetstream
+	Bucket string `json:"bucket,omitempty"`
+
+	// s3
+	Region    string `json:"region,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+}
+
+func (c *StorageConfig) validate() error {
+	switch c.Driver {
+	case StorageFS, StorageMem, StorageJetStream:
+	case StorageS3:
+		if c.Bucket == "" {
+			return fmt.Errorf("storage s3 requires a bucket")
+		}
+	default:
+		return fmt.Errorf("unknown storage driver %q (use fs, mem, s3 or jetstream)", c.Driver)
+	}
+	return nil
+}
+
+// setupStorage builds the configured provider. It runs after the embedded
+// NATS server is up because the jetstream driver stores blobs in it. A
+// Storage set programmatically is kept as is.
+func (r *Gojinn) setupStorage() error {
+	if r.Storage != nil || r.StorageConfig == nil {
+		return nil
+	}
+	cfg := r.StorageConfig
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	switch cfg.Driver {
+	case StorageFS:
+		path := cfg.Path
+		if path == "" {
+			path = filepath.Join(r.DataDir, "blobs")
+		}
+		store, err := fs.New(path)
+		if err != nil {
+			return err
+		}
+		r.Storage = store
+	case StorageMem:
+		r.Storage = mem.New()
+	case StorageS3:
+		r.Storage = s3.New(s3.Config{
+			Bucket:    cfg.Bucket,
+			Region:    cfg.Region,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+			Endpoint:  cfg.Endpoint,
+		})
+	case StorageJetStream:
+		bucket := cfg.Bucket
+		if bucket == "" {
+			bucket = defaultBlobBucket
+		}
+		store, err := jetstream.New(r.js, jetstream.Config{Bucket: bucket, Replicas: r.ClusterReplicas})
+		if err != nil {
+			return err
+		}
+		r.Storage = store
+	}
+
+	r.logger.Info("Blob storage ready", zap.String("driver", cfg.Driver))
+	return nil
+}
@@ -0,0 +1,267 @@
+package gojinn
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gojinn-io/gojinn/pkg/migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTenantDBMaxOpen = 64
+	tenantDBFile           = "db.sqlite"
+
+	// sqlitePageSize is the page size of databases created by modernc.org/sqlite.
+	// Size quotas are enforced with max_page_count, which counts pages.
+	sqlitePageSize = 4096
+)
+
+// TenantDBConfig gives every tenant a private SQLite file at
+// DataDir/tenants/<id>/db.sqlite, opened on first use.
+type TenantDBConfig struct {
+	// MaxOpen bounds the handles kept open; the least recently used idle
+	// ones are closed first.
+	MaxOpen int `json:"max_open,omitempty"`
+
+	// Migrations is a directory of .sql files applied in name order the
+	// first time a tenant database is opened.
+	Migrations string `json:"migrations,omitempty"`
+
+	// MaxSize is the default size quota. TenantConfig.MaxDBSize overrides it.
+	MaxSize string `json:"max_size,omitempty"`
+}
+
+func (c *TenantDBConfig) validate() error {
+	if c.MaxOpen < 0 {
+		return fmt.Errorf("tenant_db max_open must not be negative")
+	}
+	if c.MaxSize != "" {
+		if _, err := humanize.ParseBytes(c.MaxSize); err != nil {
+			return fmt.Errorf("invalid tenant_db max_size: %v", err)
+		}
+	}
+	if c.Migrations != "" {
+		if fi, err := os.Stat(c.Migrations); err != nil || !fi.IsDir() {
+			return fmt.Errorf("tenant_db migrations %q is not a directory", c.Migrations)
+		}
+	}
+	return nil
+}
+
+type tenantDB struct {
+	id       string
+	db       *sql.DB
+	maxPages uint64
+	refs     int
+}
+
+// tenantDBPool is an LRU of open tenant databases. Handles in use by an
+// invocation are never closed; the pool may briefly exceed max when every
+// handle is busy.
+type tenantDBPool struct {
+	mu      sync.Mutex
+	root    string
+	max     int
+	cfg     *TenantDBConfig
+	lru     *list.List
+	entries map[string]*list.Element
+	logger  *zap.Logger
+}
+
+func (r *Gojinn) setupTenantDBs() error {
+	if r.TenantDB == nil {
+		return nil
+	}
+	if err := r.TenantDB.validate(); err != nil {
+		return err
+	}
+	maxOpen := r.TenantDB.MaxOpen
+	if maxOpen == 0 {
+		maxOpen = defaultTenantDBMaxOpen
+	}
+	r.tenantDBs = &tenantDBPool{
+		root:    filepath.Join(r.DataDir, "tenants"),
+		max:     maxOpen,
+		cfg:     r.TenantDB,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		logger:  r.logger,
+	}
+	return nil
+}
+
+// maxPages converts the tenant's size quota to a page count, 0 meaning
+// unlimited.
+func (p *tenantDBPool) maxPages(tenant *TenantConfig) uint64 {
+	limit := p.cfg.MaxSize
+	if tenant != nil && tenant.MaxDBSize != "" {
+		limit = tenant.MaxDBSize
+	}
+	if limit == "" {
+		return 0
+	}
+	n, err := humanize.ParseBytes(limit)
+	if err != nil {
+		return 0
+	}
+	return max(n/sqlitePageSize, 1)
+}
+
+// acquire returns the database of tenantID, opening and migrating it on first
+// use. Every successful acquire must be paired with release.
+func (p *tenantDBPool) acquire(ctx context.Context, tenantID string, tenant *TenantConfig) (*sql.DB, error) {
+	if !validTenantID.MatchString(tenantID) {
+		return nil, fmt.Errorf("invalid tenant id %q for tenant database", tenantID)
+	}
+	pages := p.maxPages(tenant)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.entries[tenantID]; ok {
+		entry := el.Value.(*tenantDB)
+		if entry.maxPages == pages || entry.refs > 0 {
+			// A changed quota is picked up once the handle is idle.
+			entry.refs++
+			p.lru.MoveToFront(el)
+			return entry.db, nil
+		}
+		p.remove(el)
+	}
+
+	db, err := p.open(ctx, tenantID, pages)
+	if err != nil {
+		return nil, err
+	}
+	p.entries[tenantID] = p.lru.PushFront(&tenantDB{id: tenantID, db: db, maxPages: pages, refs: 1})
+	p.evict()
+	return db, nil
+}
+
+func (p *tenantDBPool) release(tenantID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.entries[tenantID]; ok {
+		el.Value.(*tenantDB).refs--
+	}
+	p.evict()
+}
+
+// open creates the tenant file if needed. The quota is set per connection
+// through the DSN, so writes past it fail with SQLITE_FULL.
+func (p *tenantDBPool) open(ctx context.Context, tenantID string, pages uint64) (*sql.DB, error) {
+	dir := filepath.Join(p.root, tenantID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tenant database dir: %w", err)
+	}
+
+	dsn := "file:" + filepath.Join(dir, tenantDBFile) + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	if pages > 0 {
+		dsn += fmt.Sprintf("&_pragma=max_page_count(%d)", pages)
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant database: %w", err)
+	}
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(1)
+
+	if p.cfg.Migrations != "" {
+		m := &migrate.Migrator{DB: db, Dialect: migrate.SQLite, Dir: p.cfg.Migrations}
+		if _, err := m.Up(ctx, 0); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+	}
+	p.logger.Debug("Tenant database opened", zap.String("tenant", tenantID))
+	return db, nil
+}
+
+// evict closes idle handles from the cold end until the pool fits max.
+func (p *tenantDBPool) evict() {
+	for el := p.lru.Back(); el != nil && p.lru.Len() > p.max; {
+		prev := el.Prev()
+		if el.Value.(*tenantDB).refs <= 0 {
+			p.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (p *tenantDBPool) remove(el *list.Element) {
+	entry := p.lru.Remove(el).(*tenantDB)
+	delete(p.entries, entry.id)
+	if err := entry.db.Close(); err != nil {
+		p.logger.Warn("Failed to close tenant database", zap.String("tenant", entry.id), zap.Error(err))
+	}
+}
+
+// tenants lists every tenant that has a database on disk, open or not.
+func (p *tenantDBPool) tenants() ([]string, error) {
+	entries, err := os.ReadDir(p.root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() || !validTenantID.MatchString(e.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(p.root, e.Name(), tenantDBFile)); err == nil {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (p *tenantDBPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for el := p.lru.Back(); el != nil; {
+		prev := el.Prev()
+		p.remove(el)
+		el = prev
+	}
+}
+
+// database resolves the database of the invocation: the tenant's own file
+// when tenant databases are enabled, the shared pool otherwise.
+func (inv *invocation) database(ctx context.Context) (*sql.DB, error) {
+	if inv == nil {
+		return nil, errDBUnavailable
+	}
+	if inv.db != nil {
+		return inv.db, nil
+	}
+	if inv.tenantDBs == nil || inv.tenantID == "" {
+		return nil, errDBUnavailable
+	}
+	db, err := inv.tenantDBs.acquire(ctx, inv.tenantID, inv.tenant)
+	if err != nil {
+		return nil, err
+	}
+	inv.db = db
+	inv.ownsDB = true
+	return db, nil
+}
+
+// releaseDB hands a tenant database back to the pool.
+func (inv *invocation) releaseDB() {
+	if inv == nil || !inv.ownsDB {
+		return
+	}
+	inv.tenantDBs.release(inv.tenantID)
+	inv.db = nil
+	inv.ownsDB = false
+}
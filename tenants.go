@@ -0,0 +1,486 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dustin/go-humanize"
+	"github.com/nats-io/nats.go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"go.uber.org/zap"
+)
+
+const (
+	tenantsBucket     = "TENANTS"
+	tenantUsageBucket = "TENANT_USAGE"
+	tenantUsageMaxAge = 400 * 24 * time.Hour
+	usageUpdateTries  = 5
+)
+
+// TenantConfig is a tenant registry entry. Unset fields fall back to the
+// handler settings; ceilings and grants can only narrow them.
+type TenantConfig struct {
+	ID string `json:"id"`
+
+	// Grants caps the permissions of every function run for the tenant.
+	// A capability is used only if both the function and the grant allow it.
+	Grants *Permissions `json:"grants,omitempty"`
+
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	RateBurst int     `json:"rate_burst,omitempty"`
+
+	MaxMemory  string         `json:"max_memory,omitempty"`
+	MaxTimeout caddy.Duration `json:"max_timeout,omitempty"`
+
+	// MaxDBSize overrides the tenant_db max_size for this tenant.
+	MaxDBSize string `json:"max_db_size,omitempty"`
+
+	Daily   *TenantQuota `json:"daily,omitempty"`
+	Monthly *TenantQuota `json:"monthly,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+
+	maxMemoryBytes uint64
+}
+
+// TenantQuota limits usage over one calendar period (UTC). Zero means
+// unlimited.
+type TenantQuota struct {
+	Invocations uint64         `json:"invocations,omitempty"`
+	CPUTime     caddy.Duration `json:"cpu_time,omitempty"`
+	EgressBytes uint64         `json:"egress_bytes,omitempty"`
+}
+
+// TenantUsage is the metered consumption of a tenant over one period.
+// CPUTime is the wall-clock time spent inside the sandbox.
+type TenantUsage struct {
+	Period      string         `json:"period"`
+	Invocations uint64         `json:"invocations"`
+	CPUTime     caddy.Duration `json:"cpu_time"`
+	EgressBytes uint64         `json:"egress_bytes"`
+}
+
+func (c *TenantConfig) validate() error {
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return fmt.Errorf("rate_limit and rate_burst must not be negative")
+	}
+	if c.MaxTimeout < 0 {
+		return fmt.Errorf("max_timeout must not be negative")
+	}
+	c.maxMemoryBytes = 0
+	if c.MaxMemory != "" {
+		n, err := humanize.ParseBytes(c.MaxMemory)
+		if err != nil {
+			return fmt.Errorf("invalid max_memory: %w", err)
+		}
+		c.maxMemoryBytes = n
+	}
+	if c.MaxDBSize != "" {
+		if _, err := humanize.ParseBytes(c.MaxDBSize); err != nil {
+			return fmt.Errorf("invalid max_db_size: %w", err)
+		}
+	}
+	return nil
+}
+
+// exceeded names the first exhausted dimension of q, or returns "".
+func (q *TenantQuota) exceeded(u TenantUsage) string {
+	switch {
+	case q == nil:
+		return ""
+	case q.Invocations > 0 && u.Invocations >= q.Invocations:
+		return "invocations"
+	case q.CPUTime > 0 && u.CPUTime >= q.CPUTime:
+		return "cpu_time"
+	case q.EgressBytes > 0 && u.EgressBytes >= q.EgressBytes:
+		return "egress_bytes"
+	}
+	return ""
+}
+
+func usagePeriods(now time.Time) (day, month string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01")
+}
+
+func usageKey(tenantID, period string) string {
+	return tenantID + "." + period
+}
+
+// startTenantRegistry opens the registry buckets and mirrors TENANTS into
+// memory, so lookups on the request path never leave the process.
+func (r *Gojinn) startTenantRegistry() error {
+	kv, err := r.js.KeyValue(tenantsBucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      tenantsBucket,
+			Description: "Tenant registry",
+			Storage:     nats.FileStorage,
+			History:     5,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision tenant registry: %w", err)
+		}
+	}
+	r.tenantsKV = kv
+
+	usage, err := r.js.KeyValue(tenantUsageBucket)
+	if err != nil {
+		usage, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      tenantUsageBucket,
+			Description: "Per-tenant usage counters",
+			Storage:     nats.FileStorage,
+			History:     1,
+			TTL:         tenantUsageMaxAge,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision tenant usage bucket: %w", err)
+		}
+	}
+	r.usageKV = usage
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return fmt.Errorf("failed to watch tenant registry: %w", err)
+	}
+	r.tenantWatcher = watcher
+
+	ready := make(chan struct{})
+	go func() {
+		initial := true
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				if initial {
+					initial = false
+					close(ready)
+				}
+				continue
+			}
+			if entry.Operation() != nats.KeyValuePut {
+				r.tenants.Delete(entry.Key())
+				continue
+			}
+			var cfg TenantConfig
+			if err := json.Unmarshal(entry.Value(), &cfg); err != nil {
+				r.logger.Warn("Ignoring malformed tenant record", zap.String("tenant", entry.Key()), zap.Error(err))
+				continue
+			}
+			if err := cfg.validate(); err != nil {
+				r.logger.Warn("Ignoring invalid tenant record", zap.String("tenant", entry.Key()), zap.Error(err))
+				continue
+			}
+			r.tenants.Store(entry.Key(), &cfg)
+		}
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		r.logger.Warn("Tenant registry still loading, continuing without it")
+	}
+	return nil
+}
+
+// tenantConfig returns the registry entry of a tenant, or nil when the tenant
+// only uses the handler defaults.
+func (r *Gojinn) tenantConfig(tenantID string) *TenantConfig {
+	if cfg, ok := r.tenants.Load(tenantID); ok {
+		return cfg.(*TenantConfig)
+	}
+	return nil
+}
+
+func (r *Gojinn) tenantUsage(tenantID string, now time.Time) (day, month TenantUsage) {
+	dayPeriod, monthPeriod := usagePeriods(now)
+	return r.loadUsage(tenantID, dayPeriod), r.loadUsage(tenantID, monthPeriod)
+}
+
+func (r *Gojinn) loadUsage(tenantID, period string) TenantUsage {
+	u := TenantUsage{Period: period}
+	if r.usageKV == nil {
+		return u
+	}
+	if entry, err := r.usageKV.Get(usageKey(tenantID, period)); err == nil {
+		_ = json.Unmarshal(entry.Value(), &u)
+	}
+	return u
+}
+
+// checkQuota rejects a new invocation once a daily or monthly quota of a
+// registered tenant is used up.
+func (r *Gojinn) checkQuota(tenantID string) error {
+	cfg := r.tenantConfig(tenantID)
+	if cfg == nil || (cfg.Daily == nil && cfg.Monthly == nil) {
+		return nil
+	}
+	day, month := r.tenantUsage(tenantID, time.Now())
+	if dim := cfg.Daily.exceeded(day); dim != "" {
+		return fmt.Errorf("daily %s quota exceeded for tenant %s", dim, tenantID)
+	}
+	if dim := cfg.Monthly.exceeded(month); dim != "" {
+		return fmt.Errorf("monthly %s quota exceeded for tenant %s", dim, tenantID)
+	}
+	return nil
+}
+
+// recordUsage adds one finished invocation to the day and month counters of
+// a registered tenant. Counters are updated with compare-and-swap, so every
+// node of a cluster can meter the same tenant.
+func (r *Gojinn) recordUsage(inv *invocation, elapsed time.Duration) {
+	if inv == nil || inv.tenant == nil || r.usageKV == nil {
+		return
+	}
+	dayPeriod, monthPeriod := usagePeriods(time.Now())
+	for _, period := range []string{dayPeriod, monthPeriod} {
+		key := usageKey(inv.tenantID, period)
+		var err error
+		for try := 0; try < usageUpdateTries; try++ {
+			u := TenantUsage{Period: period}
+			var rev uint64
+			entry, getErr := r.usageKV.Get(key)
+			if getErr == nil {
+				_ = json.Unmarshal(entry.Value(), &u)
+				rev = entry.Revision()
+			} else if !errors.Is(getErr, nats.ErrKeyNotFound) {
+				err = getErr
+				break
+			}
+
+			u.Invocations++
+			u.CPUTime += caddy.Duration(elapsed)
+			u.EgressBytes += inv.egressBytes
+
+			data, _ := json.Marshal(u)
+			if rev == 0 {
+				_, err = r.usageKV.Create(key, data)
+			} else {
+				_, err = r.usageKV.Update(key, data, rev)
+			}
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			r.logger.Warn("Failed to record tenant usage", zap.String("tenant", inv.tenantID), zap.String("period", period), zap.Error(err))
+		}
+	}
+}
+
+// egressBudget returns how many more bytes the invocation may transfer,
+// or -1 when its tenant has no egress quota.
+func (r *Gojinn) egressBudget(inv *invocation) int64 {
+	if inv == nil || inv.tenant == nil {
+		return -1
+	}
+	if !inv.egressLoaded {
+		inv.egressLoaded = true
+		inv.egressLimit = -1
+		day, month := r.tenantUsage(inv.tenantID, time.Now())
+		for _, q := range []struct {
+			quota *TenantQuota
+			used  uint64
+		}{{inv.tenant.Daily, day.EgressBytes}, {inv.tenant.Monthly, month.EgressBytes}} {
+			if q.quota == nil || q.quota.EgressBytes == 0 {
+				continue
+			}
+			left := int64(q.quota.EgressBytes) - int64(q.used) //nolint:gosec
+			if inv.egressLimit < 0 || left < inv.egressLimit {
+				inv.egressLimit = left
+			}
+		}
+	}
+	if inv.egressLimit < 0 {
+		return -1
+	}
+	return max(inv.egressLimit-int64(inv.egressBytes), 0) //nolint:gosec
+}
+
+// withMemoryCeiling caps the linear memory of the module instantiated with
+// the returned context at the tenant's max_memory. Growing past it fails like
+// an out-of-memory memory.grow.
+func withMemoryCeiling(ctx context.Context, code wazero.CompiledModule) (context.Context, error) {
+	inv := invocationFromContext(ctx)
+	if inv == nil || inv.tenant == nil || inv.tenant.maxMemoryBytes == 0 {
+		return ctx, nil
+	}
+	ceiling := inv.tenant.maxMemoryBytes
+	for _, mem := range code.ExportedMemories() {
+		if uint64(mem.Min())*65536 > ceiling {
+			return ctx, fmt.Errorf("module needs %d bytes of memory, above the tenant max_memory of %s", uint64(mem.Min())*65536, inv.tenant.MaxMemory)
+		}
+	}
+	return experimental.WithMemoryAllocator(ctx, experimental.MemoryAllocatorFunc(func(capacity, maxBytes uint64) experimental.LinearMemory {
+		return &cappedMemory{
+			buf:     make([]byte, 0, min(capacity, ceiling)),
+			ceiling: min(maxBytes, ceiling),
+		}
+	})), nil
+}
+
+type cappedMemory struct {
+	buf     []byte
+	ceiling uint64
+}
+
+func (m *cappedMemory) Reallocate(size uint64) []byte {
+	if size > m.ceiling {
+		return nil
+	}
+	if size <= uint64(cap(m.buf)) {
+		m.buf = m.buf[:size]
+		return m.buf
+	}
+	grown := make([]byte, size, min(max(size, 2*uint64(cap(m.buf))), m.ceiling))
+	copy(grown, m.buf)
+	m.buf = grown
+	return m.buf
+}
+
+func (m *cappedMemory) Free() { m.buf = nil }
+
+// requestAPIKey returns the key sent as X-API-Key or as a bearer token.
+func requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// authorizeTenantAdmin admits admin keys, and for read-only calls the tenant
+// itself. Without any keys configured the registry is open, like the other
+// /_sys endpoints.
+func (r *Gojinn) authorizeTenantAdmin(rw http.ResponseWriter, req *http.Request, tenantID string, selfAllowed bool) bool {
+	if key := requestAPIKey(req); key != "" && slices.Contains(r.AdminKeys, key) {
+		return true
+	}
+	if len(r.AdminKeys) == 0 && len(r.APIKeys) == 0 {
+		return true
+	}
+	if selfAllowed && tenantID != "" {
+		_, ok := r.resolveSysTenant(rw, req, tenantID)
+		return ok
+	}
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// serveTenants manages the tenant registry:
+//
+//	GET    /_sys/tenants              list registered tenants (admin)
+//	GET    /_sys/tenants/{id}         show a tenant (admin or the tenant)
+//	PUT    /_sys/tenants/{id}         create or replace a tenant (admin)
+//	DELETE /_sys/tenants/{id}         remove a tenant (admin)
+//	GET    /_sys/tenants/{id}/usage   current day and month usage (admin or the tenant)
+func (r *Gojinn) serveTenants(rw http.ResponseWriter, req *http.Request, rest string) {
+	if r.tenantsKV == nil {
+		http.Error(rw, "JetStream not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if parts[0] == "" {
+		if req.Method != "GET" {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !r.authorizeTenantAdmin(rw, req, "", false) {
+			return
+		}
+		var list []*TenantConfig
+		r.tenants.Range(func(_, v any) bool {
+			list = append(list, v.(*TenantConfig))
+			return true
+		})
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"items": list})
+		return
+	}
+
+	tenantID := parts[0]
+	if !validTenantID.MatchString(tenantID) {
+		http.Error(rw, "Invalid tenant id", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && len(parts) == 1:
+		if !r.authorizeTenantAdmin(rw, req, tenantID, true) {
+			return
+		}
+		cfg := r.tenantConfig(tenantID)
+		if cfg == nil {
+			http.Error(rw, "Tenant not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, http.StatusOK, cfg)
+
+	case req.Method == "PUT" && len(parts) == 1:
+		if !r.authorizeTenantAdmin(rw, req, tenantID, false) {
+			return
+		}
+		var cfg TenantConfig
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			http.Error(rw, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		cfg.ID = tenantID
+		cfg.UpdatedAt = time.Now().UTC()
+		if err := cfg.validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(cfg)
+		if _, err := r.tenantsKV.Put(tenantID, data); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.tenants.Store(tenantID, &cfg)
+		r.logger.Info("Tenant registry updated", zap.String("tenant", tenantID))
+		writeJSON(rw, http.StatusOK, cfg)
+
+	case req.Method == "DELETE" && len(parts) == 1:
+		if !r.authorizeTenantAdmin(rw, req, tenantID, false) {
+			return
+		}
+		if err := r.tenantsKV.Delete(tenantID); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.tenants.Delete(tenantID)
+		r.logger.Info("Tenant removed from registry", zap.String("tenant", tenantID))
+		rw.WriteHeader(http.StatusNoContent)
+
+	case req.Method == "GET" && len(parts) == 2 && parts[1] == "usage":
+		if !r.authorizeTenantAdmin(rw, req, tenantID, true) {
+			return
+		}
+		day, month := r.tenantUsage(tenantID, time.Now())
+		resp := map[string]interface{}{
+			"tenant": tenantID,
+			"day":    day,
+			"month":  month,
+		}
+		if cfg := r.tenantConfig(tenantID); cfg != nil {
+			resp["daily"] = cfg.Daily
+			resp["monthly"] = cfg.Monthly
+		}
+		writeJSON(rw, http.StatusOK, resp)
+
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,521 @@
+package gojinn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	AliasProd   = "prod"
+	AliasCanary = "canary"
+
+	headerFunctionVersion = "X-Gojinn-Version"
+
+	maxVersionUpload = 64 * 1024 * 1024
+	maxProdHistory   = 20
+)
+
+// FunctionVersion is an immutable module stored under
+// <data_dir>/functions/<name>/<digest>.wasm.
+type FunctionVersion struct {
+	ID        string    `json:"id"`
+	Digest    string    `json:"digest"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// versionManifest tracks the stored versions of one function, the aliases
+// pointing at them and how traffic is split between aliases.
+type versionManifest struct {
+	Function    string            `json:"function"`
+	Versions    []FunctionVersion `json:"versions"`
+	Aliases     map[string]string `json:"aliases,omitempty"`
+	Weights     map[string]int    `json:"weights,omitempty"`
+	ProdHistory []string          `json:"prod_history,omitempty"`
+}
+
+// version resolves an alias or a version id.
+func (m *versionManifest) version(ref string) *FunctionVersion {
+	if id, ok := m.Aliases[ref]; ok {
+		ref = id
+	}
+	for i := range m.Versions {
+		if m.Versions[i].ID == ref {
+			return &m.Versions[i]
+		}
+	}
+	return nil
+}
+
+func (m *versionManifest) clone() *versionManifest {
+	c := &versionManifest{
+		Function:    m.Function,
+		Versions:    slices.Clone(m.Versions),
+		Aliases:     make(map[string]string, len(m.Aliases)),
+		Weights:     make(map[string]int, len(m.Weights)),
+		ProdHistory: slices.Clone(m.ProdHistory),
+	}
+	for k, v := range m.Aliases {
+		c.Aliases[k] = v
+	}
+	for k, v := range m.Weights {
+		c.Weights[k] = v
+	}
+	return c
+}
+
+func (m *versionManifest) setAlias(alias, id string) {
+	if alias == AliasProd {
+		if prev := m.Aliases[AliasProd]; prev != "" && prev != id {
+			m.ProdHistory = append(m.ProdHistory, prev)
+			if len(m.ProdHistory) > maxProdHistory {
+				m.ProdHistory = m.ProdHistory[len(m.ProdHistory)-maxProdHistory:]
+			}
+		}
+	}
+	m.Aliases[alias] = id
+}
+
+// endCanary drops the canary alias and any traffic split.
+func (m *versionManifest) endCanary() {
+	delete(m.Aliases, AliasCanary)
+	m.Weights = map[string]int{}
+}
+
+func (r *Gojinn) versionsDir(name string) string {
+	return filepath.Join(r.DataDir, "functions", name)
+}
+
+// loadManifest returns the cached manifest of a function, reading it from
+// disk on first use. Functions that were never versioned get an empty one.
+func (r *Gojinn) loadManifest(name string) *versionManifest {
+	r.versionsMu.RLock()
+	m, ok := r.manifests[name]
+	r.versionsMu.RUnlock()
+	if ok {
+		return m
+	}
+
+	r.versionsMu.Lock()
+	defer r.versionsMu.Unlock()
+	return r.readManifestLocked(name)
+}
+
+func (r *Gojinn) readManifestLocked(name string) *versionManifest {
+	if m, ok := r.manifests[name]; ok {
+		return m
+	}
+
+	m := &versionManifest{Function: name}
+	data, err := os.ReadFile(filepath.Join(r.versionsDir(name), "manifest.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			r.logger.Error("Corrupt version manifest, ignoring stored versions", zap.String("function", name), zap.Error(err))
+			m = &versionManifest{Function: name}
+		}
+	}
+	r.manifests[name] = m
+	return m
+}
+
+// updateManifest applies fn to a copy of the manifest and persists it
+// atomically before publishing it to the request path.
+func (r *Gojinn) updateManifest(name string, fn func(*versionManifest) error) (*versionManifest, error) {
+	r.versionsMu.Lock()
+	defer r.versionsMu.Unlock()
+
+	m := r.readManifestLocked(name).clone()
+	if err := fn(m); err != nil {
+		return nil, err
+	}
+
+	dir := r.versionsDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	data, _ := json.MarshalIndent(m, "", "  ")
+	tmp := filepath.Join(dir, "manifest.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "manifest.json")); err != nil {
+		return nil, err
+	}
+
+	r.manifests[name] = m
+	return m, nil
+}
+
+// storeVersion saves a module as an immutable version after the same
+// signature and compilation checks applied at startup. Uploading the same
+// bytes twice returns the existing version.
+func (r *Gojinn) storeVersion(name string, wasm []byte) (*FunctionVersion, error) {
+	sum := sha256.Sum256(wasm)
+	digest := hex.EncodeToString(sum[:])
+	v := FunctionVersion{ID: digest[:12], Digest: digest, Size: len(wasm), CreatedAt: time.Now().UTC()}
+
+	if existing := r.loadManifest(name).version(v.ID); existing != nil {
+		return existing, nil
+	}
+
+	dir := r.versionsDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(dir, digest+".wasm.tmp")
+	if err := os.WriteFile(tmp, wasm, 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	clean, err := r.loadWasmSecurely(tmp)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := r.createWazeroRuntime(clean)
+	if err != nil {
+		return nil, err
+	}
+	_ = pair.Runtime.Close(context.Background())
+
+	if err := os.Rename(tmp, filepath.Join(dir, digest+".wasm")); err != nil {
+		return nil, err
+	}
+
+	_, err = r.updateManifest(name, func(m *versionManifest) error {
+		if m.version(v.ID) == nil {
+			m.Versions = append(m.Versions, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("Function version stored", zap.String("function", name), zap.String("version", v.ID))
+	return &v, nil
+}
+
+// ensureProdVersion snapshots the live module as the prod version of a
+// function that has never been versioned, so a canary has a baseline.
+func (r *Gojinn) ensureProdVersion(fn *function) error {
+	if r.loadManifest(fn.name()).Aliases[AliasProd] != "" {
+		return nil
+	}
+	live, err := os.ReadFile(fn.wasmFile())
+	if err != nil {
+		return fmt.Errorf("failed to snapshot live module: %w", err)
+	}
+	v, err := r.storeVersion(fn.name(), live)
+	if err != nil {
+		return err
+	}
+	_, err = r.updateManifest(fn.name(), func(m *versionManifest) error {
+		if m.Aliases[AliasProd] == "" {
+			m.setAlias(AliasProd, v.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *Gojinn) rollbackFunction(name, to string) (*versionManifest, error) {
+	return r.updateManifest(name, func(m *versionManifest) error {
+		if to != "" {
+			v := m.version(to)
+			if v == nil {
+				return fmt.Errorf("unknown version: %s", to)
+			}
+			m.setAlias(AliasProd, v.ID)
+			m.endCanary()
+			return nil
+		}
+		if m.Aliases[AliasCanary] != "" || len(m.Weights) > 0 {
+			m.endCanary()
+			return nil
+		}
+		if len(m.ProdHistory) == 0 {
+			return fmt.Errorf("nothing to roll back for %s", name)
+		}
+		m.Aliases[AliasProd] = m.ProdHistory[len(m.ProdHistory)-1]
+		m.ProdHistory = m.ProdHistory[:len(m.ProdHistory)-1]
+		return nil
+	})
+}
+
+func (r *Gojinn) versionVariant(fn *function, v *FunctionVersion) *function {
+	variant := *fn
+	variant.spec.WasmFile = filepath.Join(r.versionsDir(fn.name()), v.Digest+".wasm")
+	variant.version = v.ID
+	return &variant
+}
+
+// versionPin returns the X-Gojinn-Version pin a caller may use. Aliases are
+// open to everyone; exact version ids, rolled-back ones included, need an
+// admin key, since every pinned version gets its own pool. Other pins are
+// ignored.
+func (r *Gojinn) versionPin(fn *function, req *http.Request) string {
+	pin := req.Header.Get(headerFunctionVersion)
+	if pin == "" {
+		return ""
+	}
+	if key := requestAPIKey(req); key != "" && slices.Contains(r.AdminKeys, key) {
+		return pin
+	}
+	if _, ok := r.loadManifest(fn.name()).Aliases[pin]; ok {
+		return pin
+	}
+	return ""
+}
+
+// pickVersion selects the module serving an invocation of fn: a pinned
+// alias or version id, a weighted draw between aliases, or the prod alias.
+// Functions without stored versions keep running their live module.
+func (r *Gojinn) pickVersion(fn *function, pin string) *function {
+	m := r.loadManifest(fn.name())
+	if len(m.Versions) == 0 {
+		return fn
+	}
+
+	var v *FunctionVersion
+	switch {
+	case pin != "":
+		v = m.version(pin)
+	case len(m.Weights) > 0:
+		v = m.version(drawAlias(m.Weights))
+	}
+	if v == nil {
+		v = m.version(AliasProd)
+	}
+	if v == nil {
+		return fn
+	}
+	return r.versionVariant(fn, v)
+}
+
+func drawAlias(weights map[string]int) string {
+	aliases := make([]string, 0, len(weights))
+	total := 0
+	for alias, w := range weights {
+		aliases = append(aliases, alias)
+		total += w
+	}
+	if total <= 0 {
+		return ""
+	}
+	sort.Strings(aliases)
+
+	n := rand.IntN(total)
+	for _, alias := range aliases {
+		n -= weights[alias]
+		if n < 0 {
+			return alias
+		}
+	}
+	return ""
+}
+
+// activeFunctions lists every module currently reachable: live modules of
+// unversioned functions plus each aliased version.
+func (r *Gojinn) activeFunctions() []*function {
+	var active []*function
+	for _, fn := range r.servedFunctions() {
+		m := r.loadManifest(fn.name())
+		if m.Aliases[AliasProd] == "" {
+			active = append(active, fn)
+		}
+		seen := make(map[string]bool)
+		for _, id := range m.Aliases {
+			if v := m.version(id); v != nil && !seen[v.ID] {
+				seen[v.ID] = true
+				active = append(active, r.versionVariant(fn, v))
+			}
+		}
+	}
+	return active
+}
+
+func (r *Gojinn) servedFunction(name string) *function {
+	for _, fn := range r.servedFunctions() {
+		if fn.name() == name {
+			return fn
+		}
+	}
+	return nil
+}
+
+// serveFunctionVersions handles the version API below /_sys/functions/{name}:
+//
+// Listing is open to any tenant; every change requires an admin key.
+//
+//	GET  /versions                          list versions, aliases and weights
+//	POST /versions?alias=<a>&weight=<pct>   store the request body as a version
+//	PUT  /aliases/{alias}                   point an alias at {"version": "<id>"}
+//	PUT  /traffic                           split traffic {"weights": {"prod": 90, "canary": 10}}
+//	POST /rollback                          end a canary or restore the previous prod
+func (r *Gojinn) serveFunctionVersions(rw http.ResponseWriter, req *http.Request, rest string) {
+	if !slices.Contains(r.AdminKeys, requestAPIKey(req)) {
+		if _, err := r.extractTenantAndHandleMiddleware(rw, req); err != nil {
+			return
+		}
+	}
+	// Functions serve every tenant, so only admins may change what runs.
+	if req.Method != "GET" && !r.authorizeTenantAdmin(rw, req, "", false) {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	fn := r.servedFunction(parts[0])
+	if fn == nil {
+		http.Error(rw, "Function not found", http.StatusNotFound)
+		return
+	}
+	name := fn.name()
+
+	var (
+		m   *versionManifest
+		err error
+	)
+	status := http.StatusOK
+
+	switch {
+	case req.Method == "GET" && len(parts) == 2 && parts[1] == "versions":
+		m = r.loadManifest(name)
+
+	case req.Method == "POST" && len(parts) == 2 && parts[1] == "versions":
+		m, err = r.uploadVersion(fn, req)
+		status = http.StatusCreated
+
+	case req.Method == "PUT" && len(parts) == 3 && parts[1] == "aliases":
+		var body struct {
+			Version string `json:"version"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		alias := parts[2]
+		if !validFunctionName.MatchString(alias) {
+			http.Error(rw, "Invalid alias", http.StatusBadRequest)
+			return
+		}
+		m, err = r.updateManifest(name, func(m *versionManifest) error {
+			v := m.version(body.Version)
+			if v == nil {
+				return fmt.Errorf("unknown version: %s", body.Version)
+			}
+			m.setAlias(alias, v.ID)
+			return nil
+		})
+
+	case req.Method == "PUT" && len(parts) == 2 && parts[1] == "traffic":
+		var body struct {
+			Weights map[string]int `json:"weights"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		m, err = r.updateManifest(name, func(m *versionManifest) error {
+			for alias, w := range body.Weights {
+				if _, ok := m.Aliases[alias]; !ok {
+					return fmt.Errorf("unknown alias: %s", alias)
+				}
+				if w < 0 {
+					return fmt.Errorf("negative weight for %s", alias)
+				}
+			}
+			m.Weights = body.Weights
+			return nil
+		})
+
+	case req.Method == "POST" && len(parts) == 2 && parts[1] == "rollback":
+		var body struct {
+			Version string `json:"version"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		m, err = r.rollbackFunction(name, body.Version)
+
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(rw, status, m)
+}
+
+func (r *Gojinn) uploadVersion(fn *function, req *http.Request) (*versionManifest, error) {
+	wasm, err := io.ReadAll(io.LimitReader(req.Body, maxVersionUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(wasm) == 0 || len(wasm) > maxVersionUpload {
+		return nil, fmt.Errorf("module must be between 1 byte and %d bytes", maxVersionUpload)
+	}
+
+	alias := req.URL.Query().Get("alias")
+	weight := -1
+	if raw := req.URL.Query().Get("weight"); raw != "" {
+		weight, err = strconv.Atoi(strings.TrimSuffix(raw, "%"))
+		if err != nil || weight < 0 || weight > 100 {
+			return nil, fmt.Errorf("weight must be a percentage between 0 and 100")
+		}
+	}
+	if alias != "" && !validFunctionName.MatchString(alias) {
+		return nil, errors.New("invalid alias")
+	}
+	if alias == AliasCanary {
+		if err := r.ensureProdVersion(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := r.storeVersion(fn.name(), wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := r.updateManifest(fn.name(), func(m *versionManifest) error {
+		switch {
+		case alias == AliasProd:
+			m.setAlias(AliasProd, v.ID)
+			m.endCanary()
+		case alias == AliasCanary && weight >= 0:
+			m.setAlias(AliasCanary, v.ID)
+			m.Weights = map[string]int{AliasProd: 100 - weight, AliasCanary: weight}
+		case alias != "":
+			m.setAlias(alias, v.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("Function version deployed",
+		zap.String("function", fn.name()),
+		zap.String("version", v.ID),
+		zap.String("alias", alias),
+		zap.Int("weight", weight))
+	return m, nil
+}
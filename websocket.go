@@ -0,0 +1,295 @@
+package gojinn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 5 * time.Second
+	maxWSRooms     = 32
+
+	headerWSExclude = "Gojinn-WS-Exclude"
+	headerWSBinary  = "Gojinn-WS-Binary"
+
+	// Publish flags shared with the SDKs.
+	wsFlagBinary      = 1
+	wsFlagExcludeSelf = 2
+
+	// host_ws_receive packs the frame type above the 32-bit size and reports
+	// a closed connection with every bit set.
+	wsBinaryFrame = uint64(1) << 32
+	wsClosed      = ^uint64(0)
+
+	// Status codes returned by the room host functions.
+	wsOK     = 0
+	wsFailed = 1
+	wsDenied = 2
+)
+
+var (
+	errWSNotUpgraded = errors.New("websocket not upgraded")
+	errWSUnavailable = errors.New("websocket rooms need the embedded NATS connection")
+	errWSRoom        = errors.New("invalid websocket room")
+	errWSDenied      = errors.New("websocket room not permitted")
+)
+
+// wsFrame is a message read from the client that did not fit the guest
+// buffer yet.
+type wsFrame struct {
+	typ  websocket.MessageType
+	data []byte
+}
+
+// wsSession is the upgraded connection of an invocation together with the
+// rooms it joined. Room messages are written to the socket by the host, so
+// the guest only has to read when it expects input from the client.
+type wsSession struct {
+	id   string
+	conn *websocket.Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	rooms   map[string]*nats.Subscription
+	pending *wsFrame
+
+	reading atomic.Bool
+	broken  atomic.Bool
+	closed  sync.Once
+}
+
+func (r *Gojinn) wsAcceptOptions() *websocket.AcceptOptions {
+	origins := r.WSOrigins
+	if len(origins) == 0 {
+		origins = r.CorsOrigins
+	}
+	return &websocket.AcceptOptions{OriginPatterns: origins}
+}
+
+// upgradeWS accepts the WebSocket handshake of the request the invocation is
+// serving. Same-host origins are always accepted; others must match
+// ws_origin, or cors_origin when no ws_origin is configured.
+func (r *Gojinn) upgradeWS(ctx context.Context) (*wsSession, error) {
+	inv := invocationFromContext(ctx)
+	httpCtx, _ := ctx.Value(wsContextKey{}).(*HttpContext)
+	if inv == nil || httpCtx == nil {
+		return nil, errors.New("websocket upgrade outside of an HTTP request")
+	}
+	if inv.ws != nil {
+		return inv.ws, nil
+	}
+
+	c, err := websocket.Accept(httpCtx.W, httpCtx.R, r.wsAcceptOptions())
+	if err != nil {
+		httpCtx.rejected = true
+		return nil, err
+	}
+	httpCtx.WSConn = c
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	sctx, cancel := context.WithCancel(context.Background())
+	s := &wsSession{
+		id:     hex.EncodeToString(b),
+		conn:   c,
+		ctx:    sctx,
+		cancel: cancel,
+		rooms:  make(map[string]*nats.Subscription),
+	}
+	inv.ws = s
+	go s.keepalive(r.logger)
+	return s, nil
+}
+
+// keepalive pings the client while the guest is waiting for a frame, which
+// is when pongs can be read. A client that stops answering is disconnected.
+func (s *wsSession) keepalive(logger *zap.Logger) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.reading.Load() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, wsWriteTimeout)
+		err := s.conn.Ping(ctx)
+		cancel()
+		if err != nil && s.ctx.Err() == nil {
+			logger.Debug("WebSocket ping failed", zap.String("session", s.id), zap.Error(err))
+			s.broken.Store(true)
+			_ = s.conn.CloseNow()
+			return
+		}
+	}
+}
+
+// receive returns the next frame from the client. A frame larger than max is
+// kept so the guest can retry with a bigger buffer.
+func (s *wsSession) receive(ctx context.Context, max uint32) (*wsFrame, error) {
+	s.mu.Lock()
+	f := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if f == nil {
+		s.reading.Store(true)
+		typ, data, err := s.conn.Read(ctx)
+		s.reading.Store(false)
+		if err != nil {
+			s.broken.Store(true)
+			return nil, err
+		}
+		f = &wsFrame{typ: typ, data: data}
+	}
+	//nolint:gosec
+	if uint32(len(f.data)) > max {
+		s.mu.Lock()
+		s.pending = f
+		s.mu.Unlock()
+	}
+	return f, nil
+}
+
+func (s *wsSession) send(typ websocket.MessageType, data []byte) error {
+	ctx, cancel := context.WithTimeout(s.ctx, wsWriteTimeout)
+	defer cancel()
+	return s.conn.Write(ctx, typ, data)
+}
+
+// close leaves every room and closes the connection. A connection the client
+// already dropped is torn down without waiting for a close handshake.
+func (s *wsSession) close(code websocket.StatusCode, reason string) error {
+	var err error
+	s.closed.Do(func() {
+		s.mu.Lock()
+		for room, sub := range s.rooms {
+			_ = sub.Unsubscribe()
+			delete(s.rooms, room)
+		}
+		s.mu.Unlock()
+		s.cancel()
+		if s.broken.Load() {
+			err = s.conn.CloseNow()
+			return
+		}
+		err = s.conn.Close(code, reason)
+	})
+	return err
+}
+
+func (inv *invocation) closeWS() {
+	if inv == nil || inv.ws == nil {
+		return
+	}
+	_ = inv.ws.close(websocket.StatusNormalClosure, "")
+}
+
+func (r *Gojinn) wsRoomSubject(tenantID, room string) string {
+	return fmt.Sprintf("gojinn.ws.%s.%s", tenantID, room)
+}
+
+func (r *Gojinn) checkWSRoom(ctx context.Context, room string) (*invocation, error) {
+	inv := invocationFromContext(ctx)
+	if inv == nil || !validFunctionName.MatchString(room) {
+		return nil, errWSRoom
+	}
+	if r.natsConn == nil {
+		return nil, errWSUnavailable
+	}
+	if !r.permitted(ctx, room, wsRooms) {
+		return nil, errWSDenied
+	}
+	return inv, nil
+}
+
+// joinRoom subscribes the connection of the invocation to room on every
+// node. Messages published with the exclude flag skip the sender.
+func (r *Gojinn) joinRoom(ctx context.Context, room string) error {
+	inv, err := r.checkWSRoom(ctx, room)
+	if err != nil {
+		return err
+	}
+	s := inv.ws
+	if s == nil {
+		return errWSNotUpgraded
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[room]; ok {
+		return nil
+	}
+	if len(s.rooms) >= maxWSRooms {
+		return fmt.Errorf("websocket session joined more than %d rooms", maxWSRooms)
+	}
+	sub, err := r.natsConn.Subscribe(r.wsRoomSubject(inv.tenantID, room), func(m *nats.Msg) {
+		if m.Header.Get(headerWSExclude) == s.id {
+			return
+		}
+		typ := websocket.MessageText
+		if m.Header.Get(headerWSBinary) == "true" {
+			typ = websocket.MessageBinary
+		}
+		if err := s.send(typ, m.Data); err != nil && s.ctx.Err() == nil {
+			r.logger.Debug("WebSocket room delivery failed", zap.String("room", room), zap.Error(err))
+			s.broken.Store(true)
+			_ = s.conn.CloseNow()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.rooms[room] = sub
+	return nil
+}
+
+func (r *Gojinn) leaveRoom(ctx context.Context, room string) error {
+	inv := invocationFromContext(ctx)
+	if inv == nil || inv.ws == nil {
+		return errWSNotUpgraded
+	}
+	s := inv.ws
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.rooms[room]; ok {
+		delete(s.rooms, room)
+		return sub.Unsubscribe()
+	}
+	return nil
+}
+
+// publishRoom fans data out to every socket in room across the cluster. It
+// does not need an upgraded connection, so HTTP and job functions can push
+// to rooms as well.
+func (r *Gojinn) publishRoom(ctx context.Context, room string, data []byte, flags uint32) error {
+	inv, err := r.checkWSRoom(ctx, room)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(r.wsRoomSubject(inv.tenantID, room))
+	msg.Data = data
+	if flags&wsFlagBinary != 0 {
+		msg.Header.Set(headerWSBinary, "true")
+	}
+	if inv.ws != nil && flags&wsFlagExcludeSelf != 0 {
+		msg.Header.Set(headerWSExclude, inv.ws.id)
+	}
+	return r.natsConn.PublishMsg(msg)
+}
@@ -7,12 +7,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 	"go.uber.org/zap"
 )
 
@@ -22,10 +24,11 @@ const (
 )
 
 type cappedWriter struct {
-	buf     *bytes.Buffer
-	limit   int
-	written int
-	cancel  context.CancelFunc
+	buf      *bytes.Buffer
+	limit    int
+	written  int
+	exceeded bool
+	cancel   context.CancelFunc
 }
 
 func (cw *cappedWriter) Write(p []byte) (int, error) {
@@ -35,6 +38,7 @@ func (cw *cappedWriter) Write(p []byte) (int, error) {
 			cw.buf.Write(p[:allowed])
 			cw.written += allowed
 		}
+		cw.exceeded = true
 
 		if cw.cancel != nil {
 			cw.cancel()
@@ -46,23 +50,22 @@ func (cw *cappedWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string) (string, error) {
-	wasmBytes, err := r.loadWasmSecurely(wasmPath)
+func (r *Gojinn) runSyncJob(ctx context.Context, fn *function, input string) (string, error) {
+	pool, pair, err := r.acquireSandbox(fn)
 	if err != nil {
 		return "", err
 	}
-
-	pair, err := r.createWazeroRuntime(wasmBytes)
-	if err != nil {
-		return "", err
-	}
-	defer pair.Runtime.Close(ctx)
+	defer r.releaseSandbox(pool, pair)
 
 	stdout := new(bytes.Buffer)
 	stderr := new(bytes.Buffer)
 
-	execCtx, cancel := context.WithCancel(ctx)
+	inv := invocationFromContext(ctx)
+	execCtx, cancel := context.WithTimeout(ctx, inv.timeout(fn.timeout()))
 	defer cancel()
+	execCtx, fuel := r.withFuel(execCtx)
+
+	start := time.Now()
 
 	cwOut := &cappedWriter{buf: stdout, limit: MaxOutputBytes, cancel: cancel}
 	cwErr := &cappedWriter{buf: stderr, limit: MaxOutputBytes, cancel: cancel}
@@ -80,26 +83,48 @@ func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string)
 		WithSysNanotime().
 		WithFSConfig(fsConfig)
 
-	for k, v := range r.Env {
+	for k, v := range fn.env() {
 		modConfig = modConfig.WithEnv(k, v)
 	}
 
+	execCtx, err = withMemoryCeiling(execCtx, pair.Code)
+	if err != nil {
+		return "", err
+	}
+
 	mod, err := pair.Runtime.InstantiateModule(execCtx, pair.Code, modConfig)
+	inv.finish()
+	r.observeFuel(fn, fuel)
+	r.recordUsage(inv, time.Since(start))
+	if errors.Is(err, ErrFuelExhausted) {
+		r.observeDuration(fn, "fuel_exhausted", start)
+		return "", fmt.Errorf("wasm sync execution failed: %w after %d units | stderr: %s", ErrFuelExhausted, fuel.spent(), stderr.String())
+	}
 	if err != nil {
+		r.observeDuration(fn, "error", start)
 		return "", fmt.Errorf("wasm sync execution failed: %w | stderr: %s", err, stderr.String())
 	}
 	defer mod.Close(execCtx)
+	r.observeDuration(fn, "success", start)
 
 	return stdout.String(), nil
 }
 
-func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, topic string, wasmBytes []byte) (*nats.Subscription, error) {
+func (r *Gojinn) startTenantWorker(tenantID string, fn *function, id int, wasmBytes []byte) (*nats.Subscription, error) {
 	pair, err := r.createWazeroRuntime(wasmBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create wazero runtime for tenant %s worker %d: %w", tenantID, id, err)
 	}
 
-	queueGroup := fmt.Sprintf("WORKERS_%s", tenantID)
+	streamName := tenantStreamName(tenantID)
+	queueGroup := fn.queueGroup(tenantID)
+	topic := r.functionTopic(tenantID, fn)
+
+	if err := r.ensureWorkerConsumer(fn, streamName, queueGroup, topic); err != nil {
+		return nil, fmt.Errorf("failed to configure worker consumer for tenant %s: %w", tenantID, err)
+	}
+	policy := fn.retry()
+	maxAttempts := uint64(policy.maxAttempts()) //nolint:gosec
 
 	sub, err := r.js.QueueSubscribe(topic, queueGroup, func(m *nats.Msg) {
 		meta, err := m.Metadata()
@@ -112,8 +137,42 @@ func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, t
 		deliverCount := meta.NumDelivered
 		_ = m.InProgress()
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout))
+		kv, kvErr := r.js.KeyValue(tenantBucketName(tenantID))
+		if kvErr != nil {
+			kv = nil
+		}
+		inv := r.newInvocation(tenantID, kv, fn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), inv.timeout(fn.timeout()))
 		defer cancel()
+		ctx = withInvocation(ctx, inv)
+		ctx, fuel := r.withFuel(ctx)
+		jobID := meta.Sequence.Stream
+
+		cronRunID := m.Header.Get(headerCronRun)
+
+		// Deliveries past the last attempt only happen when a worker died
+		// mid-execution; the job is dead-lettered without running again.
+		if deliverCount > maxAttempts {
+			errMsg := fmt.Sprintf("delivery limit exceeded: worker lost after %d attempts", maxAttempts)
+			if cronRunID != "" {
+				r.updateCronRunFromMsg(kv, m, cronStatusFailed, deliverCount, errMsg)
+			}
+			job := r.jobFailed(tenantID, fn, jobID, deliverCount, "", errMsg)
+			r.deadLetterJob(tenantID, fn, m, job, errMsg, "")
+			return
+		}
+		if cronRunID != "" {
+			run := r.updateCronRunFromMsg(kv, m, cronStatusRunning, deliverCount, "")
+			if run != nil && run.Status == cronStatusReplaced {
+				_ = m.Ack()
+				return
+			}
+			r.cronCancels.Store(cronRunID, func() { cancel() })
+			defer r.cronCancels.Delete(cronRunID)
+		}
+		r.jobStarted(tenantID, fn, jobID, deliverCount)
+		start := time.Now()
 
 		stdoutBuf := bufferPool.Get().(*bytes.Buffer)
 		stdoutBuf.Reset()
@@ -139,33 +198,53 @@ func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, t
 			WithSysNanotime().
 			WithFSConfig(fsConfig)
 
-		for k, v := range r.Env {
+		for k, v := range fn.env() {
 			modConfig = modConfig.WithEnv(k, v)
 		}
 
-		mod, err := pair.Runtime.InstantiateModule(ctx, pair.Code, modConfig)
+		var mod api.Module
+		ctx, err = withMemoryCeiling(ctx, pair.Code)
+		if err == nil {
+			mod, err = pair.Runtime.InstantiateModule(ctx, pair.Code, modConfig)
+			inv.finish()
+			r.observeFuel(fn, fuel)
+			r.recordUsage(inv, time.Since(start))
+		}
 		if err != nil {
+			status := "error"
 			errMsg := fmt.Sprintf("Wasm Error/Quota Exceeded: %v | Stderr: %s", err, stderrBuf.String())
-
-			if deliverCount >= MaxRetries {
-				snapshot := CrashSnapshot{
-					Timestamp: time.Now(),
-					Error:     errMsg,
-					Input:     json.RawMessage(m.Data),
-					Env:       r.Env,
-					WasmFile:  r.Path,
+			if errors.Is(err, ErrFuelExhausted) {
+				status = "fuel_exhausted"
+				errMsg = fmt.Sprintf("%v after %d units | Stderr: %s", ErrFuelExhausted, fuel.spent(), stderrBuf.String())
+			}
+			r.observeDuration(fn, status, start)
+			class := classifyFailure(ctx, err, cwOut.exceeded || cwErr.exceeded)
+			final := deliverCount >= maxAttempts || !policy.retryable(class)
+
+			if cronRunID != "" {
+				status := cronStatusRetrying
+				if final {
+					status = cronStatusFailed
 				}
-				dumpBytes, _ := json.MarshalIndent(snapshot, "", "  ")
-				filename := fmt.Sprintf("crash_tenant_%s_%s_seq%d.json", tenantID, time.Now().Format("20060102-150405"), meta.Sequence.Stream)
-				r.saveCrashDump(filename, dumpBytes)
-				_ = m.Ack()
+				run := r.updateCronRunFromMsg(kv, m, status, deliverCount, errMsg)
+				if run != nil && run.Status == cronStatusReplaced {
+					_ = m.Ack()
+					return
+				}
+			}
+
+			job := r.jobFailed(tenantID, fn, jobID, deliverCount, class, errMsg)
+
+			if final {
+				r.deadLetterJob(tenantID, fn, m, job, errMsg, stderrBuf.String())
 				return
 			}
 
-			backoff := time.Duration(deliverCount) * time.Second
-			_ = m.NakWithDelay(backoff)
+			r.countJob(fn, "retry")
+			_ = m.NakWithDelay(policy.nextDelay(deliverCount))
 			return
 		}
+		r.observeDuration(fn, "success", start)
 
 		if stdoutBuf.Len() > 0 {
 			r.logger.Info("Tenant Worker Output", zap.String("tenant", tenantID), zap.String("stdout", strings.TrimSpace(stdoutBuf.String())))
@@ -174,14 +253,19 @@ func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, t
 			r.logger.Info("Tenant Worker Log", zap.String("tenant", tenantID), zap.String("stderr", strings.TrimSpace(stderrBuf.String())))
 		}
 
-		kvBucket := fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
-		kv, kvErr := r.js.KeyValue(kvBucket)
-		if kvErr == nil {
+		if cronRunID != "" {
+			r.updateCronRunFromMsg(kv, m, cronStatusSucceeded, deliverCount, "")
+		}
+		job := r.jobSucceeded(tenantID, fn, jobID, deliverCount, stdoutBuf.String())
+		r.enqueueCallback(tenantID, m, job)
+		r.countJob(fn, "success")
+
+		if kv != nil {
 			outStr := strings.TrimSpace(stdoutBuf.String())
 			errStr := strings.TrimSpace(stderrBuf.String())
 			timestamp := time.Now().UTC().Format(time.RFC3339)
 
-			payload := fmt.Sprintf("tenant:%s|job:%d|out:%s|err:%s|ts:%s", tenantID, meta.Sequence.Stream, outStr, errStr, timestamp)
+			payload := fmt.Sprintf("tenant:%s|job:%d|out:%s|err:%s|ts:%s", tenantID, jobID, outStr, errStr, timestamp)
 
 			secret := r.StoreCipherKey
 			if secret == "" {
@@ -192,14 +276,17 @@ func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, t
 			signature := hex.EncodeToString(mac.Sum(nil))
 
 			auditData := map[string]interface{}{
-				"job_id":    meta.Sequence.Stream,
+				"job_id":    jobID,
 				"timestamp": timestamp,
 				"signature": signature,
 				"status":    "success",
 			}
+			if fuel != nil {
+				auditData["fuel_used"] = fuel.spent()
+			}
 			auditJSON, _ := json.Marshal(auditData)
 
-			auditKey := fmt.Sprintf("audit.job.%d", meta.Sequence.Stream)
+			auditKey := fmt.Sprintf("audit.job.%d", jobID)
 			_, _ = kv.Put(auditKey, auditJSON)
 
 			r.logger.Info("Signed Audit Log Saved", zap.String("tenant", tenantID), zap.String("audit_key", auditKey), zap.String("signature", signature[:16]+"..."))
@@ -208,7 +295,36 @@ func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, t
 		mod.Close(ctx)
 		_ = m.Ack()
 
-	}, nats.ManualAck(), nats.BindStream(streamName), nats.MaxDeliver(MaxRetries+1))
+	}, nats.ManualAck(), nats.Bind(streamName, queueGroup))
 
 	return sub, err
 }
+
+// deadLetterJob finishes a job that will not be retried: it keeps a crash
+// dump for local replay, moves the message to the tenant DLQ, and only then
+// reports the job as dead and acks it off the work queue.
+func (r *Gojinn) deadLetterJob(tenantID string, fn *function, m *nats.Msg, job *JobRecord, errMsg, stderr string) {
+	jobID := uint64(0)
+	if meta, err := m.Metadata(); err == nil {
+		jobID = meta.Sequence.Stream
+	}
+
+	snapshot := CrashSnapshot{
+		Timestamp: time.Now(),
+		Error:     errMsg,
+		Input:     json.RawMessage(m.Data),
+		Env:       fn.env(),
+		WasmFile:  fn.wasmFile(),
+	}
+	dumpBytes, _ := json.MarshalIndent(snapshot, "", "  ")
+	filename := fmt.Sprintf("crash_tenant_%s_%s_seq%d.json", tenantID, time.Now().Format("20060102-150405"), jobID)
+	r.saveCrashDump(filename, dumpBytes)
+
+	if err := r.deadLetter(tenantID, fn, m, job, errMsg, stderr); err != nil {
+		r.logger.Error("Failed to dead-letter job, crash dump is the only copy", zap.String("tenant", tenantID), zap.Uint64("job_id", jobID), zap.Error(err))
+	}
+
+	r.enqueueCallback(tenantID, m, r.jobDead(tenantID, fn, jobID))
+	r.countJob(fn, "dead")
+	_ = m.Ack()
+}